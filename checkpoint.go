@@ -0,0 +1,402 @@
+// durable checkpoints of binlog position
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andsha/replicagor/pgfuncs"
+	"github.com/andsha/replicagor/structs"
+	"github.com/andsha/vconfig"
+	"github.com/sirupsen/logrus"
+)
+
+/* Binlog position replication restarts from is written into binlog section
+of sconfig file while replication runs, not only at exit, so a crash or kill
+loses no progress. Every event read from binlog holds checkpoint until its
+buffer writes it: checkpoint is the last committed position before the
+oldest event not written yet, so events waiting in queues of buffers are
+read from binlog again after restart. Events of delayed buffers (see
+throttle.go) are released when they are synced into spill (see spill.go).
+The file is written into temporary file which is synced and renamed over
+sconfig, so a crash leaves either old or new checkpoint, never a partly
+written file. Checkpoints are written when events
+are written or at most once per interval.
+With store = postgres every apply worker of every buffer (see workers.go)
+also keeps position of the last transaction or statement it committed in
+checkpoint table of destination. The position is updated in the same
+transaction which commits rows of the worker, so a crash keeps both or
+neither. At start replication resumes from checkpoint file, or from the
+smallest position of the table if file has no checkpoint, and every worker
+skips events up to its own position. So every transaction is applied exactly
+once by every worker with rows of it. Workers having no rows of recent
+transactions keep old positions, which are used only if checkpoint file is
+lost. Row events outside of transactions and repair chunks are applied at
+least once, so they can be applied again after restart.
+Checkpoints are configured in checkpoint section of rconfig
+	interval = 5s (optional, default 0 writes after every committed transaction)
+	store = file | postgres (optional, default file)
+	table = replicagor.checkpoint (optional, default replicagor.checkpoint)
+*/
+
+const (
+	checkpointFile     = "file"
+	checkpointPostgres = "postgres"
+)
+
+type checkpointConfig struct {
+	interval time.Duration // 0 writes file after every transaction
+	store    string
+	table    string // postgres table of positions
+}
+
+// reads checkpoint section of rconfig
+func readCheckpointConfig(rconf vconfig.VConfig) (*checkpointConfig, error) {
+	cfg := &checkpointConfig{store: checkpointFile, table: "replicagor.checkpoint"}
+	sections, err := rconf.GetSectionsByName("checkpoint")
+	if err != nil { // checkpoint file after every transaction
+		return cfg, nil
+	}
+	if s, err := sections[0].GetSingleValue("interval", ""); err == nil && len(s) != 0 {
+		if cfg.interval, err = time.ParseDuration(s); err != nil || cfg.interval < 0 {
+			return nil, errors.New(fmt.Sprintf("interval in checkpoint section must be duration like 5s. Got %v", s))
+		}
+	}
+	if s, err := sections[0].GetSingleValue("store", ""); err == nil && len(s) != 0 {
+		if s != checkpointFile && s != checkpointPostgres {
+			return nil, errors.New(fmt.Sprintf("store in checkpoint section must be file or postgres. Got %v", s))
+		}
+		cfg.store = s
+	}
+	cfg.table, _ = sections[0].GetSingleValue("table", cfg.table)
+	return cfg, nil
+}
+
+type checkpoints struct {
+	mutex     sync.Mutex
+	holds     []*hold                  // events routed to buffers and not written yet, in binlog order
+	events    map[*structs.Event]*hold // hold of every event or part of event not written yet
+	routed    structs.BinLogInfo       // position of latest committed transaction or statement routed to buffers
+	fileMutex sync.Mutex               // serializes writes of sconfig
+	sconf     *vconfig.VConfig
+	saved     structs.BinLogInfo // last written checkpoint
+	commits   chan bool          // signals written events
+	interval  time.Duration
+}
+
+// event routed to buffer. Checkpoint does not pass position at until all
+// parts of the event are written
+type hold struct {
+	at    structs.BinLogInfo // last committed position before the event, empty if unknown
+	parts int                // parts of event not written yet
+}
+
+func newCheckpoints(sconf *vconfig.VConfig, interval time.Duration) *checkpoints {
+	return &checkpoints{events: make(map[*structs.Event]*hold), sconf: sconf, commits: make(chan bool, 1),
+		interval: interval}
+}
+
+// holds checkpoint until event e is written by its buffer. Events are held
+// in binlog order, event ending transaction or statement moves position of
+// events held after it
+func (cp *checkpoints) hold(e *structs.Event) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	h := &hold{at: cp.routed, parts: 1}
+	cp.holds = append(cp.holds, h)
+	cp.events[e] = h
+	if e.Position != 0 {
+		cp.routed = structs.BinLogInfo{Position: e.Position, File: e.File}
+	}
+}
+
+// part is written as part of event e, e.g. rows of e given to apply worker.
+// Hold of e is released when e and all its parts are written
+func (cp *checkpoints) share(e *structs.Event, part *structs.Event) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if h, ok := cp.events[e]; ok {
+		h.parts++
+		cp.events[part] = h
+	}
+}
+
+// releases hold of event or part of event written by buffer
+func (cp *checkpoints) written(e *structs.Event) {
+	cp.mutex.Lock()
+	h, ok := cp.events[e]
+	if !ok {
+		cp.mutex.Unlock()
+		return
+	}
+	delete(cp.events, e)
+	h.parts--
+	moved := false
+	for len(cp.holds) != 0 && cp.holds[0].parts == 0 {
+		cp.holds = cp.holds[1:]
+		moved = true
+	}
+	cp.mutex.Unlock()
+
+	if moved {
+		select {
+		case cp.commits <- true:
+		default: // checkpoint is already due
+		}
+	}
+}
+
+// position all events before are written at, false if it is not known yet
+func (cp *checkpoints) position() (structs.BinLogInfo, bool) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	at := cp.routed
+	if len(cp.holds) != 0 {
+		at = cp.holds[0].at
+	}
+	return at, len(at.File) != 0
+}
+
+// checkpoint routine
+func (cp *checkpoints) run(logging *logrus.Logger, stop <-chan bool, stopped chan<- bool) {
+	var tick <-chan time.Time
+	if cp.interval > 0 {
+		ticker := time.NewTicker(cp.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-stop:
+			stopped <- true
+			return
+		case <-cp.commits:
+			if cp.interval > 0 {
+				continue
+			}
+		case <-tick:
+		}
+		if _, _, err := cp.save(); err != nil {
+			logging.Errorf("Cannot save checkpoint: %v", err)
+		}
+	}
+}
+
+// writes position all events before are written at into sconfig file.
+// Returns written position
+func (cp *checkpoints) save() (uint32, string, error) {
+	cp.fileMutex.Lock()
+	defer cp.fileMutex.Unlock()
+
+	s, err := cp.sconf.GetSingleValue("binlog", "position", "")
+	if err != nil {
+		return 0, "", err
+	}
+	oldpos, _ := strconv.Atoi(s)
+	oldfile, err := cp.sconf.GetSingleValue("binlog", "file", "")
+	if err != nil {
+		return 0, "", err
+	}
+	path, err := cp.sconf.GetSingleValue("File", "Path", "")
+	if err != nil {
+		return 0, "", err
+	}
+
+	pos, file := uint32(oldpos), oldfile
+	if at, ok := cp.position(); ok {
+		pos, file = at.Position, at.File
+	}
+	if pos == cp.saved.Position && file == cp.saved.File {
+		return pos, file, nil
+	}
+
+	blsec, err := cp.sconf.GetSections("binlog")
+	if err != nil {
+		return 0, "", err
+	}
+	blsec[0].SetValues("position", []string{fmt.Sprintf("%v", pos)})
+	blsec[0].SetValues("file", []string{file})
+	if err := writeFileAtomic(path, cp.sconf.ToFile); err != nil {
+		return 0, "", err
+	}
+	cp.saved = structs.BinLogInfo{Position: pos, File: file}
+	return pos, file, nil
+}
+
+// replaces file with file written by write. It is written into temporary
+// file in the same directory, synced and renamed over the file
+func writeFileAtomic(path string, write func(string) error) error {
+	tmp := path + ".tmp"
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		os.Chmod(tmp, fi.Mode().Perm())
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// rename is durable once directory is synced
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// true if binlog position pos of file is before position toPos of toFile
+func binlogBefore(file string, pos uint32, toFile string, toPos uint32) bool {
+	if file != toFile {
+		return binlogNumber(file) < binlogNumber(toFile)
+	}
+	return pos < toPos
+}
+
+// binlog position event ends at, false if it is unknown. Event starting
+// before a position ends not after it
+func eventEnd(e *structs.Event) (structs.BinLogInfo, bool) {
+	pos := e.Position // end of statement or transaction
+	if pos == 0 {
+		pos = e.EventPosition + 1
+	}
+	if len(e.File) == 0 || pos == 1 {
+		return structs.BinLogInfo{}, false
+	}
+	return structs.BinLogInfo{Position: pos, File: e.File}, true
+}
+
+// number of binlog file like mysql-bin.000004
+func binlogNumber(file string) int {
+	parts := strings.Split(file, ".")
+	n, _ := strconv.Atoi(parts[len(parts)-1])
+	return n
+}
+
+// sets position replication starts from. Checkpoint file does not pass
+// events which are not written, so replication resumes from it and workers
+// skip transactions they applied after it. Without checkpoint in file
+// replication resumes from the smallest position stored in destination.
+// Position is set in memory and written by next checkpoint
+func (r *replicagor) resumeFromDestination() error {
+	applied, err := r.dest.appliedPositions()
+	if err != nil || len(applied) == 0 {
+		return err
+	}
+	blsec, err := r.source.GetSConfig().GetSections("binlog")
+	if err != nil {
+		return err
+	}
+	source, _ := blsec[0].GetSingleValue("source", "")
+	spos, _ := blsec[0].GetSingleValue("position", "")
+	file, _ := blsec[0].GetSingleValue("file", "")
+	if _, err := strconv.Atoi(spos); err == nil && source == "config" && len(file) != 0 {
+		r.logging.Infof("Resuming from %v binlogposition in %v of checkpoint file, %v workers skip transactions applied after it",
+			spos, file, len(applied))
+		return nil
+	}
+	blinfos := make([]structs.BinLogInfo, 0, len(applied))
+	for _, bli := range applied {
+		blinfos = append(blinfos, bli)
+	}
+	pos, file := getsmallestPosition(blinfos, 0, "")
+	blsec[0].SetValues("source", []string{"config"})
+	blsec[0].SetValues("position", []string{fmt.Sprintf("%v", pos)})
+	blsec[0].SetValues("file", []string{file})
+	r.logging.Infof("Resuming from %v binlogposition in %v stored in destination", pos, file)
+	return nil
+}
+
+// creates checkpoint table and reads positions applied before
+func (c *pgConnection) initCheckpoints() error {
+	cfg, err := readCheckpointConfig(c.rconf)
+	if err != nil || cfg.store != checkpointPostgres {
+		return err
+	}
+	if c.checkpointTable, err = pgfuncs.NewCheckpointTable(cfg.table); err != nil {
+		return err
+	}
+	if err := c.runQuery(c.checkpointTable.CreateTable()); err != nil {
+		return err
+	}
+	res, err := c.queryRows(c.checkpointTable.Select())
+	if err != nil {
+		return err
+	}
+	c.applied = make(map[workerSlot]structs.BinLogInfo)
+	for _, row := range res {
+		if len(row) < 4 {
+			return errors.New(fmt.Sprintf("Unexpected row %v in checkpoint table", row))
+		}
+		buf, err := strconv.Atoi(resultText(row[0]))
+		if err != nil {
+			return errors.New(fmt.Sprintf("Incorrect buffer %v in checkpoint table", row[0]))
+		}
+		worker, err := strconv.Atoi(resultText(row[1]))
+		if err != nil {
+			return errors.New(fmt.Sprintf("Incorrect worker %v in checkpoint table", row[1]))
+		}
+		pos, err := strconv.ParseUint(resultText(row[3]), 10, 32)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Incorrect position %v in checkpoint table", row[3]))
+		}
+		c.applied[workerSlot{buf: buf, worker: worker}] = structs.BinLogInfo{Position: uint32(pos), File: resultText(row[2])}
+	}
+	return nil
+}
+
+// positions stored in destination at start, key is worker of buffer
+func (c *pgConnection) appliedPositions() (map[workerSlot]structs.BinLogInfo, error) {
+	if c.checkpointTable == nil {
+		return nil, errors.New("Checkpoints are not stored in postgres")
+	}
+	c.txMutex.Lock()
+	defer c.txMutex.Unlock()
+	applied := make(map[workerSlot]structs.BinLogInfo)
+	for slot, bli := range c.applied {
+		applied[slot] = bli
+	}
+	return applied, nil
+}
+
+// true if event was applied before restart. Events of worker of buffer are
+// skipped until the first event after the worker's stored position
+func (c *pgConnection) alreadyApplied(e *structs.Event) bool {
+	c.txMutex.Lock()
+	defer c.txMutex.Unlock()
+	slot := workerSlot{buf: e.Buf, worker: c.worker}
+	stored, ok := c.applied[slot]
+	if !ok {
+		return false
+	}
+	end, known := eventEnd(e)
+	if !known {
+		return false
+	}
+	if !binlogBefore(stored.File, stored.Position, end.File, end.Position) {
+		return true
+	}
+	delete(c.applied, slot)
+	return false
+}
+
+func (c *mysqlConnection) appliedPositions() (map[workerSlot]structs.BinLogInfo, error) {
+	return nil, errors.New("Mysql does not store applied positions")
+}
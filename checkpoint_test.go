@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// destination keeping played events in batch until flush
+type batchDest struct {
+	connection
+	played  chan bool
+	batch   int
+	flushes int
+}
+
+func (d *batchDest) playEvent(e *structs.Event) error {
+	d.batch++
+	d.played <- true
+	return nil
+}
+
+func (d *batchDest) flushEvents(buf int) error {
+	if d.batch != 0 {
+		d.flushes++
+	}
+	d.batch = 0
+	return nil
+}
+
+func (d *batchDest) pending(buf int) bool {
+	return d.batch != 0
+}
+
+// event holds checkpoint until batch with it is written, buffer writes the
+// batch when it is stopped
+func TestBufferWritten(t *testing.T) {
+	cp := newCheckpoints(nil, 0)
+	dest := &batchDest{played: make(chan bool, 2)}
+	cont, event := make(chan bool, 2), make(chan *structs.Event, 2)
+	stop, stopped := make(chan bool, 1), make(chan bool, 1)
+
+	commit := &structs.Event{Query: "COMMIT", Position: 120, File: "mysql-bin.000001"}
+	row := &structs.Event{EventType: structs.INSERT_EVENT}
+	cp.hold(commit)
+	cp.hold(row)
+	event <- commit
+	event <- row
+	go eventBuffer(0, cont, event, dest, stop, stopped, cp, &bufferStats{}, nil)
+
+	cont <- true // COMMIT is played and waits in batch
+	<-dest.played
+	if at, ok := cp.position(); ok {
+		t.Fatal("Incorrect checkpoint", "expected", false, "got", at)
+	}
+	stop <- true
+	<-stopped
+	if dest.flushes != 1 {
+		t.Fatal("Incorrect flushes", "expected", 1, "got", dest.flushes)
+	}
+	if at, _ := cp.position(); at.Position != 120 {
+		t.Fatal("Incorrect checkpoint", "expected", 120, "got", at.Position)
+	}
+}
+
+// checkpoint is the last committed position before the oldest event not
+// written yet
+func TestCheckpointHolds(t *testing.T) {
+	cp := newCheckpoints(nil, 0)
+	file := "mysql-bin.000002"
+	begin1 := &structs.Event{Query: "BEGIN", File: file, EventPosition: 4}
+	row1 := &structs.Event{Buf: 1, File: file, EventPosition: 60}
+	commit1 := &structs.Event{Query: "COMMIT", Position: 100, File: file}
+	begin2 := &structs.Event{Query: "BEGIN", File: file, EventPosition: 100}
+	row2 := &structs.Event{Buf: 1, File: file, EventPosition: 160}
+	commit2 := &structs.Event{Query: "COMMIT", Position: 200, File: file}
+	for _, e := range []*structs.Event{begin1, row1, commit1, begin2, row2, commit2} {
+		cp.hold(e)
+	}
+	commit1b := &structs.Event{Buf: 1, Query: "COMMIT", Position: 100, File: file} // COMMIT of buffer 1
+	cp.share(commit1, commit1b)
+
+	position := func(expected uint32) {
+		at, ok := cp.position()
+		if expected == 0 && ok || expected != 0 && (at.Position != expected || at.File != file) {
+			t.Fatal("Incorrect checkpoint", "expected", expected, "got", at, ok)
+		}
+	}
+	position(0) // nothing is written
+	for _, e := range []*structs.Event{begin1, commit1, begin2, row2, commit2} {
+		cp.written(e) // default buffer and rows of second transaction of buffer 1
+	}
+	position(0) // first transaction is not written by buffer 1
+	cp.written(row1)
+	position(0) // first transaction is not committed by buffer 1
+	cp.written(commit1b)
+	position(200)
+
+	cp.written(commit1b) // event written twice or not held does not move checkpoint
+	cp.written(&structs.Event{Position: 300, File: file})
+	position(200)
+
+	row3 := &structs.Event{Buf: 1, File: file, EventPosition: 260}
+	cp.hold(row3)
+	cp.hold(&structs.Event{Query: "COMMIT", Position: 300, File: file})
+	position(200)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sconfig")
+	if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("write failed")
+	err = writeFileAtomic(path, func(tmp string) error {
+		ioutil.WriteFile(tmp, []byte("partial"), 0644)
+		return failed
+	})
+	if err != failed {
+		t.Fatal("Incorrect error", "expected", failed, "got", err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "old" {
+		t.Fatal("Incorrect file after failed write", "expected", "old", "got", string(b))
+	}
+
+	if err := writeFileAtomic(path, func(tmp string) error { return ioutil.WriteFile(tmp, []byte("new"), 0644) }); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "new" {
+		t.Fatal("Incorrect file", "expected", "new", "got", string(b))
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Fatal("Incorrect mode", "expected", os.FileMode(0600), "got", fi.Mode().Perm())
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("Incorrect temporary file", "expected", "no file", "got", err)
+	}
+}
@@ -0,0 +1,200 @@
+// detection of UPDATE and DELETE matching no destination rows
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/andsha/replicagor/pgfuncs"
+	"github.com/andsha/replicagor/structs"
+)
+
+/* UPDATE and DELETE of tables with conflict policy are played row by row
+and the number of matched destination rows is checked. A row matching
+nothing means the destination drifted from mysql and is handled by policy
+ - log: drift is logged and counted
+ - insert: after-image of UPDATE is inserted (upserted), DELETE is logged
+ - fail: row fails and is handled by error policy of the table
+ - repair: key of the row is queued in repair queue table
+Policies are configured in conflictPolicy sections of rconfig
+	policy = log | insert | fail | repair
+	tables = db1.table1, db1.table2 (optional, default for all other tables)
+and the queue in repairQueue section (see repair.go).
+Tables without policy are not checked. Drift is counted per table and
+operation in expvar map drift, served with -stats flag
+*/
+
+const (
+	conflictLog    = "log"
+	conflictInsert = "insert"
+	conflictFail   = "fail"
+	conflictRepair = "repair"
+)
+
+// drift counters, key is mysql schema.table, values count update and delete
+var driftStats = expvar.NewMap("drift")
+
+// conflict policies of mysql tables
+type conflictPolicies struct {
+	def    string // empty if tables are not checked
+	tables map[string]string
+}
+
+func (p *conflictPolicies) get(schema string, table string) string {
+	if p == nil {
+		return ""
+	}
+	if policy, ok := p.tables[schema+"."+table]; ok {
+		return policy
+	}
+	return p.def
+}
+
+// reads conflictPolicy sections of rconfig
+func (c *pgConnection) initConflicts() error {
+	c.conflicts = &conflictPolicies{tables: make(map[string]string)}
+	sections, err := c.rconf.GetSectionsByName("conflictPolicy")
+	if err != nil { // no checks
+		return nil
+	}
+
+	for _, sec := range sections {
+		policy, err := sec.GetSingleValue("policy", "")
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v. policy is a required field in conflictPolicy section", err))
+		}
+		switch policy {
+		case conflictLog, conflictInsert, conflictFail, conflictRepair:
+		default:
+			return errors.New(fmt.Sprintf("policy in conflictPolicy section must be log, insert, fail or repair. Got %v", policy))
+		}
+
+		tables, _ := sec.GetValues("tables")
+		tables = trimValues(tables)
+		if len(tables) == 0 {
+			c.conflicts.def = policy
+		}
+		for _, t := range tables {
+			st := strings.Split(t, ".")
+			if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+				return errors.New(fmt.Sprintf("Table in conflictPolicy section should be schemaname.tablename. Got %v", t))
+			}
+			c.conflicts.tables[t] = policy
+		}
+	}
+
+	return nil
+}
+
+// true if matched rows of event are counted
+func (c *pgConnection) countsRows(e *structs.Event) bool {
+	if e.EventType != structs.UPDATE_EVENT && e.EventType != structs.DELETE_EVENT {
+		return false
+	}
+	if e.SkipMirror || !c.audit.Mirrors(e.SchemaName, e.TableName) {
+		return false
+	}
+	return len(c.conflicts.get(e.SchemaName, e.TableName)) != 0
+}
+
+// plays single-row event and handles row matching no destination rows
+func (c *pgConnection) playCheckedRow(e *structs.Event) error {
+	if c.audit.Audits(e.SchemaName, e.TableName) {
+		q, err := c.audit.GenQuery(e, &c.opts)
+		if err != nil {
+			c.logging.Errorf("Error while generating audit query in postgres. ERROR: %v", err)
+			return err
+		}
+		if err := c.runQuery(q); err != nil {
+			return err
+		}
+	}
+
+	counted, rest, err := pgfuncs.GenCountedQuery(e, &c.opts)
+	if err != nil {
+		c.logging.Errorf("Error while generating query in postgres. ERROR: %v", err)
+		return err
+	}
+	matched, err := c.runCount(counted)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		if err := c.runQuery(rest); err != nil {
+			return err
+		}
+	}
+	if matched != 0 {
+		return nil
+	}
+	return c.onConflict(e)
+}
+
+// handles row of event which matched no destination rows
+func (c *pgConnection) onConflict(e *structs.Event) error {
+	op := "delete"
+	if e.EventType == structs.UPDATE_EVENT {
+		op = "update"
+	}
+	key := e.SchemaName + "." + e.TableName
+	stats, ok := driftStats.Get(key).(*expvar.Map)
+	if !ok {
+		stats = new(expvar.Map).Init()
+		driftStats.Set(key, stats)
+	}
+	stats.Add(op, 1)
+
+	policy := c.conflicts.get(e.SchemaName, e.TableName)
+	msg := fmt.Sprintf("%v of %v at %v:%v matched no rows in postgres", strings.Title(op), key, e.File, e.EventPosition)
+	switch policy {
+	case conflictFail:
+		return errors.New(msg)
+	case conflictRepair:
+		c.logging.Warnf("%v. Row is queued for repair", msg)
+		return c.runQuery(c.repairs.Insert(e, &c.opts, op+" matched no rows"))
+	case conflictInsert:
+		if e.EventType == structs.UPDATE_EVENT {
+			c.logging.Warnf("%v. After-image is inserted", msg)
+			return c.insertAfterImage(e)
+		}
+	}
+	c.logging.Warn(msg)
+	return nil
+}
+
+// upserts after-image of single-row UPDATE event
+func (c *pgConnection) insertAfterImage(e *structs.Event) error {
+	ins := *e
+	ins.EventType = structs.INSERT_EVENT
+	ins.OldValues = e.NewValues
+	ins.NewValues = nil
+	opts := c.opts
+	opts.Upsert = true
+	query, err := pgfuncs.GenQuery(&ins, &opts)
+	if err != nil {
+		c.logging.Errorf("Error while generating query in postgres. ERROR: %v", err)
+		return err
+	}
+	return c.runQuery(query)
+}
+
+// runs query returning one number
+func (c *pgConnection) runCount(query string) (int, error) {
+	res, err := c.process.Run(query)
+	if err != nil {
+		c.logging.Errorf("Error while running query in postgres:%v ERROR: %v", query, err)
+		return 0, err
+	}
+	if len(res) == 0 || len(res[0]) == 0 {
+		return 0, errors.New(fmt.Sprintf("Query %v returned no count", query))
+	}
+	n, err := strconv.Atoi(resultText(res[0][0]))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Query %v returned %v instead of count", query, res[0][0]))
+	}
+	return n, nil
+}
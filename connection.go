@@ -24,13 +24,25 @@ type connection interface {
 	sqlconnect() error
 	disconnect() error
 	getConnCredentials() (map[string]string, error)
+	queryRows(query string) ([][]interface{}, error)
 
 	// implemented by source only
 	startDump(<-chan bool, chan<- bool, <-chan bool, chan<- bool) (<-chan *structs.Event, error)
 	getFreqs() []int
+	getInfo() []structs.Schema
+	repair(req *structs.Repair, stop <-chan bool) (bool, error)
 
 	//implemented by destination only
 	playEvent(e *structs.Event) error
+	flushEvents(buf int) error
+	pending(buf int) bool
+	provision(source connection) error
+	redrive() (int, int, error)
+	validate(source connection) (int, error)
+	repairRequests() ([]*structs.Repair, error)
+	queueRepair(schema string, table string, ranges [][2][]interface{}) error
+	appliedPositions() (map[workerSlot]structs.BinLogInfo, error)
+	newWorker(worker int) (connection, error)
 }
 
 //generic connection data structure
@@ -44,6 +56,11 @@ type conn struct {
 	freqs    []int
 }
 
+// replication info, empty for destination
+func (c *conn) getInfo() []structs.Schema {
+	return c.rinfo
+}
+
 // Create conection object
 func NewConnection(conntype int, sconf vconfig.VConfig, rconf vconfig.VConfig, logging *logrus.Logger) (connection, error) {
 	c := new(conn)
@@ -0,0 +1,193 @@
+// ordering of events across buffers
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/andsha/replicagor/structs"
+	"github.com/andsha/vconfig"
+)
+
+/* Every buffer plays its events in source order, but buffers are not ordered
+between each other, so parent and child rows in different buffers may be
+written in any order. Related tables can be played by one buffer: tables of
+consistencyGroup section, and with foreignKeys tables linked by foreign keys
+in mysql, are moved into buffer of the lowest number among their buffers.
+	[consistencyGroup]
+		tables = db1.orders, db1.order_items
+With order = strict buffers are synchronised at ends of transactions: COMMIT
+or statement is played after all events before it are played by all buffers,
+and events after it wait until it is played. Source order of transactions is
+kept in destination but buffers play in parallel only within transactions.
+Every buffer commits its rows of transaction in own transaction, so rows
+referencing rows of the same transaction need their tables in one group.
+Consistency is configured in consistency section of rconfig
+	order = buffer | strict (optional, default buffer)
+	foreignKeys = true | false (optional, default false)
+*/
+
+const (
+	orderBuffer = "buffer"
+	orderStrict = "strict"
+)
+
+type consistencyConfig struct {
+	order       string
+	foreignKeys bool
+	groups      [][]string // schema.table of tables of every group
+}
+
+// reads consistency and consistencyGroup sections of rconfig
+func readConsistencyConfig(rconf vconfig.VConfig) (*consistencyConfig, error) {
+	cfg := &consistencyConfig{order: orderBuffer}
+	if sections, err := rconf.GetSectionsByName("consistency"); err == nil {
+		if s, err := sections[0].GetSingleValue("order", ""); err == nil && len(s) != 0 {
+			if s != orderBuffer && s != orderStrict {
+				return nil, errors.New(fmt.Sprintf("order in consistency section must be buffer or strict. Got %v", s))
+			}
+			cfg.order = s
+		}
+		if s, err := sections[0].GetSingleValue("foreignKeys", ""); err == nil && len(s) != 0 {
+			if s != "true" && s != "false" {
+				return nil, errors.New(fmt.Sprintf("foreignKeys in consistency section must be true or false. Got %v", s))
+			}
+			cfg.foreignKeys = s == "true"
+		}
+	}
+
+	sections, err := rconf.GetSectionsByName("consistencyGroup")
+	if err != nil { // no groups
+		return cfg, nil
+	}
+	for _, sec := range sections {
+		tables, err := sec.GetValues("tables")
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%v. tables is a required field in consistencyGroup section", err))
+		}
+		for _, table := range tables {
+			if len(strings.Split(table, ".")) != 2 {
+				return nil, errors.New(fmt.Sprintf("Table %v of consistencyGroup section must be like schema.table", table))
+			}
+		}
+		cfg.groups = append(cfg.groups, tables)
+	}
+	return cfg, nil
+}
+
+// moves tables of every consistency group into buffer of the lowest number
+// among buffers of the group's tables
+func (c *mysqlConnection) initLanes(rinfo []structs.Schema) error {
+	cfg, err := readConsistencyConfig(c.rconf)
+	if err != nil {
+		return err
+	}
+
+	tables := make(map[string]*structs.Table)
+	var schemas []string
+	for _, s := range rinfo {
+		schemas = append(schemas, s.Name)
+		for _, t := range s.Tables {
+			tables[s.Name+"."+t.Name] = t
+		}
+	}
+
+	// groups are trees of tables, root of tree is key of the group
+	parent := make(map[string]string)
+	var root func(string) string
+	root = func(table string) string {
+		p, ok := parent[table]
+		if !ok || p == table {
+			return table
+		}
+		parent[table] = root(p)
+		return parent[table]
+	}
+	join := func(a string, b string) {
+		for _, table := range []string{a, b} {
+			if _, ok := tables[table]; !ok {
+				c.logging.Warnf("Table %v of consistency group is not replicated", table)
+				return
+			}
+		}
+		parent[root(a)] = root(b)
+	}
+
+	for _, group := range cfg.groups {
+		for _, table := range group[1:] {
+			join(group[0], table)
+		}
+	}
+	if cfg.foreignKeys && len(schemas) != 0 {
+		res, err := c.sqlprocess.Run(fmt.Sprintf(`SELECT TABLE_SCHEMA, TABLE_NAME, REFERENCED_TABLE_SCHEMA, REFERENCED_TABLE_NAME
+			FROM information_schema.KEY_COLUMN_USAGE
+			WHERE REFERENCED_TABLE_NAME IS NOT NULL AND TABLE_SCHEMA IN ('%v')`, strings.Join(schemas, "', '")))
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			if len(row) < 4 {
+				continue
+			}
+			child := fmt.Sprintf("%s.%s", row[0], row[1])
+			referenced := fmt.Sprintf("%s.%s", row[2], row[3])
+			if _, ok := tables[referenced]; ok && child != referenced {
+				join(child, referenced)
+			}
+		}
+	}
+
+	lanes := make(map[string]int) // buffer of every group
+	for name, t := range tables {
+		if buf, ok := lanes[root(name)]; !ok || t.Buf < buf {
+			lanes[root(name)] = t.Buf
+		}
+	}
+	for name, t := range tables {
+		if buf := lanes[root(name)]; buf != t.Buf {
+			c.logging.Infof("Table %v is moved from buffer %v to buffer %v of its consistency group", name, t.Buf, buf)
+			t.Buf = buf
+		}
+	}
+	return nil
+}
+
+// counts events queued in buffers and not played yet. Used with strict order
+type barrier struct {
+	mutex   sync.Mutex
+	count   int
+	drained chan bool // closed when count gets to zero
+}
+
+func (b *barrier) add() {
+	b.mutex.Lock()
+	b.count++
+	b.mutex.Unlock()
+}
+
+// called by buffer when event is played and written
+func (b *barrier) done() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.count--
+	if b.count == 0 && b.drained != nil {
+		close(b.drained)
+		b.drained = nil
+	}
+}
+
+// returns channel closed when all queued events are played
+func (b *barrier) wait() <-chan bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	drained := make(chan bool)
+	if b.count == 0 {
+		close(drained)
+	} else {
+		b.drained = drained
+	}
+	return drained
+}
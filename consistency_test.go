@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBarrier(t *testing.T) {
+	b := new(barrier)
+	select {
+	case <-b.wait():
+	default:
+		t.Fatal("Incorrect barrier", "expected", "drained", "got", "waiting")
+	}
+
+	b.add()
+	b.add()
+	drained := b.wait()
+	b.done()
+	select {
+	case <-drained:
+		t.Fatal("Incorrect barrier", "expected", "waiting", "got", "drained")
+	default:
+	}
+	b.done()
+	select {
+	case <-drained:
+	default:
+		t.Fatal("Incorrect barrier", "expected", "drained", "got", "waiting")
+	}
+}
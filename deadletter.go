@@ -0,0 +1,512 @@
+// error policies and dead-letter store for postgres destination
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andsha/replicagor/pgfuncs"
+	"github.com/andsha/replicagor/structs"
+)
+
+/* Row events failing in postgres are handled by error policy of their table
+ - stop: replication stops (default)
+ - skip: failed rows are logged and dropped
+ - deadLetter: failed rows are written to dead-letter store
+When a statement fails and policy is not stop, rows of the event (or of the
+insert batch) are applied one by one and only failing rows are skipped or
+dead-lettered. Inside a transaction every statement runs under a savepoint,
+so the transaction goes on after the failure. DDL and other queries always stop.
+Policies are configured in errorPolicy sections of rconfig
+	policy = stop | skip | deadLetter
+	tables = db1.table1, db1.table2 (optional, default for all other tables)
+and the store in deadLetter section
+	store = postgres | file (optional, default postgres)
+	table = replicagor.dead_letter (optional, postgres store)
+	path = /var/lib/replicagor/dead_letter.jsonl (file store)
+Dead-lettered events are played again by running replicagor with -redrive.
+Postgres store writes dead letter in the transaction of the failed row, so it
+is rolled back together with the transaction. Both stores keep one dead letter
+per row of binlog event, so rows failing again when transaction is replayed
+are not dead-lettered twice
+*/
+
+const (
+	policyStop       = "stop"
+	policySkip       = "skip"
+	policyDeadLetter = "deadLetter"
+
+	rowSavepoint = "replicagor_row"
+)
+
+// error policies of mysql tables
+type errorPolicies struct {
+	def    string
+	tables map[string]string // key is mysql schema.table
+}
+
+func (p *errorPolicies) get(schema string, table string) string {
+	if p == nil {
+		return policyStop
+	}
+	if policy, ok := p.tables[schema+"."+table]; ok {
+		return policy
+	}
+	return p.def
+}
+
+// true if any table dead-letters its rows
+func (p *errorPolicies) deadLetters() bool {
+	if p == nil {
+		return false
+	}
+	if p.def == policyDeadLetter {
+		return true
+	}
+	for _, policy := range p.tables {
+		if policy == policyDeadLetter {
+			return true
+		}
+	}
+	return false
+}
+
+// event kept in dead-letter store
+type deadLetter struct {
+	id    int64
+	error string
+	event *structs.Event
+}
+
+// store of events failed to apply
+type deadLetterStore interface {
+	add(e *structs.Event, errText string) error
+	list() ([]*deadLetter, error)
+	remove(ids []int64) error
+}
+
+// dead letters in postgres table
+type pgDeadLetters struct {
+	c     *pgConnection
+	table *pgfuncs.DeadLetters
+}
+
+func (s *pgDeadLetters) add(e *structs.Event, errText string) error {
+	query, err := s.table.Insert(e, errText)
+	if err != nil {
+		return err
+	}
+	return s.c.runQuery(query)
+}
+
+func (s *pgDeadLetters) list() ([]*deadLetter, error) {
+	res, err := s.c.process.Run(s.table.Select())
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*deadLetter, 0, len(res))
+	for _, row := range res {
+		if len(row) < 3 {
+			return nil, errors.New(fmt.Sprintf("Unexpected row %v in dead-letter table", row))
+		}
+		id, err := strconv.ParseInt(resultText(row[0]), 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Incorrect id %v in dead-letter table", row[0]))
+		}
+		e, err := structs.DecodeEvent([]byte(resultText(row[2])))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Cannot read dead letter %v. %v", id, err))
+		}
+		letters = append(letters, &deadLetter{id: id, error: resultText(row[1]), event: e})
+	}
+	return letters, nil
+}
+
+func (s *pgDeadLetters) remove(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.c.runQuery(s.table.Delete(ids))
+}
+
+// text of value returned by postgres
+func resultText(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// line of dead-letter file
+type deadLetterLine struct {
+	Id       int64           `json:"id"`
+	Schema   string          `json:"schema"`
+	Table    string          `json:"table"`
+	File     string          `json:"file,omitempty"`
+	Position uint32          `json:"position,omitempty"`
+	Gtid     string          `json:"gtid,omitempty"`
+	Error    string          `json:"error"`
+	Created  time.Time       `json:"created"`
+	Event    json.RawMessage `json:"event"`
+	Key      string          `json:"key,omitempty"` // see pgfuncs.DeadLetterKey
+}
+
+// dead letters in local file, one json object per line
+type fileDeadLetters struct {
+	mutex  sync.Mutex
+	path   string
+	nextId int64
+	keys   map[string]int64 // ids of dead-lettered rows
+}
+
+func newFileDeadLetters(path string) (*fileDeadLetters, error) {
+	s := &fileDeadLetters{path: path, nextId: 1, keys: make(map[string]int64)}
+	lines, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range lines {
+		if l.Id >= s.nextId {
+			s.nextId = l.Id + 1
+		}
+		if len(l.Key) != 0 {
+			s.keys[l.Key] = l.Id
+		}
+	}
+	return s, nil
+}
+
+// lines of file, no lines if file does not exist yet
+func (s *fileDeadLetters) read() ([]*deadLetterLine, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []*deadLetterLine
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		l := new(deadLetterLine)
+		if err := json.Unmarshal(scanner.Bytes(), l); err != nil {
+			return nil, errors.New(fmt.Sprintf("Cannot read dead-letter file %v. %v", s.path, err))
+		}
+		lines = append(lines, l)
+	}
+	return lines, scanner.Err()
+}
+
+func (s *fileDeadLetters) add(e *structs.Event, errText string) error {
+	payload, err := structs.EncodeEvent(e)
+	if err != nil {
+		return err
+	}
+	key := pgfuncs.DeadLetterKey(e, payload)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.keys[key]; ok { // row is dead-lettered already
+		return nil
+	}
+
+	b, err := json.Marshal(&deadLetterLine{Id: s.nextId, Schema: e.SchemaName, Table: e.TableName, File: e.File,
+		Position: e.EventPosition, Gtid: e.Gtid, Error: errText, Created: time.Now(), Event: payload, Key: key})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	s.keys[key] = s.nextId
+	s.nextId++
+	return f.Close()
+}
+
+func (s *fileDeadLetters) list() ([]*deadLetter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lines, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*deadLetter, 0, len(lines))
+	for _, l := range lines {
+		e, err := structs.DecodeEvent(l.Event)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Cannot read dead letter %v. %v", l.Id, err))
+		}
+		letters = append(letters, &deadLetter{id: l.Id, error: l.Error, event: e})
+	}
+	return letters, nil
+}
+
+// rewrites file without removed lines
+func (s *fileDeadLetters) remove(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lines, err := s.read()
+	if err != nil {
+		return err
+	}
+	removed := make(map[int64]bool)
+	for _, id := range ids {
+		removed[id] = true
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, l := range lines {
+		if removed[l.Id] {
+			continue
+		}
+		b, err := json.Marshal(l)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	for key, id := range s.keys {
+		if removed[id] {
+			delete(s.keys, key)
+		}
+	}
+	return nil
+}
+
+// reads errorPolicy sections of rconfig
+func (c *pgConnection) initErrorPolicies() error {
+	c.policies = &errorPolicies{def: policyStop, tables: make(map[string]string)}
+	sections, err := c.rconf.GetSectionsByName("errorPolicy")
+	if err != nil { // stop on every error
+		return nil
+	}
+
+	for _, sec := range sections {
+		policy, err := sec.GetSingleValue("policy", "")
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v. policy is a required field in errorPolicy section", err))
+		}
+		switch policy {
+		case policyStop, policySkip, policyDeadLetter:
+		default:
+			return errors.New(fmt.Sprintf("policy in errorPolicy section must be stop, skip or deadLetter. Got %v", policy))
+		}
+
+		tables, _ := sec.GetValues("tables")
+		tables = trimValues(tables)
+		if len(tables) == 0 {
+			c.policies.def = policy
+		}
+		for _, t := range tables {
+			st := strings.Split(t, ".")
+			if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+				return errors.New(fmt.Sprintf("Table in errorPolicy section should be schemaname.tablename. Got %v", t))
+			}
+			c.policies.tables[t] = policy
+		}
+	}
+	return nil
+}
+
+// reads deadLetter section of rconfig. Table of postgres store is created after connecting
+func (c *pgConnection) initDeadLetters() error {
+	sections, err := c.rconf.GetSectionsByName("deadLetter")
+	if err != nil {
+		if c.policies.deadLetters() {
+			return errors.New("deadLetter policy requires deadLetter section in rconfig")
+		}
+		return nil
+	}
+
+	store, _ := sections[0].GetSingleValue("store", "postgres")
+	switch store {
+	case "postgres":
+		table, _ := sections[0].GetSingleValue("table", "replicagor.dead_letter")
+		dl, err := pgfuncs.NewDeadLetters(table)
+		if err != nil {
+			return err
+		}
+		c.deadLetters = &pgDeadLetters{c: c, table: dl}
+	case "file":
+		path, err := sections[0].GetSingleValue("path", "")
+		if err != nil || len(path) == 0 {
+			return errors.New("path is a required field in deadLetter section with file store")
+		}
+		if c.deadLetters, err = newFileDeadLetters(path); err != nil {
+			return err
+		}
+	default:
+		return errors.New(fmt.Sprintf("store in deadLetter section must be postgres or file. Got %v", store))
+	}
+	return nil
+}
+
+// plays rows of event e by play. If it fails and table's policy is not
+// stop, rows given by split are played one by one by playRow and failing
+// ones are skipped or dead-lettered
+func (c *pgConnection) applyRows(e *structs.Event, play func() error, split func() []*structs.Event,
+	playRow func(*structs.Event) error) error {
+	policy := c.policies.get(e.SchemaName, e.TableName)
+	if policy == policyStop {
+		return play()
+	}
+
+	failed, err := c.runGuarded(e.Buf, play)
+	if err != nil || failed == nil {
+		return err
+	}
+	if pgfuncs.ClassifyError(failed) != pgfuncs.FatalError { // whole transaction is retried
+		return failed
+	}
+
+	for _, r := range split() {
+		failed, err := c.runGuarded(r.Buf, func() error { return playRow(r) })
+		if err != nil {
+			return err
+		}
+		if failed != nil {
+			if pgfuncs.ClassifyError(failed) != pgfuncs.FatalError {
+				return failed
+			}
+			if err := c.divert(r, policy, failed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runs play, inside transaction under savepoint. failed is error of play,
+// err is returned when transaction cannot go on
+func (c *pgConnection) runGuarded(buf int, play func() error) (failed error, err error) {
+	if !c.inTx(buf) {
+		return play(), nil
+	}
+	if err := c.runQuery("SAVEPOINT " + rowSavepoint + ";"); err != nil {
+		return nil, err
+	}
+	if failed := play(); failed != nil {
+		if err := c.runQuery("ROLLBACK TO SAVEPOINT " + rowSavepoint + ";"); err != nil {
+			return nil, err
+		}
+		return failed, nil
+	}
+	return nil, c.runQuery("RELEASE SAVEPOINT " + rowSavepoint + ";")
+}
+
+// skips or dead-letters row event failed with error failed
+func (c *pgConnection) divert(e *structs.Event, policy string, failed error) error {
+	if policy == policySkip {
+		c.logging.Warnf("Skipped row of %v.%v at %v:%v. ERROR: %v", e.SchemaName, e.TableName, e.File, e.EventPosition, failed)
+		return nil
+	}
+	if err := c.deadLetters.add(e, failed.Error()); err != nil {
+		c.logging.Errorf("Cannot write row of %v.%v to dead-letter store. ERROR: %v", e.SchemaName, e.TableName, err)
+		return err
+	}
+	c.logging.Warnf("Row of %v.%v at %v:%v moved to dead-letter store. ERROR: %v", e.SchemaName, e.TableName, e.File,
+		e.EventPosition, failed)
+	return nil
+}
+
+// single-row events of row event
+func splitRows(e *structs.Event) []*structs.Event {
+	rows := make([]*structs.Event, len(e.OldValues))
+	for idr := range e.OldValues {
+		r := *e
+		r.OldValues = e.OldValues[idr : idr+1]
+		if len(e.NewValues) > idr {
+			r.NewValues = e.NewValues[idr : idr+1]
+		}
+		rows[idr] = &r
+	}
+	return rows
+}
+
+// tracks transactions of buffers by BEGIN and COMMIT queries
+func (c *pgConnection) trackTx(buf int, query string) {
+	c.txMutex.Lock()
+	defer c.txMutex.Unlock()
+	switch strings.ToUpper(strings.Trim(query, " ;\t\n")) {
+	case "BEGIN", "START TRANSACTION":
+		c.txs[buf] = true
+	case "COMMIT", "ROLLBACK":
+		delete(c.txs, buf)
+	}
+}
+
+func (c *pgConnection) inTx(buf int) bool {
+	c.txMutex.Lock()
+	defer c.txMutex.Unlock()
+	return c.txs[buf]
+}
+
+// plays events of dead-letter store again and removes applied ones.
+// Returns numbers of applied and still failing events
+func (c *pgConnection) redrive() (int, int, error) {
+	if c.deadLetters == nil {
+		return 0, 0, errors.New("No deadLetter section in rconfig")
+	}
+	letters, err := c.deadLetters.list()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	applied := make([]int64, 0, len(letters))
+	for _, dl := range letters {
+		if err := c.rowPlayer(dl.event)(dl.event); err != nil {
+			c.logging.Warnf("Dead letter %v of %v.%v still fails. ERROR: %v", dl.id, dl.event.SchemaName, dl.event.TableName, err)
+			continue
+		}
+		applied = append(applied, dl.id)
+	}
+	return len(applied), len(letters) - len(applied), c.deadLetters.remove(applied)
+}
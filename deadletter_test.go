@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// row failing again after replay is dead-lettered once, also after restart
+func TestFileDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead_letter.jsonl")
+	s, err := newFileDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []*structs.Column{{Name: "id", Type: "int", IsKey: true}}
+	row := func(id int32) *structs.Event {
+		return &structs.Event{SchemaName: "db1", TableName: "table1", Columns: columns, EventType: structs.INSERT_EVENT,
+			File: "mysql-bin.000003", EventPosition: 154, OldValues: [][]*structs.QueryValues{{{ColumnId: 0, Value: id}}}}
+	}
+	for _, e := range []*structs.Event{row(1), row(2), row(1)} { // row 1 is replayed
+		if err := s.add(e, "duplicate key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if letters, _ := s.list(); len(letters) != 2 {
+		t.Fatal("Incorrect dead letters", "expected", 2, "got", len(letters))
+	}
+
+	if s, err = newFileDeadLetters(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add(row(2), "duplicate key"); err != nil {
+		t.Fatal(err)
+	}
+	letters, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatal("Incorrect dead letters after restart", "expected", 2, "got", len(letters))
+	}
+
+	// removed row can be dead-lettered again
+	if err := s.remove([]int64{letters[0].id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add(row(1), "duplicate key"); err != nil {
+		t.Fatal(err)
+	}
+	if letters, _ = s.list(); len(letters) != 2 || letters[1].id != 3 {
+		t.Fatal("Incorrect dead letters after remove", "expected", 3, "got", letters[len(letters)-1].id)
+	}
+}
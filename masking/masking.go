@@ -0,0 +1,174 @@
+// Package masking transforms values of columns holding personal data before
+// they leave the source. Masks work on values as they are decoded from binlog
+// and keep NULLs as NULLs:
+//
+//	hmac     keyed sha256 of value, hex encoded. Equal values give equal
+//	         hashes, so masked keys still join. Destination column should be
+//	         text (see typeMapping)
+//	email    keeps first letter and domain: j***@example.com
+//	phone    keeps last four digits and formatting: +*-***-***-4567
+//	month    truncates date to first day of month
+//	constant replaces value with given one
+package masking
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// Creates mask of given kind. param is key of hmac mask and value of
+// constant mask, other masks have no parameter
+func New(kind string, param string) (structs.ColumnMask, error) {
+	switch strings.ToLower(kind) {
+	case "hmac":
+		if len(param) == 0 {
+			return nil, errors.New("hmac mask requires key")
+		}
+		return &hmacMask{key: []byte(param)}, nil
+	case "email":
+		return emailMask{}, nil
+	case "phone":
+		return phoneMask{}, nil
+	case "month":
+		return monthMask{}, nil
+	case "constant":
+		return &constantMask{value: param}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown mask %v. Mask should be one of hmac, email, phone, month, constant", kind))
+}
+
+// true if mask gives different values for different values, so masked
+// key still identifies rows. Only hmac mask does
+func Distinct(m structs.ColumnMask) bool {
+	_, ok := m.(*hmacMask)
+	return ok
+}
+
+type (
+	hmacMask     struct{ key []byte }
+	emailMask    struct{}
+	phoneMask    struct{}
+	monthMask    struct{}
+	constantMask struct{ value string }
+)
+
+func (m *hmacMask) Mask(column *structs.Column, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	h := hmac.New(sha256.New, m.key)
+	h.Write([]byte(text(column, v)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (emailMask) Mask(column *structs.Column, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	s := text(column, v)
+	at := strings.LastIndex(s, "@")
+	if at < 0 {
+		return keepFirst(s)
+	}
+	return keepFirst(s[:at]) + s[at:]
+}
+
+// first letter followed by fixed number of stars, so length is not disclosed
+func keepFirst(s string) string {
+	for _, r := range s {
+		return string(r) + "***"
+	}
+	return ""
+}
+
+func (phoneMask) Mask(column *structs.Column, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	b := []byte(text(column, v))
+	keep := 4
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] >= '0' && b[i] <= '9' {
+			if keep > 0 {
+				keep--
+			} else {
+				b[i] = '*'
+			}
+		}
+	}
+	return string(b)
+}
+
+// dates and datetimes keep their type, strings starting with date are
+// truncated to date. Values which are not dates are replaced with NULL
+func (monthMask) Mask(column *structs.Column, v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	s := text(column, v)
+	if len(s) >= 10 {
+		if d, err := time.Parse("2006-01-02", s[:10]); err == nil {
+			return d.Format("2006-01") + "-01"
+		}
+	}
+	return nil
+}
+
+func (m *constantMask) Mask(column *structs.Column, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return m.value
+}
+
+// text form of value decoded from binlog. Integers come unsigned from binlog
+// and are converted to signed ones unless column is unsigned, enums are
+// converted to labels
+func text(column *structs.Column, v interface{}) string {
+	signed := !strings.Contains(column.Type, "unsigned")
+	switch t := v.(type) {
+	case uint8:
+		if strings.HasPrefix(column.Type, "enum") {
+			if int(t) > 0 && int(t) <= len(column.Enum) {
+				return column.Enum[t-1]
+			}
+			return ""
+		}
+		if signed {
+			return strconv.FormatInt(int64(int8(t)), 10)
+		}
+	case uint16:
+		if signed && !strings.HasPrefix(column.Type, "year") {
+			return strconv.FormatInt(int64(int16(t)), 10)
+		}
+	case uint32:
+		if signed {
+			if strings.HasPrefix(column.Type, "mediumint") && t&0x800000 != 0 {
+				return strconv.FormatInt(int64(t)-0x1000000, 10)
+			}
+			return strconv.FormatInt(int64(int32(t)), 10)
+		}
+	case uint64:
+		if signed {
+			return strconv.FormatInt(int64(t), 10)
+		}
+	case []byte:
+		return string(t)
+	case string:
+		return t
+	case time.Time:
+		return t.Format("2006-01-02 15:04:05.999999")
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,75 @@
+package masking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestMasks(t *testing.T) {
+	varchar := &structs.Column{Name: "c", Type: "varchar(50)"}
+	date := &structs.Column{Name: "d", Type: "date"}
+	id := &structs.Column{Name: "id", Type: "int(11)"}
+	bigid := &structs.Column{Name: "id", Type: "bigint(20)"}
+
+	for _, c := range []struct {
+		kind, param string
+		column      *structs.Column
+		value       interface{}
+		expected    interface{}
+	}{
+		{"email", "", varchar, "john.doe@example.com", "j***@example.com"},
+		{"email", "", varchar, []byte("nobody"), "n***"},
+		{"phone", "", varchar, "+1-202-555-4567", "+*-***-***-4567"},
+		{"month", "", date, time.Date(2020, 5, 17, 0, 0, 0, 0, time.UTC), time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"month", "", varchar, "2020-05-17 10:00:00", "2020-05-01"},
+		{"month", "", varchar, "soon", nil},
+		{"constant", "***", varchar, "secret", "***"},
+		{"constant", "***", varchar, nil, nil},
+		{"hmac", "key", varchar, nil, nil},
+	} {
+		mask, err := New(c.kind, c.param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if masked := mask.Mask(c.column, c.value); masked != c.expected {
+			t.Fatal(
+				"Incorrect", c.kind, "mask of", c.value,
+				"expected", c.expected,
+				"got", masked,
+			)
+		}
+	}
+
+	// same id hashes equally whatever integer type holds it
+	mask, _ := New("hmac", "key")
+	a := mask.Mask(id, uint32(0xffffffff))
+	b := mask.Mask(bigid, uint64(0xffffffffffffffff))
+	if a != b || a == mask.Mask(id, uint32(1)) {
+		t.Fatal("Incorrect hmac of -1", "got", a, b)
+	}
+	other, _ := New("hmac", "other key")
+	if a == other.Mask(id, uint32(0xffffffff)) {
+		t.Fatal("Hmac does not depend on key")
+	}
+
+	if _, err := New("hmac", ""); err == nil {
+		t.Fatal("Expected error for hmac without key")
+	}
+	if _, err := New("scramble", ""); err == nil {
+		t.Fatal("Expected error for unknown mask")
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	for kind, expected := range map[string]bool{"hmac": true, "email": false, "phone": false, "month": false, "constant": false} {
+		mask, err := New(kind, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Distinct(mask) != expected {
+			t.Fatal("Incorrect distinct", kind, "expected", expected, "got", !expected)
+		}
+	}
+}
@@ -6,12 +6,15 @@ import (
 	//	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	//	"time"
 
 	"github.com/andsha/mysqlutils"
+	"github.com/andsha/replicagor/masking"
 	"github.com/andsha/replicagor/mysqlconnection"
+	"github.com/andsha/replicagor/rowfilter"
 	"github.com/andsha/replicagor/structs"
 	"github.com/andsha/securestorage"
 	"github.com/andsha/vconfig"
@@ -24,7 +27,9 @@ type mysqlConnection struct {
 	sqlprocess     *mysqlutils.MysqlProcess
 	updateRinfo    chan structs.ST
 	sendNewTabInfo chan *structs.Table
-	//eventLog *mysqlconnection.EventLog
+	eventlog       *mysqlconnection.EventLog // nil until binlog dump is started
+	repairCfg      *repairConfig             // nil if repairs are disabled
+	repairRun      int64                     // start of process, prefix of watermark ids
 }
 
 func NewMysqlConnection(c *conn) (*mysqlConnection, error) {
@@ -46,6 +51,10 @@ func NewMysqlConnection(c *conn) (*mysqlConnection, error) {
 		return nil, err
 	}
 
+	if err := mysqlc.initRepairs(); err != nil {
+		return nil, err
+	}
+
 	// generate binlog process
 	if err := mysqlc.blconnect(); err != nil {
 		return nil, err
@@ -220,6 +229,10 @@ func (c *mysqlConnection) startDump(
 	if err != nil {
 		return nil, err
 	}
+	c.eventlog = eventlog
+	if c.repairCfg != nil {
+		eventlog.SetWatermarkTable(c.repairCfg.schema, c.repairCfg.table)
+	}
 	echan := eventlog.GetEventChan()
 	go eventlog.Start(stop_d, stopped_d, pos)
 	go c.UpdateRinfo(stop_uri, stopped_uri)
@@ -237,6 +250,30 @@ func (c *mysqlConnection) playEvent(e *structs.Event) error {
 	return nil
 }
 
+func (c *mysqlConnection) flushEvents(buf int) error {
+	return nil
+}
+
+func (c *mysqlConnection) pending(buf int) bool {
+	return false
+}
+
+func (c *mysqlConnection) provision(source connection) error {
+	return nil
+}
+
+func (c *mysqlConnection) redrive() (int, int, error) {
+	return 0, 0, errors.New("Dead letters cannot be played into mysql")
+}
+
+func (c *mysqlConnection) validate(source connection) (int, error) {
+	return 0, errors.New("Mysql cannot be validated as destination")
+}
+
+func (c *mysqlConnection) queryRows(query string) ([][]interface{}, error) {
+	return c.sqlprocess.Run(query)
+}
+
 // get structure of source db
 func (c *mysqlConnection) getDBInfo(schemas []string) ([]structs.Schema, error) {
 
@@ -313,6 +350,90 @@ func (c *mysqlConnection) getDBInfo(schemas []string) ([]structs.Schema, error)
 	return sstructs, nil
 }
 
+// marks columns of the key used to identify rows in UPDATE and DELETE
+func (c *mysqlConnection) setTableKey(schema string, t *structs.Table) error {
+	res, err := c.sqlprocess.Run(fmt.Sprintf("SHOW INDEX FROM `%v`.`%v`", schema, t.Name))
+	if err != nil {
+		return err
+	}
+	if !markTableKey(t, res) {
+		c.logging.Warnf("Primary key of %v.%v has excluded or masked columns, rows are identified by other key or all columns",
+			schema, t.Name)
+	}
+	return nil
+}
+
+// marks key columns of table t by rows of SHOW INDEX. Key is primary key, or
+// first unique key without NULL-able or prefix columns if table has no
+// primary key. Keys with columns which are excluded or masked to values not
+// identifying rows are skipped, without usable key rows are matched on all
+// columns. False if primary key is skipped
+func markTableKey(t *structs.Table, index [][]interface{}) bool {
+	// columns identifying rows in destination
+	identifying := make(map[string]bool)
+	for _, col := range t.Columns {
+		identifying[col.Name] = !col.ExcludedFromReplication && (col.Mask == nil || masking.Distinct(col.Mask))
+	}
+
+	// SHOW INDEX columns: Table, Non_unique, Key_name, Seq_in_index, Column_name,
+	// Collation, Cardinality, Sub_part, Packed, Null, ...
+	keys := make(map[string][]string)
+	unusable := make(map[string]bool)
+	hidden := make(map[string]bool) // keys with columns not identifying rows in destination
+	knames := make([]string, 0)
+	for _, idx := range index {
+		nonUnique, _ := idx[1].(string)
+		kname, _ := idx[2].(string)
+		cname, _ := idx[4].(string)
+		subPart, _ := idx[7].(string)
+		null, _ := idx[9].(string)
+		if nonUnique != "0" {
+			continue
+		}
+		if _, ok := keys[kname]; !ok {
+			knames = append(knames, kname)
+		}
+		keys[kname] = append(keys[kname], cname)
+		if len(subPart) != 0 && subPart != "NULL" || null == "YES" {
+			unusable[kname] = true
+		}
+		if !identifying[cname] {
+			hidden[kname] = true
+		}
+	}
+
+	key, ok := keys["PRIMARY"]
+	if ok && hidden["PRIMARY"] {
+		key, ok = nil, false
+	}
+	if ok {
+		for _, col := range t.Columns {
+			for _, kcol := range key {
+				if col.Name == kcol {
+					col.IsPKey = true
+				}
+			}
+		}
+	} else {
+		for _, kname := range knames {
+			if kname != "PRIMARY" && !unusable[kname] && !hidden[kname] {
+				key = keys[kname]
+				break
+			}
+		}
+	}
+
+	for _, col := range t.Columns {
+		for _, kcol := range key {
+			if col.Name == kcol {
+				col.IsKey = true
+			}
+		}
+	}
+
+	return !hidden["PRIMARY"]
+}
+
 // fill rinfo struct
 func (c *mysqlConnection) initInfo() error {
 	schemaSections, err := c.rconf.GetSectionsByName("replicatedDatabases")
@@ -353,6 +474,29 @@ func (c *mysqlConnection) initInfo() error {
 		return err
 	}
 	enableDeleteTablesMap, _ := m.(map[string]map[string]interface{})
+
+	softDeleteTablesMap := make(map[string]map[string]interface{})
+	if m, err := getCFGInfo(c.rconf, "softDelete", "tables"); err == nil {
+		softDeleteTablesMap, _ = m.(map[string]map[string]interface{})
+	}
+
+	historyTablesMap := make(map[string]map[string]interface{})
+	if m, err := getCFGInfo(c.rconf, "history", "tables"); err == nil {
+		historyTablesMap, _ = m.(map[string]map[string]interface{})
+	}
+
+	// audit section without tables audits all tables
+	var auditTablesMap map[string]map[string]interface{}
+	auditAll := false
+	if sections, err := c.rconf.GetSectionsByName("audit"); err == nil {
+		if _, err := sections[0].GetValues("tables"); err != nil {
+			auditAll = true
+		} else if m, err := getCFGInfo(c.rconf, "audit", "tables"); err == nil {
+			auditTablesMap, _ = m.(map[string]map[string]interface{})
+		} else {
+			return err
+		}
+	}
 	//fmt.Println("1", enableDeleteTablesMap["db1"])
 
 	m, err = getCFGInfo(c.rconf, "excludedColumns", "columns")
@@ -373,6 +517,15 @@ func (c *mysqlConnection) initInfo() error {
 				rinfo[idr].Tables[idt].EnableDelete = true
 				//fmt.Println(rinfo[idr].Tables[idt].Name)
 			}
+			if _, ok := softDeleteTablesMap[schema.Name][t.Name]; ok {
+				rinfo[idr].Tables[idt].SoftDelete = true
+			}
+			if _, ok := historyTablesMap[schema.Name][t.Name]; ok {
+				rinfo[idr].Tables[idt].History = true
+			}
+			if _, ok := auditTablesMap[schema.Name][t.Name]; ok || auditAll {
+				rinfo[idr].Tables[idt].Audit = true
+			}
 			for idc, c := range t.Columns {
 				if _, ok := excludedColumnsMap[schema.Name][t.Name][c.Name]; ok {
 					rinfo[idr].Tables[idt].Columns[idc].ExcludedFromReplication = true
@@ -381,6 +534,26 @@ func (c *mysqlConnection) initInfo() error {
 		}
 	}
 
+	if err := c.initRowFilters(rinfo); err != nil {
+		return err
+	}
+
+	if err := c.initMasks(rinfo); err != nil {
+		return err
+	}
+
+	// keys are chosen when excluded and masked columns are known
+	for _, schema := range rinfo {
+		for _, t := range schema.Tables {
+			if t.ExcludedFromReplication {
+				continue
+			}
+			if err := c.setTableKey(schema.Name, t); err != nil {
+				return err
+			}
+		}
+	}
+
 	bufferSections, err := c.rconf.GetSectionsByName("buffer")
 	if err != nil {
 		return err
@@ -458,9 +631,11 @@ func (c *mysqlConnection) initInfo() error {
 		return errors.New(fmt.Sprintf("Frequency of default (0'th) buffer shall be 1"))
 	}
 
-	c.rinfo = rinfo
+	if err := c.initLanes(rinfo); err != nil {
+		return err
+	}
 
-	printRinfo(rinfo)
+	c.rinfo = rinfo
 
 	//	for _, s := range rinfo {
 	//		fmt.Println(s.Name)
@@ -486,6 +661,128 @@ func (c *mysqlConnection) initInfo() error {
 	return nil
 }
 
+// reads rowFilter sections of rconfig. Each section has predicate for one table
+//
+//	table = schema1.table1
+//	filter = tenant_id IN (3,7) AND status != 'draft'
+//
+// Only rows matching predicate are replicated
+func (c *mysqlConnection) initRowFilters(rinfo []structs.Schema) error {
+	sections, err := c.rconf.GetSectionsByName("rowFilter")
+	if err != nil { // no filters
+		return nil
+	}
+
+	for _, sec := range sections {
+		table, err := sec.GetSingleValue("table", "")
+		if err != nil || len(table) == 0 {
+			return errors.New("rowFilter should have variable 'table' in following format: schemaname1.tablename1")
+		}
+		vals, err := sec.GetValues("filter")
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v. filter is a required field in rowFilter section of %v", err, table))
+		}
+		// predicate is split by config separator
+		filter, err := rowfilter.Parse(strings.Join(vals, ","))
+		if err != nil {
+			return err
+		}
+
+		st := strings.Split(strings.TrimSpace(table), ".")
+		if len(st) != 2 {
+			return errors.New(fmt.Sprintf("Table of rowFilter should be schemaname.tablename. Got %v", table))
+		}
+		for idr := range rinfo {
+			if rinfo[idr].Name != st[0] {
+				continue
+			}
+			for _, t := range rinfo[idr].Tables {
+				if t.Name != st[1] {
+					continue
+				}
+				for _, name := range filter.Columns() {
+					found := false
+					for _, col := range t.Columns {
+						if strings.EqualFold(col.Name, name) {
+							found = true
+							break
+						}
+					}
+					if !found {
+						return errors.New(fmt.Sprintf("Column %v of row filter %v does not exist in table %v", name, filter, table))
+					}
+				}
+				t.RowFilter = filter
+			}
+		}
+	}
+	return nil
+}
+
+// reads masking sections of rconfig. Each section sets one mask for columns
+//
+//	columns = schema1.table1.email, schema1.table2.email
+//	mask = hmac | email | phone | month | constant
+//	key = secret or keyFile = /path/to/file (hmac key)
+//	value = *** (value of constant mask)
+//
+// Masked values replace original ones in every event leaving source, row
+// filters are evaluated before masking
+func (c *mysqlConnection) initMasks(rinfo []structs.Schema) error {
+	sections, err := c.rconf.GetSectionsByName("masking")
+	if err != nil { // no masks
+		return nil
+	}
+
+	for _, sec := range sections {
+		tm, err := getCFGSectionInfo(sec, "columns")
+		if err != nil {
+			return err
+		}
+		columns, ok := tm.(map[string]map[string]map[string]interface{})
+		if !ok {
+			return errors.New("masking should have variable 'columns' in following format: schemanane1.tablename1.column1, schemaname1.tablename2.column2, ...")
+		}
+		kind, err := sec.GetSingleValue("mask", "")
+		if err != nil || len(kind) == 0 {
+			return errors.New(fmt.Sprintf("mask is a required field in masking section of %v", columns))
+		}
+
+		var param string
+		switch kind = strings.ToLower(kind); kind {
+		case "hmac":
+			if file, _ := sec.GetSingleValue("keyFile", ""); len(file) > 0 {
+				b, err := ioutil.ReadFile(file)
+				if err != nil {
+					return errors.New(fmt.Sprintf("Cannot read hmac key. %v", err))
+				}
+				param = strings.TrimSpace(string(b))
+			} else if vals, err := sec.GetValues("key"); err == nil {
+				param = strings.Join(vals, ",")
+			}
+		case "constant":
+			if vals, err := sec.GetValues("value"); err == nil {
+				param = strings.Join(vals, ",")
+			}
+		}
+		mask, err := masking.New(kind, param)
+		if err != nil {
+			return err
+		}
+
+		for idr := range rinfo {
+			for _, t := range rinfo[idr].Tables {
+				for _, col := range t.Columns {
+					if _, ok := columns[rinfo[idr].Name][t.Name][col.Name]; ok {
+						col.Mask = mask
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (c *mysqlConnection) GetTableFromRinfo(schema string, table string) *structs.Table {
 	if len(schema) == 0 || len(table) == 0 {
 		return nil
@@ -522,8 +819,6 @@ func (c *mysqlConnection) UpdateRinfo(stop <-chan bool, stopped chan<- bool) {
 			t := c.GetTableFromRinfo(s.Schema, s.Table)
 			c.blprocess.SetRinfo(c.rinfo)
 			c.sendNewTabInfo <- t
-		default:
-			//time.Sleep(time.Second * 1)
 		}
 	}
 }
@@ -537,7 +832,7 @@ func getCFGInfo(config vconfig.VConfig, secname string, varname string) (interfa
 	var i interface{}
 
 	switch secname {
-	case "excludedTables", "enableDelete":
+	case "excludedTables", "enableDelete", "softDelete", "history", "audit":
 		mp := make(map[string]map[string]interface{})
 		for _, es := range sections {
 			tm, err := getCFGSectionInfo(es, "tables")
@@ -546,7 +841,7 @@ func getCFGInfo(config vconfig.VConfig, secname string, varname string) (interfa
 			}
 			m, ok := tm.(map[string]map[string]interface{})
 			if !ok {
-				return nil, errors.New("excludedTables and enableDelete should have variable 'tables' in following format: schemanane1.tablename1, schemaname1.tablename2, ...")
+				return nil, errors.New("excludedTables, enableDelete, softDelete, history and audit should have variable 'tables' in following format: schemanane1.tablename1, schemaname1.tablename2, ...")
 			}
 			for key, val := range m {
 				mp[key] = val
@@ -646,15 +941,3 @@ func sintappend(sslice [][]int, aslice []int, pos int) [][]int {
 	sslice = append(sslice, aslice)
 	return sslice
 }
-
-func printRinfo(rinfo []structs.Schema) {
-	for _, schema := range rinfo {
-		fmt.Printf("Schema name:%v, buf:%v, freq: %v\n", schema.Name, schema.Buf, schema.Freq)
-		for _, table := range schema.Tables {
-			fmt.Printf("    Table name: %v, excluded: %v, delete:%v, buf: %v, freq: %v", table.Name, table.ExcludedFromReplication, table.EnableDelete, table.Buf, table.Freq)
-			for _, column := range table.Columns {
-				fmt.Printf("        Column name: %v, enum: %v, excluded: %v, isPkey: %v, type: %v", column.Name, column.Enum, column.ExcludedFromReplication, column.IsPKey, column.Type)
-			}
-		}
-	}
-}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/masking"
+	"github.com/andsha/replicagor/structs"
+)
+
+// key with excluded or masked columns does not identify rows in destination
+func TestMarkTableKey(t *testing.T) {
+	constant, _ := masking.New("constant", "***")
+	hmac, _ := masking.New("hmac", "key")
+	// Table, Non_unique, Key_name, Seq_in_index, Column_name, Collation, Cardinality, Sub_part, Packed, Null
+	index := [][]interface{}{
+		{"t", "0", "PRIMARY", "1", "id", "A", "10", "NULL", "", ""},
+		{"t", "0", "uk_email", "1", "email", "A", "10", "NULL", "", ""},
+		{"t", "0", "uk_code", "1", "code", "A", "10", "NULL", "", ""},
+	}
+
+	for _, c := range []struct {
+		id, email *structs.Column
+		key       string
+		pkey      bool
+	}{
+		{&structs.Column{Name: "id"}, &structs.Column{Name: "email"}, "id", true},
+		{&structs.Column{Name: "id", Mask: hmac}, &structs.Column{Name: "email"}, "id", true},
+		{&structs.Column{Name: "id", ExcludedFromReplication: true}, &structs.Column{Name: "email"}, "email", false},
+		{&structs.Column{Name: "id", Mask: constant}, &structs.Column{Name: "email", Mask: constant}, "code", false},
+	} {
+		table := &structs.Table{Name: "t", Columns: []*structs.Column{c.id, c.email, {Name: "code"}}}
+		ok := markTableKey(table, index)
+		var key string
+		for _, col := range table.Columns {
+			if col.IsKey {
+				key += col.Name
+			}
+		}
+		if key != c.key || ok != c.pkey || c.id.IsPKey != c.pkey {
+			t.Fatal("Incorrect key", "expected", c.key, c.pkey, "got", key, ok, c.id.IsPKey)
+		}
+	}
+}
@@ -27,10 +27,13 @@ type (
 		headerWriteRowsEventV1Length  byte
 
 		lastTableMapEvent *TableMapEvent
+		lastGtid          string // gtid of current transaction
 
 		additionalLength int
 
 		eventChan chan *structs.Event
+
+		repairs repairWindows // windows of chunks being repaired
 	}
 
 	eventLogHeader struct {
@@ -79,6 +82,14 @@ type (
 		TransactionId uint64
 	}
 
+	// starts transaction in gtid mode. Anonymous gtid event has zero sid
+	GtidEvent struct {
+		*eventLogHeader
+		Flags byte
+		Sid   []byte
+		Gno   uint64
+	}
+
 	IntVarEvent struct {
 		*eventLogHeader
 		_type byte
@@ -559,6 +570,21 @@ func (event *XidEvent) read(pack *pack) {
 	pack.readUint64(&event.TransactionId)
 }
 
+func (event *GtidEvent) read(pack *pack) {
+	event.Flags, _ = pack.ReadByte()
+	event.Sid = append([]byte{}, pack.Next(16)...)
+	pack.readUint64(&event.Gno)
+}
+
+// gtid as source uuid and transaction number, empty for anonymous gtid
+func (event *GtidEvent) GetGtid() string {
+	if len(event.Sid) != 16 || event.Gno == 0 {
+		return ""
+	}
+	s := event.Sid
+	return fmt.Sprintf("%x-%x-%x-%x-%x:%v", s[0:4], s[4:6], s[6:8], s[8:10], s[10:16], event.Gno)
+}
+
 func (event *QueryEvent) GetQuery() string {
 	return event.query
 }
@@ -635,6 +661,7 @@ func newEventLog(mysqlConnection *MysqlProcess, additionalLength int) *EventLog
 	el.mysqlConnection = mysqlConnection
 	el.eventChan = make(chan *structs.Event, 1)
 	el.additionalLength = additionalLength
+	el.repairs.windows = make(map[string]*RepairWindow)
 	return &el
 }
 
@@ -654,6 +681,8 @@ func (ev *EventLog) GetEventChan() <-chan *structs.Event {
 func (evlog *EventLog) Start(stop <-chan bool, stopped chan<- bool, startPos uint32) {
 	replicateEv := true
 	deleteEv := false
+	auditDeleteEv := false // deletes are sent only to audit table
+	watermarkEv := false   // rows are watermarks of repair windows
 	buffer := 0
 	tab := new(structs.Table)
 	var columns []*structs.Column
@@ -723,7 +752,11 @@ func (evlog *EventLog) Start(stop <-chan bool, stopped chan<- bool, startPos uin
 				event.Query = "COMMIT"
 				event.Position = pos
 				event.File = evlog.lastRotateFileName
+				event.Timestamp = e.Timestamp
+				event.Gtid = evlog.lastGtid
 				evlog.eventChan <- event
+			case *GtidEvent:
+				evlog.lastGtid = e.GetGtid()
 			case *QueryEvent:
 				for _, s := range evlog.mysqlConnection.rinfo {
 					if s.Name == e.schema {
@@ -735,18 +768,21 @@ func (evlog *EventLog) Start(stop <-chan bool, stopped chan<- bool, startPos uin
 							_ = evlog.mysqlConnection.UpdateDBinfo(e.schema, "")
 							q = fmt.Sprintf("SET SEARCH_PATH TO \"%v\"; %v", e.schema, q)
 							event.Position = pos
-							event.File = evlog.lastRotateFileName
 						}
+						event.File = evlog.lastRotateFileName
+						event.EventPosition = e.NextPosition - e.EventSize
 						event.Query = q
 						evlog.eventChan <- event
 					}
 				}
 			case *TableMapEvent:
-				fmt.Println("TableMapEvent. Schema:", e.SchemaName, "Table:", e.TableName)
+				evlog.mysqlConnection.logging.Debugf("TableMapEvent. Schema:%v Table:%v", e.SchemaName, e.TableName)
 				//fmt.Println("2")
 				evlog.lastTableMapEvent = e
 				replicateEv = false
 				deleteEv = false
+				auditDeleteEv = false
+				watermarkEv = evlog.isWatermark(e.SchemaName, e.TableName)
 				columns = nil
 
 				for _, s := range evlog.mysqlConnection.rinfo {
@@ -782,8 +818,11 @@ func (evlog *EventLog) Start(stop <-chan bool, stopped chan<- bool, startPos uin
 							if tab.ExcludedFromReplication {
 								replicateEv = false
 							}
-							if tab.EnableDelete {
+							if tab.EnableDelete || tab.SoftDelete || tab.History {
 								deleteEv = true
+							} else if tab.Audit {
+								deleteEv = true
+								auditDeleteEv = true
 							}
 						}
 						break
@@ -792,6 +831,21 @@ func (evlog *EventLog) Start(stop <-chan bool, stopped chan<- bool, startPos uin
 
 			case *rowsEvent:
 				//fmt.Println("3")
+				if watermarkEv {
+					switch e.EventType {
+					case _WRITE_ROWS_EVENTv0, _WRITE_ROWS_EVENTv1, _WRITE_ROWS_EVENTv2:
+						for _, re := range evlog.watermark(e.values, e.eventLogHeader) {
+							evlog.eventChan <- re
+						}
+					}
+					listencont <- true
+					continue
+				}
+				if replicateEv && tab != nil {
+					evlog.touchRows(&structs.Event{SchemaName: evlog.lastTableMapEvent.SchemaName,
+						TableName: evlog.lastTableMapEvent.TableName, Columns: columns, OldValues: e.values, NewValues: e.newValues})
+				}
+
 				if !replicateEv {
 					listencont <- true
 					continue
@@ -803,7 +857,10 @@ func (evlog *EventLog) Start(stop <-chan bool, stopped chan<- bool, startPos uin
 				event.Columns = columns
 				event.Buf = buffer
 				//event.Position = evlog.lastRotatePosition
-				//event.File = evlog.lastRotateFileName
+				event.File = evlog.lastRotateFileName
+				event.EventPosition = e.NextPosition - e.EventSize
+				event.Timestamp = e.Timestamp
+				event.Gtid = evlog.lastGtid
 				switch e.EventType {
 				case _DELETE_ROWS_EVENTv0, _DELETE_ROWS_EVENTv1, _DELETE_ROWS_EVENTv2:
 					//fmt.Println("delete event?", deleteEv)
@@ -812,6 +869,7 @@ func (evlog *EventLog) Start(stop <-chan bool, stopped chan<- bool, startPos uin
 						continue
 					}
 					event.EventType = structs.DELETE_EVENT
+					event.SkipMirror = auditDeleteEv
 				case _UPDATE_ROWS_EVENTv0, _UPDATE_ROWS_EVENTv1, _UPDATE_ROWS_EVENTv2:
 					event.EventType = structs.UPDATE_EVENT
 					event.NewValues = e.newValues
@@ -819,7 +877,24 @@ func (evlog *EventLog) Start(stop <-chan bool, stopped chan<- bool, startPos uin
 					event.EventType = structs.INSERT_EVENT
 				}
 				event.OldValues = e.values
-				evlog.eventChan <- event
+
+				events := []*structs.Event{event}
+				if tab != nil && tab.RowFilter != nil {
+					// deletes produced by updates moving rows out of filter are sent
+					// even if delete is not enabled, they keep destination filtered
+					var err error
+					events, err = filterRows(event, tab.RowFilter)
+					if err != nil {
+						evlog.mysqlConnection.logging.Errorf("Error while filtering rows of %v.%v:%v", event.SchemaName, event.TableName, err)
+						stopped <- true
+						listencont <- true
+						return
+					}
+				}
+				for _, fe := range events {
+					maskRows(fe)
+					evlog.eventChan <- fe
+				}
 				//				if t >= 1 {
 				//					stopped <- true
 				//					close(stopped)
@@ -834,7 +909,6 @@ func (evlog *EventLog) Start(stop <-chan bool, stopped chan<- bool, startPos uin
 			//fmt.Println("5")
 			//pos = evlog.lastRotatePosition // current position is next read position
 			listencont <- true
-		default:
 		}
 	}
 }
@@ -879,6 +953,10 @@ func (ev *EventLog) readEvent() (interface{}, error) {
 		event = &XidEvent{
 			eventLogHeader: header,
 		}
+	case _GTID_EVENT, _ANONYMOUS_GTID_EVENT:
+		event = &GtidEvent{
+			eventLogHeader: header,
+		}
 	case _INTVAR_EVENT:
 		event = &IntVarEvent{
 			eventLogHeader: header,
@@ -0,0 +1,29 @@
+package mysqlconnection
+
+import (
+	"github.com/andsha/replicagor/structs"
+)
+
+// replaces values of masked columns of event rows with masked values
+func maskRows(event *structs.Event) {
+	masked := false
+	for _, column := range event.Columns {
+		if column.Mask != nil {
+			masked = true
+			break
+		}
+	}
+	if !masked {
+		return
+	}
+
+	for _, rows := range [][][]*structs.QueryValues{event.OldValues, event.NewValues} {
+		for _, row := range rows {
+			for _, val := range row {
+				if column := event.Columns[val.ColumnId]; column.Mask != nil {
+					val.Value = column.Mask.Mask(column, val.Value)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package mysqlconnection
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// RepairWindow is a chunk of table read from mysql between low and high
+// watermarks written into watermark table. Rows of the table changed in
+// binlog between the watermarks are newer than rows read, so at the high
+// watermark they are removed from the chunk and chunk is sent as
+// REPAIR_EVENT in binlog order with other events
+type RepairWindow struct {
+	Id     string // id of watermark rows
+	Schema string
+	Table  *structs.Table
+	Buf    int
+	Chunk  *structs.RepairChunk
+	Done   chan bool // closed when chunk is sent
+
+	rows    [][]*structs.QueryValues
+	open    bool                     // low watermark is read
+	touched map[string][]interface{} // keys of rows changed in window
+}
+
+type repairWindows struct {
+	sync.Mutex
+	schema  string // watermark table, empty if repairs are disabled
+	table   string
+	windows map[string]*RepairWindow
+}
+
+// Sets mysql table whose row events are watermarks of repair windows
+func (ev *EventLog) SetWatermarkTable(schema string, table string) {
+	ev.repairs.Lock()
+	defer ev.repairs.Unlock()
+	ev.repairs.schema, ev.repairs.table = schema, table
+}
+
+// Registers window before its low watermark is written
+func (ev *EventLog) AddRepairWindow(w *RepairWindow) {
+	ev.repairs.Lock()
+	defer ev.repairs.Unlock()
+	w.touched = make(map[string][]interface{})
+	ev.repairs.windows[w.Id] = w
+}
+
+// Sets rows read from mysql, before high watermark is written.
+// Values are text of result set
+func (ev *EventLog) SetRepairRows(id string, rows [][]*structs.QueryValues) {
+	ev.repairs.Lock()
+	defer ev.repairs.Unlock()
+	if w, ok := ev.repairs.windows[id]; ok {
+		w.rows = rows
+	}
+}
+
+// Forgets window which will not be finished
+func (ev *EventLog) RemoveRepairWindow(id string) {
+	ev.repairs.Lock()
+	defer ev.repairs.Unlock()
+	delete(ev.repairs.windows, id)
+}
+
+func (ev *EventLog) isWatermark(schema string, table string) bool {
+	ev.repairs.Lock()
+	defer ev.repairs.Unlock()
+	return len(ev.repairs.table) != 0 && schema == ev.repairs.schema && table == ev.repairs.table
+}
+
+// handles rows written into watermark table, each row is (id, mark).
+// Returns events of windows closed by high watermarks
+func (ev *EventLog) watermark(rows [][]*structs.QueryValues, header *eventLogHeader) []*structs.Event {
+	ev.repairs.Lock()
+	defer ev.repairs.Unlock()
+	var events []*structs.Event
+	for _, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		w, ok := ev.repairs.windows[fmt.Sprintf("%s", row[0].Value)]
+		if !ok { // window of other process or of earlier run
+			continue
+		}
+		switch fmt.Sprintf("%s", row[1].Value) {
+		case "low":
+			w.open = true
+		case "high":
+			events = append(events, ev.repairEvent(w, header))
+			delete(ev.repairs.windows, w.Id)
+			close(w.Done)
+		}
+	}
+	return events
+}
+
+// remembers keys of rows of event changed in open windows of its table
+func (ev *EventLog) touchRows(event *structs.Event) {
+	ev.repairs.Lock()
+	defer ev.repairs.Unlock()
+	for _, w := range ev.repairs.windows {
+		if !w.open || w.Schema != event.SchemaName || w.Table.Name != event.TableName {
+			continue
+		}
+		for _, rows := range [][][]*structs.QueryValues{event.OldValues, event.NewValues} {
+			for _, row := range rows {
+				key, values := rowKey(event.Columns, row)
+				w.touched[key] = values
+			}
+		}
+	}
+}
+
+// event of window without rows touched in binlog
+func (ev *EventLog) repairEvent(w *RepairWindow, header *eventLogHeader) *structs.Event {
+	event := &structs.Event{
+		SchemaName:    w.Schema,
+		TableName:     w.Table.Name,
+		Columns:       w.Table.Columns,
+		EventType:     structs.REPAIR_EVENT,
+		Buf:           w.Buf,
+		File:          ev.lastRotateFileName,
+		EventPosition: header.NextPosition - header.EventSize,
+		Timestamp:     header.Timestamp,
+		Gtid:          ev.lastGtid,
+		Chunk:         w.Chunk,
+	}
+	for _, row := range w.rows {
+		if key, _ := rowKey(w.Table.Columns, row); !isTouched(w, key) {
+			event.OldValues = append(event.OldValues, row)
+		}
+	}
+	for _, values := range w.touched {
+		w.Chunk.Keys = append(w.Chunk.Keys, values)
+	}
+	maskRows(event)
+	return event
+}
+
+func isTouched(w *RepairWindow, key string) bool {
+	_, ok := w.touched[key]
+	return ok
+}
+
+// key of row built from key columns (see structs.Column.IsKey) and values of the key
+func rowKey(columns []*structs.Column, row []*structs.QueryValues) (string, []interface{}) {
+	var texts []string
+	var values []interface{}
+	for _, val := range row {
+		if !columns[val.ColumnId].IsKey {
+			continue
+		}
+		if val.Value == nil {
+			texts = append(texts, "\x00")
+			values = append(values, nil)
+			continue
+		}
+		s := keyText(columns[val.ColumnId], val.Value)
+		texts = append(texts, s)
+		values = append(values, s)
+	}
+	return strings.Join(texts, "\x01"), values
+}
+
+// text of key value decoded from binlog as mysql returns it in result set.
+// Integers come unsigned from binlog and are converted to signed ones unless
+// column is unsigned, enums are converted to labels
+func keyText(column *structs.Column, v interface{}) string {
+	signed := !strings.Contains(column.Type, "unsigned")
+	switch t := v.(type) {
+	case uint8:
+		if strings.HasPrefix(column.Type, "enum") {
+			if int(t) > 0 && int(t) <= len(column.Enum) {
+				return column.Enum[t-1]
+			}
+			return ""
+		}
+		if signed {
+			return strconv.FormatInt(int64(int8(t)), 10)
+		}
+	case uint16:
+		if signed && !strings.HasPrefix(column.Type, "year") {
+			return strconv.FormatInt(int64(int16(t)), 10)
+		}
+	case uint32:
+		if signed {
+			if strings.HasPrefix(column.Type, "mediumint") && t&0x800000 != 0 {
+				return strconv.FormatInt(int64(t)-0x1000000, 10)
+			}
+			return strconv.FormatInt(int64(int32(t)), 10)
+		}
+	case uint64:
+		if signed {
+			return strconv.FormatInt(int64(t), 10)
+		}
+	case []byte:
+		return string(t)
+	case string:
+		return t
+	case time.Time:
+		return t.Format("2006-01-02 15:04:05.999999")
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,57 @@
+package mysqlconnection
+
+import (
+	"github.com/andsha/replicagor/structs"
+)
+
+// applies row filter of table to event. Rows of inserts and deletes are kept if
+// they match filter. Update of row moving into filter becomes insert of new
+// row, update of row moving out of filter becomes delete of old row, so
+// destination keeps only matching rows. Resulting events keep order of rows
+func filterRows(event *structs.Event, filter structs.RowFilter) ([]*structs.Event, error) {
+	events := make([]*structs.Event, 0)
+
+	// appends row to last event if it has same type, otherwise starts new event
+	add := func(eventType byte, oldValues []*structs.QueryValues, newValues []*structs.QueryValues) {
+		if len(events) == 0 || events[len(events)-1].EventType != eventType {
+			e := *event
+			e.EventType = eventType
+			e.OldValues = nil
+			e.NewValues = nil
+			events = append(events, &e)
+		}
+		last := events[len(events)-1]
+		last.OldValues = append(last.OldValues, oldValues)
+		if newValues != nil {
+			last.NewValues = append(last.NewValues, newValues)
+		}
+	}
+
+	for idv, values := range event.OldValues {
+		oldMatch, err := filter.Match(event.Columns, values)
+		if err != nil {
+			return nil, err
+		}
+		if event.EventType != structs.UPDATE_EVENT {
+			if oldMatch {
+				add(event.EventType, values, nil)
+			}
+			continue
+		}
+
+		newValues := event.NewValues[idv]
+		newMatch, err := filter.Match(event.Columns, newValues)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case oldMatch && newMatch:
+			add(structs.UPDATE_EVENT, values, newValues)
+		case newMatch: // row moves into filter
+			add(structs.INSERT_EVENT, newValues, nil)
+		case oldMatch: // row moves out of filter
+			add(structs.DELETE_EVENT, values, nil)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,153 @@
+// batching of insert events for postgres destination
+
+package main
+
+import (
+	"sync"
+
+	"github.com/andsha/replicagor/pgfuncs"
+	"github.com/andsha/replicagor/structs"
+)
+
+/* Consecutive INSERT rows of the same table (and the same set of
+columns) are collected per buffer and written with one multi-row INSERT.
+A batch is flushed when
+ - it reaches batchSize rows
+ - an event for another table or with another set of columns arrives
+ - any non-insert event (UPDATE, DELETE, query, BEGIN, COMMIT) arrives,
+   so the order of events and transaction boundaries are kept
+ - the buffer has no events to play
+ - in upsert mode, a row with a key already present in the batch arrives
+Batching is configured in the apply section of rconfig:
+	batchSize = 1000 (0 or 1 disables batching)
+*/
+
+type insertBatch struct {
+	schema  string
+	table   string
+	columns []*structs.Column
+	sig     string
+	rows    [][]*structs.QueryValues
+	sources []*structs.Event // event of each row, gives metadata columns
+	keys    map[string]bool  // primary keys of rows in upsert mode
+}
+
+// pending batch of one buffer. Only the buffer's goroutine plays its events,
+// mutex protects from flushes coming from elsewhere
+type bufferBatch struct {
+	mutex sync.Mutex
+	batch *insertBatch
+}
+
+type insertBatches struct {
+	size    int
+	opts    *pgfuncs.Options
+	mutex   sync.Mutex           // protects batches map
+	batches map[int]*bufferBatch // key is buffer number
+}
+
+func newInsertBatches(size int, opts *pgfuncs.Options) *insertBatches {
+	return &insertBatches{size: size, opts: opts, batches: make(map[int]*bufferBatch)}
+}
+
+func (b *insertBatches) enabled() bool {
+	return b != nil && b.size > 1
+}
+
+func (b *insertBatches) get(buf int) *bufferBatch {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	bb, ok := b.batches[buf]
+	if !ok {
+		bb = new(bufferBatch)
+		b.batches[buf] = bb
+	}
+	return bb
+}
+
+// adds rows of insert event to batch of the event's buffer.
+// apply is called for every batch which has to be written before the rows are added
+func (b *insertBatches) add(e *structs.Event, apply func(*insertBatch) error) error {
+	bb := b.get(e.Buf)
+	bb.mutex.Lock()
+	defer bb.mutex.Unlock()
+
+	for _, row := range e.OldValues {
+		sig := pgfuncs.RowSignature(row)
+		var key string
+		if b.opts.Upserts(e.SchemaName, e.TableName) {
+			key = pgfuncs.RowKey(e.Columns, row)
+		}
+		if bb.batch != nil && (bb.batch.schema != e.SchemaName || bb.batch.table != e.TableName || bb.batch.sig != sig ||
+			(len(key) != 0 && bb.batch.keys[key])) {
+			if err := bb.flush(apply); err != nil {
+				return err
+			}
+		}
+		if bb.batch == nil {
+			bb.batch = &insertBatch{schema: e.SchemaName, table: e.TableName, columns: e.Columns, sig: sig, keys: make(map[string]bool)}
+		}
+		bb.batch.rows = append(bb.batch.rows, row)
+		bb.batch.sources = append(bb.batch.sources, e)
+		if len(key) != 0 {
+			bb.batch.keys[key] = true
+		}
+		if len(bb.batch.rows) >= b.size {
+			if err := bb.flush(apply); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writes pending batch of buffer buf
+func (b *insertBatches) flush(buf int, apply func(*insertBatch) error) error {
+	bb := b.get(buf)
+	bb.mutex.Lock()
+	defer bb.mutex.Unlock()
+	return bb.flush(apply)
+}
+
+// true if buffer buf has rows in pending batch
+func (b *insertBatches) pending(buf int) bool {
+	if !b.enabled() {
+		return false
+	}
+	bb := b.get(buf)
+	bb.mutex.Lock()
+	defer bb.mutex.Unlock()
+	return bb.batch != nil
+}
+
+// drops pending batch of buffer buf, its rows are played again after rollback
+func (b *insertBatches) drop(buf int) {
+	if !b.enabled() {
+		return
+	}
+	bb := b.get(buf)
+	bb.mutex.Lock()
+	defer bb.mutex.Unlock()
+	bb.batch = nil
+}
+
+func (bb *bufferBatch) flush(apply func(*insertBatch) error) error {
+	batch := bb.batch
+	if batch == nil || len(batch.rows) == 0 {
+		return nil
+	}
+	bb.batch = nil
+	return apply(batch)
+}
+
+// single-row insert events of batch
+func (batch *insertBatch) split() []*structs.Event {
+	rows := make([]*structs.Event, len(batch.rows))
+	for idr, row := range batch.rows {
+		r := *batch.sources[idr]
+		r.OldValues = [][]*structs.QueryValues{row}
+		r.NewValues = nil
+		rows[idr] = &r
+	}
+	return rows
+}
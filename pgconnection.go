@@ -3,9 +3,11 @@
 package main
 
 import (
-	//	"errors"
+	"errors"
 	"fmt"
-	//	"strconv"
+	"strconv"
+	"strings"
+	"sync"
 	//	"time"
 
 	"github.com/andsha/postgresutils"
@@ -18,20 +20,356 @@ import (
 type pgConnection struct {
 	*conn
 	process *postgresutils.PostgresProcess
+	batches *insertBatches // pending multi-row inserts per buffer
+	opts    pgfuncs.Options
+	audit   *pgfuncs.Audit // nil if changes are not audited
+
+	policies    *errorPolicies
+	deadLetters deadLetterStore // nil without deadLetter section
+	txMutex     sync.Mutex
+	txs         map[int]bool             // buffers with open transaction
+	txLogs      map[int][]*structs.Event // events played since BEGIN per buffer
+	retries     retryPolicy
+	conflicts   *conflictPolicies
+	repairs     *pgfuncs.RepairQueue // nil if repairs are disabled
+
+	checkpointTable *pgfuncs.CheckpointTable          // nil if positions are not stored in postgres
+	applied         map[workerSlot]structs.BinLogInfo // positions stored before start, per worker of buffer
+	connMutex       sync.Mutex                        // serializes reconnects
+	worker          int                               // apply worker using connection, 0 for main connection
 }
 
 func NewPgConnection(c *conn) (*pgConnection, error) {
 	pgc := new(pgConnection)
 	pgc.conn = c
 	pgc.process = new(postgresutils.PostgresProcess)
+	pgc.txs = make(map[int]bool)
+	pgc.txLogs = make(map[int][]*structs.Event)
+	pgc.opts.Skipped = func(statement string, reason string) {
+		pgc.logging.Warnf("Skipped mysql statement %v: %v", statement, reason)
+	}
+
+	if err := pgc.initApply(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initTypes(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initNames(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initMetadata(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initSoftDelete(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initHistory(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initAudit(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initErrorPolicies(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initDeadLetters(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initRetry(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initConflicts(); err != nil {
+		return nil, err
+	}
+
+	if err := pgc.initRepairs(); err != nil {
+		return nil, err
+	}
 
 	// connect to postgres
 	if err := pgc.blconnect(); err != nil {
 		return nil, err
 	}
+
+	if pgc.audit != nil {
+		if err := pgc.runQuery(pgc.audit.CreateTable()); err != nil {
+			return nil, err
+		}
+	}
+	if pgc.repairs != nil {
+		if err := pgc.runQuery(pgc.repairs.CreateTable()); err != nil {
+			return nil, err
+		}
+	}
+	if err := pgc.initCheckpoints(); err != nil {
+		return nil, err
+	}
+	if dl, ok := pgc.deadLetters.(*pgDeadLetters); ok {
+		if err := pgc.runQuery(dl.table.CreateTable()); err != nil {
+			return nil, err
+		}
+	}
 	return pgc, nil
 }
 
+// reads apply section of rconfig
+//
+//	mode = insert | upsert (default insert)
+//	batchSize = 1000 (0 or 1 disables batching of inserts)
+func (c *pgConnection) initApply() error {
+	var batchSize int
+	sections, err := c.rconf.GetSectionsByName("apply")
+	if err != nil { // no apply section, use defaults
+		c.batches = newInsertBatches(0, &c.opts)
+		return nil
+	}
+
+	if mode, err := sections[0].GetSingleValue("mode", ""); err == nil {
+		switch mode {
+		case "", "insert":
+		case "upsert":
+			c.opts.Upsert = true
+		default:
+			return errors.New(fmt.Sprintf("mode in apply section must be insert or upsert. Got %v", mode))
+		}
+	}
+
+	if s, err := sections[0].GetSingleValue("batchSize", ""); err == nil && len(s) != 0 {
+		batchSize, err = strconv.Atoi(s)
+		if err != nil || batchSize < 0 {
+			return errors.New(fmt.Sprintf("batchSize in apply section must be non-negative integer. Got %v", s))
+		}
+	}
+
+	c.batches = newInsertBatches(batchSize, &c.opts)
+	return nil
+}
+
+// reads typeMapping sections of rconfig. Each section maps one mysql type
+//
+//	from = tinyint(1)
+//	to = boolean
+//	tables = db1.table1, db1.table2 (optional, rule applies only to these tables)
+//	columns = db1.table3.column1 (optional, rule applies only to these columns)
+//
+// Column rules win over table rules, table rules win over global ones.
+// Types not matched by any rule are mapped by defaults of pgfuncs.TypeMap
+func (c *pgConnection) initTypes() error {
+	c.opts.Types = pgfuncs.NewTypeMap()
+	sections, err := c.rconf.GetSectionsByName("typeMapping")
+	if err != nil { // no type mapping, use defaults
+		return nil
+	}
+
+	for _, sec := range sections {
+		from, err := sec.GetValues("from")
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v. from is a required field in typeMapping section", err))
+		}
+		to, err := sec.GetValues("to")
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v. to is a required field in typeMapping section", err))
+		}
+		tables, _ := sec.GetValues("tables")
+		columns, _ := sec.GetValues("columns")
+
+		// types like decimal(10,2) are split by config separator
+		if err := c.opts.Types.AddRule(strings.Join(from, ","), strings.Join(to, ","), trimValues(tables), trimValues(columns)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reads rename sections of rconfig. Section has either schema prefix
+//
+//	schemaPrefix = raw_ (added to every schema without own rule)
+//
+// or one renaming rule
+//
+//	from = shop -> to = raw_shop (schema)
+//	from = shop.orders -> to = raw_shop.mysql_orders or mysql_orders (table)
+//	from = shop.orders.id -> to = order_id (column)
+//
+// Rules apply to generated DML, to converted DDL and to rows of repairs,
+// which are also snapshot loads of tables (see repair.go)
+func (c *pgConnection) initNames() error {
+	c.opts.Names = pgfuncs.NewNameMap()
+	sections, err := c.rconf.GetSectionsByName("rename")
+	if err != nil { // no renames, keep mysql names
+		return nil
+	}
+
+	for _, sec := range sections {
+		if prefix, err := sec.GetSingleValue("schemaPrefix", ""); err == nil && len(prefix) != 0 {
+			c.opts.Names.SetSchemaPrefix(prefix)
+			continue
+		}
+		from, err := sec.GetSingleValue("from", "")
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v. from is a required field in rename section", err))
+		}
+		to, err := sec.GetSingleValue("to", "")
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v. to is a required field in rename section", err))
+		}
+		if err := c.opts.Names.AddRule(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reads metadataColumns section of rconfig. Without the section no metadata is written
+//
+//	columns = _source_file, _source_position, _source_ts, _op, _replicated_at (optional, default all)
+//
+// Metadata columns are added to tables created by replicated DDL and to
+// existing tables at start (see provision)
+func (c *pgConnection) initMetadata() error {
+	sections, err := c.rconf.GetSectionsByName("metadataColumns")
+	if err != nil { // no metadata
+		return nil
+	}
+
+	columns, _ := sections[0].GetValues("columns")
+	meta, err := pgfuncs.NewMetadata(trimValues(columns))
+	if err != nil {
+		return err
+	}
+	c.opts.Metadata = meta
+	return nil
+}
+
+// reads softDelete sections of rconfig
+//
+//	tables = schema1.table1, schema1.table2
+//	column = _deleted (optional, default _deleted)
+//	timestampColumn = _deleted_at (optional, default _deleted_at)
+//
+// Deleted rows of these tables are marked by the flag and time of deletion
+// instead of being removed. The columns are added to existing tables at
+// start (see provision)
+func (c *pgConnection) initSoftDelete() error {
+	c.opts.SoftDelete = pgfuncs.NewSoftDelete()
+	sections, err := c.rconf.GetSectionsByName("softDelete")
+	if err != nil { // no soft deletes
+		return nil
+	}
+
+	for _, sec := range sections {
+		tables, err := sec.GetValues("tables")
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v. tables is a required field in softDelete section", err))
+		}
+		flag, _ := sec.GetSingleValue("column", "_deleted")
+		ts, _ := sec.GetSingleValue("timestampColumn", "_deleted_at")
+		if err := c.opts.SoftDelete.AddTables(trimValues(tables), flag, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reads history sections of rconfig
+//
+//	tables = schema1.table1, schema1.table2
+//	validFrom = valid_from (optional, default valid_from)
+//	validTo = valid_to (optional, default valid_to)
+//	isCurrent = is_current (optional, default is_current)
+//
+// These tables keep all versions of rows. Version columns are added when
+// table is created or altered and to existing tables at start (see
+// provision), which also extends their primary key with validFrom
+func (c *pgConnection) initHistory() error {
+	c.opts.History = pgfuncs.NewHistory()
+	sections, err := c.rconf.GetSectionsByName("history")
+	if err != nil { // no history tables
+		return nil
+	}
+
+	for _, sec := range sections {
+		tables, err := sec.GetValues("tables")
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v. tables is a required field in history section", err))
+		}
+		validFrom, _ := sec.GetSingleValue("validFrom", "valid_from")
+		validTo, _ := sec.GetSingleValue("validTo", "valid_to")
+		current, _ := sec.GetSingleValue("isCurrent", "is_current")
+		if err := c.opts.History.AddTables(trimValues(tables), validFrom, validTo, current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adds columns configured in rconfig to existing destination tables of
+// replicated tables of source, as tables created before the columns were
+// enabled lack them and every write into them would fail
+func (c *pgConnection) provision(source connection) error {
+	for _, schema := range source.getInfo() {
+		for _, t := range schema.Tables {
+			if t.ExcludedFromReplication {
+				continue
+			}
+			query := pgfuncs.ProvisionTable(schema.Name, t.Name, t.Columns, &c.opts)
+			if len(query) == 0 {
+				continue
+			}
+			if err := c.runQuery(query); err != nil {
+				return errors.New(fmt.Sprintf("Cannot add columns to table %v.%v: %v", schema.Name, t.Name, err))
+			}
+		}
+	}
+	return nil
+}
+
+// reads audit section of rconfig
+//
+//	table = replicagor.audit (optional, default replicagor.audit)
+//	tables = schema1.table1, schema1.table2 (optional, default all tables)
+//	mirror = true | false (optional, default true)
+//
+// Every row change of audited tables is appended to audit table with before
+// and after images. Without mirror audited tables are not replicated
+func (c *pgConnection) initAudit() error {
+	sections, err := c.rconf.GetSectionsByName("audit")
+	if err != nil { // no audit
+		return nil
+	}
+
+	table, _ := sections[0].GetSingleValue("table", "replicagor.audit")
+	tables, _ := sections[0].GetValues("tables")
+	mirror, _ := sections[0].GetSingleValue("mirror", "true")
+	if mirror != "true" && mirror != "false" {
+		return errors.New(fmt.Sprintf("mirror in audit section must be true or false. Got %v", mirror))
+	}
+
+	c.audit, err = pgfuncs.NewAudit(table, trimValues(tables), mirror == "true")
+	return err
+}
+
+func trimValues(vals []string) []string {
+	res := make([]string, 0, len(vals))
+	for _, v := range vals {
+		if v = strings.TrimSpace(v); len(v) != 0 {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 func (c *pgConnection) GetSConfig() *vconfig.VConfig {
 	return &c.sconf
 }
@@ -131,26 +469,155 @@ func (c *pgConnection) getFreqs() []int {
 }
 
 func (c *pgConnection) playEvent(e *structs.Event) error {
-	query := e.Query
-	if len(query) == 0 {
-		if q, err := pgfuncs.GenQuery(e); err != nil {
-			c.logging.Errorf("Error while generating query in postgres. ERROR: %v", err)
-			return err
-		} else {
-			query = q
+	return c.withRetry(e.Buf, e, func() error { return c.apply(e) })
+}
+
+func (c *pgConnection) apply(e *structs.Event) error {
+	if c.checkpointTable != nil && c.alreadyApplied(e) {
+		c.logging.Debugf("Skipped event at %v:%v applied before restart", e.File, e.EventPosition)
+		return nil
+	}
+	if e.EventType == structs.REPAIR_EVENT && len(e.Query) == 0 {
+		return c.playRepair(e)
+	}
+	if len(e.Query) == 0 {
+		return c.playRows(e)
+	}
+
+	query, err := pgfuncs.ConvertMysql57ToPostgres(e.Query, &c.opts)
+	if err != nil {
+		c.logging.Errorf("Error while converting query %v to postgres. ERROR: %v", e.Query, err)
+		return err
+	}
+	if len(query) == 0 { // nothing to replicate, e.g. grants
+		return nil
+	}
+
+	// pending inserts go first to keep order of events and transaction boundaries
+	if err := c.flush(e.Buf); err != nil {
+		return err
+	}
+
+	if c.checkpointTable != nil && e.Position != 0 { // position is committed with COMMIT or statement
+		query = c.checkpointTable.Update(e.Buf, c.worker, e.File, e.Position, e.Gtid) + query
+	}
+	if err := c.runQuery(query); err != nil {
+		return err
+	}
+	c.trackTx(e.Buf, e.Query)
+	return nil
+}
+
+// plays row event. Inserts of tables which are mirrored only are batched,
+// so a failed row is applied again together with its audit record
+func (c *pgConnection) playRows(e *structs.Event) error {
+	audited := c.audit.Audits(e.SchemaName, e.TableName)
+	if !audited && e.EventType == structs.INSERT_EVENT && c.batches.enabled() {
+		return c.batches.add(e, c.applyBatch)
+	}
+	if err := c.flush(e.Buf); err != nil {
+		return err
+	}
+
+	playRow := c.rowPlayer(e)
+	split := func() []*structs.Event { return splitRows(e) }
+	play := func() error { return playRow(e) }
+	if c.countsRows(e) { // affected rows are counted row by row
+		play = func() error {
+			for _, r := range split() {
+				if err := playRow(r); err != nil {
+					return err
+				}
+			}
+			return nil
 		}
-	} else {
-		if q, err := pgfuncs.ConvertMysql57ToPostgres(query); err != nil {
-			c.logging.Errorf("Error while converting query %v to postgres. ERROR: %v", query, err)
+	}
+	return c.applyRows(e, play, split, playRow)
+}
+
+// function playing rows of event
+func (c *pgConnection) rowPlayer(e *structs.Event) func(*structs.Event) error {
+	if c.countsRows(e) {
+		return c.playCheckedRow
+	}
+	return c.playRow
+}
+
+// generates and runs statements of row event
+func (c *pgConnection) playRow(e *structs.Event) error {
+	query, err := c.genRows(e)
+	if err != nil {
+		c.logging.Errorf("Error while generating query in postgres. ERROR: %v", err)
+		return err
+	}
+	return c.runQuery(query)
+}
+
+// statements of row event: audit records and changes of mirrored table
+func (c *pgConnection) genRows(e *structs.Event) (string, error) {
+	var query string
+	if c.audit.Audits(e.SchemaName, e.TableName) {
+		q, err := c.audit.GenQuery(e, &c.opts)
+		if err != nil {
+			return "", err
+		}
+		query = q
+		if e.SkipMirror || !c.audit.Mirrors(e.SchemaName, e.TableName) {
+			return query, nil
+		}
+	}
+	q, err := pgfuncs.GenQuery(e, &c.opts)
+	if err != nil {
+		return "", err
+	}
+	return query + q, nil
+}
+
+// writes batch of inserts
+func (c *pgConnection) applyBatch(batch *insertBatch) error {
+	play := func() error {
+		query, err := pgfuncs.GenBulkInsert(batch.schema, batch.table, batch.columns, batch.rows, batch.sources, &c.opts)
+		if err != nil {
+			c.logging.Errorf("Error while generating query in postgres. ERROR: %v", err)
 			return err
-		} else {
-			query = q
 		}
+		return c.runQuery(query)
+	}
+	return c.applyRows(batch.sources[0], play, batch.split, c.playRow)
+}
+
+// writes pending inserts of the buffer
+func (c *pgConnection) flushEvents(buf int) error {
+	if !c.batches.enabled() {
+		return nil
 	}
+	return c.withRetry(buf, nil, func() error { return c.flush(buf) })
+}
+
+// true if buffer has inserts not written yet
+func (c *pgConnection) pending(buf int) bool {
+	return c.batches.pending(buf)
+}
+
+func (c *pgConnection) flush(buf int) error {
+	if !c.batches.enabled() {
+		return nil
+	}
+	return c.batches.flush(buf, c.applyBatch)
+}
 
+func (c *pgConnection) queryRows(query string) ([][]interface{}, error) {
 	res, err := c.process.Run(query)
-	fmt.Println(query, res, err)
 	if err != nil {
+		c.logging.Errorf("Error while running query in postgres:%v ERROR: %v", query, err)
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *pgConnection) runQuery(query string) error {
+	c.logging.Debugf("Running query in postgres:%v", query)
+	if _, err := c.process.Run(query); err != nil {
 		c.logging.Errorf("Error while running query in postgres:%v ERROR: %v", query, err)
 		return err
 	}
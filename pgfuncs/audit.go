@@ -0,0 +1,170 @@
+// audit table of row changes
+
+package pgfuncs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// Audit appends every row change of audited tables to one audit table.
+// Row images are jsonb objects keyed by mysql column names, excluded columns
+// are left out. Mirroring of tables can be kept or turned off
+type Audit struct {
+	schema string          // quoted schema of audit table
+	table  string          // quoted audit table
+	tables map[string]bool // mysql schema.table, empty for all tables
+	mirror bool
+}
+
+// Creates audit writing into table given as schema.table. tables lists
+// audited tables as schema.table, empty list audits all tables.
+// If mirror is false changes of audited tables are only audited
+func NewAudit(table string, tables []string, mirror bool) (*Audit, error) {
+	st := strings.Split(strings.TrimSpace(table), ".")
+	if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+		return nil, errors.New(fmt.Sprintf("Audit table should be schemaname.tablename. Got %v", table))
+	}
+
+	a := &Audit{schema: pgIdent(st[0]), table: pgTable(st[0], st[1]), tables: make(map[string]bool), mirror: mirror}
+	for _, t := range tables {
+		ts := strings.Split(strings.TrimSpace(t), ".")
+		if len(ts) != 2 || len(ts[0]) == 0 || len(ts[1]) == 0 {
+			return nil, errors.New(fmt.Sprintf("Audited table should be schemaname.tablename. Got %v", t))
+		}
+		a.tables[ts[0]+"."+ts[1]] = true
+	}
+	return a, nil
+}
+
+// true if changes of mysql table are audited
+func (a *Audit) Audits(schema string, table string) bool {
+	if a == nil {
+		return false
+	}
+	return len(a.tables) == 0 || a.tables[schema+"."+table]
+}
+
+// true if changes of mysql table are mirrored as well
+func (a *Audit) Mirrors(schema string, table string) bool {
+	return !a.Audits(schema, table) || a.mirror
+}
+
+// statements creating audit table and its schema
+func (a *Audit) CreateTable() string {
+	return fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %v; CREATE TABLE IF NOT EXISTS %v ("+
+		"id bigserial PRIMARY KEY, schema_name text NOT NULL, table_name text NOT NULL, op char(1) NOT NULL, "+
+		"pkey jsonb, before jsonb, after jsonb, binlog_file text, binlog_position bigint, gtid text, "+
+		"source_ts timestamp with time zone, replicated_at timestamp with time zone NOT NULL DEFAULT now());", a.schema, a.table)
+}
+
+// Generates insert of audit records of rows of event
+func (a *Audit) GenQuery(event *structs.Event, opts *Options) (string, error) {
+	var op string
+	switch event.EventType {
+	case structs.INSERT_EVENT:
+		op = "I"
+	case structs.UPDATE_EVENT:
+		op = "U"
+	case structs.DELETE_EVENT:
+		op = "D"
+	default:
+		return "", errors.New(fmt.Sprintf("Unknown Event Type %v", event.EventType))
+	}
+
+	tg := opts.target(event.SchemaName, event.TableName, event.Columns)
+	file := "NULL"
+	if len(event.File) != 0 {
+		file = pgQuote(event.File)
+	}
+	gtid := "NULL"
+	if len(event.Gtid) != 0 {
+		gtid = pgQuote(event.Gtid)
+	}
+	ts := "NULL"
+	if event.Timestamp != 0 {
+		ts = eventTime(event)
+	}
+
+	sql := fmt.Sprintf("INSERT INTO %v (schema_name, table_name, op, pkey, before, after, binlog_file, binlog_position, gtid, source_ts) VALUES ",
+		a.table)
+	for idr, row := range event.OldValues {
+		var before, after []*structs.QueryValues
+		switch event.EventType {
+		case structs.INSERT_EVENT:
+			after = row
+		case structs.UPDATE_EVENT:
+			before = row
+			after = event.NewValues[idr]
+		case structs.DELETE_EVENT:
+			before = row
+		}
+		key := after
+		if before != nil {
+			key = before
+		}
+
+		if idr > 0 {
+			sql += ", "
+		}
+		sql += fmt.Sprintf("(%v, %v, '%v', %v, %v, %v, %v, %v, %v, %v)", pgQuote(event.SchemaName),
+			pgQuote(event.TableName), op, jsonImage(event.Columns, tg, key, true),
+			jsonImage(event.Columns, tg, before, false), jsonImage(event.Columns, tg, after, false),
+			file, event.EventPosition, gtid, ts)
+	}
+	return sql + "; ", nil
+}
+
+// jsonb literal of row image, only primary key columns if keys is set
+func jsonImage(columns []*structs.Column, tg *target, row []*structs.QueryValues, keys bool) string {
+	if row == nil {
+		return "NULL"
+	}
+	var sb strings.Builder
+	sb.WriteString("{")
+	n := 0
+	for _, val := range row {
+		column := columns[val.ColumnId]
+		if column.ExcludedFromReplication || (keys && !column.IsPKey) {
+			continue
+		}
+		if n > 0 {
+			sb.WriteString(", ")
+		}
+		name, _ := json.Marshal(column.Name)
+		sb.Write(name)
+		sb.WriteString(": ")
+		sb.WriteString(jsonValue(column, tg.types[val.ColumnId], val.Value))
+		n++
+	}
+	sb.WriteString("}")
+	if keys && n == 0 {
+		return "NULL"
+	}
+	return pgQuote(sb.String()) + "::jsonb"
+}
+
+// json value of value coming from binlog. Numbers are kept as numbers,
+// other values are written as text they have in destination column of pgtype
+func jsonValue(column *structs.Column, pgtype string, value interface{}) string {
+	s, ok := pgText(column, pgtype, value)
+	if !ok {
+		return "null"
+	}
+	if isBoolean(pgtype) {
+		return s
+	}
+	switch strings.SplitN(pgtype, "(", 2)[0] {
+	case "smallint", "int", "integer", "bigint", "int2", "int4", "int8", "decimal", "numeric", "real", "double precision", "float4", "float8":
+		if _, err := strconv.ParseFloat(s, 64); err == nil && json.Valid([]byte(s)) {
+			return s
+		}
+	}
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,55 @@
+package pgfuncs
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestAuditQuery(t *testing.T) {
+	audit, err := NewAudit("replicagor.audit", []string{"db1.tab1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !audit.Audits("db1", "tab1") || audit.Mirrors("db1", "tab1") || audit.Audits("db1", "tab2") || !audit.Mirrors("db1", "tab2") {
+		t.Fatal("Incorrect audited tables")
+	}
+
+	columns := append(testColumns(), &structs.Column{Name: "price", Type: "decimal(10,2)"})
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    columns,
+		EventType:  structs.UPDATE_EVENT,
+		OldValues: [][]*structs.QueryValues{
+			append(testRow(uint32(1), "it's", byte(1)), &structs.QueryValues{ColumnId: 3, Value: "10.50"}),
+		},
+		NewValues: [][]*structs.QueryValues{
+			append(testRow(uint32(1), "b", byte(2)), &structs.QueryValues{ColumnId: 3, Value: nil}),
+		},
+		File:          "mysql-bin.000003",
+		EventPosition: 154,
+		Gtid:          "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+		Timestamp:     1600000000,
+	}
+
+	sql, err := audit.GenQuery(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `INSERT INTO "replicagor"."audit" (schema_name, table_name, op, pkey, before, after, binlog_file, binlog_position, gtid, source_ts) ` +
+		`VALUES ('db1', 'tab1', 'U', '{"id": 1}'::jsonb, '{"id": 1, "name": "it''s", "state": "new", "price": 10.50}'::jsonb, ` +
+		`'{"id": 1, "name": "b", "state": "done", "price": null}'::jsonb, 'mysql-bin.000003', 154, ` +
+		`'3e11fa47-71ca-11e1-9e33-c80aa9429562:23', to_timestamp(1600000000)); `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect audit query",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	if _, err := NewAudit("audit", nil, true); err == nil {
+		t.Fatal("Expected error for audit table without schema")
+	}
+}
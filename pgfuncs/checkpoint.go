@@ -0,0 +1,49 @@
+// binlog positions stored in destination
+
+package pgfuncs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CheckpointTable keeps binlog position of the last event applied by every
+// apply worker of every buffer. Position is updated in the transaction
+// applying the event
+type CheckpointTable struct {
+	schema string // quoted schema of checkpoint table
+	table  string // quoted checkpoint table
+}
+
+// Creates checkpoints in table given as schema.table
+func NewCheckpointTable(table string) (*CheckpointTable, error) {
+	st := strings.Split(strings.TrimSpace(table), ".")
+	if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+		return nil, errors.New(fmt.Sprintf("Checkpoint table should be schemaname.tablename. Got %v", table))
+	}
+	return &CheckpointTable{schema: pgIdent(st[0]), table: pgTable(st[0], st[1])}, nil
+}
+
+// statements creating checkpoint table and its schema
+func (t *CheckpointTable) CreateTable() string {
+	return fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %v; CREATE TABLE IF NOT EXISTS %v ("+
+		"buffer integer NOT NULL, worker integer NOT NULL DEFAULT 0, binlog_file text NOT NULL, binlog_position bigint NOT NULL, "+
+		"gtid text, updated_at timestamp with time zone NOT NULL DEFAULT now(), PRIMARY KEY (buffer, worker));", t.schema, t.table)
+}
+
+// Generates upsert of position of worker of buffer buf. Empty gtid is written as NULL
+func (t *CheckpointTable) Update(buf int, worker int, file string, position uint32, gtid string) string {
+	g := "NULL"
+	if len(gtid) != 0 {
+		g = pgQuote(gtid)
+	}
+	return fmt.Sprintf("INSERT INTO %v (buffer, worker, binlog_file, binlog_position, gtid) VALUES (%v, %v, %v, %v, %v) "+
+		"ON CONFLICT (buffer, worker) DO UPDATE SET binlog_file = EXCLUDED.binlog_file, binlog_position = EXCLUDED.binlog_position, "+
+		"gtid = EXCLUDED.gtid, updated_at = now(); ", t.table, buf, worker, pgQuote(file), position, g)
+}
+
+// select of positions: buffer, worker, binlog_file, binlog_position and gtid
+func (t *CheckpointTable) Select() string {
+	return fmt.Sprintf("SELECT buffer, worker, binlog_file, binlog_position, gtid FROM %v ORDER BY buffer, worker;", t.table)
+}
@@ -0,0 +1,27 @@
+package pgfuncs
+
+import (
+	"testing"
+)
+
+func TestCheckpointTable(t *testing.T) {
+	table, err := NewCheckpointTable("replicagor.checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql := table.Update(1, 2, "mysql-bin.000004", 4711, "")
+	expected := `INSERT INTO "replicagor"."checkpoint" (buffer, worker, binlog_file, binlog_position, gtid) ` +
+		`VALUES (1, 2, 'mysql-bin.000004', 4711, NULL) ON CONFLICT (buffer, worker) DO UPDATE SET binlog_file = EXCLUDED.binlog_file, ` +
+		`binlog_position = EXCLUDED.binlog_position, gtid = EXCLUDED.gtid, updated_at = now(); `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect checkpoint update",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	if _, err := NewCheckpointTable("checkpoint"); err == nil {
+		t.Fatal("Incorrect checkpoint table name is accepted")
+	}
+}
@@ -4,461 +4,562 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
-	"strconv"
 	"strings"
-)
+	"unicode/utf8"
 
-var sysWords []string
+	"github.com/andsha/replicagor/structs"
+)
 
-func init() {
-	sysWords = []string{"select", "from", "where", "group", "sort", "left", "join", "by", "rigth", ",", ")", "(", "sum", "if", "as", "and", "0", "1", "2", "3", "4", "5", "6", "7", "8", "9", " ", "\n", "<", "=", ">", "in", "count",
-		";", "when", "then", "else", "end", "distinct", "-", "extract", "date", "*", "on", ".", "date_trunc", "table", "create", "primary", "key", "index",
-		"decimal", "varchar", "integer", "bigint", "timestamp", "int", "not", "schema", "set", "default", "null", "to", "insert", "into", "current_timestamp", "values", "now", "alter", "add",
-		"unique", "type", "text", "drop", "exists", "delete", "column", "update", "is", "ifnull", "coalesce", "least", "greatest", "or", "like", "including", "all", "first", "constraint", "rename", "procedure",
-		"localtimestamp", "smallint", "char", "/*", "*/", "temporary", "desc", "using", ":", "tablespace", "modify", "view", "/", "replace", "case", "lower", "trim", "regexp_replace", "round", "||", "begin", "commit"}
-}
+// pt-online-schema-change works on shadow table _name_new and swaps it with
+// the original table at the end. Replica changes the original table instead
+var (
+	perconaNewTable = regexp.MustCompile(`^_(.+)_new$`)
+	perconaOldTable = regexp.MustCompile(`^_(.+)_old$`)
+)
 
-func getReplaces() [][]string {
-	var replaces [][]string
-
-	r := []string{`0000-00-00 00:00:00`, `1957-01-01 00:00:00`} //replace 0000 year with 1957-01-01
-	replaces = append(replaces, r)
-	//r = []string{`DROP`, `DASHA`} //replace 0000 year with 1957-01-01
-	//replaces = append(replaces, r)
-
-	r = []string{`tinyint\(\d*\)`, `int`} // replace tinyint with int
-	replaces = append(replaces, r)
-	r = []string{`smallint\(\d*\)`, `int`} // replace tinyint with int
-	replaces = append(replaces, r)
-	r = []string{`longtext`, `text`} // replace longtext with text
-	replaces = append(replaces, r)
-	r = []string{`longblob([, ])`, `text$1`} // replace longtext with text
-	replaces = append(replaces, r)
-	r = []string{`blob([, ])`, `text$1`} // replace longtext with text
-	replaces = append(replaces, r)
-	r = []string{`ALGORITHM.*SQL SECURITY DEFINER`, ``} // remove definer for the view
-	replaces = append(replaces, r)
-	r = []string{`COMMENT '[a-zA-Z\s0-9\/]*'`, ``} // remove comment
-	replaces = append(replaces, r)
-	r = []string{`CREATE\s*VIEW`, `CREATE OR REPLACE VIEW`} // replace CREATE VIEW with CREATE OR REPLACE VIEW
-	replaces = append(replaces, r)
-	r = []string{`/\*!50001 ([a-zA-Z0-9\s_]*)\*/`, `$1`} // add support for /*!50001 DROP VIEW IF EXISTS cisOffers*/
-	replaces = append(replaces, r)
-	r = []string{`lcase`, `lower`} // lcase to lower
-	replaces = append(replaces, r)
-	r = []string{`ifnull\(([^,\)\(]*),([^,\)\(]*)\)`, `case when $1 is null then $2 else $1 end`} // replace ifnull and if with case statements
-	replaces = append(replaces, r)
-	r = []string{`ifnull\(([^,\)\(]*),([^,\)\(]*)\)`, `case when $1 is null then $2 else $1 end`} // replace ifnull and if with case statements
-	replaces = append(replaces, r)
-	r = []string{`nullif\(([^,\)\(]*),([^,\)\(]*)\)`, `case when $1 is null then $2 else $1 end`} // replace ifnull and if with case statements
-	replaces = append(replaces, r)
-	r = []string{`if\(([^,]*),([^,\)\(]*),([^,\)\(]*)\)`, `case when $1 is null then $2 else $3 end`} // replace ifnull and if with case statements
-	replaces = append(replaces, r)
-	r = []string{`if\(([^,]*),([^,\)\(]*),([^,\)\(]*)\)`, `case when $1 is null then $2 else $3 end`} // replace ifnull and if with case statements
-	replaces = append(replaces, r)
-	r = []string{`case when ([^\s=]*) then (.*) end`, `case when $1=1 then $2 end`} // replace case where no condition
-	replaces = append(replaces, r)
-	r = []string{`case when ([^\s=]*) then (.*) end`, `case when $1=1 then $2 end`} // case when cis.studios.is_licensor then `true` else `false` end
-	replaces = append(replaces, r)
-	r = []string{`straight_join`, `join`} // straight_join to join
-	replaces = append(replaces, r)
-	r = []string{`trailing\s([^\s]*)\sfrom\s([^\s\)]*)`, `regexp_replace($2,$1,'')`} //replace trailing with regexp_replace
-	replaces = append(replaces, r)
-	r = []string{`format\(\(`, `ROUND((0.01*`} //format to round
-	replaces = append(replaces, r)
-	r = []string{`concat\(([^,]*),([^,]*),([^,]*),([^,]*),([^,]*)\),`, `($1||$2||($3)||$4||($5)),`} //replcase concat
-	replaces = append(replaces, r)
-	r = []string{`if\(([^,]*),([^,]*),([^,]*)\) AS`, `case when $1 is null then $2 else $3 end AS `} //replcase concat
-	replaces = append(replaces, r)
-	r = []string{"`", `"`} //quotes from Mysqlreplace to double quotes
-	replaces = append(replaces, r)
-	r = []string{`"_([a-zA-Z_]+)_new`, `"$1`} //rename table for percona upgrades to normal table
-	replaces = append(replaces, r)
-	r = []string{`\._([a-zA-Z_]+)_new`, `.$1`} // rename table for percona upgrades to normal table
-	replaces = append(replaces, r)
-	r = []string{`'_([a-zA-Z_]+)_new`, `'$1`} // rename table for percona upgrades to normal table
-	replaces = append(replaces, r)
-	r = []string{`CHARACTER SET [a-z0-9]+`, ``} // remove charachter sets
-	replaces = append(replaces, r)
-	r = []string{`DEFAULT CHARSET=[a-z0-9]+`, ``} // remove charachter sets
-	replaces = append(replaces, r)
-	r = []string{`(MODIFY[^,]*) DEFAULT [a-zA-Z0-9'\_]+`, `$1`} // we dont need default value for alter, we replicate complete record from mysql
-	replaces = append(replaces, r)
-	r = []string{`(CHANGE[^,]*) DEFAULT [a-zA-Z0-9'\_]+`, `$1`} // we dont need default value for alter, we replicate complete record from mysql
-	replaces = append(replaces, r)
-	r = []string{`bigint\(\d*\)`, `bigint`} // remove size for int
-	replaces = append(replaces, r)
-	r = []string{`int\(\d*\)`, `bigint`} // remove size for int
-	replaces = append(replaces, r)
-	r = []string{`UNSIGNED`, ``} //remove unsigned
-	replaces = append(replaces, r)
-	r = []string{` DATETIME`, ` timestamp`} //datetime to timestamp
-	replaces = append(replaces, r)
-	r = []string{`ENGINE=[a-z]+`, ``} //emove engine
-	replaces = append(replaces, r)
-	r = []string{`,\s*\)`, `)`} // if we have `,)` than we dont need comma
-	replaces = append(replaces, r)
-	r = []string{`enum\s*\([^)]*\)`, `varchar(100)`} //replace all enums to varchar 100
-	replaces = append(replaces, r)
-	r = []string{`""`, `''''`} //replace empty string in MySQL to empty string in postgres
-	replaces = append(replaces, r)
-	r = []string{`MODIFY COLUMN`, `MODIFY`} // modify all MODIFY statements
-	replaces = append(replaces, r)
-	r = []string{`MODIFY\s+([a-z"_]+)\s+([a-zA-Z0-9(),]+) NOT NULL DEFAULT ([a-zA-Z0-9"']+)`, `ALTER COLUMN $1 TYPE $2, ALTER COLUMN $1 SET NOT NULL,ALTER COLUMN $1 SET DEFAULT $3`} // modify all MODIFY statements
-	replaces = append(replaces, r)
-	r = []string{`MODIFY\s+([a-z"_]+)\s+([a-zA-Z0-9(),]+) DEFAULT ([a-zA-Z0-9"']+)`, `ALTER COLUMN $1 TYPE $2,ALTER COLUMN $1 SET DEFAULT $3`} //modify all MODIFY statements
-	replaces = append(replaces, r)
-	r = []string{`MODIFY\s+([a-z"_]+)\s+([a-zA-Z0-9(),]+) NOT NULL`, `ALTER COLUMN $1 TYPE $2, ALTER COLUMN $1 SET NOT NULL`} // modify all MODIFY statements
-	replaces = append(replaces, r)
-	r = []string{`MODIFY\s+([a-z"_]+)\s+([a-zA-Z0-9(),]+)\s+NULL`, `ALTER COLUMN $1 TYPE $2, ALTER COLUMN $1 DROP NOT NULL`} // modify all MODIFY statements
-	replaces = append(replaces, r)
-	r = []string{`MODIFY\s+([a-z"_]+)\s+([a-zA-Z0-9(),]+)\s+DEFAULT\s+NULL`, `ALTER COLUMN $1 TYPE $2, ALTER COLUMN $1 SET DEFAULT NULL`} // modify all MODIFY statements
-	replaces = append(replaces, r)
-	r = []string{`MODIFY\s+([a-z"_]+)\s+([a-zA-Z0-9(),]+)`, `ALTER COLUMN $1 TYPE $2`} // modify all MODIFY statements
-	replaces = append(replaces, r)
-	r = []string{`MODIFY\s+([a-z"_]+)\s+([a-zA-Z0-9(),]+),`, `ALTER COLUMN $1 TYPE $2,`} // modify all MODIFY statements
-	replaces = append(replaces, r)
-	r = []string{`MODIFY\s+([a-z"_]+)\s+([a-zA-Z0-9(),]+);`, `ALTER COLUMN $1 TYPE $2;`} // modify all MODIFY statements
-	replaces = append(replaces, r)
-	r = []string{`CHANGE ([a-zA-Z"]+) ([a-zA-Z]+) VARCHAR\((\d+)\)`, `DROP COLUMN $1, ADD COLUMN $2 VARCHAR($3)`} //modify change column to rename
-	replaces = append(replaces, r)
-	r = []string{`CHANGE\s+COLUMN\s+([a-zA-Z]+)\s+([a-zA-Z]+)\s+([a-zA-Z0-9()]+)\s*(unsigned)*(NOT)*\s*(NULL)*`, `RENAME COLUMN $1 TO $2`} //
-	replaces = append(replaces, r)
-	r = []string{`ALTER TABLE \S+\s{0,};`, ``} //remove alter table statement if it is empty (we had only indexes there)
-	replaces = append(replaces, r)
-	r = []string{`database `, `schema `} //replace database to schema
-	replaces = append(replaces, r)
-	r = []string{`mediumtext`, `text`} // medium text to text
-	replaces = append(replaces, r)
-	r = []string{`,;`, `;`} // remove unnecessary comma at the end
-	replaces = append(replaces, r)
-	r = []string{`\/\*[^\/^\*]+\*\/`, ``} //remove comments /* */
-	replaces = append(replaces, r)
-	r = []string{`float`, `decimal`} // change float to decimal
-	replaces = append(replaces, r)
-	r = []string{`double`, `decimal`} // double to decimal
-	replaces = append(replaces, r)
-	r = []string{`rename table ([a-z]+) to ([a-z]+)`, `ALTER TABLE $1 RENAME TO $2`} //handle rename table
-	replaces = append(replaces, r)
-	r = []string{`AUTO_INCREMENT(=\d+)?`, ``} //remove AUTO INCREMENT
-	replaces = append(replaces, r)
-	r = []string{`ALTER COLUMN ([a-z]+) TYPE int`, `ALTER COLUMN $1 TYPE int USING ($1::integer)`} //
-	replaces = append(replaces, r)
-	r = []string{`ON UPDATE CURRENT_TIMESTAMP`, ``} //we don`t need statemnet how to update timestamp
-	replaces = append(replaces, r)
-	r = []string{` change ([a-z0-9_]+) ([a-z0-9_]+) ([a-z0-9_]+)`, ` rename column $1 TO $2`} //
-	replaces = append(replaces, r)
-
-	return replaces
+// state of conversion of one script
+type ddlGenerator struct {
+	types      *TypeMap
+	names      *NameMap
+	meta       *Metadata
+	soft       *SoftDelete
+	hist       *History
+	skipped    func(statement string, reason string)
+	schema     string // current mysql schema set by SET SEARCH_PATH
+	pathSent   bool   // SET SEARCH_PATH is written to output
+	statements []string
 }
 
-func ConvertMysql57ToPostgres(mysqlscript string) (string, error) {
-	updateId := `0`
-	//updateId = strings.Split(strings.Split(mysqlscript, `_`)[1], `.`)[0]
-
-	mysqlscript = regexp.MustCompile(`(?i)alter table\s{1,}([^\s/(]*)`).ReplaceAllString(mysqlscript, " \n alter table $1 \n")
-	mysqlscript = regexp.MustCompile(`(?i)create table\s{1,}([^\s/(]*)`).ReplaceAllString(mysqlscript, " \n create table $1 \n")
-	mysqlscript = regexp.MustCompile(`(?i)[^drop ]primary key`).ReplaceAllString(mysqlscript, " \n primary key")
-	mysqlscript = regexp.MustCompile(`(?i)(add)?\s+unique (key|index)`).ReplaceAllString(mysqlscript, " \n unique key")
-	mysqlscript = regexp.MustCompile(`(?i)[^primary|unique|add] key `).ReplaceAllString(mysqlscript, " \n key ")
-	mysqlscript = regexp.MustCompile(`(?i)[^ADD|DROP|CREATE] index `).ReplaceAllString(mysqlscript, " \n index ")
-	if !strings.HasPrefix(strings.ToLower(mysqlscript), "add") {
-		mysqlscript = regexp.MustCompile(`\)\s{0,5}\)$`).ReplaceAllString(mysqlscript, " )\n)\n")
-	}
-	mysqlscripts := strings.Split(mysqlscript, "\n")
-
-	for ide, e := range mysqlscripts {
-		fmt.Println(ide, ":", e)
+// Converts mysql script into postgres script. The script is parsed by
+// ParseMysqlDDL and postgres statements are generated from the parsed
+// statements using types and names of opts for column types and destination names.
+// Statements which are meaningless for replica or are not DDL are skipped
+// and reported to Skipped of opts, unsupported DDL is reported as error. Returns empty string if there is nothing to run in postgres.
+// Bodies of views are not renamed, views should use mysql names.
+// Created tables get metadata, soft delete and history columns of opts
+func ConvertMysql57ToPostgres(mysqlscript string, opts *Options) (string, error) {
+	stmts, err := ParseMysqlDDL(mysqlscript)
+	if err != nil {
+		return "", err
 	}
 
-	indexre := regexp.MustCompile(`.*(\s|^)(index|key)[\s\(]+.*`)    // check for lower case
-	pkeyre := regexp.MustCompile(`.*(\s|^)primary\s+key([\s\(]+).*`) // check for lower case
-
-	var scripts string
-	var database string
-	var table string
-	var indexes string
-	var pkey string
-
-	for _, mysqls := range mysqlscripts {
-		mysqls = strings.Trim(mysqls, ` `)
-		if len(mysqls) == 0 {
-			continue
+	g := newDDLGenerator(opts)
+	for _, stmt := range stmts {
+		if err := g.statement(stmt); err != nil {
+			return "", err
 		}
-		lmysqls := strings.ToLower(mysqls)
+	}
 
-		if strings.Contains(lmysqls, `convert to character set`) {
-			continue
-		}
+	if len(g.statements) == 0 {
+		return "", nil
+	}
+	return strings.Join(g.statements, "; ") + ";", nil
+}
 
-		if strings.Contains(lmysqls, `function`) {
-			scripts = ``
-			break
-		}
+func newDDLGenerator(opts *Options) *ddlGenerator {
+	g := new(ddlGenerator)
+	if opts != nil {
+		g.types, g.names, g.meta, g.soft, g.hist = opts.Types, opts.Names, opts.Metadata, opts.SoftDelete, opts.History
+		g.skipped = opts.Skipped
+	}
+	return g
+}
 
-		if strings.Contains(lmysqls, `set search_path`) {
-			database = strings.Replace(strings.Split(strings.Trim(lmysqls, " "), " ")[3], ";", "", -1)
-		}
+// Generates statements adding metadata, soft delete and history columns of
+// opts to existing destination table of mysql table schema.table with
+// columns, as tables created before the columns were enabled lack them.
+// Primary key of history table is extended with its valid from column.
+// Statements do nothing if table does not exist or has the columns and
+// key. Returns empty string if there is nothing to add
+func ProvisionTable(schema string, table string, columns []*structs.Column, opts *Options) string {
+	g := newDDLGenerator(opts)
+	t := TableName{Schema: schema, Name: table}
+	actions := g.meta.addColumns()
+	actions = append(actions, g.soft.columns(schema, table).addColumns()...)
+	actions = append(actions, g.history(t).addColumns()...)
+	if len(actions) == 0 {
+		return ""
+	}
+	sql := []string{fmt.Sprintf("ALTER TABLE IF EXISTS %v %v", g.pgName(t), strings.Join(actions, ", "))}
 
-		if strings.Contains(lmysqls, `alter table`) || strings.Contains(lmysqls, `create table`) {
-			fmt.Println("**************************************** 1 ", lmysqls)
-			table = strings.Split(strings.Trim(mysqls, " "), " ")[2]
-			fmt.Println("2", table)
-			table = strings.Split(table, "(")[0]
-			fmt.Println("3", table)
-			if strings.Contains(table, ".") {
-				ts := strings.Split(table, ".")
-				database = ts[0]
-				table = ts[1]
+	if h := g.history(t); h != nil {
+		keys := make([]string, 0)
+		for _, col := range columns {
+			if col.IsPKey {
+				keys = append(keys, g.col(t, col.Name))
 			}
-			table = strings.Replace(table, "`", "", -1)
-			fmt.Println("4", table)
 		}
-		//fmt.Println("1:", mysqls)
-		if !strings.HasPrefix(mysqls, `--`) && !strings.HasPrefix(mysqls, `#`) {
-			if indexre.MatchString(lmysqls) && !pkeyre.MatchString(lmysqls) {
-				if len(indexre.FindAllString(lmysqls, -1)) > 1 {
-					return "", errors.New(`Looks like we have several index statements in one line. Please make one line per index`)
-				}
-				fmt.Println("5", table)
-				if i, err := getIndex(table, mysqls, database); err != nil {
-					return "", err
-				} else {
-					indexes += i
-				}
-			} else if strings.Contains(lmysqls, `drop primary key`) {
-				if i, err := getIndex(table, mysqls, database); err != nil {
-					return "", err
-				} else {
-					scripts += i
-				}
-			} else if strings.Contains(lmysqls, "primary key") {
-				pkey = getPKey(table, mysqls)
-				//fmt.Println("getpkey:", pkey, "\n")
-				mysqls = strings.Replace(mysqls, pkey, "", -1)
-				scripts += strings.Replace(mysqls, "\n", " ", -1) + " "
-			} else {
-				scripts += strings.Replace(mysqls, "\n", " ", -1) + " "
-			}
+		if len(keys) != 0 { // versions are upserted on key and valid from
+			sql = append(sql, h.provisionKey(g.pgName(t), pkeyName(g.dest(t).Name), strings.Join(keys, ", ")))
 		}
-		//mt.Println("2:", scripts)
-
 	}
+	return strings.Join(sql, "; ") + ";"
+}
 
-	mysqls := strings.Trim(scripts, ` `)
-	//fmt.Println("m", mysqls)
-
-	if !strings.HasSuffix(mysqls, `;`) && len(scripts) != 0 {
-		mysqls += `;`
+func (g *ddlGenerator) add(sql ...string) {
+	if len(sql) == 0 {
+		return
 	}
+	if !g.pathSent && len(g.schema) != 0 { // unqualified names in views are resolved by search path
+		g.statements = append(g.statements, "SET SEARCH_PATH TO "+pgIdent(g.names.Schema(g.schema)))
+		g.pathSent = true
+	}
+	g.statements = append(g.statements, sql...)
+}
 
-	if len(table) == 0 {
-		t := regexp.MustCompile(`TABLE\s+IF\s+EXISTS\s+([a-z0-9]+)`).FindStringSubmatch(mysqls)
-		if len(t) > 0 {
-			table = t[1]
-		}
+// mysql table name with schema and percona shadow table replaced by original table
+func (g *ddlGenerator) table(t TableName) TableName {
+	if len(t.Schema) == 0 {
+		t.Schema = g.schema
 	}
-	if len(table) == 0 {
-		t := regexp.MustCompile(`TABLE\s+([a-z0-9]+)`).FindStringSubmatch(mysqls)
-		if len(t) > 0 {
-			table = t[1]
-		}
+	if m := perconaNewTable.FindStringSubmatch(t.Name); m != nil {
+		t.Name = m[1]
 	}
+	return t
+}
 
-	//mysqls += `\n` + indexes + `\nupdate replication.upgrades set tbl='` + database + `.` + table + `' where ` + `"upgradeId"` + `=` + updateId + `;`
-	if len(indexes) != 0 {
-		mysqls += "\n" + indexes + ";"
+// destination table of mysql table
+func (g *ddlGenerator) dest(t TableName) TableName {
+	t = g.table(t)
+	if len(t.Schema) == 0 {
+		return t
 	}
-	//fmt.Println("m", mysqls)
+	schema, table := g.names.Table(t.Schema, t.Name)
+	return TableName{Schema: schema, Name: table}
+}
 
-	fmt.Println("mysqls:", mysqls, "\n")
-	fmt.Println("pkey:", pkey, "\n")
+// quoted destination name of column of mysql table t
+func (g *ddlGenerator) col(t TableName, column string) string {
+	t = g.table(t)
+	return pgIdent(g.names.Column(t.Schema, t.Name, column))
+}
 
-	for _, r := range getReplaces() {
-		//fmt.Println("replaces:", r)
-		re := regexp.MustCompile(fmt.Sprintf("(?i)%v", r[0]))
-		mysqls = re.ReplaceAllString(mysqls, r[1])
-		//fmt.Println(r, mysqls)
+func (g *ddlGenerator) pgName(t TableName) string {
+	return qualified(g.dest(t))
+}
 
-		re = regexp.MustCompile(fmt.Sprintf("(?i)%v", r[0]))
+func (g *ddlGenerator) statement(stmt interface{}) error {
+	switch s := stmt.(type) {
+	case *SearchPathStmt:
+		if s.Schema != g.schema {
+			g.schema = s.Schema
+			g.pathSent = false
+		}
+	case *TransactionStmt:
+		g.add(s.Command)
+	case *IgnoredStmt:
+		if g.skipped != nil {
+			g.skipped(s.Text, s.Reason)
+		}
+	case *CreateTableStmt:
+		return g.createTable(s)
+	case *AlterTableStmt:
+		return g.alterTable(s)
+	case *DropTableStmt:
+		tables := make([]string, 0)
+		for _, t := range s.Tables {
+			if perconaOldTable.MatchString(t.Name) { // never created in replica
+				continue
+			}
+			tables = append(tables, g.pgName(t))
+		}
+		if len(tables) != 0 {
+			g.add(fmt.Sprintf("DROP TABLE %v%v", ifExists(s.IfExists), strings.Join(tables, ", ")))
+		}
+	case *RenameTableStmt:
+		for idx, from := range s.From {
+			to := s.To[idx]
+			if perconaOldTable.MatchString(to.Name) || g.dest(from) == g.dest(to) {
+				continue
+			}
+			g.add(g.renameTable(from, to)...)
+		}
+	case *TruncateTableStmt:
+		g.add("TRUNCATE TABLE " + g.pgName(s.Table))
+	case *CreateIndexStmt:
+		g.add(g.createIndex(s.Table, s.Index))
+	case *DropIndexStmt:
+		g.add(g.dropIndex(s.Table, s.Name))
+	case *CreateViewStmt:
+		body, err := convertSelect(s.Select)
+		if err != nil {
+			return err
+		}
+		var cols string
+		if len(s.Columns) != 0 {
+			names := make([]string, len(s.Columns))
+			for idx, c := range s.Columns {
+				names[idx] = pgIdent(c)
+			}
+			cols = " (" + strings.Join(names, ", ") + ")"
+		}
+		g.add(fmt.Sprintf("CREATE OR REPLACE VIEW %v%v AS %v", g.pgName(s.View), cols, body))
+	case *DropViewStmt:
+		views := make([]string, len(s.Views))
+		for idx, v := range s.Views {
+			views[idx] = g.pgName(v)
+		}
+		g.add(fmt.Sprintf("DROP VIEW %v%v", ifExists(s.IfExists), strings.Join(views, ", ")))
+	case *CreateSchemaStmt:
+		var ine string
+		if s.IfNotExists {
+			ine = "IF NOT EXISTS "
+		}
+		g.add(fmt.Sprintf("CREATE SCHEMA %v%v", ine, pgIdent(g.names.Schema(s.Name))))
+	case *DropSchemaStmt:
+		g.add(fmt.Sprintf("DROP SCHEMA %v%v", ifExists(s.IfExists), pgIdent(g.names.Schema(s.Name))))
+	default:
+		return errors.New(fmt.Sprintf("Unknown statement %T", stmt))
 	}
+	return nil
+}
 
-	var db string
-	t := regexp.MustCompile(`SET search_path TO "([a-z0-9]+)";`).FindStringSubmatch(mysqls)
-	if len(t) > 0 {
-		db = t[1]
+func ifExists(b bool) string {
+	if b {
+		return "IF EXISTS "
 	}
+	return ""
+}
 
-	t = regexp.MustCompile(`RENAME COLUMN ([a-zA-Z0-9]+) TO ([a-z0-9]+)`).FindStringSubmatch(mysqls)
-	if len(t) > 0 {
-		oldcol := t[1]
-		newcol := t[2]
-		mysqls += fmt.Sprintf(`INSERT INTO replication.alter_table("upgradeId" ,db,table_name,column_name,action,new_name)
-            VALUES ('%v','%v','%v','%v','RENAME','%v'));`, updateId, db, table, oldcol, newcol)
+// name of index in postgres: table_index, or table_col1_col2 for unnamed index.
+// Index names are unique per schema in postgres, so table name is prepended
+// and indexes are renamed with table (see renameIndexes). Names longer than 63 symbols are cut from the beginning
+func indexName(table string, idx *IndexDef) string {
+	name := table
+	if len(idx.Name) != 0 {
+		name += "_" + idx.Name
+	} else {
+		for _, c := range idx.Columns {
+			name += "_" + c.Name
+		}
 	}
-
-	t = regexp.MustCompile(`DROP\s+COLUMN\s+([a-zA-Z0-9]+)`).FindStringSubmatch(mysqls)
-
-	if len(t) > 0 {
-		col := t[1]
-		mysqls += fmt.Sprintf(`INSERT INTO replication.alter_table("upgradeId" ,db,table_name,column_name,action,new_name)
-            VALUES ('%v','%v','%v','%v','DROP COLUMN',''));`, updateId, db, table, col)
+	if len(name) > 63 {
+		name = name[len(name)-63:]
 	}
+	return name
+}
 
-	var res string
-	for _, word := range getWords(mysqls) {
-		//fmt.Println("word:", word)
-		_, err := strconv.ParseFloat(word, 64)
-		if strSliceHasItem(sysWords, strings.ToLower(word)) ||
-			len(strings.Trim(word, " ")) == 0 ||
-			word[:1] == "\"" ||
-			word[:1] == "'" ||
-			word[:1] == "@" ||
-			err == nil {
-			res += word
+// name of primary key constraint, the same as postgres gives by default
+func pkeyName(table string) string {
+	return table + "_pkey"
+}
+
+// index columns of mysql table t, prefix index on col(n) becomes index on left(col, n)
+func (g *ddlGenerator) indexColumns(t TableName, idx *IndexDef, prefixes bool) string {
+	cols := make([]string, len(idx.Columns))
+	for i, c := range idx.Columns {
+		if c.Length > 0 && prefixes {
+			cols[i] = fmt.Sprintf("left(%v, %v)", g.col(t, c.Name), c.Length)
 		} else {
-			res += `"` + word + `"`
+			cols[i] = g.col(t, c.Name)
 		}
 	}
+	return strings.Join(cols, ", ")
+}
 
-	//return strings.Replace(res, `\n`, "\n", -1), nil
-	return res, nil
+// history columns of mysql table t
+func (g *ddlGenerator) history(t TableName) *historyColumns {
+	src := g.table(t)
+	return g.hist.columns(src.Schema, src.Name)
 }
 
-func strSliceHasItem(slice []string, s string) bool {
-	for _, str := range slice {
-		if str == s {
-			return true
-		}
+// unique index of history table is not unique as it has many versions of rows
+func (g *ddlGenerator) createIndex(t TableName, idx *IndexDef) string {
+	var unique string
+	if idx.Unique && g.history(t) == nil {
+		unique = "UNIQUE "
 	}
-	return false
+	dest := g.dest(t)
+	return fmt.Sprintf("CREATE %vINDEX %v ON %v (%v)", unique, pgIdent(indexName(dest.Name, idx)),
+		qualified(dest), g.indexColumns(t, idx, true))
 }
 
-func getIndex(table, mysqls, database string) (string, error) {
-	mysqls = strings.Trim(mysqls, " ")
-	smysqls := strings.ToLower(mysqls)
+func (g *ddlGenerator) dropIndex(t TableName, name string) string {
+	dest := g.dest(t)
+	return "DROP INDEX " + qualified(TableName{Schema: dest.Schema, Name: indexName(dest.Name, &IndexDef{Name: name})})
+}
 
-	if strings.Contains(smysqls, "foreign key") {
-		return ``, nil
+// primary key constraint. Postgres has no prefix keys, so whole columns are used.
+// Primary key of history table includes start of version
+func (g *ddlGenerator) primaryKey(t TableName, idx *IndexDef) string {
+	cols := g.indexColumns(t, idx, false)
+	if h := g.history(t); h != nil {
+		cols += ", " + pgIdent(h.validFrom)
 	}
+	return fmt.Sprintf("CONSTRAINT %v PRIMARY KEY (%v)", pgIdent(pkeyName(g.dest(t).Name)), cols)
+}
 
-	table = strings.Trim(table, " ")
-
-	if strings.Contains(smysqls, "drop index") {
-		idxname := table + "_" + strings.Split(strings.Split(mysqls, "DROP")[1], " ")[2]
-		if len(idxname) > 63 {
-			idxname = idxname[len(idxname)-64:]
-		}
-		return "DROP INDEX" + idxname + ";", nil
+func qualified(t TableName) string {
+	if len(t.Schema) == 0 {
+		return pgIdent(t.Name)
 	}
+	return pgTable(t.Schema, t.Name)
+}
 
-	if strings.Contains(smysqls, "drop primary key") {
-		return fmt.Sprintf("DROP CONSTRAINT %v_pkey;", table), nil
+// column definition for CREATE TABLE and ADD COLUMN. NOT NULL of added
+// column is kept only if it has default, as existing rows need a value
+func (g *ddlGenerator) columnDef(t TableName, col *ColumnDef, added bool) (string, error) {
+	src := g.table(t)
+	typ, err := g.types.PgType(src.Schema, src.Name, col.Name, col.Type)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Column %v: %v", col.Name, err))
 	}
-
-	if strings.Contains(smysqls, "create index") {
-		return mysqls + ";", nil
+	sql := g.col(t, col.Name) + " " + typ
+	if col.NotNull && (!added || col.Default != nil) {
+		sql += " NOT NULL"
 	}
-
-	indexre := regexp.MustCompile(`(?i)(\s|^)(unique\s)?(index|key)(\s+([^\(\)\s]+))?\s*(on\s+([a-zA-Z_0-9]*))?\((.*)\s*\)`)
-	idxmatch := indexre.FindStringSubmatch(mysqls)
-
-	if idxmatch == nil {
-		return "", errors.New("index definition not found")
+	if col.Default != nil {
+		sql += " DEFAULT " + *col.Default
 	}
+	return sql, nil
+}
 
-	//fmt.Println("group7:", idxmatch[7], len(idxmatch[7]))
-	idxname := idxmatch[5]
-	if len(idxmatch[7]) != 0 {
-		table = idxmatch[7]
+func (g *ddlGenerator) createTable(s *CreateTableStmt) error {
+	t := s.Table
+	var ine string
+	if s.IfNotExists {
+		ine = "IF NOT EXISTS "
 	}
-	fields := idxmatch[8]
-	fmt.Println("fields:", fields)
-	fields = regexp.MustCompile("(?i)`").ReplaceAllString(fields, "\"")
-	fields = regexp.MustCompile(`(?i)("?[a-zA-Z0-9_]+"?)\((\d*)\)`).ReplaceAllString(fields, `left($1,$2)`)
-	if len(idxname) == 0 {
-		idxname = table
-		for _, field := range strings.Split(fields, ",") {
-			idxname += "_" + strings.Trim(field, " ")
+
+	if s.Like != nil {
+		if g.dest(*s.Like) == g.dest(t) { // percona shadow table
+			return nil
 		}
-	} else {
-		idxname = table + "_" + idxname
+		g.add(fmt.Sprintf("CREATE TABLE %v%v (LIKE %v INCLUDING ALL)", ine, g.pgName(t), g.pgName(*s.Like)))
+		return nil
 	}
 
-	if len(idxname) > 63 {
-		idxname = idxname[len(idxname)-64:]
+	defs := make([]string, 0)
+	indexes := make([]string, 0)
+	pkey := s.PrimaryKey
+	for _, col := range s.Columns {
+		def, err := g.columnDef(t, col, false)
+		if err != nil {
+			return err
+		}
+		defs = append(defs, def)
+		if col.PrimaryKey {
+			pkey = &IndexDef{Primary: true, Columns: []IndexColumn{IndexColumn{Name: col.Name}}}
+		}
+		if col.Unique {
+			indexes = append(indexes, g.createIndex(t, &IndexDef{Unique: true, Columns: []IndexColumn{IndexColumn{Name: col.Name}}}))
+		}
+	}
+	defs = append(defs, g.meta.columnDefs()...)
+	src := g.table(t)
+	defs = append(defs, g.soft.columns(src.Schema, src.Name).columnDefs()...)
+	defs = append(defs, g.history(t).columnDefs()...)
+	if pkey != nil {
+		defs = append(defs, g.primaryKey(t, pkey))
+	}
+	for _, idx := range s.Indexes {
+		indexes = append(indexes, g.createIndex(t, idx))
 	}
 
-	sql := fmt.Sprintf("CREATE INDEX %v ON %v.%v (%v)", idxname, database, table, fields)
-	fmt.Println("idxname:", idxname)
-	fmt.Println("database:", database)
-	fmt.Println("table:", table)
-	fmt.Println("fields:", fields)
-	fmt.Println("getIndex:", sql)
-	return sql + ";", nil
-
+	g.add(fmt.Sprintf("CREATE TABLE %v%v (%v)", ine, g.pgName(t), strings.Join(defs, ", ")))
+	g.add(indexes...)
+	return nil
 }
 
-func getPKey(table, mysqls string) string {
-	fmt.Println("mysqls in pkey:", mysqls, "\n")
+func (g *ddlGenerator) renameTable(from, to TableName) []string {
+	f := g.dest(from)
+	t := g.dest(to)
+	sql := make([]string, 0)
+	if f.Name != t.Name {
+		sql = append(sql, fmt.Sprintf("ALTER TABLE %v RENAME TO %v", qualified(f), pgIdent(t.Name)),
+			renameIndexes(f.Schema, f.Name, t.Name))
+	}
+	if f.Schema != t.Schema {
+		sql = append(sql, fmt.Sprintf("ALTER TABLE %v SET SCHEMA %v", qualified(TableName{Schema: f.Schema, Name: t.Name}), pgIdent(t.Schema)))
+	}
+	return sql
+}
 
-	mysqls = strings.Trim(mysqls, " ")
-	mysqls = strings.Replace(strings.Replace(mysqls, "(", " $", -1), ")", "$", -1)
+// renames indexes and primary key of renamed table, whose names start with
+// table name (see indexName), so later DROP INDEX finds them. Names of indexes
+// are not known while converting, they are read from pg_indexes
+func renameIndexes(schema string, from string, to string) string {
+	s := "current_schema()"
+	if len(schema) != 0 {
+		s = pgQuote(schema)
+	}
+	prefix := from + "_"
+	return fmt.Sprintf("DO $rename$DECLARE i record; BEGIN FOR i IN SELECT schemaname, indexname FROM pg_indexes "+
+		"WHERE schemaname = %v AND tablename = %v AND left(indexname, %v) = %v LOOP "+
+		"EXECUTE format('ALTER INDEX %%I.%%I RENAME TO %%I', i.schemaname, i.indexname, right(%v || substr(i.indexname, %v), 63)); "+
+		"END LOOP; END$rename$", s, pgQuote(to), utf8.RuneCountInString(prefix), pgQuote(prefix), pgQuote(to),
+		utf8.RuneCountInString(from)+1)
+}
 
-	var s string
-	for _, m := range strings.Split(mysqls, " ") {
-		if m != "" &&
-			strings.ToLower(m) != "primary" &&
-			strings.ToLower(m) != "key" &&
-			strings.ToLower(m) != "add" {
-			s = m
+// ALTER TABLE is split into column renames, one ALTER TABLE with
+// all column changes, index changes and finally table rename, since postgres
+// does not allow renames and indexes within ALTER TABLE actions
+func (g *ddlGenerator) alterTable(s *AlterTableStmt) error {
+	t := s.Table
+	src := g.table(t)
+	table := g.pgName(t)
+	renames := make([]string, 0)
+	actions := make([]string, 0)
+	indexes := make([]string, 0)
+	var rename []string
+
+	// tables created before history was enabled get history columns
+	actions = append(actions, g.history(t).addColumns()...)
+
+	for _, spec := range s.Specs {
+		if spec == nil {
+			continue
+		}
+		switch spec.Action {
+		case "ADD COLUMN":
+			def, err := g.columnDef(t, spec.Column, true)
+			if err != nil {
+				return err
+			}
+			actions = append(actions, "ADD COLUMN "+def)
+		case "DROP COLUMN":
+			actions = append(actions, "DROP COLUMN "+g.col(t, spec.OldName))
+		case "MODIFY", "CHANGE":
+			col := spec.Column
+			name := g.col(t, col.Name)
+			if old := g.col(t, spec.OldName); old != name {
+				renames = append(renames, fmt.Sprintf("ALTER TABLE %v RENAME COLUMN %v TO %v", table, old, name))
+			}
+			typ, err := g.types.PgType(src.Schema, src.Name, col.Name, col.Type)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Column %v: %v", col.Name, err))
+			}
+			// defaults are not changed, complete records are replicated from mysql
+			actions = append(actions, fmt.Sprintf("ALTER COLUMN %v TYPE %v USING %v::%v", name, typ, name, typ))
+			if col.NotNull {
+				actions = append(actions, fmt.Sprintf("ALTER COLUMN %v SET NOT NULL", name))
+			} else {
+				actions = append(actions, fmt.Sprintf("ALTER COLUMN %v DROP NOT NULL", name))
+			}
+		case "SET DEFAULT":
+			actions = append(actions, fmt.Sprintf("ALTER COLUMN %v SET DEFAULT %v", g.col(t, spec.OldName), spec.DefaultVal))
+		case "DROP DEFAULT":
+			actions = append(actions, fmt.Sprintf("ALTER COLUMN %v DROP DEFAULT", g.col(t, spec.OldName)))
+		case "RENAME COLUMN":
+			renames = append(renames, fmt.Sprintf("ALTER TABLE %v RENAME COLUMN %v TO %v", table, g.col(t, spec.OldName), g.col(t, spec.Column.Name)))
+		case "ADD PRIMARY KEY":
+			actions = append(actions, "ADD "+g.primaryKey(t, spec.Index))
+		case "DROP PRIMARY KEY":
+			actions = append(actions, "DROP CONSTRAINT "+pgIdent(pkeyName(g.dest(t).Name)))
+		case "ADD INDEX":
+			indexes = append(indexes, g.createIndex(t, spec.Index))
+		case "DROP INDEX":
+			indexes = append(indexes, g.dropIndex(t, spec.OldName))
+		case "RENAME":
+			rename = g.renameTable(t, *spec.NewTable)
+		default:
+			return errors.New(fmt.Sprintf("Unknown ALTER TABLE action %v", spec.Action))
 		}
 	}
-	pkeyname := s
 
-	if s[:1] == "$" {
-		pkeyname = table + "_pkey"
+	g.add(renames...)
+	if len(actions) != 0 {
+		g.add(fmt.Sprintf("ALTER TABLE %v %v", table, strings.Join(actions, ", ")))
 	}
-
-	return pkeyname
+	g.add(indexes...)
+	g.add(rename...)
+	return nil
 }
 
-func getWords(mysqls string) []string {
-	var res []string
-	separators := []string{",", " ", "(", ")", "\n", ";", ">", "<", "=", ".", "\"", ":", "*", "||", "'"}
-	var word string
-	check_quot := 0
-	for _, s := range mysqls {
-		sym := string(s)
-		if strSliceHasItem(separators, sym) {
-			if check_quot == 0 || sym == "'" || sym == "\"" {
-				if (sym == "'" || sym == "\"") && check_quot == 0 {
-					check_quot = 1
-					res = append(res, word)
-					word = sym
-					continue
-				}
+// mysql functions with postgres equivalents
+var selectFunctions = map[string]string{
+	"ifnull": "coalesce",
+	"lcase":  "lower",
+	"ucase":  "upper",
+}
 
-				if (sym == "'" || sym == "\"") && check_quot == 1 {
-					check_quot = 0
-					word += sym
-					continue
+// keywords which are separated from following parenthesis
+var selectKeywords = []string{"select", "from", "join", "where", "and", "or", "not", "in", "as", "exists", "when", "then", "else", "union", "all"}
+
+// converts body of mysql view into postgres select
+func convertSelect(tokens []token) (string, error) {
+	var sb strings.Builder
+	prev := token{kind: tokEOF}
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		var text string
+		switch t.kind {
+		case tokQuotedIdent:
+			text = pgIdent(t.text)
+		case tokString:
+			text = "'" + strings.Replace(t.text, "'", "''", -1) + "'"
+		case tokNumber:
+			text = t.text
+		case tokVariable:
+			return "", errors.New(fmt.Sprintf("Variable %v in view is not supported", t.text))
+		case tokPunct:
+			switch t.text {
+			case "||":
+				text = "OR"
+			case "&&":
+				text = "AND"
+			case "<=>":
+				text = "IS NOT DISTINCT FROM"
+			default:
+				text = t.text
+			}
+		case tokIdent:
+			text = t.text
+			if i+1 < len(tokens) && tokens[i+1].isPunct("(") {
+				lower := strings.ToLower(t.text)
+				if f, ok := selectFunctions[lower]; ok {
+					text = f
+				} else if lower == "if" { // IF(cond, a, b) to CASE
+					args, end, err := functionArgs(tokens, i+1)
+					if err != nil {
+						return "", err
+					}
+					if len(args) != 3 {
+						return "", errors.New("IF in view must have 3 arguments")
+					}
+					conv := make([]string, 3)
+					for ida, a := range args {
+						if conv[ida], err = convertSelect(a); err != nil {
+							return "", err
+						}
+					}
+					text = fmt.Sprintf("CASE WHEN %v THEN %v ELSE %v END", conv[0], conv[1], conv[2])
+					i = end
 				}
+			} else if t.is("STRAIGHT_JOIN") {
+				text = "JOIN"
+			}
+		}
 
-				if word != "" {
-					res = append(res, word)
-					word = ""
-				}
+		if sb.Len() != 0 && !prev.isPunct(".") && !prev.isPunct("(") && !t.isPunct(".") && !t.isPunct(",") &&
+			!t.isPunct(")") && !(t.isPunct("(") && prev.kind == tokIdent && !prev.is(selectKeywords...)) {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(text)
+		prev = t
+	}
+	return sb.String(), nil
+}
 
-				res = append(res, sym)
-			} else {
-				word += sym
+// arguments of function call whose opening parenthesis is at tokens[open].
+// Returns arguments and position of closing parenthesis
+func functionArgs(tokens []token, open int) ([][]token, int, error) {
+	args := make([][]token, 0)
+	depth := 0
+	start := open + 1
+	for i := open; i < len(tokens); i++ {
+		switch {
+		case tokens[i].isPunct("("):
+			depth++
+		case tokens[i].isPunct(")"):
+			depth--
+			if depth == 0 {
+				return append(args, tokens[start:i]), i, nil
 			}
-		} else {
-			word += sym
+		case tokens[i].isPunct(",") && depth == 1:
+			args = append(args, tokens[start:i])
+			start = i + 1
 		}
 	}
-
-	return res
-
+	return nil, 0, errors.New("Unbalanced parentheses in view")
 }
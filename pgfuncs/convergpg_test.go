@@ -0,0 +1,136 @@
+package pgfuncs
+
+import (
+	"testing"
+)
+
+func testConvert(t *testing.T, mysql string, expected string) {
+	sql, err := ConvertMysql57ToPostgres(mysql, nil)
+	if err != nil {
+		t.Fatal(mysql, err)
+	}
+	if sql != expected {
+		t.Fatal(
+			"Incorrect conversion of", mysql,
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
+
+func TestConvertCreateTable(t *testing.T) {
+	testConvert(t, "SET SEARCH_PATH TO \"db1\"; CREATE TABLE `orders` (\n"+
+		"  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,\n"+
+		"  `select` varchar(20) CHARACTER SET utf8 DEFAULT '' COMMENT 'keyword, as name',\n"+
+		"  `state` enum('new','done') NOT NULL DEFAULT 'new',\n"+
+		"  `created` datetime NOT NULL DEFAULT '0000-00-00 00:00:00',\n"+
+		"  `updated` timestamp NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,\n"+
+		"  `note` longtext,\n"+
+		"  PRIMARY KEY (`id`),\n"+
+		"  UNIQUE KEY `uq_select` (`select`),\n"+
+		"  KEY `idx_note` (`note`(10), `state`),\n"+
+		"  CONSTRAINT `fk_1` FOREIGN KEY (`id`) REFERENCES `other` (`id`)\n"+
+		") ENGINE=InnoDB AUTO_INCREMENT=5 DEFAULT CHARSET=utf8",
+		`SET SEARCH_PATH TO "db1"; `+
+			`CREATE TABLE "db1"."orders" ("id" bigint NOT NULL, "select" varchar(20) DEFAULT '', `+
+			`"state" varchar(100) NOT NULL DEFAULT 'new', "created" timestamp NOT NULL DEFAULT '1957-01-01 00:00:00', `+
+			`"updated" timestamp DEFAULT CURRENT_TIMESTAMP, "note" text, CONSTRAINT "orders_pkey" PRIMARY KEY ("id")); `+
+			`CREATE UNIQUE INDEX "orders_uq_select" ON "db1"."orders" ("select"); `+
+			`CREATE INDEX "orders_idx_note" ON "db1"."orders" (left("note", 10), "state");`)
+}
+
+func TestConvertAlterTable(t *testing.T) {
+	testConvert(t, "ALTER TABLE db1.orders ADD COLUMN `function` int(11) NOT NULL DEFAULT 0 AFTER `id`, "+
+		"MODIFY `note` varchar(50) NOT NULL, CHANGE COLUMN `state` `status` tinyint(4) DEFAULT NULL, "+
+		"DROP COLUMN `created`, ADD INDEX `idx_status` (`status`), DROP INDEX `idx_note`, "+
+		"DROP PRIMARY KEY, ADD PRIMARY KEY (`id`, `status`), ALGORITHM=INPLACE, LOCK=NONE",
+		`ALTER TABLE "db1"."orders" RENAME COLUMN "state" TO "status"; `+
+			`ALTER TABLE "db1"."orders" ADD COLUMN "function" bigint NOT NULL DEFAULT 0, `+
+			`ALTER COLUMN "note" TYPE varchar(50) USING "note"::varchar(50), ALTER COLUMN "note" SET NOT NULL, `+
+			`ALTER COLUMN "status" TYPE int USING "status"::int, ALTER COLUMN "status" DROP NOT NULL, `+
+			`DROP COLUMN "created", DROP CONSTRAINT "orders_pkey", ADD CONSTRAINT "orders_pkey" PRIMARY KEY ("id", "status"); `+
+			`CREATE INDEX "orders_idx_status" ON "db1"."orders" ("status"); `+
+			`DROP INDEX "db1"."orders_idx_note";`)
+}
+
+func TestConvertTableStatements(t *testing.T) {
+	testConvert(t, "SET SEARCH_PATH TO \"db1\"; RENAME TABLE `a` TO `b`, db1.c TO db2.c",
+		`SET SEARCH_PATH TO "db1"; ALTER TABLE "db1"."a" RENAME TO "b"; `+
+			`DO $rename$DECLARE i record; BEGIN FOR i IN SELECT schemaname, indexname FROM pg_indexes `+
+			`WHERE schemaname = 'db1' AND tablename = 'b' AND left(indexname, 2) = 'a_' LOOP `+
+			`EXECUTE format('ALTER INDEX %I.%I RENAME TO %I', i.schemaname, i.indexname, right('b' || substr(i.indexname, 2), 63)); `+
+			`END LOOP; END$rename$; `+
+			`ALTER TABLE "db1"."c" SET SCHEMA "db2";`)
+	// indexes are renamed with table, so they are found by name of new table
+	testConvert(t, "DROP INDEX `idx2` ON `db1`.`b`", `DROP INDEX "db1"."b_idx2";`)
+	testConvert(t, "DROP TABLE IF EXISTS `a`, `_a_old` /* generated by server */",
+		`DROP TABLE IF EXISTS "a";`)
+	testConvert(t, "TRUNCATE `db1`.`a`", `TRUNCATE TABLE "db1"."a";`)
+
+	// percona online schema change works on original table
+	testConvert(t, "SET SEARCH_PATH TO \"db1\"; CREATE TABLE `_a_new` LIKE `a`", "")
+	testConvert(t, "ALTER TABLE `db1`.`_a_new` ADD KEY `idx` (`b`)", `CREATE INDEX "a_idx" ON "db1"."a" ("b");`)
+	testConvert(t, "RENAME TABLE `db1`.`a` TO `db1`.`_a_old`, `db1`.`_a_new` TO `db1`.`a`", "")
+
+	// statements without meaning for replica
+	testConvert(t, "GRANT SELECT ON db1.* TO 'user'@'%'", "")
+	testConvert(t, "CREATE DEFINER=`root`@`localhost` FUNCTION f() RETURNS int RETURN 1", "")
+}
+
+func TestConvertSkipped(t *testing.T) {
+	var skipped []string
+	opts := &Options{Skipped: func(statement string, reason string) { skipped = append(skipped, statement) }}
+	for _, mysql := range []string{
+		"INSERT INTO `a` VALUES (1)",
+		"UPDATE `a` SET `b` = 'x;y' WHERE `id` = 1",
+		"CREATE DEFINER=`root`@`localhost` PROCEDURE p() BEGIN DROP TABLE `a`; DELETE FROM `b`; END",
+		"CREATE TRIGGER tr BEFORE INSERT ON `a` FOR EACH ROW SET NEW.`b` = 1",
+		"GRANT SELECT ON db1.* TO 'user'@'%'",
+	} {
+		sql, err := ConvertMysql57ToPostgres(mysql, opts)
+		if err != nil {
+			t.Fatal(mysql, err)
+		}
+		if sql != "" {
+			t.Fatal("Incorrect conversion of", mysql, "expected", "", "got", sql)
+		}
+	}
+	expected := []string{
+		"INSERT INTO `a` VALUES (1)",
+		"UPDATE `a` SET `b` = 'x;y' WHERE `id` = 1",
+		"CREATE DEFINER=`root`@`localhost` PROCEDURE p() BEGIN DROP TABLE `a`; DELETE FROM `b`; END",
+		"CREATE TRIGGER tr BEFORE INSERT ON `a` FOR EACH ROW SET NEW.`b` = 1",
+		"GRANT SELECT ON db1.* TO 'user'@'%'",
+	}
+	if len(skipped) != len(expected) {
+		t.Fatal("Incorrect skipped statements", "expected", expected, "got", skipped)
+	}
+	for i := range expected {
+		if skipped[i] != expected[i] {
+			t.Fatal("Incorrect skipped statement", "expected", expected[i], "got", skipped[i])
+		}
+	}
+}
+
+func TestConvertView(t *testing.T) {
+	testConvert(t, "SET SEARCH_PATH TO \"db1\"; /*!50001 CREATE ALGORITHM=UNDEFINED DEFINER=`root`@`%` SQL SECURITY DEFINER "+
+		"VIEW `v1` AS select `a`.`id` AS `id`,ifnull(`a`.`name`,'') AS `name`,if((`a`.`n` > 1),\"many\",lcase(`a`.`s`)) AS `n` "+
+		"from (`a` straight_join `b` on((`a`.`id` = `b`.`id`))) */",
+		`SET SEARCH_PATH TO "db1"; CREATE OR REPLACE VIEW "db1"."v1" AS select "a"."id" AS "id", `+
+			`coalesce("a"."name", '') AS "name", CASE WHEN ("a"."n" > 1) THEN 'many' ELSE lower("a"."s") END AS "n" `+
+			`from ("a" JOIN "b" on(("a"."id" = "b"."id")))`+";")
+}
+
+func TestConvertErrors(t *testing.T) {
+	for _, mysql := range []string{
+		"CREATE TABLE `a` (`id` int, FULLTEXT KEY `ft` (`b`))",
+		"CREATE TABLE `a` (`id` int) PARTITION BY HASH(`id`) PARTITIONS 4",
+		"CREATE TABLE `a` (`p` point)",
+		"ALTER TABLE `a` ADD COLUMN",
+		"DROP INDEX `idx`",
+	} {
+		if _, err := ConvertMysql57ToPostgres(mysql, nil); err == nil {
+			t.Fatal("Expected error for", mysql)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// dead-letter table of events failed to apply
+
+package pgfuncs
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// DeadLetters keeps row events which failed to apply together with the
+// error and binlog position. Event payload is stored as jsonb made by
+// structs.EncodeEvent, so the event can be decoded and played again.
+// Dead letter is written in transaction of its row and is unique by
+// DeadLetterKey, so row failing again when transaction is replayed is kept once
+type DeadLetters struct {
+	schema string // quoted schema of dead-letter table
+	table  string // quoted dead-letter table
+	index  string // quoted unique index of row keys
+}
+
+// Creates dead-letter table given as schema.table
+func NewDeadLetters(table string) (*DeadLetters, error) {
+	st := strings.Split(strings.TrimSpace(table), ".")
+	if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+		return nil, errors.New(fmt.Sprintf("Dead-letter table should be schemaname.tablename. Got %v", table))
+	}
+	return &DeadLetters{schema: pgIdent(st[0]), table: pgTable(st[0], st[1]), index: pgIdent(st[1] + "_row_key")}, nil
+}
+
+// key of dead letter of row event with payload made by structs.EncodeEvent:
+// binlog position of event and hash of the row
+func DeadLetterKey(event *structs.Event, payload []byte) string {
+	return fmt.Sprintf("%v:%v:%x", event.File, event.EventPosition, md5.Sum(payload))
+}
+
+// statements creating dead-letter table and its schema. Table created
+// before row keys gets the column, its rows have no key
+func (d *DeadLetters) CreateTable() string {
+	return fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %v; CREATE TABLE IF NOT EXISTS %v ("+
+		"id bigserial PRIMARY KEY, schema_name text NOT NULL, table_name text NOT NULL, binlog_file text, "+
+		"binlog_position bigint, gtid text, error text NOT NULL, event jsonb NOT NULL, "+
+		"created_at timestamp with time zone NOT NULL DEFAULT now(), row_key text); "+
+		"ALTER TABLE %v ADD COLUMN IF NOT EXISTS row_key text; "+
+		"CREATE UNIQUE INDEX IF NOT EXISTS %v ON %v (row_key);", d.schema, d.table, d.table, d.index, d.table)
+}
+
+// Generates insert of event failed with error errText. Nothing is inserted
+// if the row has dead letter already
+func (d *DeadLetters) Insert(event *structs.Event, errText string) (string, error) {
+	payload, err := structs.EncodeEvent(event)
+	if err != nil {
+		return "", err
+	}
+	file := "NULL"
+	if len(event.File) != 0 {
+		file = pgQuote(event.File)
+	}
+	gtid := "NULL"
+	if len(event.Gtid) != 0 {
+		gtid = pgQuote(event.Gtid)
+	}
+	return fmt.Sprintf("INSERT INTO %v (schema_name, table_name, binlog_file, binlog_position, gtid, error, event, row_key) "+
+		"VALUES (%v, %v, %v, %v, %v, %v, %v::jsonb, %v) ON CONFLICT (row_key) DO NOTHING; ", d.table, pgQuote(event.SchemaName),
+		pgQuote(event.TableName), file, event.EventPosition, gtid, pgQuote(errText), pgQuote(string(payload)),
+		pgQuote(DeadLetterKey(event, payload))), nil
+}
+
+// query selecting id, error and payload of dead-lettered events in order they failed
+func (d *DeadLetters) Select() string {
+	return fmt.Sprintf("SELECT id, error, event::text FROM %v ORDER BY id;", d.table)
+}
+
+// Generates delete of dead-lettered events
+func (d *DeadLetters) Delete(ids []int64) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	list := make([]string, len(ids))
+	for idx, id := range ids {
+		list[idx] = fmt.Sprintf("%v", id)
+	}
+	return fmt.Sprintf("DELETE FROM %v WHERE id IN (%v);", d.table, strings.Join(list, ", "))
+}
@@ -0,0 +1,102 @@
+package pgfuncs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestDeadLetterEvent(t *testing.T) {
+	columns := append(testColumns(), &structs.Column{Name: "created", Type: "datetime"}, &structs.Column{Name: "data", Type: "blob"})
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    columns,
+		EventType:  structs.UPDATE_EVENT,
+		OldValues: [][]*structs.QueryValues{
+			append(testRow(uint32(1), "it's", byte(1)), &structs.QueryValues{ColumnId: 3, Value: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+				&structs.QueryValues{ColumnId: 4, Value: []byte{0, 1, 'x'}}),
+		},
+		NewValues: [][]*structs.QueryValues{
+			append(testRow(uint32(1), "b", byte(2)), &structs.QueryValues{ColumnId: 3, Value: nil},
+				&structs.QueryValues{ColumnId: 4, Value: []byte{}}),
+		},
+		File:          "mysql-bin.000003",
+		EventPosition: 154,
+	}
+
+	payload, err := structs.EncodeEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := structs.DecodeEvent(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := GenQuery(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, err := GenQuery(decoded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql != expected {
+		t.Fatal(
+			"Incorrect query of decoded event",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	dl, err := NewDeadLetters("replicagor.dead_letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, err = dl.Insert(event, "duplicate key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := `INSERT INTO "replicagor"."dead_letter" (schema_name, table_name, binlog_file, binlog_position, gtid, error, event, row_key) ` +
+		`VALUES ('db1', 'tab1', 'mysql-bin.000003', 154, NULL, 'duplicate key', '`
+	suffix := fmt.Sprintf("'::jsonb, '%v') ON CONFLICT (row_key) DO NOTHING; ", DeadLetterKey(event, payload))
+	if !strings.HasPrefix(sql, prefix) || !strings.HasSuffix(sql, suffix) {
+		t.Fatal(
+			"Incorrect dead-letter insert",
+			"expected prefix", prefix,
+			"got", sql,
+		)
+	}
+
+	// the same row of other event has other key
+	other := *event
+	other.EventPosition = 300
+	if key := DeadLetterKey(&other, payload); key == DeadLetterKey(event, payload) || !strings.HasPrefix(key, "mysql-bin.000003:300:") {
+		t.Fatal("Incorrect dead-letter key", "expected", "key of position 300", "got", key)
+	}
+
+	expected = `CREATE SCHEMA IF NOT EXISTS "replicagor"; CREATE TABLE IF NOT EXISTS "replicagor"."dead_letter" (` +
+		`id bigserial PRIMARY KEY, schema_name text NOT NULL, table_name text NOT NULL, binlog_file text, binlog_position bigint, ` +
+		`gtid text, error text NOT NULL, event jsonb NOT NULL, created_at timestamp with time zone NOT NULL DEFAULT now(), row_key text); ` +
+		`ALTER TABLE "replicagor"."dead_letter" ADD COLUMN IF NOT EXISTS row_key text; ` +
+		`CREATE UNIQUE INDEX IF NOT EXISTS "dead_letter_row_key" ON "replicagor"."dead_letter" (row_key);`
+	if sql := dl.CreateTable(); sql != expected {
+		t.Fatal(
+			"Incorrect dead-letter table",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	expected = `DELETE FROM "replicagor"."dead_letter" WHERE id IN (3, 5);`
+	if sql := dl.Delete([]int64{3, 5}); sql != expected {
+		t.Fatal(
+			"Incorrect dead-letter delete",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
@@ -0,0 +1,84 @@
+// classification of postgres errors
+
+package pgfuncs
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// what can be done after error of postgres
+type ErrorClass int
+
+const (
+	FatalError      ErrorClass = iota // replication has to stop
+	RetryableError                    // transaction can be run again
+	ConnectionError                   // transaction can be run again after reconnecting
+)
+
+func (class ErrorClass) String() string {
+	switch class {
+	case RetryableError:
+		return "retryable"
+	case ConnectionError:
+		return "connection"
+	}
+	return "fatal"
+}
+
+// Classifies error of running query. Errors with SQLSTATE are classified by
+// the code, errors of drivers without it by network errors and message
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return FatalError
+	}
+	var st interface{ SQLState() string }
+	if errors.As(err, &st) {
+		return ClassifySQLState(st.SQLState())
+	}
+	var ne net.Error
+	if errors.As(err, &ne) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ConnectionError
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"deadlock detected", "could not serialize access", "canceling statement due to lock timeout"} {
+		if strings.Contains(msg, s) {
+			return RetryableError
+		}
+	}
+	for _, s := range []string{"bad connection", "connection reset", "connection refused", "broken pipe",
+		"terminating connection", "the database system is starting up", "the database system is shutting down",
+		"server closed the connection", "no connection to the server"} {
+		if strings.Contains(msg, s) {
+			return ConnectionError
+		}
+	}
+	return FatalError
+}
+
+// Classifies SQLSTATE code
+func ClassifySQLState(code string) ErrorClass {
+	switch code {
+	case "40001", // serialization_failure
+		"40P01", // deadlock_detected
+		"55P03", // lock_not_available
+		"57014": // query_canceled, e.g. by statement_timeout
+		return RetryableError
+	case "53300", // too_many_connections
+		"57P01", // admin_shutdown
+		"57P02", // crash_shutdown
+		"57P03": // cannot_connect_now
+		return ConnectionError
+	}
+	switch {
+	case strings.HasPrefix(code, "08"): // connection exception
+		return ConnectionError
+	case strings.HasPrefix(code, "53"): // insufficient resources
+		return RetryableError
+	}
+	return FatalError
+}
@@ -0,0 +1,42 @@
+package pgfuncs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: error " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{sqlStateError("40P01"), RetryableError},
+		{sqlStateError("40001"), RetryableError},
+		{sqlStateError("53100"), RetryableError},
+		{sqlStateError("08006"), ConnectionError},
+		{sqlStateError("57P01"), ConnectionError},
+		{sqlStateError("23505"), FatalError},
+		{sqlStateError("42P01"), FatalError},
+		{fmt.Errorf("cannot run query: %w", sqlStateError("40001")), RetryableError},
+		{io.ErrUnexpectedEOF, ConnectionError},
+		{errors.New("pq: deadlock detected"), RetryableError},
+		{errors.New("read tcp 10.0.0.1:5432: connection reset by peer"), ConnectionError},
+		{errors.New("pq: duplicate key value violates unique constraint"), FatalError},
+	}
+	for _, c := range cases {
+		if class := ClassifyError(c.err); class != c.expected {
+			t.Fatal(
+				"Incorrect class of error", c.err,
+				"expected", c.expected,
+				"got", class,
+			)
+		}
+	}
+}
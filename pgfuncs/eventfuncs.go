@@ -4,133 +4,361 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/andsha/replicagor/structs"
 )
 
-func sliceHasInt(slice []int, number int) bool {
-	for _, n := range slice {
-		if number == n {
-			return true
-		}
+// Options of query generation for postgres destination
+type Options struct {
+	// Upsert makes inserts idempotent: INSERT ... ON CONFLICT (primary key) DO UPDATE.
+	// Together with key based updates and deletes (deleting a missing row is
+	// not an error in postgres) replaying events from an earlier binlog
+	// position converges instead of failing on duplicate keys
+	Upsert bool
+
+	// Types maps mysql column types to postgres types. Values are encoded
+	// for the type of destination column. Nil uses default mapping
+	Types *TypeMap
+
+	// Names maps mysql schemas, tables and columns to destination names.
+	// Nil keeps mysql names
+	Names *NameMap
+
+	// Metadata lists replication metadata columns filled on every INSERT
+	// and UPDATE. Nil writes no metadata
+	Metadata *Metadata
+
+	// SoftDelete lists tables whose deleted rows are marked instead of
+	// being removed. Inserts into these tables are always upserts
+	SoftDelete *SoftDelete
+
+	// History lists tables keeping all versions of rows. Inserts into
+	// these tables are always upserts
+	History *History
+
+	// Skipped is called with text of every mysql statement which is not
+	// replicated by ConvertMysql57ToPostgres and the reason. Nil skips
+	// statements silently
+	Skipped func(statement string, reason string)
+}
+
+// true if inserts into mysql table schema.table are upserts
+func (opts *Options) Upserts(schema string, table string) bool {
+	return opts != nil && (opts.Upsert || opts.SoftDelete.columns(schema, table) != nil || opts.History.columns(schema, table) != nil)
+}
+
+// destination of event rows
+type target struct {
+	table string   // quoted destination table
+	names []string // quoted destination names of columns, indexed as columns
+	types []string // postgres types of columns, indexed as columns
+	meta  *Metadata
+	soft  *softDeleteColumns // nil if rows are deleted
+	hist  *historyColumns    // nil if table is mirrored
+}
+
+// destination of rows of mysql table schema.table
+func (opts *Options) target(schema string, table string, columns []*structs.Column) *target {
+	var types *TypeMap
+	var names *NameMap
+	var meta *Metadata
+	var soft *SoftDelete
+	var hist *History
+	if opts != nil {
+		types = opts.Types
+		names = opts.Names
+		meta = opts.Metadata
+		soft = opts.SoftDelete
+		hist = opts.History
+	}
+
+	tg := &target{names: make([]string, len(columns)), types: make([]string, len(columns)), meta: meta,
+		soft: soft.columns(schema, table), hist: hist.columns(schema, table)}
+	tg.table = pgTable(names.Table(schema, table))
+	for idc, column := range columns {
+		tg.names[idc] = pgIdent(names.Column(schema, table, column.Name))
+		tg.types[idc] = types.ColumnType(schema, table, column)
+	}
+	return tg
+}
+
+// names and values of columns written in addition to row columns by insert
+// or update statement of event: metadata, soft delete and history columns
+func (tg *target) extra(event *structs.Event, insert bool) ([]string, []string) {
+	names := append([]string{}, tg.meta.Columns()...)
+	values := tg.meta.values(event)
+	if insert || event.EventType == structs.DELETE_EVENT {
+		sn, sv := tg.soft.values(!insert, event)
+		names = append(names, sn...)
+		values = append(values, sv...)
+	}
+	if insert {
+		hn, hv := tg.hist.values(event)
+		names = append(names, hn...)
+		values = append(values, hv...)
+	}
+	return names, values
+}
+
+// quotes schema, table or column name for postgres
+func pgIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// full name of the destination table
+func pgTable(schema, table string) string {
+	return pgIdent(schema) + "." + pgIdent(table)
+}
+
+// converts value coming from binlog into postgres literal for column of pgtype
+func pgValue(column *structs.Column, pgtype string, value interface{}) string {
+	s, ok := pgText(column, pgtype, value)
+	if !ok {
+		return "NULL"
 	}
+	if isBoolean(pgtype) {
+		return s
+	}
+	return pgQuote(s)
+}
 
+// postgres string literal
+func pgQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func isBoolean(pgtype string) bool {
+	switch strings.SplitN(pgtype, "(", 2)[0] {
+	case "boolean", "bool":
+		return true
+	}
 	return false
 }
 
+// text of value coming from binlog as it is written into column of pgtype.
+// ok is false for NULL
+func pgText(column *structs.Column, pgtype string, value interface{}) (string, bool) {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case []byte:
+		if pgtype == "bytea" {
+			return fmt.Sprintf("\\x%x", v), true
+		}
+		s = string(v)
+	case time.Time:
+		s = v.Format("2006-01-02 15:04:05.999999")
+	case time.Duration:
+		sign := ""
+		if v < 0 {
+			sign = "-"
+			v = -v
+		}
+		s = fmt.Sprintf("%v%02d:%02d:%02d", sign, int64(v/time.Hour), int64(v/time.Minute)%60, int64(v/time.Second)%60)
+	case string:
+		if pgtype == "bytea" {
+			return fmt.Sprintf("\\x%x", v), true
+		}
+		s = v
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+
+	if isBoolean(pgtype) { // mysql has no booleans, tinyint(1) is used instead
+		if s == "0" {
+			return "false", true
+		}
+		return "true", true
+	}
+	switch strings.SplitN(pgtype, "(", 2)[0] {
+	case "smallint", "int", "integer", "bigint", "int2", "int4", "int8": // enum is written as its index
+		if strings.HasPrefix(column.Type, "enum") {
+			return s, true
+		}
+	}
+
+	if strings.HasPrefix(column.Type, "enum") { // mysql enum column type
+		if idx, err := strconv.ParseInt(s, 10, 16); err == nil && idx > 0 && int(idx) <= len(column.Enum) {
+			s = column.Enum[idx-1]
+		}
+	}
+
+	return s, true
+}
+
+// Signature of the set of columns present in a row image. Rows of the same
+// table with equal signatures can be written by a single multi-row INSERT
+func RowSignature(vgroup []*structs.QueryValues) string {
+	var sig string
+	for _, val := range vgroup {
+		sig = fmt.Sprintf("%v%v,", sig, val.ColumnId)
+	}
+	return sig
+}
+
+// Key of the row built from primary key columns. Empty if table has no primary key
+func RowKey(columns []*structs.Column, vgroup []*structs.QueryValues) string {
+	var key string
+	for _, val := range vgroup {
+		if columns[val.ColumnId].IsPKey {
+			key = fmt.Sprintf("%v%v,", key, pgValue(columns[val.ColumnId], "", val.Value))
+		}
+	}
+	return key
+}
+
+// ON CONFLICT clause of insert statement for upsert mode
+func upsertClause(columns []*structs.Column, tg *target, vgroup []*structs.QueryValues, upsert bool) string {
+	if !upsert {
+		return ""
+	}
+
+	var pkeys, sets string
+	for idc, column := range columns {
+		if column.IsPKey {
+			pkeys = fmt.Sprintf("%v%v, ", pkeys, tg.names[idc])
+		}
+	}
+	if tg.hist != nil { // version of the same second is replaced
+		if len(pkeys) == 0 {
+			return ""
+		}
+		pkeys = fmt.Sprintf("%v%v, ", pkeys, pgIdent(tg.hist.validFrom))
+	}
+	if len(pkeys) == 0 { // no primary key, skip rows violating any unique constraint
+		return " ON CONFLICT DO NOTHING"
+	}
+
+	for _, val := range vgroup {
+		if !columns[val.ColumnId].IsPKey {
+			name := tg.names[val.ColumnId]
+			sets = fmt.Sprintf("%v%v = EXCLUDED.%v, ", sets, name, name)
+		}
+	}
+	extra, _ := tg.extra(nil, true)
+	for _, c := range extra {
+		if tg.hist != nil && c == tg.hist.validFrom { // part of conflict target
+			continue
+		}
+		sets = fmt.Sprintf("%v%v = EXCLUDED.%v, ", sets, pgIdent(c), pgIdent(c))
+	}
+	if len(sets) == 0 {
+		return fmt.Sprintf(" ON CONFLICT (%v) DO NOTHING", pkeys[:len(pkeys)-2])
+	}
+
+	return fmt.Sprintf(" ON CONFLICT (%v) DO UPDATE SET %v", pkeys[:len(pkeys)-2], sets[:len(sets)-2])
+}
+
+// Predicate matching the destination row of the row image.
+// Rows are matched on key columns (see structs.Column.IsKey) only.
+// If table has no key, row is matched on all replicated columns using
+// IS NOT DISTINCT FROM, so NULLs match NULLs. Such full-row match is slow and
+// may fail to find rows whose values do not survive text round trip
+// (e.g. float and double), so tables without keys should get one.
+// Excluded columns are always NULL in destination and never used for matching
+func whereClause(columns []*structs.Column, tg *target, vgroup []*structs.QueryValues) string {
+	hasKey := false
+	for _, column := range columns {
+		if column.IsKey {
+			hasKey = true
+			break
+		}
+	}
+
+	var sql string
+	for _, val := range vgroup {
+		column := columns[val.ColumnId]
+		if hasKey {
+			if column.IsKey {
+				sql = fmt.Sprintf("%v%v = %v AND ", sql, tg.names[val.ColumnId], pgValue(column, tg.types[val.ColumnId], val.Value))
+			}
+		} else if !column.ExcludedFromReplication {
+			sql = fmt.Sprintf("%v%v IS NOT DISTINCT FROM %v AND ", sql, tg.names[val.ColumnId], pgValue(column, tg.types[val.ColumnId], val.Value))
+		}
+	}
+	if len(sql) == 0 {
+		return "FALSE"
+	}
+	return sql[:len(sql)-5]
+}
+
+// column list of insert statement. NULL values are written explicitly
+// instead of leaving them to destination defaults
+func insertColumns(tg *target, vgroup []*structs.QueryValues) string {
+	var sql string
+	for _, val := range vgroup {
+		sql = fmt.Sprintf("%v%v, ", sql, tg.names[val.ColumnId])
+	}
+	extra, _ := tg.extra(nil, true)
+	for _, c := range extra {
+		sql = fmt.Sprintf("%v%v, ", sql, pgIdent(c))
+	}
+	if len(sql) == 0 {
+		return ""
+	}
+	return sql[:len(sql)-2]
+}
+
+// values tuple of insert statement. source is the event of the row, it gives
+// values of metadata columns
+func insertValues(columns []*structs.Column, tg *target, vgroup []*structs.QueryValues, source *structs.Event) string {
+	var sql string
+	for _, val := range vgroup {
+		if columns[val.ColumnId].ExcludedFromReplication {
+			sql = fmt.Sprintf("%vNULL, ", sql)
+		} else {
+			sql = fmt.Sprintf("%v%v, ", sql, pgValue(columns[val.ColumnId], tg.types[val.ColumnId], val.Value))
+		}
+	}
+	_, values := tg.extra(source, true)
+	for _, v := range values {
+		sql = fmt.Sprintf("%v%v, ", sql, v)
+	}
+	if len(sql) == 0 {
+		return "()"
+	}
+	return "(" + sql[:len(sql)-2] + ")"
+}
+
+// SET list of extra columns of update statement, ends with comma
+func extraSets(tg *target, event *structs.Event) string {
+	var sql string
+	names, values := tg.extra(event, false)
+	for idc, c := range names {
+		sql = fmt.Sprintf("%v%v = %v, ", sql, pgIdent(c), values[idc])
+	}
+	return sql
+}
+
 // Generates Postgres queries based on information coming in the event
-func GenQuery(event *structs.Event) (string, error) {
+func GenQuery(event *structs.Event, opts *Options) (string, error) {
 	var sql string
+	tg := opts.target(event.SchemaName, event.TableName, event.Columns)
+	upsert := opts.Upserts(event.SchemaName, event.TableName)
+
 	switch event.EventType {
 	case structs.INSERT_EVENT:
 		for _, vgroup := range event.OldValues {
-			sql = fmt.Sprintf("%vINSERT INTO %v.%v (", sql, event.SchemaName, event.TableName)
-			enumidxs := make([]int, 0)
-
-			for _, val := range vgroup {
-				if val.Value != nil {
-					//fmt.Println("1", val.ColumnId, val.Value)
-					sql = fmt.Sprintf("%v%v, ", sql, event.Columns[val.ColumnId].Name)
-					if event.Columns[val.ColumnId].Type[0:4] == "enum" { // mysql enum column type
-						enumidxs = append(enumidxs, val.ColumnId)
-					}
-				}
-			}
-			sql = sql[:len(sql)-2] + ") VALUES ("
-			for idv, val := range vgroup {
-				if val.Value != nil {
-					//fmt.Println("excluded from replication:", event.Columns[idv].ExcludedFromReplication)
-					if event.Columns[idv].ExcludedFromReplication {
-						sql = fmt.Sprintf("%vNULL, ", sql)
-					} else {
-						switch v := val.Value.(type) {
-						case time.Time:
-							sql = fmt.Sprintf("%v'%v-%v-%v %v:%v:%v', ", sql, v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second())
-						default:
-							if sliceHasInt(enumidxs, idv) {
-								v, _ := strconv.ParseInt(fmt.Sprintf("%v", val.Value), 10, 16)
-								//fmt.Println(v)
-								sql = fmt.Sprintf("%v'%v', ", sql, event.Columns[idv].Enum[v-1])
-							} else {
-								sql = fmt.Sprintf("%v'%v', ", sql, val.Value)
-							}
-						}
-					}
-				}
-			}
-			sql = sql[:len(sql)-2] + "); "
+			sql = fmt.Sprintf("%vINSERT INTO %v (%v) VALUES %v%v; ", sql, tg.table,
+				insertColumns(tg, vgroup), insertValues(event.Columns, tg, vgroup, event),
+				upsertClause(event.Columns, tg, vgroup, upsert))
 		}
 	case structs.UPDATE_EVENT:
 		for idg, vgroup := range event.NewValues {
-			sql = fmt.Sprintf("%vUPDATE %v.%v SET ", sql, event.SchemaName, event.TableName)
-
-			for idv, val := range vgroup {
-				if val.Value != nil {
-					if event.Columns[val.ColumnId].ExcludedFromReplication {
-						sql = fmt.Sprintf("%v%v = NULL, ", sql, event.Columns[val.ColumnId].Name)
-					} else {
-						switch v := val.Value.(type) {
-						case time.Time:
-							sql = fmt.Sprintf("%v%v = '%v-%v-%v %v:%v:%v', ", sql, event.Columns[val.ColumnId].Name, v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second())
-						default:
-							var n interface{}
-							if event.Columns[val.ColumnId].Type[0:4] == "enum" {
-								t, _ := strconv.ParseInt(fmt.Sprintf("%v", val.Value), 10, 16)
-								n = event.Columns[idv].Enum[t-1]
-							} else {
-								n = val.Value
-							}
-							sql = fmt.Sprintf("%v%v = '%v', ", sql, event.Columns[val.ColumnId].Name, n)
-						}
-					}
-				}
-			}
-
-			sql = sql[:len(sql)-2] + " WHERE "
-			for idv, val := range event.OldValues[idg] {
-				if val.Value != nil {
-					switch v := val.Value.(type) {
-					case time.Time:
-						sql = fmt.Sprintf("%v%v = '%v-%v-%v %v:%v:%v' AND ", sql, event.Columns[val.ColumnId].Name, v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second())
-					default:
-						var n interface{}
-						if event.Columns[val.ColumnId].Type[0:4] == "enum" {
-							t, _ := strconv.ParseInt(fmt.Sprintf("%v", val.Value), 10, 16)
-							n = event.Columns[idv].Enum[t-1]
-						} else {
-							n = val.Value
-						}
-						sql = fmt.Sprintf("%v%v = '%v' AND ", sql, event.Columns[val.ColumnId].Name, n)
-					}
-				}
+			sql += matchStatement(event, tg, idg) + "; "
+			if tg.hist != nil { // new version of row
+				sql = fmt.Sprintf("%vINSERT INTO %v (%v) VALUES %v%v; ", sql, tg.table,
+					insertColumns(tg, vgroup), insertValues(event.Columns, tg, vgroup, event),
+					upsertClause(event.Columns, tg, vgroup, upsert))
 			}
-			sql = sql[:len(sql)-5] + "; "
 		}
 
 	case structs.DELETE_EVENT:
-		//fmt.Println("delete event", event.OldValues)
-		for _, vgroup := range event.OldValues {
-			sql = fmt.Sprintf("%vDELETE FROM %v.%v WHERE ", sql, event.SchemaName, event.TableName)
-			enumidx := -1
-
-			for idv, val := range vgroup {
-				if val.Value != nil {
-					switch v := val.Value.(type) {
-					case time.Time:
-						sql = fmt.Sprintf("%v%v = '%v-%v-%v %v:%v:%v' AND", sql, event.Columns[val.ColumnId].Name, v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second())
-					default:
-						if idv == enumidx {
-							v, _ := strconv.ParseInt(fmt.Sprintf("%v", val.Value), 10, 16)
-							//fmt.Println(v)
-							sql = fmt.Sprintf("%v'%v' AND ", sql, event.Columns[enumidx].Enum[v-1])
-						} else {
-							sql = fmt.Sprintf("%v%v = '%v' AND ", sql, event.Columns[val.ColumnId].Name, val.Value)
-						}
-					}
-				}
-			}
-			sql = sql[:len(sql)-4] + "; "
+		for idg := range event.OldValues {
+			sql += matchStatement(event, tg, idg) + "; "
 		}
 
 	default:
@@ -139,3 +367,80 @@ func GenQuery(event *structs.Event) (string, error) {
 
 	return sql, nil
 }
+
+// statement changing destination row matched by row idg of UPDATE or DELETE
+// event. Current version of row is closed in history tables
+func matchStatement(event *structs.Event, tg *target, idg int) string {
+	where := whereClause(event.Columns, tg, event.OldValues[idg])
+	if tg.hist != nil {
+		return tg.hist.close(tg.table, event, where)
+	}
+	if event.EventType == structs.DELETE_EVENT {
+		if tg.soft != nil {
+			sets := extraSets(tg, event)
+			return fmt.Sprintf("UPDATE %v SET %v WHERE %v", tg.table, sets[:len(sets)-2], where)
+		}
+		return fmt.Sprintf("DELETE FROM %v WHERE %v", tg.table, where)
+	}
+
+	sql := fmt.Sprintf("UPDATE %v SET ", tg.table)
+	for _, val := range event.NewValues[idg] {
+		column := event.Columns[val.ColumnId]
+		if column.ExcludedFromReplication {
+			sql = fmt.Sprintf("%v%v = NULL, ", sql, tg.names[val.ColumnId])
+		} else {
+			sql = fmt.Sprintf("%v%v = %v, ", sql, tg.names[val.ColumnId], pgValue(column, tg.types[val.ColumnId], val.Value))
+		}
+	}
+	sql += extraSets(tg, event)
+	return fmt.Sprintf("%v WHERE %v", sql[:len(sql)-2], where)
+}
+
+// Generates single multi-row INSERT for rows of one table.
+// All rows must have the same RowSignature. In upsert mode rows must have
+// different keys since postgres cannot update the same row twice in one statement.
+// sources are events of rows, they give values of metadata columns
+func GenBulkInsert(schema string, table string, columns []*structs.Column, rows [][]*structs.QueryValues, sources []*structs.Event,
+	opts *Options) (string, error) {
+	if len(rows) == 0 {
+		return "", nil
+	}
+
+	sig := RowSignature(rows[0])
+	tg := opts.target(schema, table, columns)
+	sql := fmt.Sprintf("INSERT INTO %v (%v) VALUES ", tg.table, insertColumns(tg, rows[0]))
+	for idr, vgroup := range rows {
+		if RowSignature(vgroup) != sig {
+			return "", errors.New(fmt.Sprintf("Row %v of bulk insert into %v.%v has different set of columns", idr, schema, table))
+		}
+		if idr > 0 {
+			sql += ", "
+		}
+		var source *structs.Event
+		if idr < len(sources) {
+			source = sources[idr]
+		}
+		sql += insertValues(columns, tg, vgroup, source)
+	}
+
+	return sql + upsertClause(columns, tg, rows[0], opts.Upserts(schema, table)) + "; ", nil
+}
+
+// Generates statements of single-row UPDATE or DELETE event. counted changes
+// destination row and returns one row with the number of matched rows, rest
+// has other statements of the row (new version of row in history tables)
+func GenCountedQuery(event *structs.Event, opts *Options) (counted string, rest string, err error) {
+	if (event.EventType != structs.UPDATE_EVENT && event.EventType != structs.DELETE_EVENT) || len(event.OldValues) != 1 {
+		return "", "", errors.New(fmt.Sprintf("Counted query needs single-row update or delete event of %v.%v",
+			event.SchemaName, event.TableName))
+	}
+
+	tg := opts.target(event.SchemaName, event.TableName, event.Columns)
+	counted = fmt.Sprintf("WITH matched AS (%v RETURNING 1) SELECT count(*) FROM matched;", matchStatement(event, tg, 0))
+	if tg.hist != nil && event.EventType == structs.UPDATE_EVENT {
+		vgroup := event.NewValues[0]
+		rest = fmt.Sprintf("INSERT INTO %v (%v) VALUES %v%v; ", tg.table, insertColumns(tg, vgroup),
+			insertValues(event.Columns, tg, vgroup, event), upsertClause(event.Columns, tg, vgroup, true))
+	}
+	return counted, rest, nil
+}
@@ -0,0 +1,167 @@
+package pgfuncs
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func testColumns() []*structs.Column {
+	return []*structs.Column{
+		&structs.Column{Name: "id", Type: "int(11)", IsPKey: true, IsKey: true},
+		&structs.Column{Name: "name", Type: "varchar(20)"},
+		&structs.Column{Name: "state", Type: "enum('new','done')", Enum: []string{"new", "done"}},
+	}
+}
+
+func testRow(id interface{}, name interface{}, state interface{}) []*structs.QueryValues {
+	return []*structs.QueryValues{
+		&structs.QueryValues{ColumnId: 0, Value: id},
+		&structs.QueryValues{ColumnId: 1, Value: name},
+		&structs.QueryValues{ColumnId: 2, Value: state},
+	}
+}
+
+func TestGenInsertQuery(t *testing.T) {
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    testColumns(),
+		EventType:  structs.INSERT_EVENT,
+		OldValues:  [][]*structs.QueryValues{testRow(uint32(1), "O'Brien", byte(2))},
+	}
+
+	sql, err := GenQuery(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `INSERT INTO "db1"."tab1" ("id", "name", "state") VALUES ('1', 'O''Brien', 'done'); `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect insert query",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
+
+func TestGenBulkInsert(t *testing.T) {
+	rows := [][]*structs.QueryValues{
+		testRow(uint32(1), "a", byte(1)),
+		testRow(uint32(2), "b", byte(2)),
+	}
+
+	sql, err := GenBulkInsert("db1", "tab1", testColumns(), rows, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `INSERT INTO "db1"."tab1" ("id", "name", "state") VALUES ('1', 'a', 'new'), ('2', 'b', 'done'); `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect bulk insert query",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	rows = append(rows, testRow(uint32(3), "c", byte(1))[:2])
+	if _, err := GenBulkInsert("db1", "tab1", testColumns(), rows, nil, nil); err == nil {
+		t.Fatal("Expected error for rows with different set of columns")
+	}
+}
+
+func TestGenUpsertQuery(t *testing.T) {
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    testColumns(),
+		EventType:  structs.INSERT_EVENT,
+		OldValues:  [][]*structs.QueryValues{testRow(uint32(1), "a", nil)},
+	}
+
+	sql, err := GenQuery(event, &Options{Upsert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `INSERT INTO "db1"."tab1" ("id", "name", "state") VALUES ('1', 'a', NULL) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "state" = EXCLUDED."state"; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect upsert query",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
+
+func TestGenWhereClause(t *testing.T) {
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    testColumns(),
+		EventType:  structs.DELETE_EVENT,
+		OldValues:  [][]*structs.QueryValues{testRow(uint32(1), nil, byte(1))},
+	}
+
+	sql, err := GenQuery(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `DELETE FROM "db1"."tab1" WHERE "id" = '1'; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect key based delete query",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	// table without key is matched on full row
+	event.Columns[0].IsPKey = false
+	event.Columns[0].IsKey = false
+	event.Columns[1].ExcludedFromReplication = true
+
+	sql, err = GenQuery(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `DELETE FROM "db1"."tab1" WHERE "id" IS NOT DISTINCT FROM '1' AND "state" IS NOT DISTINCT FROM 'new'; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect full row delete query",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
+
+func TestGenNullValues(t *testing.T) {
+	columns := testColumns()
+	columns[1].ExcludedFromReplication = true
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    columns,
+		EventType:  structs.UPDATE_EVENT,
+		OldValues:  [][]*structs.QueryValues{testRow(uint32(1), "a", byte(1))},
+		NewValues:  [][]*structs.QueryValues{testRow(uint32(1), "b", nil)},
+	}
+
+	sql, err := GenQuery(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `UPDATE "db1"."tab1" SET "id" = '1', "name" = NULL, "state" = NULL WHERE "id" = '1'; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect update query",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
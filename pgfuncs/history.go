@@ -0,0 +1,119 @@
+// history (slowly changing dimension type 2) destination tables
+
+package pgfuncs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// columns of versions of rows
+type historyColumns struct {
+	validFrom string // start of version, part of primary key
+	validTo   string // end of version, NULL for current version
+	current   string // true for current version
+}
+
+// History lists tables which keep all versions of rows instead of mirroring
+// mysql. Version is identified by primary key and valid from time, which is
+// time of mysql event. Update closes current version and inserts new one,
+// delete closes current version. Time has precision of seconds as binlog,
+// later changes of row in the same second replace version of that second.
+// Unique keys of history tables are created as non unique indexes
+type History struct {
+	tables map[string]*historyColumns // key is mysql schema.table
+}
+
+func NewHistory() *History {
+	return &History{tables: make(map[string]*historyColumns)}
+}
+
+// Adds tables given as schema.table with names of version columns
+func (h *History) AddTables(tables []string, validFrom string, validTo string, current string) error {
+	if len(validFrom) == 0 || len(validTo) == 0 || len(current) == 0 {
+		return errors.New("History requires names of valid from, valid to and current columns")
+	}
+	for _, t := range tables {
+		st := strings.Split(strings.TrimSpace(t), ".")
+		if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+			return errors.New(fmt.Sprintf("History table should be schemaname.tablename. Got %v", t))
+		}
+		h.tables[st[0]+"."+st[1]] = &historyColumns{validFrom: validFrom, validTo: validTo, current: current}
+	}
+	return nil
+}
+
+// columns of mysql table, nil if table is mirrored
+func (h *History) columns(schema string, table string) *historyColumns {
+	if h == nil {
+		return nil
+	}
+	return h.tables[schema+"."+table]
+}
+
+// column definitions of CREATE TABLE
+func (c *historyColumns) columnDefs() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{
+		pgIdent(c.validFrom) + " timestamp with time zone NOT NULL",
+		pgIdent(c.validTo) + " timestamp with time zone",
+		pgIdent(c.current) + " boolean NOT NULL DEFAULT true",
+	}
+}
+
+// ADD COLUMN actions of ALTER TABLE for tables created before history was
+// enabled. Existing rows become current versions valid since -infinity
+func (c *historyColumns) addColumns() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{
+		"ADD COLUMN IF NOT EXISTS " + pgIdent(c.validFrom) + " timestamp with time zone NOT NULL DEFAULT '-infinity'",
+		"ADD COLUMN IF NOT EXISTS " + pgIdent(c.validTo) + " timestamp with time zone",
+		"ADD COLUMN IF NOT EXISTS " + pgIdent(c.current) + " boolean NOT NULL DEFAULT true",
+	}
+}
+
+// statement making primary key of existing history table the key columns
+// and validFrom, as versions of row share the key. Table keeping other
+// unique indexes is rejected, versions of rows would violate them
+func (c *historyColumns) provisionKey(table string, pkey string, columns string) string {
+	reg := fmt.Sprintf("to_regclass(%v)", pgQuote(table))
+	return fmt.Sprintf("DO $pkey$DECLARE c name; BEGIN "+
+		"SELECT relname INTO c FROM pg_index JOIN pg_class ON pg_class.oid = indexrelid "+
+		"WHERE indrelid = %v AND indisunique AND NOT indisprimary LIMIT 1; "+
+		"IF c IS NOT NULL THEN RAISE EXCEPTION 'History table %% has unique index %%', %v, c; END IF; "+
+		"IF %v IS NULL OR EXISTS (SELECT 1 FROM pg_index JOIN pg_attribute ON attrelid = indrelid AND attnum = ANY(indkey) "+
+		"WHERE indrelid = %v AND indisprimary AND attname = %v) THEN RETURN; END IF; "+
+		"SELECT conname INTO c FROM pg_constraint WHERE conrelid = %v AND contype = 'p'; "+
+		"IF c IS NOT NULL THEN EXECUTE format('ALTER TABLE %%s DROP CONSTRAINT %%I', %v, c); END IF; "+
+		"ALTER TABLE %v ADD CONSTRAINT %v PRIMARY KEY (%v, %v); END$pkey$",
+		reg, pgQuote(table), reg, reg, pgQuote(c.validFrom), reg, pgQuote(table), table, pgIdent(pkey), columns, pgIdent(c.validFrom))
+}
+
+// names and values of columns of inserted version
+func (c *historyColumns) values(event *structs.Event) ([]string, []string) {
+	if c == nil {
+		return nil, nil
+	}
+	return []string{c.validFrom, c.validTo, c.current}, []string{eventTime(event), "NULL", "true"}
+}
+
+// statement closing current version of row matched by where
+func (c *historyColumns) close(table string, event *structs.Event, where string) string {
+	return fmt.Sprintf("UPDATE %v SET %v = %v, %v = false WHERE %v AND %v", table, pgIdent(c.validTo), eventTime(event),
+		pgIdent(c.current), where, pgIdent(c.current))
+}
+
+// time of mysql event, time of write if event has no time
+func eventTime(event *structs.Event) string {
+	if event == nil || event.Timestamp == 0 {
+		return "now()"
+	}
+	return fmt.Sprintf("to_timestamp(%v)", event.Timestamp)
+}
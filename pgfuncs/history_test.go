@@ -0,0 +1,107 @@
+package pgfuncs
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestHistoryQueries(t *testing.T) {
+	hist := NewHistory()
+	if err := hist.AddTables([]string{"db1.tab1"}, "valid_from", "valid_to", "is_current"); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{History: hist}
+
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    testColumns(),
+		EventType:  structs.UPDATE_EVENT,
+		OldValues:  [][]*structs.QueryValues{testRow(uint32(1), "a", byte(1))},
+		NewValues:  [][]*structs.QueryValues{testRow(uint32(1), "b", byte(1))},
+		Timestamp:  1600000000,
+	}
+
+	sql, err := GenQuery(event, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `UPDATE "db1"."tab1" SET "valid_to" = to_timestamp(1600000000), "is_current" = false WHERE "id" = '1' AND "is_current"; ` +
+		`INSERT INTO "db1"."tab1" ("id", "name", "state", "valid_from", "valid_to", "is_current") ` +
+		`VALUES ('1', 'b', 'new', to_timestamp(1600000000), NULL, true) ON CONFLICT ("id", "valid_from") DO UPDATE SET ` +
+		`"name" = EXCLUDED."name", "state" = EXCLUDED."state", ` +
+		`"valid_to" = EXCLUDED."valid_to", "is_current" = EXCLUDED."is_current"; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect history update",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	event.EventType = structs.DELETE_EVENT
+	sql, err = GenQuery(event, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `UPDATE "db1"."tab1" SET "valid_to" = to_timestamp(1600000000), "is_current" = false WHERE "id" = '1' AND "is_current"; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect history delete",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	sql, err = ConvertMysql57ToPostgres("CREATE TABLE `db1`.`tab1` (`id` int(11) NOT NULL, `code` char(3), "+
+		"PRIMARY KEY (`id`), UNIQUE KEY `uk_code` (`code`))", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `CREATE TABLE "db1"."tab1" ("id" bigint NOT NULL, "code" char(3), "valid_from" timestamp with time zone NOT NULL, ` +
+		`"valid_to" timestamp with time zone, "is_current" boolean NOT NULL DEFAULT true, ` +
+		`CONSTRAINT "tab1_pkey" PRIMARY KEY ("id", "valid_from")); CREATE INDEX "tab1_uk_code" ON "db1"."tab1" ("code");`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect create of history table",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	sql, err = ConvertMysql57ToPostgres("ALTER TABLE `db1`.`tab1` ADD COLUMN `note` text", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `ALTER TABLE "db1"."tab1" ADD COLUMN IF NOT EXISTS "valid_from" timestamp with time zone NOT NULL DEFAULT '-infinity', ` +
+		`ADD COLUMN IF NOT EXISTS "valid_to" timestamp with time zone, ADD COLUMN IF NOT EXISTS "is_current" boolean NOT NULL DEFAULT true, ` +
+		`ADD COLUMN "note" text;`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect alter of history table",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	// table created before history was enabled gets columns and key of versions
+	sql = ProvisionTable("db1", "tab1", testColumns(), opts)
+	expected = `ALTER TABLE IF EXISTS "db1"."tab1" ADD COLUMN IF NOT EXISTS "valid_from" timestamp with time zone NOT NULL DEFAULT '-infinity', ` +
+		`ADD COLUMN IF NOT EXISTS "valid_to" timestamp with time zone, ADD COLUMN IF NOT EXISTS "is_current" boolean NOT NULL DEFAULT true; ` +
+		`DO $pkey$DECLARE c name; BEGIN SELECT relname INTO c FROM pg_index JOIN pg_class ON pg_class.oid = indexrelid ` +
+		`WHERE indrelid = to_regclass('"db1"."tab1"') AND indisunique AND NOT indisprimary LIMIT 1; ` +
+		`IF c IS NOT NULL THEN RAISE EXCEPTION 'History table % has unique index %', '"db1"."tab1"', c; END IF; ` +
+		`IF to_regclass('"db1"."tab1"') IS NULL OR EXISTS (SELECT 1 FROM pg_index JOIN pg_attribute ON attrelid = indrelid AND attnum = ANY(indkey) ` +
+		`WHERE indrelid = to_regclass('"db1"."tab1"') AND indisprimary AND attname = 'valid_from') THEN RETURN; END IF; ` +
+		`SELECT conname INTO c FROM pg_constraint WHERE conrelid = to_regclass('"db1"."tab1"') AND contype = 'p'; ` +
+		`IF c IS NOT NULL THEN EXECUTE format('ALTER TABLE %s DROP CONSTRAINT %I', '"db1"."tab1"', c); END IF; ` +
+		`ALTER TABLE "db1"."tab1" ADD CONSTRAINT "tab1_pkey" PRIMARY KEY ("id", "valid_from"); END$pkey$;`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect provision of existing history table",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
@@ -0,0 +1,112 @@
+// replication metadata columns of destination tables
+
+package pgfuncs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// metadata columns and their postgres types
+var metadataTypes = map[string]string{
+	"_source_file":     "text",                     // binlog file of the event
+	"_source_position": "bigint",                   // binlog position of the event
+	"_source_ts":       "timestamp with time zone", // time of the event in mysql
+	"_op":              "char(1)",                  // I for inserts, U for updates, D for soft deletes
+	"_replicated_at":   "timestamp with time zone", // time of the write to postgres
+}
+
+// ordered names of all metadata columns
+var metadataNames = []string{"_source_file", "_source_position", "_source_ts", "_op", "_replicated_at"}
+
+// Metadata lists replication metadata columns added to every destination
+// table. Columns are created with tables, added to existing tables by
+// ProvisionTable and are filled on every INSERT and UPDATE
+type Metadata struct {
+	columns []string
+}
+
+// Creates metadata of given columns, empty list gives all columns
+func NewMetadata(columns []string) (*Metadata, error) {
+	if len(columns) == 0 {
+		return &Metadata{columns: metadataNames}, nil
+	}
+
+	m := &Metadata{}
+	for _, c := range columns {
+		c = strings.TrimSpace(c)
+		if _, ok := metadataTypes[c]; !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown metadata column %v. Metadata columns are %v", c, strings.Join(metadataNames, ", ")))
+		}
+		m.columns = append(m.columns, c)
+	}
+	return m, nil
+}
+
+// names of metadata columns. Nil metadata has no columns
+func (m *Metadata) Columns() []string {
+	if m == nil {
+		return nil
+	}
+	return m.columns
+}
+
+// column definitions of CREATE TABLE
+func (m *Metadata) columnDefs() []string {
+	defs := make([]string, 0)
+	for _, c := range m.Columns() {
+		defs = append(defs, pgIdent(c)+" "+metadataTypes[c])
+	}
+	return defs
+}
+
+// ADD COLUMN actions of ALTER TABLE for tables created before metadata was
+// enabled. Metadata of existing rows is NULL
+func (m *Metadata) addColumns() []string {
+	actions := make([]string, 0)
+	for _, def := range m.columnDefs() {
+		actions = append(actions, "ADD COLUMN IF NOT EXISTS "+def)
+	}
+	return actions
+}
+
+// values of metadata columns for row of event, indexed as Columns
+func (m *Metadata) values(event *structs.Event) []string {
+	values := make([]string, 0)
+	if event == nil { // source unknown
+		event = &structs.Event{EventType: structs.INSERT_EVENT}
+	}
+	for _, c := range m.Columns() {
+		var v string
+		switch c {
+		case "_source_file":
+			v = pgQuote(event.File)
+			if len(event.File) == 0 {
+				v = "NULL"
+			}
+		case "_source_position":
+			v = fmt.Sprintf("%v", event.EventPosition)
+		case "_source_ts":
+			v = fmt.Sprintf("to_timestamp(%v)", event.Timestamp)
+			if event.Timestamp == 0 {
+				v = "NULL"
+			}
+		case "_op":
+			switch event.EventType {
+			case structs.UPDATE_EVENT:
+				v = "'U'"
+			case structs.DELETE_EVENT: // soft delete
+				v = "'D'"
+			default:
+				v = "'I'"
+			}
+		case "_replicated_at":
+			v = "now()"
+		}
+		values = append(values, v)
+	}
+	return values
+}
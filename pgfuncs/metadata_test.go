@@ -0,0 +1,91 @@
+package pgfuncs
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestMetadataQueries(t *testing.T) {
+	meta, err := NewMetadata(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Metadata: meta}
+
+	event := &structs.Event{
+		SchemaName:    "db1",
+		TableName:     "tab1",
+		Columns:       testColumns(),
+		EventType:     structs.UPDATE_EVENT,
+		OldValues:     [][]*structs.QueryValues{testRow(uint32(1), "a", byte(1))},
+		NewValues:     [][]*structs.QueryValues{testRow(uint32(1), "b", byte(1))},
+		File:          "mysql-bin.000003",
+		EventPosition: 154,
+		Timestamp:     1600000000,
+	}
+
+	sql, err := GenQuery(event, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `UPDATE "db1"."tab1" SET "id" = '1', "name" = 'b', "state" = 'new', "_source_file" = 'mysql-bin.000003', ` +
+		`"_source_position" = 154, "_source_ts" = to_timestamp(1600000000), "_op" = 'U', "_replicated_at" = now() WHERE "id" = '1'; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect update with metadata",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	event.EventType = structs.INSERT_EVENT
+	sql, err = GenBulkInsert("db1", "tab1", event.Columns, event.OldValues, []*structs.Event{event}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `INSERT INTO "db1"."tab1" ("id", "name", "state", "_source_file", "_source_position", "_source_ts", "_op", "_replicated_at") ` +
+		`VALUES ('1', 'a', 'new', 'mysql-bin.000003', 154, to_timestamp(1600000000), 'I', now()); `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect insert with metadata",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	meta, err = NewMetadata([]string{"_op"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, err = ConvertMysql57ToPostgres("CREATE TABLE `db1`.`tab1` (`id` int(11) NOT NULL, PRIMARY KEY (`id`))", &Options{Metadata: meta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `CREATE TABLE "db1"."tab1" ("id" bigint NOT NULL, "_op" char(1), CONSTRAINT "tab1_pkey" PRIMARY KEY ("id"));`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect create table with metadata",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	// table created before metadata was enabled
+	sql = ProvisionTable("db1", "tab1", testColumns(), &Options{Metadata: meta})
+	expected = `ALTER TABLE IF EXISTS "db1"."tab1" ADD COLUMN IF NOT EXISTS "_op" char(1);`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect provision of existing table",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+	if sql = ProvisionTable("db1", "tab1", testColumns(), &Options{}); sql != "" {
+		t.Fatal("Incorrect provision without metadata", "expected", "", "got", sql)
+	}
+
+	if _, err := NewMetadata([]string{"_source_host"}); err == nil {
+		t.Fatal("Expected error for unknown metadata column")
+	}
+}
@@ -0,0 +1,1385 @@
+// parser of mysql DDL statements
+
+package pgfuncs
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokQuotedIdent // `name`
+	tokString      // 'text' or "text"
+	tokNumber
+	tokVariable // @name or @@name
+	tokPunct
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int // offset in the script
+}
+
+// keyword check, case insensitive. Quoted identifiers are never keywords
+func (t token) is(words ...string) bool {
+	if t.kind != tokIdent {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t token) isPunct(p string) bool {
+	return t.kind == tokPunct && t.text == p
+}
+
+// splits mysql script into tokens. Comments are skipped, content of
+// executable comments /*!50001 ... */ is treated as regular text
+func tokenize(script string) ([]token, error) {
+	tokens := make([]token, 0)
+	i := 0
+	n := len(script)
+	for i < n {
+		c := script[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || (c == '-' && i+2 < n && script[i+1] == '-' && (script[i+2] == ' ' || script[i+2] == '\t')) ||
+			(c == '-' && i+2 == n && script[i+1] == '-'):
+			for i < n && script[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < n && script[i+1] == '*':
+			if i+2 < n && script[i+2] == '!' { // executable comment, skip version and keep content
+				i += 3
+				for i < n && script[i] >= '0' && script[i] <= '9' {
+					i++
+				}
+				continue
+			}
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("Unterminated comment at position %v", i))
+			}
+			i += end + 4
+		case c == '*' && i+1 < n && script[i+1] == '/': // end of executable comment
+			i += 2
+		case c == '`':
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= n {
+					return nil, errors.New(fmt.Sprintf("Unterminated quoted identifier at position %v", i))
+				}
+				if script[j] == '`' {
+					if j+1 < n && script[j+1] == '`' {
+						sb.WriteByte('`')
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(script[j])
+				j++
+			}
+			tokens = append(tokens, token{kind: tokQuotedIdent, text: sb.String(), pos: i})
+			i = j + 1
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= n {
+					return nil, errors.New(fmt.Sprintf("Unterminated string at position %v", i))
+				}
+				if script[j] == '\\' && j+1 < n {
+					switch script[j+1] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					case 'r':
+						sb.WriteByte('\r')
+					case '0':
+						sb.WriteByte(0)
+					default:
+						sb.WriteByte(script[j+1])
+					}
+					j += 2
+					continue
+				}
+				if script[j] == c {
+					if j+1 < n && script[j+1] == c {
+						sb.WriteByte(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(script[j])
+				j++
+			}
+			tokens = append(tokens, token{kind: tokString, text: sb.String(), pos: i})
+			i = j + 1
+		case c >= '0' && c <= '9' || (c == '.' && i+1 < n && script[i+1] >= '0' && script[i+1] <= '9'):
+			j := i
+			for j < n && (script[j] >= '0' && script[j] <= '9' || script[j] == '.' ||
+				((script[j] == 'e' || script[j] == 'E') && j+1 < n && (script[j+1] >= '0' && script[j+1] <= '9' || script[j+1] == '-' || script[j+1] == '+'))) {
+				if script[j] == 'e' || script[j] == 'E' {
+					j++
+				}
+				j++
+			}
+			if j < n && isIdentChar(script[j]) { // identifiers may start with digits
+				for j < n && isIdentChar(script[j]) {
+					j++
+				}
+				tokens = append(tokens, token{kind: tokIdent, text: script[i:j], pos: i})
+			} else {
+				tokens = append(tokens, token{kind: tokNumber, text: script[i:j], pos: i})
+			}
+			i = j
+		case c == '@':
+			j := i + 1
+			for j < n && (isIdentChar(script[j]) || script[j] == '@' || script[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokVariable, text: script[i:j], pos: i})
+			i = j
+		case isIdentChar(c):
+			j := i
+			for j < n && isIdentChar(script[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: script[i:j], pos: i})
+			i = j
+		default:
+			if i+1 < n {
+				two := script[i : i+2]
+				switch two {
+				case "<=", ">=", "<>", "!=", "||", "&&", ":=", "<<", ">>":
+					if two == "<=" && i+2 < n && script[i+2] == '>' {
+						tokens = append(tokens, token{kind: tokPunct, text: "<=>", pos: i})
+						i += 3
+						continue
+					}
+					tokens = append(tokens, token{kind: tokPunct, text: two, pos: i})
+					i += 2
+					continue
+				}
+			}
+			tokens = append(tokens, token{kind: tokPunct, text: string(c), pos: i})
+			i++
+		}
+	}
+	tokens = append(tokens, token{kind: tokEOF, pos: n})
+	return tokens, nil
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c >= 0x80
+}
+
+type (
+	// table name, schema is empty if not qualified
+	TableName struct {
+		Schema string
+		Name   string
+	}
+
+	// mysql column type
+	DataType struct {
+		Name     string   // lower case type name, e.g. int, varchar, enum
+		Args     []string // length, precision and scale
+		Values   []string // values of enum and set
+		Unsigned bool
+	}
+
+	ColumnDef struct {
+		Name          string
+		Type          *DataType
+		NotNull       bool
+		Null          bool // explicit NULL
+		Default       *string
+		AutoIncrement bool
+		PrimaryKey    bool
+		Unique        bool
+	}
+
+	IndexColumn struct {
+		Name   string
+		Length int // prefix length, 0 if whole column
+	}
+
+	IndexDef struct {
+		Name    string
+		Primary bool
+		Unique  bool
+		Columns []IndexColumn
+	}
+
+	CreateTableStmt struct {
+		Table       TableName
+		IfNotExists bool
+		Like        *TableName
+		Columns     []*ColumnDef
+		PrimaryKey  *IndexDef
+		Indexes     []*IndexDef
+	}
+
+	// one action of ALTER TABLE
+	AlterSpec struct {
+		Action     string // ADD COLUMN, DROP COLUMN, MODIFY, CHANGE, SET DEFAULT, DROP DEFAULT, ADD INDEX, DROP INDEX, ADD PRIMARY KEY, DROP PRIMARY KEY, RENAME, RENAME COLUMN
+		Column     *ColumnDef
+		OldName    string // CHANGE, RENAME COLUMN, DROP COLUMN, DROP INDEX, SET/DROP DEFAULT
+		Index      *IndexDef
+		NewTable   *TableName // RENAME
+		DefaultVal string     // SET DEFAULT
+	}
+
+	AlterTableStmt struct {
+		Table TableName
+		Specs []*AlterSpec
+	}
+
+	DropTableStmt struct {
+		Tables   []TableName
+		IfExists bool
+	}
+
+	RenameTableStmt struct {
+		From []TableName
+		To   []TableName
+	}
+
+	TruncateTableStmt struct {
+		Table TableName
+	}
+
+	CreateIndexStmt struct {
+		Table TableName
+		Index *IndexDef
+	}
+
+	DropIndexStmt struct {
+		Table TableName
+		Name  string
+	}
+
+	CreateViewStmt struct {
+		View    TableName
+		Columns []string
+		Select  []token // body of the view
+	}
+
+	DropViewStmt struct {
+		Views    []TableName
+		IfExists bool
+	}
+
+	CreateSchemaStmt struct {
+		Name        string
+		IfNotExists bool
+	}
+
+	DropSchemaStmt struct {
+		Name     string
+		IfExists bool
+	}
+
+	// SET SEARCH_PATH TO "schema" added to queries by binlog reader
+	SearchPathStmt struct {
+		Schema string
+	}
+
+	// BEGIN, COMMIT, ROLLBACK
+	TransactionStmt struct {
+		Command string
+	}
+
+	// statements which are not replicated (grants, users, routines, maintenance,
+	// data changes logged as statements)
+	IgnoredStmt struct {
+		Text   string
+		Reason string
+	}
+)
+
+type ddlParser struct {
+	script string
+	tokens []token
+	pos    int
+}
+
+// Parses mysql script into list of statements.
+// Supported are CREATE/ALTER/DROP/RENAME/TRUNCATE TABLE, CREATE/DROP INDEX,
+// CREATE/DROP VIEW, CREATE/DROP DATABASE, transaction control and
+// SET SEARCH_PATH. Statements which are meaningless for replica and
+// statements which are not DDL are returned as IgnoredStmt. DDL which
+// cannot be parsed is an error
+func ParseMysqlDDL(script string) ([]interface{}, error) {
+	tokens, err := tokenize(script)
+	if err != nil {
+		return nil, err
+	}
+	p := &ddlParser{script: script, tokens: tokens}
+
+	stmts := make([]interface{}, 0)
+	for {
+		for p.peek().isPunct(";") {
+			p.next()
+		}
+		if p.peek().kind == tokEOF {
+			break
+		}
+		start := p.pos
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek().isPunct(";") && p.peek().kind != tokEOF {
+			return nil, p.errorf("unexpected %v after %v statement", p.describe(p.peek()), p.tokens[start].text)
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts, nil
+}
+
+func (p *ddlParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *ddlParser) peekAt(offset int) token {
+	if p.pos+offset >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+offset]
+}
+
+func (p *ddlParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// consumes keyword sequence if it is next
+func (p *ddlParser) accept(words ...string) bool {
+	for i, w := range words {
+		if !p.peekAt(i).is(w) {
+			return false
+		}
+	}
+	p.pos += len(words)
+	return true
+}
+
+func (p *ddlParser) acceptPunct(s string) bool {
+	if p.peek().isPunct(s) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *ddlParser) expect(words ...string) error {
+	for _, w := range words {
+		if !p.peek().is(w) {
+			return p.errorf("expected %v, got %v", strings.ToUpper(w), p.describe(p.peek()))
+		}
+		p.next()
+	}
+	return nil
+}
+
+func (p *ddlParser) expectPunct(s string) error {
+	if !p.acceptPunct(s) {
+		return p.errorf("expected '%v', got %v", s, p.describe(p.peek()))
+	}
+	return nil
+}
+
+func (p *ddlParser) describe(t token) string {
+	if t.kind == tokEOF {
+		return "end of statement"
+	}
+	return fmt.Sprintf("'%v'", t.text)
+}
+
+func (p *ddlParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.script[:p.peek().pos], "\n") + 1
+	return errors.New(fmt.Sprintf("Cannot parse mysql statement at line %v: %v", line, fmt.Sprintf(format, args...)))
+}
+
+// skips tokens up to the end of the statement
+func (p *ddlParser) skipStatement() string {
+	start := p.peek().pos
+	for !p.peek().isPunct(";") && p.peek().kind != tokEOF {
+		p.next()
+	}
+	return strings.TrimSpace(p.script[start:p.peek().pos])
+}
+
+// skips tokens up to the end of the script. Bodies of routines and
+// triggers have statements separated by ; which are not run by the script
+func (p *ddlParser) skipScript() string {
+	start := p.peek().pos
+	for p.peek().kind != tokEOF {
+		p.next()
+	}
+	return strings.TrimSpace(p.script[start:])
+}
+
+func (p *ddlParser) ident() (string, error) {
+	t := p.peek()
+	if t.kind == tokIdent || t.kind == tokQuotedIdent {
+		p.next()
+		return t.text, nil
+	}
+	return "", p.errorf("expected name, got %v", p.describe(t))
+}
+
+func (p *ddlParser) tableName() (TableName, error) {
+	name, err := p.ident()
+	if err != nil {
+		return TableName{}, err
+	}
+	if p.acceptPunct(".") {
+		table, err := p.ident()
+		if err != nil {
+			return TableName{}, err
+		}
+		return TableName{Schema: name, Name: table}, nil
+	}
+	return TableName{Name: name}, nil
+}
+
+func (p *ddlParser) tableNames() ([]TableName, error) {
+	names := make([]TableName, 0)
+	for {
+		t, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, t)
+		if !p.acceptPunct(",") {
+			return names, nil
+		}
+	}
+}
+
+func (p *ddlParser) parseStatement() (interface{}, error) {
+	t := p.peek()
+	switch {
+	case t.is("BEGIN", "COMMIT", "ROLLBACK"):
+		p.next()
+		p.accept("WORK")
+		return &TransactionStmt{Command: strings.ToUpper(t.text)}, nil
+	case t.is("START") && p.peekAt(1).is("TRANSACTION"):
+		p.pos += 2
+		return &TransactionStmt{Command: "BEGIN"}, nil
+	case t.is("SET") && p.peekAt(1).is("SEARCH_PATH"):
+		p.pos += 2
+		if !p.accept("TO") && !p.acceptPunct("=") {
+			return nil, p.errorf("expected TO after SET SEARCH_PATH")
+		}
+		tk := p.next()
+		return &SearchPathStmt{Schema: tk.text}, nil
+	case t.is("CREATE"):
+		return p.parseCreate()
+	case t.is("ALTER"):
+		return p.parseAlter()
+	case t.is("DROP"):
+		return p.parseDrop()
+	case t.is("RENAME"):
+		return p.parseRename()
+	case t.is("TRUNCATE"):
+		p.next()
+		p.accept("TABLE")
+		table, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		return &TruncateTableStmt{Table: table}, nil
+	case t.is("GRANT", "REVOKE", "FLUSH", "ANALYZE", "OPTIMIZE", "REPAIR", "CHECK", "CHECKSUM", "SET", "USE",
+		"INSTALL", "UNINSTALL", "RESET", "PURGE", "SAVEPOINT", "RELEASE", "XA", "LOCK", "UNLOCK", "DO"):
+		return &IgnoredStmt{Text: p.skipStatement(), Reason: "no meaning for replica"}, nil
+	}
+	// rows changed by INSERT, UPDATE, DELETE etc. logged as statements are not
+	// in row events, so replica misses them
+	return &IgnoredStmt{Text: p.skipStatement(), Reason: "not DDL, use binlog_format = ROW to replicate data changes"}, nil
+}
+
+func (p *ddlParser) parseCreate() (interface{}, error) {
+	start := p.next().pos // CREATE
+	p.accept("OR", "REPLACE")
+
+	if p.peek().is("TEMPORARY") {
+		return &IgnoredStmt{Text: p.skipStatement(), Reason: "temporary tables are not replicated"}, nil
+	}
+
+	// view options before VIEW keyword
+	for {
+		if p.accept("ALGORITHM") || p.accept("SQL", "SECURITY") {
+			p.acceptPunct("=")
+			p.next()
+			continue
+		}
+		if p.accept("DEFINER") {
+			p.acceptPunct("=")
+			p.next() // user
+			if t := p.peek(); t.kind == tokVariable {
+				p.next() // @host
+				if t.text == "@" {
+					p.next() // quoted host of 'user'@'host'
+				}
+			}
+			if p.acceptPunct("(") { // CURRENT_USER()
+				p.expectPunct(")")
+			}
+			continue
+		}
+		break
+	}
+
+	t := p.peek()
+	switch {
+	case t.is("TABLE"):
+		return p.parseCreateTable()
+	case t.is("UNIQUE", "INDEX"):
+		return p.parseCreateIndex()
+	case t.is("FULLTEXT", "SPATIAL"):
+		return nil, p.errorf("%v indexes are not supported by postgres replica", strings.ToUpper(t.text))
+	case t.is("VIEW"):
+		return p.parseCreateView()
+	case t.is("DATABASE", "SCHEMA"):
+		p.next()
+		s := &CreateSchemaStmt{IfNotExists: p.accept("IF", "NOT", "EXISTS")}
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		s.Name = name
+		p.skipStatement() // character set and collation
+		return s, nil
+	case t.is("FUNCTION", "PROCEDURE", "TRIGGER", "EVENT", "AGGREGATE"):
+		p.skipScript()
+		return &IgnoredStmt{Text: strings.TrimSpace(p.script[start:]), Reason: "routines and triggers are not replicated"}, nil
+	case t.is("USER", "ROLE", "SERVER", "TABLESPACE", "LOGFILE"):
+		return &IgnoredStmt{Text: p.skipStatement(), Reason: "no meaning for replica"}, nil
+	}
+	return nil, p.errorf("unsupported CREATE %v", p.describe(t))
+}
+
+func (p *ddlParser) parseCreateTable() (interface{}, error) {
+	p.next() // TABLE
+	s := &CreateTableStmt{IfNotExists: p.accept("IF", "NOT", "EXISTS")}
+	table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	s.Table = table
+
+	if p.accept("LIKE") {
+		like, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		s.Like = &like
+		return s, nil
+	}
+	if p.peek().isPunct("(") && p.peekAt(1).is("LIKE") {
+		p.next()
+		p.next()
+		like, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		s.Like = &like
+		return s, p.expectPunct(")")
+	}
+
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.parseTableElement(s); err != nil {
+			return nil, err
+		}
+		if p.acceptPunct(")") {
+			break
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.parseTableOptions(); err != nil {
+		return nil, err
+	}
+	if p.peek().is("AS", "SELECT", "IGNORE", "REPLACE") {
+		return nil, p.errorf("CREATE TABLE ... SELECT is not supported")
+	}
+	return s, nil
+}
+
+// column, index or constraint definition in CREATE TABLE
+func (p *ddlParser) parseTableElement(s *CreateTableStmt) error {
+	p.constraintName()
+
+	t := p.peek()
+	switch {
+	case t.is("PRIMARY", "UNIQUE", "INDEX", "KEY"):
+		idx, err := p.parseIndexDef()
+		if err != nil {
+			return err
+		}
+		if idx.Primary {
+			s.PrimaryKey = idx
+		} else {
+			s.Indexes = append(s.Indexes, idx)
+		}
+		return nil
+	case t.is("FULLTEXT", "SPATIAL"):
+		return p.errorf("%v indexes are not supported by postgres replica", strings.ToUpper(t.text))
+	case t.is("FOREIGN"), t.is("CHECK"):
+		// foreign keys and checks are not replicated, mysql enforces them on source
+		return p.skipParenthesized()
+	}
+
+	col, err := p.parseColumnDef()
+	if err != nil {
+		return err
+	}
+	s.Columns = append(s.Columns, col)
+	return nil
+}
+
+// skips CONSTRAINT [name], constraint names are not kept in replica
+func (p *ddlParser) constraintName() {
+	if p.accept("CONSTRAINT") && !p.peek().is("PRIMARY", "UNIQUE", "FOREIGN", "CHECK") {
+		p.next()
+	}
+}
+
+// skips up to the next comma or closing parenthesis on the current level
+func (p *ddlParser) skipParenthesized() error {
+	depth := 0
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokEOF || t.isPunct(";"):
+			return p.errorf("unexpected end of statement")
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		case t.isPunct(","):
+			if depth == 0 {
+				return nil
+			}
+		}
+		p.next()
+	}
+}
+
+// PRIMARY KEY [name] (cols), UNIQUE [KEY|INDEX] [name] (cols), KEY|INDEX [name] (cols)
+func (p *ddlParser) parseIndexDef() (*IndexDef, error) {
+	idx := new(IndexDef)
+	switch {
+	case p.accept("PRIMARY", "KEY"):
+		idx.Primary = true
+	case p.accept("UNIQUE"):
+		idx.Unique = true
+		if !p.accept("KEY") {
+			p.accept("INDEX")
+		}
+	case p.accept("KEY"), p.accept("INDEX"):
+	default:
+		return nil, p.errorf("expected index definition, got %v", p.describe(p.peek()))
+	}
+
+	if !p.peek().isPunct("(") && !p.peek().is("USING") {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		idx.Name = name
+	}
+	if p.accept("USING") {
+		p.next() // BTREE or HASH
+	}
+	cols, err := p.indexColumns()
+	if err != nil {
+		return nil, err
+	}
+	idx.Columns = cols
+
+	// index options
+	for {
+		switch {
+		case p.accept("USING"), p.accept("KEY_BLOCK_SIZE"), p.accept("WITH", "PARSER"):
+			p.acceptPunct("=")
+			p.next()
+		case p.accept("COMMENT"):
+			p.next()
+		case p.accept("VISIBLE"), p.accept("INVISIBLE"):
+		default:
+			return idx, nil
+		}
+	}
+}
+
+func (p *ddlParser) indexColumns() ([]IndexColumn, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	cols := make([]IndexColumn, 0)
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		col := IndexColumn{Name: name}
+		if p.acceptPunct("(") {
+			length, err := strconv.Atoi(p.next().text)
+			if err != nil {
+				return nil, p.errorf("expected index prefix length")
+			}
+			col.Length = length
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+		}
+		p.accept("ASC")
+		p.accept("DESC")
+		cols = append(cols, col)
+		if p.acceptPunct(")") {
+			return cols, nil
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *ddlParser) parseDataType() (*DataType, error) {
+	t := p.peek()
+	if t.kind != tokIdent {
+		return nil, p.errorf("expected column type, got %v", p.describe(t))
+	}
+	p.next()
+	dt := &DataType{Name: strings.ToLower(t.text)}
+
+	switch dt.Name {
+	case "double":
+		p.accept("PRECISION")
+	case "character", "char", "national":
+		if dt.Name == "national" {
+			dt.Name = strings.ToLower(p.next().text)
+		}
+		if p.accept("VARYING") {
+			dt.Name = "varchar"
+		}
+		if dt.Name == "character" {
+			dt.Name = "char"
+		}
+	case "long":
+		if p.accept("VARCHAR") || p.accept("VARBINARY") {
+			dt.Name = "mediumtext"
+		}
+	case "integer":
+		dt.Name = "int"
+	case "dec", "numeric", "fixed":
+		dt.Name = "decimal"
+	case "real":
+		dt.Name = "double"
+	case "bool", "boolean": // the same as mysql shows in column types
+		dt.Name = "tinyint"
+		dt.Args = []string{"1"}
+	}
+
+	if p.acceptPunct("(") {
+		for {
+			tk := p.next()
+			switch tk.kind {
+			case tokNumber:
+				dt.Args = append(dt.Args, tk.text)
+			case tokString:
+				dt.Values = append(dt.Values, tk.text)
+			default:
+				return nil, p.errorf("unexpected %v in type %v", p.describe(tk), dt.Name)
+			}
+			if p.acceptPunct(")") {
+				break
+			}
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for {
+		switch {
+		case p.accept("UNSIGNED"):
+			dt.Unsigned = true
+		case p.accept("SIGNED"), p.accept("ZEROFILL"), p.accept("BINARY"):
+		case p.accept("CHARACTER", "SET"), p.accept("CHARSET"), p.accept("COLLATE"):
+			p.next()
+		default:
+			return dt, nil
+		}
+	}
+}
+
+// Parses mysql column type, e.g. "int(10) unsigned" or "enum('a','b')"
+func ParseMysqlType(s string) (*DataType, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &ddlParser{script: s, tokens: tokens}
+	dt, err := p.parseDataType()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected %v after column type", p.describe(p.peek()))
+	}
+	return dt, nil
+}
+
+func (p *ddlParser) parseColumnDef() (*ColumnDef, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	dt, err := p.parseDataType()
+	if err != nil {
+		return nil, err
+	}
+	col := &ColumnDef{Name: name, Type: dt}
+
+	for {
+		t := p.peek()
+		switch {
+		case p.accept("NOT", "NULL"):
+			col.NotNull = true
+		case p.accept("NULL"):
+			col.Null = true
+		case p.accept("DEFAULT"):
+			def, err := p.defaultValue()
+			if err != nil {
+				return nil, err
+			}
+			col.Default = &def
+		case p.accept("ON", "UPDATE"):
+			if _, err := p.defaultValue(); err != nil {
+				return nil, err
+			}
+		case p.accept("AUTO_INCREMENT"):
+			col.AutoIncrement = true
+		case p.accept("PRIMARY", "KEY"):
+			col.PrimaryKey = true
+		case p.accept("UNIQUE"):
+			p.accept("KEY")
+			col.Unique = true
+		case p.accept("KEY"):
+			col.PrimaryKey = true
+		case p.accept("COMMENT"), p.accept("COLUMN_FORMAT"), p.accept("STORAGE"):
+			p.next()
+		case p.accept("COLLATE"), p.accept("CHARACTER", "SET"), p.accept("CHARSET"):
+			p.next()
+		case t.is("GENERATED", "AS"):
+			return nil, p.errorf("generated column %v is not supported", name)
+		case t.is("REFERENCES"):
+			return nil, p.errorf("inline REFERENCES of column %v is not supported", name)
+		case t.is("CHECK"):
+			p.next()
+			if err := p.expectPunct("("); err != nil {
+				return nil, err
+			}
+			if err := p.skipParenthesized(); err != nil {
+				return nil, err
+			}
+			p.next()
+		case t.is("FIRST"), t.is("AFTER"):
+			return col, nil
+		default:
+			return col, nil
+		}
+	}
+}
+
+// default value of column as postgres expression
+func (p *ddlParser) defaultValue() (string, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		if t.text == "0000-00-00 00:00:00" || t.text == "0000-00-00" { // postgres has no zero dates
+			return "'1957-01-01 00:00:00'", nil
+		}
+		return "'" + strings.Replace(t.text, "'", "''", -1) + "'", nil
+	case tokNumber:
+		return t.text, nil
+	case tokPunct:
+		if t.text == "-" || t.text == "+" {
+			n := p.next()
+			if n.kind != tokNumber {
+				return "", p.errorf("expected number after %v", t.text)
+			}
+			return t.text + n.text, nil
+		}
+		if t.text == "(" { // expression default of mysql 8
+			return "", p.errorf("expression defaults are not supported")
+		}
+	case tokIdent:
+		switch {
+		case t.is("NULL"):
+			return "NULL", nil
+		case t.is("TRUE", "FALSE"):
+			return strings.ToUpper(t.text), nil
+		case t.is("CURRENT_TIMESTAMP", "NOW", "LOCALTIME", "LOCALTIMESTAMP"):
+			if p.acceptPunct("(") {
+				for !p.acceptPunct(")") {
+					if p.peek().kind == tokEOF {
+						return "", p.errorf("unexpected end of statement")
+					}
+					p.next()
+				}
+			}
+			return "CURRENT_TIMESTAMP", nil
+		case len(t.text) > 1 && (t.text[0] == 'b' || t.text[0] == 'B') && p.peek().kind == tokString:
+			return "", p.errorf("bit literal defaults are not supported")
+		}
+	}
+	return "", p.errorf("unsupported default value %v", p.describe(t))
+}
+
+// ENGINE=InnoDB DEFAULT CHARSET=utf8 ... are ignored, partitioning is not supported
+func (p *ddlParser) parseTableOptions() error {
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokEOF || t.isPunct(";"):
+			return nil
+		case t.is("PARTITION"):
+			return p.errorf("partitioned tables are not supported")
+		case t.is("AS", "SELECT", "IGNORE", "REPLACE"):
+			return nil
+		case t.isPunct(","), t.isPunct("="):
+			p.next()
+		case t.is("DEFAULT"):
+			p.next()
+		case t.is("CHARACTER") && p.peekAt(1).is("SET"):
+			p.pos += 2
+			p.acceptPunct("=")
+			p.next()
+		case t.kind == tokIdent:
+			p.next()
+			if p.acceptPunct("=") || !p.peek().isPunct(",") && p.peek().kind != tokEOF && !p.peek().isPunct(";") {
+				if p.acceptPunct("(") { // UNION=(t1, t2)
+					if err := p.skipParenthesized(); err != nil {
+						return err
+					}
+					p.next()
+				} else {
+					p.next()
+				}
+			}
+		default:
+			return p.errorf("unexpected %v in table options", p.describe(t))
+		}
+	}
+}
+
+func (p *ddlParser) parseCreateIndex() (interface{}, error) {
+	idx := &IndexDef{Unique: p.accept("UNIQUE")}
+	if err := p.expect("INDEX"); err != nil {
+		return nil, err
+	}
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	idx.Name = name
+	if p.accept("USING") {
+		p.next()
+	}
+	if err := p.expect("ON"); err != nil {
+		return nil, err
+	}
+	table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	cols, err := p.indexColumns()
+	if err != nil {
+		return nil, err
+	}
+	idx.Columns = cols
+	p.skipStatement() // index options, ALGORITHM and LOCK
+	return &CreateIndexStmt{Table: table, Index: idx}, nil
+}
+
+func (p *ddlParser) parseCreateView() (interface{}, error) {
+	p.next() // VIEW
+	view, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	s := &CreateViewStmt{View: view}
+	if p.acceptPunct("(") {
+		for {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			s.Columns = append(s.Columns, col)
+			if p.acceptPunct(")") {
+				break
+			}
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.expect("AS"); err != nil {
+		return nil, err
+	}
+	for !p.peek().isPunct(";") && p.peek().kind != tokEOF {
+		s.Select = append(s.Select, p.next())
+	}
+	if len(s.Select) == 0 {
+		return nil, p.errorf("view %v has no select", view.Name)
+	}
+	return s, nil
+}
+
+func (p *ddlParser) parseDrop() (interface{}, error) {
+	p.next() // DROP
+	t := p.peek()
+	switch {
+	case t.is("TEMPORARY"):
+		return &IgnoredStmt{Text: p.skipStatement(), Reason: "temporary tables are not replicated"}, nil
+	case t.is("TABLE", "TABLES"):
+		p.next()
+		s := &DropTableStmt{IfExists: p.accept("IF", "EXISTS")}
+		tables, err := p.tableNames()
+		if err != nil {
+			return nil, err
+		}
+		s.Tables = tables
+		p.accept("RESTRICT")
+		p.accept("CASCADE")
+		return s, nil
+	case t.is("VIEW"):
+		p.next()
+		s := &DropViewStmt{IfExists: p.accept("IF", "EXISTS")}
+		views, err := p.tableNames()
+		if err != nil {
+			return nil, err
+		}
+		s.Views = views
+		p.accept("RESTRICT")
+		p.accept("CASCADE")
+		return s, nil
+	case t.is("INDEX"):
+		p.next()
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("ON"); err != nil {
+			return nil, err
+		}
+		table, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		p.skipStatement()
+		return &DropIndexStmt{Table: table, Name: name}, nil
+	case t.is("DATABASE", "SCHEMA"):
+		p.next()
+		s := &DropSchemaStmt{IfExists: p.accept("IF", "EXISTS")}
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		s.Name = name
+		return s, nil
+	case t.is("FUNCTION", "PROCEDURE", "TRIGGER", "EVENT"):
+		return &IgnoredStmt{Text: p.skipStatement(), Reason: "routines and triggers are not replicated"}, nil
+	case t.is("USER", "ROLE", "SERVER", "TABLESPACE", "LOGFILE"):
+		return &IgnoredStmt{Text: p.skipStatement(), Reason: "no meaning for replica"}, nil
+	}
+	return nil, p.errorf("unsupported DROP %v", p.describe(t))
+}
+
+func (p *ddlParser) parseRename() (interface{}, error) {
+	p.next() // RENAME
+	if p.peek().is("USER") {
+		return &IgnoredStmt{Text: p.skipStatement(), Reason: "no meaning for replica"}, nil
+	}
+	if err := p.expect("TABLE"); err != nil {
+		return nil, err
+	}
+	s := new(RenameTableStmt)
+	for {
+		from, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("TO"); err != nil {
+			return nil, err
+		}
+		to, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		s.From = append(s.From, from)
+		s.To = append(s.To, to)
+		if !p.acceptPunct(",") {
+			return s, nil
+		}
+	}
+}
+
+func (p *ddlParser) parseAlter() (interface{}, error) {
+	p.next() // ALTER
+	p.accept("ONLINE")
+	p.accept("IGNORE")
+	t := p.peek()
+	switch {
+	case t.is("TABLE"):
+	case t.is("FUNCTION", "PROCEDURE", "EVENT"):
+		return &IgnoredStmt{Text: p.skipScript(), Reason: "routines and triggers are not replicated"}, nil
+	case t.is("DATABASE", "SCHEMA", "USER", "SERVER", "TABLESPACE", "LOGFILE", "INSTANCE"):
+		return &IgnoredStmt{Text: p.skipStatement(), Reason: "no meaning for replica"}, nil
+	case t.is("VIEW"):
+		p.pos--
+		p.tokens[p.pos] = token{kind: tokIdent, text: "CREATE", pos: t.pos}
+		return p.parseCreate()
+	default:
+		return nil, p.errorf("unsupported ALTER %v", p.describe(t))
+	}
+	p.next() // TABLE
+
+	table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	s := &AlterTableStmt{Table: table}
+	if p.peek().isPunct(";") || p.peek().kind == tokEOF {
+		return s, nil
+	}
+
+	for {
+		specs, err := p.parseAlterSpec()
+		if err != nil {
+			return nil, err
+		}
+		s.Specs = append(s.Specs, specs...)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if p.peek().is("PARTITION") {
+		return nil, p.errorf("partitioning is not supported")
+	}
+	return s, nil
+}
+
+func (p *ddlParser) parseAlterSpec() ([]*AlterSpec, error) {
+	t := p.peek()
+	switch {
+	case p.accept("ADD"):
+		p.constraintName()
+		n := p.peek()
+		switch {
+		case n.is("PRIMARY"):
+			idx, err := p.parseIndexDef()
+			if err != nil {
+				return nil, err
+			}
+			return []*AlterSpec{&AlterSpec{Action: "ADD PRIMARY KEY", Index: idx}}, nil
+		case n.is("UNIQUE", "INDEX", "KEY"):
+			idx, err := p.parseIndexDef()
+			if err != nil {
+				return nil, err
+			}
+			return []*AlterSpec{&AlterSpec{Action: "ADD INDEX", Index: idx}}, nil
+		case n.is("FULLTEXT", "SPATIAL"):
+			return nil, p.errorf("%v indexes are not supported by postgres replica", strings.ToUpper(n.text))
+		case n.is("FOREIGN", "CHECK"):
+			return nil, p.skipParenthesized()
+		case n.is("PARTITION"):
+			return nil, p.errorf("partitioning is not supported")
+		}
+		p.accept("COLUMN")
+		if p.acceptPunct("(") { // ADD (col1 ..., col2 ...)
+			specs := make([]*AlterSpec, 0)
+			for {
+				col, err := p.parseColumnDef()
+				if err != nil {
+					return nil, err
+				}
+				specs = append(specs, &AlterSpec{Action: "ADD COLUMN", Column: col})
+				if p.acceptPunct(")") {
+					return specs, nil
+				}
+				if err := p.expectPunct(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+		col, err := p.parseColumnDef()
+		if err != nil {
+			return nil, err
+		}
+		p.columnPosition()
+		return []*AlterSpec{&AlterSpec{Action: "ADD COLUMN", Column: col}}, nil
+
+	case p.accept("DROP"):
+		switch {
+		case p.accept("PRIMARY", "KEY"):
+			return []*AlterSpec{&AlterSpec{Action: "DROP PRIMARY KEY"}}, nil
+		case p.accept("INDEX"), p.accept("KEY"):
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			return []*AlterSpec{&AlterSpec{Action: "DROP INDEX", OldName: name}}, nil
+		case p.accept("FOREIGN", "KEY"):
+			p.next()
+			return nil, nil
+		case p.peek().is("PARTITION"):
+			return nil, p.errorf("partitioning is not supported")
+		}
+		p.accept("COLUMN")
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		return []*AlterSpec{&AlterSpec{Action: "DROP COLUMN", OldName: name}}, nil
+
+	case p.accept("MODIFY"):
+		p.accept("COLUMN")
+		col, err := p.parseColumnDef()
+		if err != nil {
+			return nil, err
+		}
+		p.columnPosition()
+		return []*AlterSpec{&AlterSpec{Action: "MODIFY", Column: col, OldName: col.Name}}, nil
+
+	case p.accept("CHANGE"):
+		p.accept("COLUMN")
+		old, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		col, err := p.parseColumnDef()
+		if err != nil {
+			return nil, err
+		}
+		p.columnPosition()
+		return []*AlterSpec{&AlterSpec{Action: "CHANGE", Column: col, OldName: old}}, nil
+
+	case p.accept("ALTER"):
+		p.accept("COLUMN")
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if p.accept("DROP", "DEFAULT") {
+			return []*AlterSpec{&AlterSpec{Action: "DROP DEFAULT", OldName: name}}, nil
+		}
+		if err := p.expect("SET", "DEFAULT"); err != nil {
+			return nil, err
+		}
+		def, err := p.defaultValue()
+		if err != nil {
+			return nil, err
+		}
+		return []*AlterSpec{&AlterSpec{Action: "SET DEFAULT", OldName: name, DefaultVal: def}}, nil
+
+	case p.accept("RENAME"):
+		if p.accept("COLUMN") {
+			old, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("TO"); err != nil {
+				return nil, err
+			}
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			return []*AlterSpec{&AlterSpec{Action: "RENAME COLUMN", OldName: old, Column: &ColumnDef{Name: name}}}, nil
+		}
+		if p.accept("INDEX") || p.accept("KEY") {
+			return nil, p.errorf("RENAME INDEX is not supported")
+		}
+		if !p.accept("TO") {
+			p.accept("AS")
+		}
+		to, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		return []*AlterSpec{&AlterSpec{Action: "RENAME", NewTable: &to}}, nil
+
+	case t.is("ENGINE", "AUTO_INCREMENT", "COMMENT", "ROW_FORMAT", "KEY_BLOCK_SIZE", "AVG_ROW_LENGTH",
+		"MAX_ROWS", "MIN_ROWS", "PACK_KEYS", "CHECKSUM", "STATS_PERSISTENT", "STATS_AUTO_RECALC",
+		"ALGORITHM", "LOCK", "CHARSET", "COLLATE", "DEFAULT", "FORCE"):
+		p.next()
+		if t.is("DEFAULT") {
+			return p.parseAlterSpec()
+		}
+		p.acceptPunct("=")
+		if !p.peek().isPunct(",") && !p.peek().isPunct(";") && p.peek().kind != tokEOF {
+			p.next()
+		}
+		return nil, nil
+
+	case p.accept("CHARACTER", "SET"):
+		p.acceptPunct("=")
+		p.next()
+		p.accept("COLLATE")
+		return nil, nil
+
+	case p.accept("CONVERT", "TO"):
+		p.skipStatement() // character set conversion does not change postgres table
+		return nil, nil
+
+	case t.is("ORDER", "ENABLE", "DISABLE", "DISCARD", "IMPORT"):
+		for !p.peek().isPunct(",") && !p.peek().isPunct(";") && p.peek().kind != tokEOF {
+			p.next()
+		}
+		return nil, nil
+	}
+	return nil, p.errorf("unsupported ALTER TABLE action %v", p.describe(t))
+}
+
+// FIRST and AFTER col are meaningless in postgres
+func (p *ddlParser) columnPosition() {
+	if p.accept("FIRST") {
+		return
+	}
+	if p.accept("AFTER") {
+		p.next()
+	}
+}
@@ -0,0 +1,98 @@
+// mapping of mysql names to postgres names
+
+package pgfuncs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NameMap gives destination names of mysql schemas, tables and columns.
+// Table rule wins over schema rule, schema rule wins over schema prefix.
+// Names without rules are kept as in mysql
+type NameMap struct {
+	schemaPrefix string
+	schemas      map[string]string    // mysql schema to postgres schema
+	tables       map[string]TableName // key is schema.table
+	columns      map[string]string    // key is schema.table.column
+}
+
+func NewNameMap() *NameMap {
+	return &NameMap{
+		schemas: make(map[string]string),
+		tables:  make(map[string]TableName),
+		columns: make(map[string]string),
+	}
+}
+
+// prefix added to schemas which have no schema or table rule
+func (m *NameMap) SetSchemaPrefix(prefix string) {
+	m.schemaPrefix = prefix
+}
+
+// Adds renaming rule. Kind of rule is given by number of parts of from:
+//
+//	schema -> schema
+//	schema.table -> schema.table or table (schema is mapped by schema rules)
+//	schema.table.column -> column
+func (m *NameMap) AddRule(from string, to string) error {
+	f := strings.Split(strings.TrimSpace(from), ".")
+	t := strings.Split(strings.TrimSpace(to), ".")
+	for _, n := range append(f, t...) {
+		if len(n) == 0 {
+			return errors.New(fmt.Sprintf("Incorrect rename rule %v -> %v", from, to))
+		}
+	}
+
+	switch {
+	case len(f) == 1 && len(t) == 1:
+		m.schemas[f[0]] = t[0]
+	case len(f) == 2 && len(t) == 2:
+		m.tables[f[0]+"."+f[1]] = TableName{Schema: t[0], Name: t[1]}
+	case len(f) == 2 && len(t) == 1:
+		m.tables[f[0]+"."+f[1]] = TableName{Name: t[0]}
+	case len(f) == 3 && len(t) == 1:
+		m.columns[f[0]+"."+f[1]+"."+f[2]] = t[0]
+	default:
+		return errors.New(fmt.Sprintf("Rename rule should be schema -> schema, schema.table -> [schema.]table "+
+			"or schema.table.column -> column. Got %v -> %v", from, to))
+	}
+	return nil
+}
+
+// destination schema of mysql schema. Nil map keeps the name
+func (m *NameMap) Schema(schema string) string {
+	if m == nil {
+		return schema
+	}
+	if s, ok := m.schemas[schema]; ok {
+		return s
+	}
+	return m.schemaPrefix + schema
+}
+
+// destination schema and table of mysql table
+func (m *NameMap) Table(schema string, table string) (string, string) {
+	if m == nil {
+		return schema, table
+	}
+	if t, ok := m.tables[schema+"."+table]; ok {
+		if len(t.Schema) == 0 {
+			return m.Schema(schema), t.Name
+		}
+		return t.Schema, t.Name
+	}
+	return m.Schema(schema), table
+}
+
+// destination name of column of mysql table
+func (m *NameMap) Column(schema string, table string, column string) string {
+	if m == nil {
+		return column
+	}
+	if c, ok := m.columns[schema+"."+table+"."+column]; ok {
+		return c
+	}
+	return column
+}
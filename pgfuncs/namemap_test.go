@@ -0,0 +1,130 @@
+package pgfuncs
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func testNameMap(t *testing.T) *NameMap {
+	names := NewNameMap()
+	names.SetSchemaPrefix("raw_")
+	for _, r := range [][]string{
+		{"shop", "store"},
+		{"shop.orders", "sales.mysql_orders"},
+		{"shop.items", "mysql_items"},
+		{"shop.orders.id", "order_id"},
+	} {
+		if err := names.AddRule(r[0], r[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return names
+}
+
+func TestNameMapRules(t *testing.T) {
+	names := testNameMap(t)
+
+	for _, c := range [][]string{
+		{"shop", "orders", "sales", "mysql_orders"},
+		{"shop", "items", "store", "mysql_items"},
+		{"shop", "users", "store", "users"},
+		{"db1", "tab1", "raw_db1", "tab1"},
+	} {
+		schema, table := names.Table(c[0], c[1])
+		if schema != c[2] || table != c[3] {
+			t.Fatal(
+				"Incorrect destination of", c[0], c[1],
+				"expected", c[2], c[3],
+				"got", schema, table,
+			)
+		}
+	}
+
+	if err := names.AddRule("shop.orders.id", "shop.order_id"); err == nil {
+		t.Fatal("Expected error for column renamed into table")
+	}
+}
+
+func TestNameMapQueries(t *testing.T) {
+	names := testNameMap(t)
+
+	event := &structs.Event{
+		SchemaName: "shop",
+		TableName:  "orders",
+		Columns: []*structs.Column{
+			&structs.Column{Name: "id", Type: "int(11)", IsPKey: true, IsKey: true},
+			&structs.Column{Name: "name", Type: "varchar(20)"},
+		},
+		EventType: structs.DELETE_EVENT,
+		OldValues: [][]*structs.QueryValues{[]*structs.QueryValues{
+			&structs.QueryValues{ColumnId: 0, Value: 1},
+			&structs.QueryValues{ColumnId: 1, Value: "a"},
+		}},
+	}
+
+	sql, err := GenQuery(event, &Options{Names: names})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `DELETE FROM "sales"."mysql_orders" WHERE "order_id" = '1'; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect renamed delete query",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	sql, err = ConvertMysql57ToPostgres("SET SEARCH_PATH TO \"shop\"; ALTER TABLE `orders` CHANGE `id` `oid` int(11) NOT NULL, "+
+		"ADD KEY `idx_name` (`name`), RENAME TO `orders2`", &Options{Names: names})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `SET SEARCH_PATH TO "store"; ALTER TABLE "sales"."mysql_orders" RENAME COLUMN "order_id" TO "oid"; ` +
+		`ALTER TABLE "sales"."mysql_orders" ALTER COLUMN "oid" TYPE bigint USING "oid"::bigint, ALTER COLUMN "oid" SET NOT NULL; ` +
+		`CREATE INDEX "mysql_orders_idx_name" ON "sales"."mysql_orders" ("name"); ` +
+		`ALTER TABLE "sales"."mysql_orders" RENAME TO "orders2"; ` +
+		`DO $rename$DECLARE i record; BEGIN FOR i IN SELECT schemaname, indexname FROM pg_indexes ` +
+		`WHERE schemaname = 'sales' AND tablename = 'orders2' AND left(indexname, 13) = 'mysql_orders_' LOOP ` +
+		`EXECUTE format('ALTER INDEX %I.%I RENAME TO %I', i.schemaname, i.indexname, right('orders2' || substr(i.indexname, 13), 63)); ` +
+		`END LOOP; END$rename$; ` +
+		`ALTER TABLE "sales"."orders2" SET SCHEMA "store";`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect renamed alter table",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
+
+// snapshot load of table is repair of the whole table
+func TestNameMapRepair(t *testing.T) {
+	event := &structs.Event{
+		SchemaName: "shop",
+		TableName:  "orders",
+		Columns:    testColumns(),
+		EventType:  structs.REPAIR_EVENT,
+		OldValues:  [][]*structs.QueryValues{testRow("1", "a", "new"), testRow("2", "b", "done")},
+		Chunk: &structs.RepairChunk{
+			Repair: &structs.Repair{Id: 1, Schema: "shop", Table: "orders"},
+			To:     []interface{}{"2"},
+			Delete: true,
+		},
+	}
+	sql, err := GenRepair(event, &Options{Names: testNameMap(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `DELETE FROM "sales"."mysql_orders" WHERE ("order_id") <= ('2') AND ("order_id") NOT IN (('1'), ('2')); ` +
+		`INSERT INTO "sales"."mysql_orders" ("order_id", "name", "state") VALUES ('1', 'a', 'new'), ('2', 'b', 'done') ` +
+		`ON CONFLICT ("order_id") DO UPDATE SET "name" = EXCLUDED."name", "state" = EXCLUDED."state"; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect renamed repair",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
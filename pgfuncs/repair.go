@@ -0,0 +1,235 @@
+// queue of rows to repair in destination
+
+package pgfuncs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// reason of repairs of tables and key ranges requested by user
+const RepairRequested = "requested"
+
+// RepairQueue keeps keys of destination rows found out of sync with mysql,
+// e.g. rows missing for UPDATE or DELETE, and ranges of keys to repair
+type RepairQueue struct {
+	schema string // quoted schema of queue table
+	table  string // quoted queue table
+}
+
+// Creates repair queue in table given as schema.table
+func NewRepairQueue(table string) (*RepairQueue, error) {
+	st := strings.Split(strings.TrimSpace(table), ".")
+	if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+		return nil, errors.New(fmt.Sprintf("Repair queue table should be schemaname.tablename. Got %v", table))
+	}
+	return &RepairQueue{schema: pgIdent(st[0]), table: pgTable(st[0], st[1])}, nil
+}
+
+// statements creating queue table and its schema
+func (q *RepairQueue) CreateTable() string {
+	return fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %v; CREATE TABLE IF NOT EXISTS %v ("+
+		"id bigserial PRIMARY KEY, schema_name text NOT NULL, table_name text NOT NULL, pkey jsonb, image jsonb, "+
+		"range_from jsonb, range_to jsonb, reason text NOT NULL, binlog_file text, binlog_position bigint, "+
+		"created_at timestamp with time zone NOT NULL DEFAULT now()); "+
+		"ALTER TABLE %v ADD COLUMN IF NOT EXISTS range_from jsonb, ADD COLUMN IF NOT EXISTS range_to jsonb;",
+		q.schema, q.table, q.table)
+}
+
+// Generates insert queueing rows of event. Key and image are taken from
+// before-image of rows, image is kept for tables without primary key
+func (q *RepairQueue) Insert(event *structs.Event, opts *Options, reason string) string {
+	tg := opts.target(event.SchemaName, event.TableName, event.Columns)
+	file := "NULL"
+	if len(event.File) != 0 {
+		file = pgQuote(event.File)
+	}
+
+	sql := fmt.Sprintf("INSERT INTO %v (schema_name, table_name, pkey, image, reason, binlog_file, binlog_position) VALUES ", q.table)
+	for idr, row := range event.OldValues {
+		if idr > 0 {
+			sql += ", "
+		}
+		sql += fmt.Sprintf("(%v, %v, %v, %v, %v, %v, %v)", pgQuote(event.SchemaName), pgQuote(event.TableName),
+			jsonImage(event.Columns, tg, row, true), jsonImage(event.Columns, tg, row, false), pgQuote(reason),
+			file, event.EventPosition)
+	}
+	return sql + "; "
+}
+
+// Generates insert queueing repair of mysql table schema.table. Rows with
+// keys after from and up to to are repaired, nil is no bound. Values of
+// bounds are values of key columns (see structs.Column.IsKey) in order of columns
+func (q *RepairQueue) InsertRange(schema string, table string, from []interface{}, to []interface{}) (string, error) {
+	bounds := []string{"NULL", "NULL"}
+	for idb, b := range [][]interface{}{from, to} {
+		if b == nil {
+			continue
+		}
+		j, err := json.Marshal(b)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Incorrect range of keys %v. %v", b, err))
+		}
+		bounds[idb] = pgQuote(string(j)) + "::jsonb"
+	}
+	return fmt.Sprintf("INSERT INTO %v (schema_name, table_name, range_from, range_to, reason) VALUES (%v, %v, %v, %v, %v); ",
+		q.table, pgQuote(schema), pgQuote(table), bounds[0], bounds[1], pgQuote(RepairRequested)), nil
+}
+
+// select of queued repairs: id, schema, table, key, range_from and range_to.
+// Rows of tables without primary key are queued without key and can only be
+// repaired by requesting repair of the table
+func (q *RepairQueue) Select() string {
+	return fmt.Sprintf("SELECT id, schema_name, table_name, pkey::text, range_from::text, range_to::text FROM %v "+
+		"WHERE pkey IS NOT NULL OR reason = %v ORDER BY id;", q.table, pgQuote(RepairRequested))
+}
+
+// Generates delete of finished repair
+func (q *RepairQueue) Delete(id int64) string {
+	return fmt.Sprintf("DELETE FROM %v WHERE id = %v; ", q.table, id)
+}
+
+// Generates statements writing chunk of REPAIR_EVENT into destination.
+// Rows of event are upserted. If Chunk.Delete is set, destination rows with
+// keys in the chunk which are neither in event nor changed in binlog while
+// the chunk was read (Chunk.Keys) are deleted. History tables are not repaired
+func GenRepair(event *structs.Event, opts *Options) (string, error) {
+	chunk := event.Chunk
+	if event.EventType != structs.REPAIR_EVENT || chunk == nil || chunk.Repair == nil {
+		return "", errors.New(fmt.Sprintf("Repair of %v.%v needs repair event", event.SchemaName, event.TableName))
+	}
+	tg := opts.target(event.SchemaName, event.TableName, event.Columns)
+	if tg.hist != nil {
+		return "", errors.New(fmt.Sprintf("History table %v.%v cannot be repaired", event.SchemaName, event.TableName))
+	}
+
+	var keys []int
+	hasPKey := false
+	for idc, column := range event.Columns {
+		if column.IsKey {
+			keys = append(keys, idc)
+		}
+		hasPKey = hasPKey || column.IsPKey
+	}
+	if len(keys) == 0 {
+		return "", errors.New(fmt.Sprintf("Table %v.%v has no key to repair it", event.SchemaName, event.TableName))
+	}
+	names := make([]string, len(keys))
+	for idk, idc := range keys {
+		names[idk] = tg.names[idc]
+	}
+	keyNames := strings.Join(names, ", ")
+
+	// key tuples of rows of event
+	var rowKeys []string
+	for _, row := range event.OldValues {
+		key := make([]interface{}, len(keys))
+		for _, val := range row {
+			for idk, idc := range keys {
+				if val.ColumnId == idc {
+					key[idk] = val.Value
+				}
+			}
+		}
+		rowKeys = append(rowKeys, "("+keyTuple(event.Columns, tg, keys, key)+")")
+	}
+
+	var sql string
+	if chunk.Delete {
+		conds, err := repairRange(event.Columns, tg, keys, chunk)
+		if err != nil {
+			return "", err
+		}
+		protected := append([]string{}, rowKeys...)
+		for _, key := range chunk.Keys {
+			protected = append(protected, "("+keyTuple(event.Columns, tg, keys, key)+")")
+		}
+		if len(protected) != 0 {
+			conds = append(conds, fmt.Sprintf("(%v) NOT IN (%v)", keyNames, strings.Join(protected, ", ")))
+		}
+		if tg.soft != nil {
+			del := *event
+			del.EventType = structs.DELETE_EVENT
+			sets := extraSets(tg, &del)
+			conds = append(conds, "NOT "+pgIdent(tg.soft.flag))
+			sql = fmt.Sprintf("UPDATE %v SET %v WHERE %v; ", tg.table, sets[:len(sets)-2], strings.Join(conds, " AND "))
+		} else if len(conds) != 0 {
+			sql = fmt.Sprintf("DELETE FROM %v WHERE %v; ", tg.table, strings.Join(conds, " AND "))
+		} else {
+			sql = fmt.Sprintf("DELETE FROM %v; ", tg.table)
+		}
+	}
+	if len(event.OldValues) == 0 {
+		return sql, nil
+	}
+
+	upsert := Options{}
+	if opts != nil {
+		upsert = *opts
+	}
+	upsert.Upsert = true
+	if !hasPKey { // conflicts on unique key cannot be updated, rows are replaced
+		sql = fmt.Sprintf("%vDELETE FROM %v WHERE (%v) IN (%v); ", sql, tg.table, keyNames, strings.Join(rowKeys, ", "))
+	}
+	sources := make([]*structs.Event, len(event.OldValues))
+	for idr := range sources {
+		sources[idr] = event
+	}
+	insert, err := GenBulkInsert(event.SchemaName, event.TableName, event.Columns, event.OldValues, sources, &upsert)
+	if err != nil {
+		return "", err
+	}
+	return sql + insert, nil
+}
+
+// conditions of destination rows in chunk of repair
+func repairRange(columns []*structs.Column, tg *target, keys []int, chunk *structs.RepairChunk) ([]string, error) {
+	var conds []string
+	if chunk.Repair.Key != nil {
+		for idc, column := range columns {
+			if value, ok := chunk.Repair.Key[column.Name]; ok {
+				conds = append(conds, fmt.Sprintf("%v = %v", tg.names[idc], pgValue(column, tg.types[idc], value)))
+			}
+		}
+		if len(conds) != len(chunk.Repair.Key) {
+			return nil, errors.New(fmt.Sprintf("Key %v of repair %v does not match columns of table", chunk.Repair.Key, chunk.Repair.Id))
+		}
+		return conds, nil
+	}
+
+	names := make([]string, len(keys))
+	for idk, idc := range keys {
+		names[idk] = tg.names[idc]
+	}
+	for idb, b := range [][]interface{}{chunk.From, chunk.To} {
+		if b == nil {
+			continue
+		}
+		if len(b) != len(keys) {
+			return nil, errors.New(fmt.Sprintf("Range %v of repair %v does not match key of table", b, chunk.Repair.Id))
+		}
+		op := ">"
+		if idb == 1 {
+			op = "<="
+		}
+		conds = append(conds, fmt.Sprintf("(%v) %v (%v)", strings.Join(names, ", "), op, keyTuple(columns, tg, keys, b)))
+	}
+	return conds, nil
+}
+
+// values of key columns keys as postgres literals
+func keyTuple(columns []*structs.Column, tg *target, keys []int, key []interface{}) string {
+	values := make([]string, len(keys))
+	for idk, idc := range keys {
+		var value interface{}
+		if idk < len(key) {
+			value = key[idk]
+		}
+		values[idk] = pgValue(columns[idc], tg.types[idc], value)
+	}
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,131 @@
+package pgfuncs
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestCountedQuery(t *testing.T) {
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    testColumns(),
+		EventType:  structs.UPDATE_EVENT,
+		OldValues:  [][]*structs.QueryValues{testRow(uint32(1), "a", byte(1))},
+		NewValues:  [][]*structs.QueryValues{testRow(uint32(1), "b", byte(2))},
+	}
+
+	counted, rest, err := GenCountedQuery(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `WITH matched AS (UPDATE "db1"."tab1" SET "id" = '1', "name" = 'b', "state" = 'done' WHERE "id" = '1' RETURNING 1) ` +
+		`SELECT count(*) FROM matched;`
+	if counted != expected || len(rest) != 0 {
+		t.Fatal(
+			"Incorrect counted update",
+			"expected", expected,
+			"got", counted, rest,
+		)
+	}
+
+	event.EventType = structs.DELETE_EVENT
+	event.NewValues = nil
+	counted, _, err = GenCountedQuery(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `WITH matched AS (DELETE FROM "db1"."tab1" WHERE "id" = '1' RETURNING 1) SELECT count(*) FROM matched;`
+	if counted != expected {
+		t.Fatal(
+			"Incorrect counted delete",
+			"expected", expected,
+			"got", counted,
+		)
+	}
+
+	queue, err := NewRepairQueue("replicagor.repair_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.File = "mysql-bin.000003"
+	event.EventPosition = 154
+	sql := queue.Insert(event, nil, "delete matched no rows")
+	expected = `INSERT INTO "replicagor"."repair_queue" (schema_name, table_name, pkey, image, reason, binlog_file, binlog_position) ` +
+		`VALUES ('db1', 'tab1', '{"id": 1}'::jsonb, '{"id": 1, "name": "a", "state": "new"}'::jsonb, 'delete matched no rows', ` +
+		`'mysql-bin.000003', 154); `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect repair queue insert",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
+
+func TestGenRepair(t *testing.T) {
+	repair := &structs.Repair{Id: 7, Schema: "db1", Table: "tab1"}
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    testColumns(),
+		EventType:  structs.REPAIR_EVENT,
+		OldValues:  [][]*structs.QueryValues{testRow("2", "b", "new"), testRow("3", "c", "done")},
+		Chunk: &structs.RepairChunk{
+			Repair: repair,
+			From:   []interface{}{"1"},
+			To:     []interface{}{"5"},
+			Keys:   [][]interface{}{[]interface{}{uint32(4)}},
+			Delete: true,
+		},
+	}
+
+	sql, err := GenRepair(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `DELETE FROM "db1"."tab1" WHERE ("id") > ('1') AND ("id") <= ('5') AND ("id") NOT IN (('2'), ('3'), ('4')); ` +
+		`INSERT INTO "db1"."tab1" ("id", "name", "state") VALUES ('2', 'b', 'new'), ('3', 'c', 'done') ` +
+		`ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "state" = EXCLUDED."state"; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect repair of chunk",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	event.Chunk = &structs.RepairChunk{Repair: &structs.Repair{Id: 8, Key: map[string]interface{}{"id": "9"}}, Delete: true, Last: true}
+	event.OldValues = nil
+	sql, err = GenRepair(event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `DELETE FROM "db1"."tab1" WHERE "id" = '9'; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect repair of missing row",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	queue, err := NewRepairQueue("replicagor.repair_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, err = queue.InsertRange("db1", "tab1", nil, []interface{}{100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `INSERT INTO "replicagor"."repair_queue" (schema_name, table_name, range_from, range_to, reason) ` +
+		`VALUES ('db1', 'tab1', NULL, '[100]'::jsonb, 'requested'); `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect repair range insert",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
@@ -0,0 +1,94 @@
+// soft delete of rows in destination tables
+
+package pgfuncs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// columns marking deleted rows of table
+type softDeleteColumns struct {
+	flag      string // boolean column, true for deleted rows
+	timestamp string // time of deletion, empty if not kept
+}
+
+// SoftDelete lists tables whose rows are marked as deleted instead of being
+// removed. Rows inserted again with the same key are upserted and lose the mark
+type SoftDelete struct {
+	tables map[string]*softDeleteColumns // key is mysql schema.table
+}
+
+func NewSoftDelete() *SoftDelete {
+	return &SoftDelete{tables: make(map[string]*softDeleteColumns)}
+}
+
+// Adds tables given as schema.table. flag is the name of deleted flag column,
+// timestamp is the name of deletion time column or empty if time is not kept
+func (d *SoftDelete) AddTables(tables []string, flag string, timestamp string) error {
+	if len(flag) == 0 {
+		return errors.New("Soft delete requires name of flag column")
+	}
+	for _, t := range tables {
+		st := strings.Split(strings.TrimSpace(t), ".")
+		if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+			return errors.New(fmt.Sprintf("Soft delete table should be schemaname.tablename. Got %v", t))
+		}
+		d.tables[st[0]+"."+st[1]] = &softDeleteColumns{flag: flag, timestamp: timestamp}
+	}
+	return nil
+}
+
+// columns of mysql table, nil if rows of table are deleted
+func (d *SoftDelete) columns(schema string, table string) *softDeleteColumns {
+	if d == nil {
+		return nil
+	}
+	return d.tables[schema+"."+table]
+}
+
+// column definitions of CREATE TABLE
+func (c *softDeleteColumns) columnDefs() []string {
+	if c == nil {
+		return nil
+	}
+	defs := []string{pgIdent(c.flag) + " boolean NOT NULL DEFAULT false"}
+	if len(c.timestamp) != 0 {
+		defs = append(defs, pgIdent(c.timestamp)+" timestamp with time zone")
+	}
+	return defs
+}
+
+// ADD COLUMN actions of ALTER TABLE for tables created before soft delete
+// was enabled. Existing rows are not deleted
+func (c *softDeleteColumns) addColumns() []string {
+	actions := make([]string, 0)
+	for _, def := range c.columnDefs() {
+		actions = append(actions, "ADD COLUMN IF NOT EXISTS "+def)
+	}
+	return actions
+}
+
+// names and values of columns set by insert (deleted is false) or by delete
+func (c *softDeleteColumns) values(deleted bool, event *structs.Event) ([]string, []string) {
+	if c == nil {
+		return nil, nil
+	}
+	names := []string{c.flag}
+	values := []string{"false"}
+	if deleted {
+		values[0] = "true"
+	}
+	if len(c.timestamp) != 0 {
+		names = append(names, c.timestamp)
+		if deleted {
+			values = append(values, eventTime(event))
+		} else {
+			values = append(values, "NULL")
+		}
+	}
+	return names, values
+}
@@ -0,0 +1,97 @@
+package pgfuncs
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestSoftDeleteQueries(t *testing.T) {
+	soft := NewSoftDelete()
+	if err := soft.AddTables([]string{"db1.tab1"}, "_deleted", "_deleted_at"); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{SoftDelete: soft}
+
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns:    testColumns(),
+		EventType:  structs.DELETE_EVENT,
+		OldValues:  [][]*structs.QueryValues{testRow(uint32(1), "a", byte(1))},
+		Timestamp:  1600000000,
+	}
+
+	sql, err := GenQuery(event, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `UPDATE "db1"."tab1" SET "_deleted" = true, "_deleted_at" = to_timestamp(1600000000) WHERE "id" = '1'; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect soft delete query",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	event.EventType = structs.INSERT_EVENT
+	sql, err = GenQuery(event, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `INSERT INTO "db1"."tab1" ("id", "name", "state", "_deleted", "_deleted_at") VALUES ('1', 'a', 'new', false, NULL) ` +
+		`ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "state" = EXCLUDED."state", ` +
+		`"_deleted" = EXCLUDED."_deleted", "_deleted_at" = EXCLUDED."_deleted_at"; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect insert into soft delete table",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	event.TableName = "tab2"
+	event.EventType = structs.DELETE_EVENT
+	sql, err = GenQuery(event, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `DELETE FROM "db1"."tab2" WHERE "id" = '1'; `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect delete from table without soft delete",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	sql, err = ConvertMysql57ToPostgres("SET SEARCH_PATH TO \"db1\"; CREATE TABLE `tab1` (`id` int(11))", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `SET SEARCH_PATH TO "db1"; CREATE TABLE "db1"."tab1" ("id" bigint, "_deleted" boolean NOT NULL DEFAULT false, ` +
+		`"_deleted_at" timestamp with time zone);`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect create of soft delete table",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	// table created before soft delete was enabled
+	sql = ProvisionTable("db1", "tab1", testColumns(), opts)
+	expected = `ALTER TABLE IF EXISTS "db1"."tab1" ADD COLUMN IF NOT EXISTS "_deleted" boolean NOT NULL DEFAULT false, ` +
+		`ADD COLUMN IF NOT EXISTS "_deleted_at" timestamp with time zone;`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect provision of existing soft delete table",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+	if sql = ProvisionTable("db1", "tab2", testColumns(), opts); sql != "" {
+		t.Fatal("Incorrect provision of table without soft delete", "expected", "", "got", sql)
+	}
+}
@@ -0,0 +1,183 @@
+// mapping of mysql column types to postgres types
+
+package pgfuncs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+type typeRule struct {
+	from    *DataType
+	to      string
+	tables  map[string]bool // schema.table, empty if rule is not limited to tables
+	columns map[string]bool // schema.table.column, empty if rule is not limited to columns
+}
+
+// TypeMap gives postgres type of mysql column. Rules added by AddRule are
+// checked before built-in defaults: rules for columns first, then rules for
+// tables, then global rules. Within one level the rule added first wins.
+// The same map is used for DDL and for encoding values, so written values
+// always match the type of destination column
+type TypeMap struct {
+	rules []*typeRule
+	mutex sync.Mutex
+	cache map[string]string // postgres types of event columns, key is schema.table.column.type
+}
+
+func NewTypeMap() *TypeMap {
+	return &TypeMap{cache: make(map[string]string)}
+}
+
+// Adds mapping of mysql type from to postgres type to.
+// from is type name, optionally with arguments and unsigned, e.g. double,
+// tinyint(1) or bigint unsigned. Type without arguments matches any arguments.
+// $args in to is replaced by arguments of mysql type, e.g. varchar($args)
+func (m *TypeMap) AddRule(from string, to string, tables []string, columns []string) error {
+	dt, err := ParseMysqlType(from)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot parse mysql type %v. %v", from, err))
+	}
+	if len(strings.TrimSpace(to)) == 0 {
+		return errors.New(fmt.Sprintf("Postgres type for %v is empty", from))
+	}
+
+	rule := &typeRule{from: dt, to: strings.TrimSpace(to), tables: make(map[string]bool), columns: make(map[string]bool)}
+	for _, t := range tables {
+		if len(strings.Split(t, ".")) != 2 {
+			return errors.New(fmt.Sprintf("Tables of type mapping should be in format schema.table. Got %v", t))
+		}
+		rule.tables[t] = true
+	}
+	for _, c := range columns {
+		if len(strings.Split(c, ".")) != 3 {
+			return errors.New(fmt.Sprintf("Columns of type mapping should be in format schema.table.column. Got %v", c))
+		}
+		rule.columns[c] = true
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rules = append(m.rules, rule)
+	m.cache = make(map[string]string)
+	return nil
+}
+
+func (r *typeRule) matches(dt *DataType) bool {
+	if r.from.Name != dt.Name || (r.from.Unsigned && !dt.Unsigned) {
+		return false
+	}
+	if len(r.from.Args) != 0 && strings.Join(r.from.Args, ",") != strings.Join(dt.Args, ",") {
+		return false
+	}
+	return true
+}
+
+func (r *typeRule) pgType(dt *DataType) string {
+	args := strings.Join(dt.Args, ",")
+	if len(args) == 0 {
+		return strings.Replace(r.to, "($args)", "", -1)
+	}
+	return strings.Replace(r.to, "$args", args, -1)
+}
+
+// postgres type of column of table schema.table. Nil map gives default types
+func (m *TypeMap) PgType(schema string, table string, column string, dt *DataType) (string, error) {
+	if m != nil {
+		m.mutex.Lock()
+		rules := m.rules
+		m.mutex.Unlock()
+
+		t := schema + "." + table
+		c := t + "." + column
+		for _, level := range []int{0, 1, 2} {
+			for _, r := range rules {
+				var ok bool
+				switch level {
+				case 0:
+					ok = r.columns[c]
+				case 1:
+					ok = len(r.columns) == 0 && r.tables[t]
+				case 2:
+					ok = len(r.columns) == 0 && len(r.tables) == 0
+				}
+				if ok && r.matches(dt) {
+					return r.pgType(dt), nil
+				}
+			}
+		}
+	}
+	return defaultPgType(dt)
+}
+
+// postgres type of event column. Empty if type cannot be mapped
+func (m *TypeMap) ColumnType(schema string, table string, column *structs.Column) string {
+	key := schema + "." + table + "." + column.Name + "." + column.Type
+	if m != nil {
+		m.mutex.Lock()
+		pgtype, ok := m.cache[key]
+		m.mutex.Unlock()
+		if ok {
+			return pgtype
+		}
+	}
+
+	var pgtype string
+	if dt, err := ParseMysqlType(column.Type); err == nil {
+		pgtype, _ = m.PgType(schema, table, column.Name, dt)
+	}
+
+	if m != nil {
+		m.mutex.Lock()
+		m.cache[key] = pgtype
+		m.mutex.Unlock()
+	}
+	return pgtype
+}
+
+// built-in mapping
+func defaultPgType(dt *DataType) (string, error) {
+	args := strings.Join(dt.Args, ",")
+	switch dt.Name {
+	case "tinyint", "smallint", "year":
+		return "int", nil
+	case "mediumint", "int", "bigint", "serial":
+		return "bigint", nil
+	case "float", "double":
+		return "decimal", nil
+	case "decimal":
+		if len(args) == 0 {
+			return "decimal", nil
+		}
+		return "decimal(" + args + ")", nil
+	case "bit":
+		if len(args) == 0 {
+			return "bit", nil
+		}
+		return "bit(" + args + ")", nil
+	case "char", "nchar", "varchar", "nvarchar":
+		name := strings.TrimPrefix(dt.Name, "n")
+		if len(args) == 0 {
+			return name, nil
+		}
+		return name + "(" + args + ")", nil
+	case "tinytext", "text", "mediumtext", "longtext", "tinyblob", "blob", "mediumblob", "longblob",
+		"binary", "varbinary", "set":
+		return "text", nil
+	case "enum":
+		return "varchar(100)", nil
+	case "date":
+		return "date", nil
+	case "datetime", "timestamp":
+		return "timestamp", nil
+	case "time":
+		return "time", nil
+	case "json":
+		return "json", nil
+	}
+	return "", errors.New(fmt.Sprintf("Unsupported mysql column type %v", dt.Name))
+}
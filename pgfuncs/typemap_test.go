@@ -0,0 +1,93 @@
+package pgfuncs
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestTypeMapRules(t *testing.T) {
+	types := NewTypeMap()
+	if err := types.AddRule("tinyint(1)", "boolean", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.AddRule("double", "double precision", []string{"db1.tab1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.AddRule("double", "decimal(10,2)", nil, []string{"db1.tab1.price"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.AddRule("char", "varchar($args)", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		table, column, mysql, expected string
+	}{
+		{"tab1", "flag", "tinyint(1)", "boolean"},
+		{"tab1", "num", "tinyint(4)", "int"},
+		{"tab1", "ratio", "double", "double precision"},
+		{"tab1", "price", "double", "decimal(10,2)"},
+		{"tab2", "ratio", "double", "decimal"},
+		{"tab2", "code", "char(3)", "varchar(3)"},
+		{"tab2", "code", "char", "varchar"},
+	} {
+		pgtype := types.ColumnType("db1", c.table, &structs.Column{Name: c.column, Type: c.mysql})
+		if pgtype != c.expected {
+			t.Fatal(
+				"Incorrect type of", c.table, c.column, c.mysql,
+				"expected", c.expected,
+				"got", pgtype,
+			)
+		}
+	}
+
+	sql, err := ConvertMysql57ToPostgres("CREATE TABLE `db1`.`tab1` (`flag` tinyint(1), `price` double)", &Options{Types: types})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `CREATE TABLE "db1"."tab1" ("flag" boolean, "price" decimal(10,2));`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect mapped types in DDL",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
+
+func TestTypeMapValues(t *testing.T) {
+	types := NewTypeMap()
+	types.AddRule("tinyint(1)", "boolean", nil, nil)
+	types.AddRule("enum", "smallint", nil, []string{"db1.tab1.state"})
+	types.AddRule("varbinary", "bytea", nil, nil)
+
+	event := &structs.Event{
+		SchemaName: "db1",
+		TableName:  "tab1",
+		Columns: []*structs.Column{
+			&structs.Column{Name: "flag", Type: "tinyint(1)"},
+			&structs.Column{Name: "state", Type: "enum('new','done')", Enum: []string{"new", "done"}},
+			&structs.Column{Name: "hash", Type: "varbinary(4)"},
+		},
+		EventType: structs.INSERT_EVENT,
+		OldValues: [][]*structs.QueryValues{[]*structs.QueryValues{
+			&structs.QueryValues{ColumnId: 0, Value: int8(1)},
+			&structs.QueryValues{ColumnId: 1, Value: byte(2)},
+			&structs.QueryValues{ColumnId: 2, Value: []byte{0xde, 0xad}},
+		}},
+	}
+
+	sql, err := GenQuery(event, &Options{Types: types})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `INSERT INTO "db1"."tab1" ("flag", "state", "hash") VALUES (true, '2', '\xdead'); `
+	if sql != expected {
+		t.Fatal(
+			"Incorrect values for mapped types",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+}
@@ -0,0 +1,245 @@
+// comparison of mysql rows with rows of destination tables
+
+package pgfuncs
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+// Validation compares rows of mysql table with rows of its destination.
+// Values of both sides are normalised to the text they have in destination
+// column, so values written by GenQuery compare equal whatever driver
+// returned them
+type Validation struct {
+	columns  []*structs.Column
+	tg       *target
+	keys     int    // number of key columns, they go first in compared columns
+	compared []int  // indexes of replicated columns
+	live     string // predicate of live rows in destination, empty for mirrored tables
+}
+
+// Creates validation of mysql table. Table must have key (see structs.Column.IsKey)
+func NewValidation(schema string, table string, columns []*structs.Column, opts *Options) (*Validation, error) {
+	v := &Validation{columns: columns, tg: opts.target(schema, table, columns)}
+	for idc, column := range columns {
+		if column.IsKey {
+			if column.ExcludedFromReplication {
+				return nil, errors.New(fmt.Sprintf("Key column %v of %v.%v is excluded from replication", column.Name, schema, table))
+			}
+			v.compared = append(v.compared, idc)
+		}
+	}
+	v.keys = len(v.compared)
+	if v.keys == 0 {
+		return nil, errors.New(fmt.Sprintf("Table %v.%v has no key to validate it by chunks", schema, table))
+	}
+	for idc, column := range columns {
+		if !column.IsKey && !column.ExcludedFromReplication {
+			v.compared = append(v.compared, idc)
+		}
+	}
+
+	if v.tg.hist != nil {
+		v.live = pgIdent(v.tg.hist.current)
+	} else if v.tg.soft != nil {
+		v.live = "NOT " + pgIdent(v.tg.soft.flag)
+	}
+	return v, nil
+}
+
+// indexes of compared columns. Key columns go first, rows of both sides
+// have values of these columns in this order
+func (v *Validation) Columns() []int {
+	return v.compared
+}
+
+// number of key columns
+func (v *Validation) Keys() int {
+	return v.keys
+}
+
+// Generates select of destination rows with keys after from and up to to.
+// Keys are values of key columns read from mysql, nil means no bound
+func (v *Validation) Select(from []interface{}, to []interface{}) string {
+	var names []string
+	for _, idc := range v.compared {
+		names = append(names, v.tg.names[idc])
+	}
+	sql := fmt.Sprintf("SELECT %v FROM %v", strings.Join(names, ", "), v.tg.table)
+
+	var conds []string
+	keys := strings.Join(names[:v.keys], ", ")
+	if from != nil {
+		conds = append(conds, fmt.Sprintf("(%v) > (%v)", keys, v.keyValues(from)))
+	}
+	if to != nil {
+		conds = append(conds, fmt.Sprintf("(%v) <= (%v)", keys, v.keyValues(to)))
+	}
+	if len(v.live) != 0 {
+		conds = append(conds, v.live)
+	}
+	if len(conds) != 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return sql + ";"
+}
+
+func (v *Validation) keyValues(key []interface{}) string {
+	values := make([]string, len(key))
+	for idk, value := range key {
+		idc := v.compared[idk]
+		values[idk] = pgValue(v.columns[idc], v.tg.types[idc], value)
+	}
+	return strings.Join(values, ", ")
+}
+
+// Checksum of rows which have values of Columns(). Order of rows does not
+// matter. source tells rows are read from mysql, their values are masked
+// and converted as GenQuery does
+func (v *Validation) Checksum(rows [][]interface{}, source bool) string {
+	texts := make([]string, len(rows))
+	for idr, row := range rows {
+		var sb strings.Builder
+		for idv, value := range row {
+			idc := v.compared[idv]
+			s, ok := v.normalize(idc, value, source)
+			if !ok {
+				sb.WriteString("\x00")
+				continue
+			}
+			sb.WriteString(s)
+			sb.WriteString("\x01")
+		}
+		texts[idr] = sb.String()
+	}
+	sort.Strings(texts)
+
+	h := sha256.New()
+	for _, t := range texts {
+		h.Write([]byte(t))
+		h.Write([]byte("\n"))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// text of value of column idc, ok is false for NULL
+func (v *Validation) normalize(idc int, value interface{}, source bool) (string, bool) {
+	column := v.columns[idc]
+	pgtype := v.tg.types[idc]
+	var s string
+	var ok bool
+	if source {
+		if column.Mask != nil {
+			value = column.Mask.Mask(column, value)
+		}
+		s, ok = pgText(column, pgtype, value)
+	} else {
+		s, ok = resultText(pgtype, value)
+	}
+	if !ok {
+		return "", false
+	}
+	return canonical(pgtype, s), true
+}
+
+// text of value returned by postgres driver
+func resultText(pgtype string, value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case []byte:
+		if pgtype == "bytea" {
+			return fmt.Sprintf("\\x%x", v), true
+		}
+		return string(v), true
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999Z07:00"), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return fmt.Sprintf("%v", value), true
+}
+
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// canonical text of value of pgtype. Values equal in postgres have equal text
+func canonical(pgtype string, s string) string {
+	if isBoolean(pgtype) {
+		switch strings.ToLower(s) {
+		case "t", "true", "1", "y", "yes", "on":
+			return "true"
+		}
+		return "false"
+	}
+
+	base := strings.ToLower(strings.TrimSpace(strings.SplitN(pgtype, "(", 2)[0]))
+	switch {
+	case base == "smallint" || base == "int" || base == "integer" || base == "bigint" || base == "int2" || base == "int4" || base == "int8":
+		if i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+			return strconv.FormatInt(i, 10)
+		}
+	case base == "numeric" || base == "decimal":
+		if _, ok := new(big.Rat).SetString(s); ok {
+			return canonicalDecimal(strings.TrimSpace(s))
+		}
+	case base == "real" || base == "float4":
+		if f, err := strconv.ParseFloat(s, 32); err == nil {
+			return strconv.FormatFloat(f, 'g', -1, 32)
+		}
+	case base == "double precision" || base == "float8" || base == "float":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	case strings.HasPrefix(base, "timestamp") || base == "date":
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.UTC().Format("2006-01-02 15:04:05.999999")
+			}
+		}
+	case base == "json" || base == "jsonb":
+		var j interface{}
+		if err := json.Unmarshal([]byte(s), &j); err == nil {
+			b, _ := json.Marshal(j)
+			return string(b)
+		}
+	case base == "char" || base == "character" || base == "bpchar":
+		return strings.TrimRight(s, " ")
+	case base == "bytea":
+		return strings.ToLower(s)
+	}
+	return s
+}
+
+// decimal without trailing zeros of fraction
+func canonicalDecimal(s string) string {
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(s, "0")
+		s = strings.TrimSuffix(s, ".")
+	}
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+"), "0")
+	if len(s) == 0 || s[0] == '.' {
+		s = "0" + s
+	}
+	if neg && s != "0" {
+		s = "-" + s
+	}
+	return s
+}
@@ -0,0 +1,50 @@
+package pgfuncs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestValidation(t *testing.T) {
+	columns := append(testColumns(), &structs.Column{Name: "price", Type: "decimal(10,2)"},
+		&structs.Column{Name: "created", Type: "datetime"}, &structs.Column{Name: "active", Type: "tinyint(1)"},
+		&structs.Column{Name: "secret", Type: "varchar(10)", ExcludedFromReplication: true})
+	v, err := NewValidation("db1", "tab1", columns, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql := v.Select([]interface{}{"10"}, []interface{}{"20"})
+	expected := `SELECT "id", "name", "state", "price", "created", "active" FROM "db1"."tab1" WHERE ("id") > ('10') AND ("id") <= ('20');`
+	if sql != expected {
+		t.Fatal(
+			"Incorrect select of chunk",
+			"expected", expected,
+			"got", sql,
+		)
+	}
+
+	// rows as read from mysql and from postgres, in different order
+	source := [][]interface{}{
+		{"1", "a", "new", "10.50", "2020-01-02 03:04:05", "1"},
+		{"2", nil, "done", "0.00", "2020-01-02 03:04:05.500000", "0"},
+	}
+	dest := [][]interface{}{
+		{int64(2), nil, "done", "0", time.Date(2020, 1, 2, 3, 4, 5, 5e8, time.UTC), int64(0)},
+		{int64(1), "a", "new", []byte("10.5"), time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), int64(1)},
+	}
+	if v.Checksum(source, true) != v.Checksum(dest, false) {
+		t.Fatal("Incorrect checksum, equal rows differ")
+	}
+
+	dest[1][1] = "b"
+	if v.Checksum(source, true) == v.Checksum(dest, false) {
+		t.Fatal("Incorrect checksum, different rows are equal")
+	}
+
+	if _, err := NewValidation("db1", "tab1", []*structs.Column{&structs.Column{Name: "a", Type: "int(11)"}}, nil); err == nil {
+		t.Fatal("Expected error for table without key")
+	}
+}
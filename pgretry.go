@@ -0,0 +1,162 @@
+// retries of transient errors in postgres destination
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/andsha/replicagor/pgfuncs"
+	"github.com/andsha/replicagor/structs"
+)
+
+/* Errors of postgres are classified by SQLSTATE (see pgfuncs.ClassifyError).
+Deadlocks, serialization failures and similar errors are retried, lost
+connections are restored before retrying, other errors stop replication.
+Events played since BEGIN are kept per buffer, so the whole transaction is
+rolled back and played again, then the failed event is played once more.
+Every buffer has own connection (see workers.go), so rollback and reconnect
+do not touch transactions of other buffers.
+Retries wait with exponential backoff and are configured in retry section
+	attempts = 5 (optional, default 5, 0 disables retries)
+	initialBackoff = 500ms (optional, default 500ms)
+	maxBackoff = 30s (optional, default 30s)
+*/
+
+type retryPolicy struct {
+	attempts int
+	initial  time.Duration
+	max      time.Duration
+}
+
+// time to wait before attempt, starting with 1
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	d := p.initial
+	for i := 1; i < attempt && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		return p.max
+	}
+	return d
+}
+
+// reads retry section of rconfig
+func (c *pgConnection) initRetry() error {
+	c.retries = retryPolicy{attempts: 5, initial: 500 * time.Millisecond, max: 30 * time.Second}
+	sections, err := c.rconf.GetSectionsByName("retry")
+	if err != nil { // no retry section, use defaults
+		return nil
+	}
+
+	if s, err := sections[0].GetSingleValue("attempts", ""); err == nil && len(s) != 0 {
+		if c.retries.attempts, err = strconv.Atoi(s); err != nil || c.retries.attempts < 0 {
+			return errors.New(fmt.Sprintf("attempts in retry section must be non-negative integer. Got %v", s))
+		}
+	}
+	if s, err := sections[0].GetSingleValue("initialBackoff", ""); err == nil && len(s) != 0 {
+		if c.retries.initial, err = time.ParseDuration(s); err != nil || c.retries.initial <= 0 {
+			return errors.New(fmt.Sprintf("initialBackoff in retry section must be positive duration like 500ms. Got %v", s))
+		}
+	}
+	if s, err := sections[0].GetSingleValue("maxBackoff", ""); err == nil && len(s) != 0 {
+		if c.retries.max, err = time.ParseDuration(s); err != nil || c.retries.max < c.retries.initial {
+			return errors.New(fmt.Sprintf("maxBackoff in retry section must be duration not less than initialBackoff. Got %v", s))
+		}
+	}
+	return nil
+}
+
+// runs fn playing event e (nil for flushes) of buffer buf. Transient
+// errors make the buffer's transaction run again
+func (c *pgConnection) withRetry(buf int, e *structs.Event, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil; attempt++ {
+		class := pgfuncs.ClassifyError(err)
+		if class == pgfuncs.FatalError || attempt > c.retries.attempts {
+			return err
+		}
+		wait := c.retries.backoff(attempt)
+		c.logging.Warnf("Retrying transaction of buffer %v at %v in %v, attempt %v of %v. %v error: %v",
+			buf, c.position(buf, e), wait, attempt, c.retries.attempts, class, err)
+		time.Sleep(wait)
+		if err = c.replay(buf, class); err == nil {
+			err = fn()
+		}
+	}
+	c.logEvent(buf, e)
+	return nil
+}
+
+// rolls back transaction of buffer or reconnects, and plays events of the transaction again
+func (c *pgConnection) replay(buf int, class pgfuncs.ErrorClass) error {
+	c.batches.drop(buf)
+	c.txMutex.Lock()
+	events := c.txLogs[buf]
+	delete(c.txs, buf)
+	c.txMutex.Unlock()
+
+	if class == pgfuncs.ConnectionError {
+		if err := c.reconnect(); err != nil {
+			return err
+		}
+	} else if len(events) != 0 {
+		if err := c.runQuery("ROLLBACK;"); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range events {
+		if err := c.apply(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keeps played event while buffer is in transaction
+func (c *pgConnection) logEvent(buf int, e *structs.Event) {
+	if e == nil {
+		return
+	}
+	c.txMutex.Lock()
+	defer c.txMutex.Unlock()
+	if c.txs[buf] {
+		c.txLogs[buf] = append(c.txLogs[buf], e)
+	} else {
+		delete(c.txLogs, buf)
+	}
+}
+
+// binlog position of event e or of the last event of buffer's transaction
+func (c *pgConnection) position(buf int, e *structs.Event) string {
+	if e == nil {
+		c.txMutex.Lock()
+		if events := c.txLogs[buf]; len(events) != 0 {
+			e = events[len(events)-1]
+		}
+		c.txMutex.Unlock()
+	}
+	if e == nil {
+		return "unknown position"
+	}
+	pos := e.EventPosition
+	if pos == 0 {
+		pos = e.Position
+	}
+	return fmt.Sprintf("%v:%v", e.File, pos)
+}
+
+func (c *pgConnection) reconnect() error {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	c.process.CloseDB() // lost connection of this buffer only
+	if err := c.blconnect(); err != nil {
+		c.logging.Errorf("Cannot reconnect to postgres. ERROR: %v", err)
+		return err
+	}
+	c.logging.Info("Reconnected to postgres")
+	return nil
+}
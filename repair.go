@@ -0,0 +1,432 @@
+// repair of destination tables by reading their rows from mysql again
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andsha/replicagor/mysqlconnection"
+	"github.com/andsha/replicagor/pgfuncs"
+	"github.com/andsha/replicagor/structs"
+	"github.com/andsha/vconfig"
+)
+
+/* Tables, ranges of keys or single rows are repaired while replication runs:
+rows are read from mysql again, upserted into destination and rows missing in
+mysql are deleted (if deletes of table are replicated). Repairs are queued in
+repair queue table of destination by conflict policy repair or with
+	replicagor -repair db1.table1 [-ranges '[[null, [1000]], [[1000], [2000]]]']
+where ranges are [from, to] pairs of key values, from excluded, null is no bound.
+Running replicagor polls the queue and repairs one table at a time in chunks
+ordered by key. Chunk is read between low and high watermark rows written
+into watermark table of mysql. Binlog events of the table between the
+watermarks are newer than rows read, so their rows are left out of the chunk
+and the chunk is played at the high watermark in order with other events of
+the table. No event is lost or applied twice. Repairs are configured in
+repairQueue section of rconfig, the section enables repairs
+	table = replicagor.repair_queue (optional, default replicagor.repair_queue, postgres)
+	watermarkTable = replicagor.repair_watermark (optional, default replicagor.repair_watermark, mysql)
+	chunkSize = 1000 (optional, default 1000)
+	interval = 10s (optional, default 10s, how often queue is polled)
+Watermark table is created in mysql, so the user needs rights to create and
+write it. History tables are not repaired.
+Repair of table without ranges is snapshot load of the table: all its rows
+are copied in chunks into destination table (which must exist), e.g. for a
+table added to replication after start. Rows of chunks are filtered, masked
+and renamed like rows of binlog events. Row filter is applied to rows read,
+so chunk bounds follow rows of mysql table and rows out of filter are
+deleted from destination like rows of chunk missing in mysql
+*/
+
+type repairConfig struct {
+	queue     string // postgres table of queue
+	schema    string // mysql watermark table
+	table     string
+	chunkSize int
+	interval  time.Duration
+}
+
+// reads repairQueue section of rconfig. Repairs are enabled by the section or
+// by conflict policy repair, nil is returned if they are disabled
+func readRepairConfig(rconf vconfig.VConfig) (*repairConfig, error) {
+	cfg := &repairConfig{queue: "replicagor.repair_queue", schema: "replicagor", table: "repair_watermark",
+		chunkSize: 1000, interval: 10 * time.Second}
+	sections, err := rconf.GetSectionsByName("repairQueue")
+	if err != nil {
+		policies, err := rconf.GetSectionsByName("conflictPolicy")
+		if err != nil {
+			return nil, nil
+		}
+		for _, sec := range policies {
+			if policy, _ := sec.GetSingleValue("policy", ""); policy == conflictRepair {
+				return cfg, nil
+			}
+		}
+		return nil, nil
+	}
+
+	cfg.queue, _ = sections[0].GetSingleValue("table", cfg.queue)
+	if s, err := sections[0].GetSingleValue("watermarkTable", ""); err == nil && len(s) != 0 {
+		st := strings.Split(strings.TrimSpace(s), ".")
+		if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+			return nil, errors.New(fmt.Sprintf("watermarkTable in repairQueue section should be schemaname.tablename. Got %v", s))
+		}
+		cfg.schema, cfg.table = st[0], st[1]
+	}
+	if s, err := sections[0].GetSingleValue("chunkSize", ""); err == nil && len(s) != 0 {
+		if cfg.chunkSize, err = strconv.Atoi(s); err != nil || cfg.chunkSize < 1 {
+			return nil, errors.New(fmt.Sprintf("chunkSize in repairQueue section must be positive integer. Got %v", s))
+		}
+	}
+	if s, err := sections[0].GetSingleValue("interval", ""); err == nil && len(s) != 0 {
+		if cfg.interval, err = time.ParseDuration(s); err != nil || cfg.interval <= 0 {
+			return nil, errors.New(fmt.Sprintf("interval in repairQueue section must be positive duration like 10s. Got %v", s))
+		}
+	}
+	return cfg, nil
+}
+
+func repairName(req *structs.Repair) string {
+	name := fmt.Sprintf("repair %v of %v.%v", req.Id, req.Schema, req.Table)
+	switch {
+	case req.Key != nil:
+		name += fmt.Sprintf(" key %v", req.Key)
+	case req.From != nil || req.To != nil:
+		name += fmt.Sprintf(" keys %v", validateChunk{from: req.From, to: req.To})
+	}
+	return name
+}
+
+// polls repair queue of destination and repairs queued tables one at a time
+func (r *replicagor) repairRoutine(interval time.Duration, stop <-chan bool, stopped chan<- bool) {
+	started := make(map[int64]bool) // requests repaired or failed by this run
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			stopped <- true
+			return
+		case <-ticker.C:
+		}
+
+		reqs, err := r.dest.repairRequests()
+		if err != nil {
+			r.logging.Errorf("Cannot read repair queue: %v", err)
+			continue
+		}
+		for _, req := range reqs {
+			if started[req.Id] {
+				continue
+			}
+			started[req.Id] = true
+			r.logging.Infof("Starting %v", repairName(req))
+			ok, err := r.source.repair(req, stop)
+			if !ok {
+				stopped <- true
+				return
+			}
+			if err != nil { // request stays in queue and is repaired after restart
+				r.logging.Errorf("Cannot finish %v: %v", repairName(req), err)
+				continue
+			}
+			r.logging.Infof("Finished reading %v", repairName(req))
+		}
+	}
+}
+
+func (c *mysqlConnection) repairRequests() ([]*structs.Repair, error) {
+	return nil, errors.New("Mysql has no repair queue")
+}
+
+func (c *mysqlConnection) queueRepair(schema string, table string, ranges [][2][]interface{}) error {
+	return errors.New("Mysql has no repair queue")
+}
+
+// creates watermark table in mysql
+func (c *mysqlConnection) initRepairs() error {
+	cfg, err := readRepairConfig(c.rconf)
+	if err != nil || cfg == nil {
+		return err
+	}
+	c.repairCfg = cfg
+	c.repairRun = time.Now().UnixNano()
+	for _, q := range []string{
+		fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %v", mysqlIdent(cfg.schema)),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v.%v (id varchar(64) NOT NULL, mark varchar(4) NOT NULL, "+
+			"PRIMARY KEY (id, mark))", mysqlIdent(cfg.schema), mysqlIdent(cfg.table)),
+	} {
+		if _, err := c.sqlprocess.Run(q); err != nil {
+			return errors.New(fmt.Sprintf("Cannot create repair watermark table %v.%v: %v", cfg.schema, cfg.table, err))
+		}
+	}
+	return nil
+}
+
+// repairs table of request chunk by chunk. Returns false if stop was received
+func (c *mysqlConnection) repair(req *structs.Repair, stop <-chan bool) (bool, error) {
+	if c.repairCfg == nil || c.eventlog == nil {
+		return true, errors.New("Repairs are disabled")
+	}
+	t := c.GetTableFromRinfo(req.Schema, req.Table)
+	if t == nil || t.ExcludedFromReplication {
+		return true, errors.New(fmt.Sprintf("Table %v.%v is not replicated", req.Schema, req.Table))
+	}
+	if t.History {
+		return true, errors.New(fmt.Sprintf("History table %v.%v cannot be repaired", req.Schema, req.Table))
+	}
+	var names, keys []string
+	var keyIds []int
+	for idc, column := range t.Columns {
+		names = append(names, mysqlIdent(column.Name))
+		if column.IsKey {
+			keys = append(keys, mysqlIdent(column.Name))
+			keyIds = append(keyIds, idc)
+		}
+	}
+	if len(keys) == 0 {
+		return true, errors.New(fmt.Sprintf("Table %v.%v has no key to repair it", req.Schema, req.Table))
+	}
+
+	from := req.From
+	for n := 0; ; n++ {
+		chunk := &structs.RepairChunk{Repair: req, From: from, Delete: t.EnableDelete || t.SoftDelete}
+		w := &mysqlconnection.RepairWindow{Id: fmt.Sprintf("%v-%v-%v", c.repairRun, req.Id, n), Schema: req.Schema,
+			Table: t, Buf: t.Buf, Chunk: chunk, Done: make(chan bool)}
+		c.eventlog.AddRepairWindow(w)
+
+		rows, err := c.readChunk(w, repairSelect(req, t, names, keys, from, c.repairCfg.chunkSize))
+		if err != nil {
+			c.eventlog.RemoveRepairWindow(w.Id)
+			return true, err
+		}
+		chunk.Last = req.Key != nil || len(rows) < c.repairCfg.chunkSize
+		if chunk.Last {
+			chunk.To = req.To
+		} else {
+			for _, idc := range keyIds {
+				chunk.To = append(chunk.To, rows[len(rows)-1][idc].Value)
+			}
+		}
+		if rows, err = filterChunk(t, rows); err != nil {
+			c.eventlog.RemoveRepairWindow(w.Id)
+			return true, err
+		}
+		c.eventlog.SetRepairRows(w.Id, rows)
+		if err := c.writeWatermark(w.Id, "high"); err != nil {
+			c.eventlog.RemoveRepairWindow(w.Id)
+			return true, err
+		}
+
+		select {
+		case <-w.Done:
+		case <-stop:
+			c.eventlog.RemoveRepairWindow(w.Id)
+			return false, nil
+		}
+		if _, err := c.sqlprocess.Run(fmt.Sprintf("DELETE FROM %v.%v WHERE id = %v", mysqlIdent(c.repairCfg.schema),
+			mysqlIdent(c.repairCfg.table), mysqlValues([]interface{}{w.Id}))); err != nil {
+			c.logging.Warnf("Cannot delete repair watermarks %v: %v", w.Id, err)
+		}
+		if chunk.Last {
+			return true, nil
+		}
+		from = chunk.To
+	}
+}
+
+// reads rows of chunk after low watermark
+func (c *mysqlConnection) readChunk(w *mysqlconnection.RepairWindow, query string) ([][]*structs.QueryValues, error) {
+	if err := c.writeWatermark(w.Id, "low"); err != nil {
+		return nil, err
+	}
+	res, err := c.sqlprocess.Run(query)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot read rows to repair: %v. ERROR: %v", query, err))
+	}
+	rows := make([][]*structs.QueryValues, len(res))
+	for idr, r := range res {
+		rows[idr] = make([]*structs.QueryValues, len(r))
+		for idc, v := range r {
+			rows[idr][idc] = &structs.QueryValues{ColumnId: idc, Value: v}
+		}
+	}
+	return rows, nil
+}
+
+func (c *mysqlConnection) writeWatermark(id string, mark string) error {
+	_, err := c.sqlprocess.Run(fmt.Sprintf("INSERT INTO %v.%v (id, mark) VALUES (%v)", mysqlIdent(c.repairCfg.schema),
+		mysqlIdent(c.repairCfg.table), mysqlValues([]interface{}{id, mark})))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot write %v watermark of repair chunk %v: %v", mark, id, err))
+	}
+	return nil
+}
+
+// select of chunk of rows of request with keys after from
+func repairSelect(req *structs.Repair, t *structs.Table, names []string, keys []string, from []interface{}, limit int) string {
+	sql := fmt.Sprintf("SELECT %v FROM %v.%v", strings.Join(names, ", "), mysqlIdent(req.Schema), mysqlIdent(t.Name))
+	var conds []string
+	if req.Key != nil {
+		for name, v := range req.Key {
+			conds = append(conds, fmt.Sprintf("%v = %v", mysqlIdent(name), mysqlValues([]interface{}{v})))
+		}
+	} else {
+		if from != nil {
+			conds = append(conds, fmt.Sprintf("(%v) > (%v)", strings.Join(keys, ", "), mysqlValues(from)))
+		}
+		if req.To != nil {
+			conds = append(conds, fmt.Sprintf("(%v) <= (%v)", strings.Join(keys, ", "), mysqlValues(req.To)))
+		}
+	}
+	if len(conds) != 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return fmt.Sprintf("%v ORDER BY %v LIMIT %v", sql, strings.Join(keys, ", "), limit)
+}
+
+// rows of chunk matching row filter of table. Rows out of filter are left out
+// like rows of binlog events, so they are deleted from destination
+func filterChunk(t *structs.Table, rows [][]*structs.QueryValues) ([][]*structs.QueryValues, error) {
+	if t.RowFilter == nil {
+		return rows, nil
+	}
+	matched := make([][]*structs.QueryValues, 0, len(rows))
+	for _, row := range rows {
+		match, err := t.RowFilter.Match(t.Columns, row)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Cannot filter rows to repair of %v: %v", t.Name, err))
+		}
+		if match {
+			matched = append(matched, row)
+		}
+	}
+	return matched, nil
+}
+
+// creates repair queue of destination
+func (c *pgConnection) initRepairs() error {
+	cfg, err := readRepairConfig(c.rconf)
+	if err != nil || cfg == nil {
+		return err
+	}
+	c.repairs, err = pgfuncs.NewRepairQueue(cfg.queue)
+	return err
+}
+
+// queued repairs
+func (c *pgConnection) repairRequests() ([]*structs.Repair, error) {
+	if c.repairs == nil {
+		return nil, errors.New("Repairs are disabled, add repairQueue section to rconfig")
+	}
+	res, err := c.queryRows(c.repairs.Select())
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]*structs.Repair, 0, len(res))
+	for _, row := range res {
+		req, err := readRepair(row)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// reads row of repair queue: id, schema, table, key, range_from and range_to
+func readRepair(row []interface{}) (*structs.Repair, error) {
+	if len(row) < 6 {
+		return nil, errors.New(fmt.Sprintf("Unexpected row %v in repair queue", row))
+	}
+	id, err := strconv.ParseInt(resultText(row[0]), 10, 64)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Incorrect id %v in repair queue", row[0]))
+	}
+	req := &structs.Repair{Id: id, Schema: resultText(row[1]), Table: resultText(row[2])}
+	for idv, dest := range []interface{}{&req.Key, &req.From, &req.To} {
+		if row[idv+3] == nil {
+			continue
+		}
+		d := json.NewDecoder(strings.NewReader(resultText(row[idv+3])))
+		d.UseNumber()
+		if err := d.Decode(dest); err != nil {
+			return nil, errors.New(fmt.Sprintf("Incorrect keys %v of repair %v. %v", row[idv+3], id, err))
+		}
+	}
+	for k, v := range req.Key {
+		req.Key[k] = repairValue(v)
+	}
+	for _, bound := range [][]interface{}{req.From, req.To} {
+		for idv, v := range bound {
+			bound[idv] = repairValue(v)
+		}
+	}
+	return req, nil
+}
+
+// key value of json as text, numbers keep digits they have in json
+func repairValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case json.Number:
+		return t.String()
+	case string:
+		return t
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// queues repair of mysql table schema.table, ranges are [from, to] pairs of
+// key values. Whole table is repaired without ranges
+func (c *pgConnection) queueRepair(schema string, table string, ranges [][2][]interface{}) error {
+	if c.repairs == nil {
+		return errors.New("Repairs are disabled, add repairQueue section to rconfig")
+	}
+	if len(ranges) == 0 {
+		ranges = [][2][]interface{}{{nil, nil}}
+	}
+	var sql string
+	for _, r := range ranges {
+		q, err := c.repairs.InsertRange(schema, table, r[0], r[1])
+		if err != nil {
+			return err
+		}
+		sql += q
+	}
+	return c.runQuery(sql)
+}
+
+// plays chunk of repair and removes finished repair from queue.
+// Tables which are only audited have nothing to repair
+func (c *pgConnection) playRepair(e *structs.Event) error {
+	if err := c.flush(e.Buf); err != nil {
+		return err
+	}
+	var q string
+	if c.audit.Mirrors(e.SchemaName, e.TableName) {
+		var err error
+		if q, err = pgfuncs.GenRepair(e, &c.opts); err != nil {
+			c.logging.Errorf("Error while generating repair query in postgres. ERROR: %v", err)
+			return err
+		}
+	}
+	if e.Chunk.Last && c.repairs != nil {
+		q += c.repairs.Delete(e.Chunk.Repair.Id)
+		c.logging.Infof("Finished %v", repairName(e.Chunk.Repair))
+	}
+	if len(q) == 0 {
+		return nil
+	}
+	return c.runQuery(q)
+}
+
+func (c *pgConnection) repair(req *structs.Repair, stop <-chan bool) (bool, error) {
+	return true, errors.New("Postgres cannot be repaired as source")
+}
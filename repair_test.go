@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/rowfilter"
+	"github.com/andsha/replicagor/structs"
+)
+
+// row filter is applied to rows read, not to select of chunk
+func TestFilterChunk(t *testing.T) {
+	filter, err := rowfilter.Parse("region = 'EU' AND amount > 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tab := &structs.Table{Name: "orders", RowFilter: filter, Columns: []*structs.Column{
+		{Name: "id", Type: "int", IsKey: true}, {Name: "region", Type: "varchar(8)"}, {Name: "amount", Type: "int"}}}
+	row := func(id string, region interface{}, amount string) []*structs.QueryValues {
+		return []*structs.QueryValues{{ColumnId: 0, Value: id}, {ColumnId: 1, Value: region}, {ColumnId: 2, Value: amount}}
+	}
+
+	expected := "SELECT `id`, `region`, `amount` FROM `db1`.`orders` WHERE (`id`) > ('5') ORDER BY `id` LIMIT 3"
+	if sql := repairSelect(&structs.Repair{Schema: "db1", Table: "orders"}, tab, []string{"`id`", "`region`", "`amount`"},
+		[]string{"`id`"}, []interface{}{int64(5)}, 3); sql != expected {
+		t.Fatal("Incorrect select of chunk", "expected", expected, "got", sql)
+	}
+
+	rows, err := filterChunk(tab, [][]*structs.QueryValues{row("6", "EU", "20"), row("7", "US", "20"), row("8", nil, "20"),
+		row("9", "EU", "5"), row("10", []byte("EU"), "11")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0][0].Value != "6" || rows[1][0].Value != "10" {
+		t.Fatal("Incorrect filtered rows", "expected", "6, 10", "got", rows)
+	}
+
+	tab.RowFilter = nil
+	if rows, _ = filterChunk(tab, [][]*structs.QueryValues{row("6", "US", "1")}); len(rows) != 1 {
+		t.Fatal("Incorrect rows without filter", "expected", 1, "got", len(rows))
+	}
+}
@@ -1,16 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	//	"math/rand"
-	"errors"
+	"net/http"
 	"os"
 	"os/signal"
-	"syscall"
-	//	"time"
+	"reflect"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/andsha/replicagor/structs"
 	"github.com/andsha/vconfig"
@@ -22,6 +24,11 @@ type cmdFlags struct {
 	rConfigFile string
 	sConfigFile string
 	logfile     string
+	redrive     bool
+	stats       string
+	validate    bool
+	repair      string
+	ranges      string
 }
 
 //parse command line flags
@@ -30,16 +37,27 @@ func (flags *cmdFlags) parseCmdFlags() {
 	flag.StringVar(&flags.rConfigFile, "rconfig", "", "path to the file with configuration for schemas, tables, and fields")
 	flag.StringVar(&flags.sConfigFile, "sconfig", "", "path to the file with configuration for source")
 	flag.StringVar(&flags.logfile, "logfile", "/tmp/log.log", "Where to write logs")
+	flag.StringVar(&flags.stats, "stats", "", "Address like :8080 to serve counters at /debug/vars")
+	flag.BoolVar(&flags.validate, "validate", false, "Compare replicated tables of source and destination and exit")
+	flag.BoolVar(&flags.redrive, "redrive", false, "Play events of dead-letter store into destination and exit")
+	flag.StringVar(&flags.repair, "repair", "", "Queue repair of table like db1.table1 and exit")
+	flag.StringVar(&flags.ranges, "ranges", "", "Key ranges of -repair like [[null, [1000]], [[1000], [2000]]]")
 	flag.Parse()
 }
 
 // main class
 type replicagor struct {
-	logging *logrus.Logger               //logging
-	source  connection                   // replication master (copy from)
-	dest    connection                   // replication slave (copy to)
-	stops   map[chan bool]structs.STOPCH // map of channels: key is channel to stop routine. value is whether the routine stopped
-	blinfos []structs.BinLogInfo         // slice with information about binlog positions for latest event in every buffer
+	logging       *logrus.Logger               //logging
+	source        connection                   // replication master (copy from)
+	dest          connection                   // replication slave (copy to)
+	stops         map[chan bool]structs.STOPCH // map of channels: key is channel to stop routine. value is whether the routine stopped
+	checkpoints   *checkpoints                 // events not written yet holding binlog position
+	checkpointCfg *checkpointConfig            // how checkpoints are stored
+	repairs       *repairConfig                // nil if repairs are disabled
+	throttles     map[int]*throttle            // delays and rates of buffers
+	sched         *scheduler                   // weights of buffers
+	barrier       *barrier                     // nil unless buffers keep strict order
+	workers       map[int]int                  // apply workers of buffers having several
 }
 
 // Create replicator object, initialize source & destination, and create replication info
@@ -65,6 +83,46 @@ func NewReplicagor(rconf vconfig.VConfig, sconf vconfig.VConfig, logging *logrus
 	}
 	r.logging.Infof("Destination connection is OK")
 	r.dest = dest
+	if err := dest.provision(source); err != nil {
+		return nil, err
+	}
+
+	if r.checkpointCfg, err = readCheckpointConfig(rconf); err != nil {
+		return nil, err
+	}
+	if r.throttles, err = readThrottles(rconf); err != nil {
+		return nil, err
+	}
+	for buf, th := range r.throttles {
+		if th.delay > 0 && r.checkpointCfg.store != checkpointPostgres {
+			return nil, errors.New(fmt.Sprintf("Delayed buffer %v needs store = postgres in checkpoint section", buf))
+		}
+	}
+	if r.workers, err = readWorkers(rconf, r.throttles); err != nil {
+		return nil, err
+	}
+	if r.sched, err = newScheduler(rconf, source.getFreqs()); err != nil {
+		return nil, err
+	}
+	consistency, err := readConsistencyConfig(rconf)
+	if err != nil {
+		return nil, err
+	}
+	if consistency.order == orderStrict {
+		if len(r.throttles) != 0 {
+			return nil, errors.New("Strict order cannot be used with delayed buffers")
+		}
+		r.barrier = new(barrier)
+	}
+	if r.checkpointCfg.store == checkpointPostgres {
+		if err := r.resumeFromDestination(); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.repairs, err = readRepairConfig(rconf); err != nil {
+		return nil, err
+	}
 
 	return r, nil
 
@@ -76,11 +134,24 @@ func (r *replicagor) Run() error {
 	// create goroutines
 	conts := make([]chan bool, 0)
 	events := make([]chan *structs.Event, 0)
+	queues := make([]chan *structs.Event, 0) // events of buffer or its delay routine
+	wake := make(chan bool, 1)               // signals new events to control routine
 
 	// buffers
 	freqs := r.source.getFreqs()
-	blinfos := make([]structs.BinLogInfo, len(freqs))
-	r.blinfos = blinfos
+	dests, err := r.workerConnections(len(freqs))
+	if err != nil {
+		return err
+	}
+	r.checkpoints = newCheckpoints(r.source.GetSConfig(), r.checkpointCfg.interval)
+	spills := make(map[int]*spill) // events of delayed buffers waiting for delay
+	for idf, th := range r.throttles {
+		if th.delay > 0 {
+			if spills[idf], err = openSpill(th.spill, idf); err != nil {
+				return err
+			}
+		}
+	}
 	for idf, f := range freqs {
 		/* chan length shall be equal to number of buffers since
 		  killing loop in goroutine aways sends signal to all buffers
@@ -89,8 +160,9 @@ func (r *replicagor) Run() error {
 		cont := make(chan bool, 2)
 		conts = append(conts, cont)
 
-		event := make(chan *structs.Event, 500) // get channel length from config
+		event := make(chan *structs.Event, defaultQueue)
 		events = append(events, event)
+		queues = append(queues, event)
 
 		//		bli := structs.BinLogInfo{Position: 0, File: ""}
 		//		blinfos = append(blinfos, bli)
@@ -102,7 +174,54 @@ func (r *replicagor) Run() error {
 		stops[stop] = structs.STOPCH{Name: name, Stopped: stopped, Isbuff: true, BufCont: cont}
 		//fmt.Println("freq:", freqs[idf], stop, stopped)
 
-		go eventBuffer(idf, cont, event, r.dest, stop, stopped, blinfos)
+		if len(dests[idf]) > 1 {
+			pool := newWorkerPool(len(dests[idf]), r.barrier, r.checkpoints)
+			for w, dest := range dests[idf] {
+				stop_w := make(chan bool, 1)
+				stopped_w := make(chan bool, 1)
+				stops[stop_w] = structs.STOPCH{Name: fmt.Sprintf("Worker %v of buffer %v", w, idf), Stopped: stopped_w, Isbuff: true}
+				go pool.work(w, dest, stop_w, stopped_w, r.sched.stats[idf])
+			}
+			go dispatchEvents(cont, event, pool, stop, stopped)
+		} else {
+			cp := r.checkpoints
+			if sp, ok := spills[idf]; ok { // spilled events are held by checkpoint of buffer
+				cp = sp.checkpoints
+			}
+			go eventBuffer(idf, cont, event, dests[idf][0], stop, stopped, cp, r.sched.stats[idf], r.barrier)
+		}
+
+		delayed := event // events waiting for delay
+		if th, ok := r.throttles[idf]; ok {
+			queues[idf] = make(chan *structs.Event, th.queue)
+			delayed = queues[idf]
+			if sp, ok := spills[idf]; ok {
+				delayed = make(chan *structs.Event, defaultQueue)
+				stop_s := make(chan bool, 1)
+				stopped_s := make(chan bool, 1)
+				stops[stop_s] = structs.STOPCH{Name: fmt.Sprintf("Spill of buffer %v", idf), Stopped: stopped_s, Isbuff: false}
+				go spillEvents(queues[idf], sp, r.checkpoints, r.logging, stop_s, stopped_s)
+				stop_u := make(chan bool, 1)
+				stopped_u := make(chan bool, 1)
+				stops[stop_u] = structs.STOPCH{Name: fmt.Sprintf("Unspill of buffer %v", idf), Stopped: stopped_u, Isbuff: false}
+				go unspillEvents(sp, delayed, r.logging, stop_u, stopped_u)
+			}
+			stop_d := make(chan bool, 1)
+			stopped_d := make(chan bool, 1)
+			stops[stop_d] = structs.STOPCH{Name: fmt.Sprintf("Delay of buffer %v", idf), Stopped: stopped_d, Isbuff: false}
+			go delayEvents(delayed, event, th, wake, stop_d, stopped_d)
+		}
+		queue, sp := queues[idf], spills[idf]
+		r.sched.publish(idf, func() int {
+			n := len(event) // events to play
+			if queue != event {
+				n += len(queue) // events waiting for delay
+			}
+			if sp != nil {
+				n += len(delayed) + sp.pending()
+			}
+			return n
+		})
 	}
 
 	// control routine
@@ -111,7 +230,13 @@ func (r *replicagor) Run() error {
 	stops[stop_cr] = structs.STOPCH{Name: "Control", Stopped: stopped_cr, Isbuff: false}
 	//fmt.Println("control:", stop_cr, stopped_cr)
 
-	go r.controlRoutine(freqs, conts, stop_cr, stopped_cr)
+	go r.controlRoutine(r.sched, conts, events, wake, stop_cr, stopped_cr)
+
+	// checkpoint routine
+	stop_cp := make(chan bool, 1)
+	stopped_cp := make(chan bool, 1)
+	stops[stop_cp] = structs.STOPCH{Name: "Checkpoint", Stopped: stopped_cp, Isbuff: false}
+	go r.checkpoints.run(r.logging, stop_cp, stopped_cp)
 	r.stops = stops
 
 	// start dump and get event channel
@@ -137,27 +262,38 @@ func (r *replicagor) Run() error {
 		return err
 	}
 
+	if r.repairs != nil {
+		stop_rp := make(chan bool, 1) // channel to stop repair routine
+		stopped_rp := make(chan bool, 1)
+		stops[stop_rp] = structs.STOPCH{Name: "Repair", Stopped: stopped_rp, Isbuff: false}
+		go r.repairRoutine(r.repairs.interval, stop_rp, stopped_rp)
+	}
+
 	// termination channel
 	kill := make(chan os.Signal, 2)
 	signal.Notify(kill, os.Interrupt, syscall.SIGKILL, syscall.SIGINT, syscall.SIGTSTP, syscall.SIGTERM)
 
 	// listen for all stopped channels. Once receive stopped signal initiate stopAndExit (via stopchan)
 	stopchan := make(chan bool, 1)
+	quit := make(chan bool) // closed when replication is stopped by signal
 	go func() {
-		for {
-			for stop, stopped := range r.stops {
-				select {
-				case <-stopped.Stopped:
-					r.logging.Infof("%v routine has stopped. Will stop replication", stopped.Name)
-					if !stopped.Isbuff {
-						delete(stops, stop)
-					}
-					stopchan <- true
-					return
-				default:
-				}
-			}
+		keys := make([]chan bool, 0, len(r.stops))
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(quit)}}
+		for stop, stopped := range r.stops {
+			keys = append(keys, stop)
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stopped.Stopped)})
+		}
+		chosen, _, _ := reflect.Select(cases)
+		if chosen == 0 {
+			return
 		}
+		stop := keys[chosen-1]
+		stopped := stops[stop]
+		r.logging.Infof("%v routine has stopped. Will stop replication", stopped.Name)
+		if !stopped.Isbuff {
+			delete(stops, stop)
+		}
+		stopchan <- true
 	}()
 
 	// main cycle
@@ -165,6 +301,51 @@ func (r *replicagor) Run() error {
 
 	//numes := 0
 	//t1 := time.Now()
+	// sends event to its buffer
+	send := func(event *structs.Event) {
+		if r.barrier != nil {
+			r.barrier.add()
+		}
+		queues[event.Buf] <- event
+		select {
+		case wake <- true:
+		default: // control routine is already woken
+		}
+	}
+
+	// every buffer writes rows of transaction in own transaction: buffer gets
+	// BEGIN before its first row and COMMIT, which holds checkpoint until all
+	// buffers with rows of the transaction commit it
+	var begin *structs.Event     // BEGIN of open transaction
+	txBufs := make(map[int]bool) // buffers other than default with rows of open transaction
+	play := func(event *structs.Event) {
+		r.checkpoints.hold(event)
+		switch {
+		case event.Position == 0 && len(event.Query) != 0: // BEGIN
+			begin = event
+		case event.Position != 0: // COMMIT or statement
+			for buf := range txBufs {
+				commit := *event
+				commit.Buf, commit.Query = buf, "COMMIT"
+				r.checkpoints.share(event, &commit)
+				send(&commit)
+			}
+			begin, txBufs = nil, make(map[int]bool)
+		case event.Buf != 0 && begin != nil && !txBufs[event.Buf]:
+			b := *begin
+			b.Buf = event.Buf
+			r.checkpoints.hold(&b)
+			send(&b)
+			txBufs[event.Buf] = true
+		}
+		send(event)
+	}
+
+	// with strict order event ending transaction waits until buffers play
+	// events before it, then following events wait until it is played
+	input := echan // nil while waiting for buffers
+	var boundary *structs.Event
+	var drained <-chan bool
 
 	for {
 		select {
@@ -176,19 +357,36 @@ func (r *replicagor) Run() error {
 			switch k {
 			case syscall.SIGKILL, syscall.SIGINT, syscall.SIGTSTP, syscall.SIGTERM:
 				r.logging.Info("Receive termination signal. Will stop replication")
+				close(quit)
 				r.stopAndExit()
 				return errors.New("Replication stopped due to a termination signal")
 			}
-		case event, ok := <-echan: // get source event or channel closure
+		case event, ok := <-input: // get source event or channel closure
 			if ok {
-				events[event.Buf] <- event
+				if r.barrier != nil && event.Position != 0 {
+					boundary = event
+					input = nil
+					drained = r.barrier.wait()
+					continue
+				}
+				play(event)
 				//numes++
 			} else { // when channel closed
 				//fmt.Printf("done with %v events\n", numes)
+				input = nil
 			}
 			//			if numes >= 160000 {
 			//				fmt.Println(time.Now().Sub(t1).Nanoseconds()/1e6, "ms")
 			//			}
+		case <-drained: // buffers played events before boundary or boundary itself
+			if boundary != nil {
+				play(boundary)
+				boundary = nil
+				drained = r.barrier.wait()
+			} else {
+				drained = nil
+				input = echan
+			}
 		}
 
 	}
@@ -213,7 +411,10 @@ func (r *replicagor) stopAndExit() {
 		if stopped.Isbuff {
 			r.logging.Infof("Stopping routine %v", stopped.Name)
 			stop <- true
-			stopped.BufCont <- true // send to continue channel so that stop signal can be caught by the buffer
+			select {
+			case stopped.BufCont <- true: // send to continue channel so that stop signal can be caught by the buffer
+			default:
+			}
 			_, _ = <-stopped.Stopped
 			r.logging.Infof("Routine %v stopped", stopped.Name)
 
@@ -221,45 +422,15 @@ func (r *replicagor) stopAndExit() {
 	}
 
 	// finally write to sconfig latest valid binlog position and filename
-
-	s, err := r.source.GetSConfig().GetSingleValue("binlog", "position", "")
-	if err != nil {
-		r.logging.Error(err)
-		return
-	}
-	oldpos, _ := strconv.Atoi(s)
-
-	oldfile, err := r.source.GetSConfig().GetSingleValue("binlog", "file", "")
+	pos, file, err := r.checkpoints.save()
 	if err != nil {
-		r.logging.Error(err)
-		return
-	}
-
-	path, err := r.source.GetSConfig().GetSingleValue("File", "Path", "")
-	if err != nil {
-		r.logging.Error(err)
+		r.logging.Errorf("Cannot save latest valid binlogposition: %v", err)
 		return
 	}
 
-	pos, file := getsmallestPosition(r.blinfos, uint32(oldpos), oldfile)
-
 	fmt.Println("position:", pos)
 	fmt.Println("file:", file)
 
-	blsec, err := r.source.GetSConfig().GetSections("binlog")
-	if err != nil {
-		r.logging.Error("Cannot save latest valid binlogposition: %v", err)
-		return
-	}
-
-	blsec[0].SetValues("position", []string{fmt.Sprintf("%v", pos)})
-	blsec[0].SetValues("file", []string{file})
-
-	if err := r.source.GetSConfig().ToFile(path); err != nil {
-		r.logging.Errorf("Cannot save latest valid binlogposition: %v", err)
-		return
-	}
-
 	r.logging.Infof("Exited at %v binlogposition in %v", pos, file)
 
 	// disconect from source and destination
@@ -311,8 +482,9 @@ func getsmallestPosition(blinfos []structs.BinLogInfo, defpos uint32, deffile st
 without interruptions. Zeroeth buffer is default; no schema or table shall be assigned to it.
 Frequences are how often event plays with respect to default event, whose
 frequence is always 1 (play each time). e.g. buf/freq 0/1, 1/10, 2/100 means
-1st buffer play events evety 10th time whereas 2nd buffer plays events
-every 100th time.
+1st buffer gets 1/10 of turns of default buffer whereas 2nd buffer gets 1/100
+of them while all of them have events. Weights of buffers can be set instead
+(see scheduler.go).
 Frequency of default buffer must be 1 (plays each time).
 */
 
@@ -325,71 +497,105 @@ func eventBuffer(
 	dest connection,
 	stop <-chan bool,
 	stopped chan<- bool,
-	blinfos []structs.BinLogInfo,
+	checkpoints *checkpoints,
+	stats *bufferStats,
+	barrier *barrier,
 ) {
 	s := false
+	var unwritten []*structs.Event // played events with rows in pending batched inserts
+	// releases played events when destination has written them
+	written := func() {
+		for _, e := range unwritten {
+			checkpoints.written(e) // release checkpoint held by event
+			stats.played(e, time.Now())
+			if barrier != nil { // events before transaction boundary are written
+				barrier.done()
+			}
+		}
+		unwritten = unwritten[:0]
+	}
+	// writes pending batched inserts
+	flush := func() {
+		if err := dest.flushEvents(idf); err != nil {
+			stopped <- true
+			s = true
+			return
+		}
+		written()
+	}
+
 	for {
-		<-cont // wait for signal from control routine
 		select {
 		case <-stop: // stop goroutine
+			if !s && dest.flushEvents(idf) == nil {
+				written()
+			}
 			stopped <- true
 			return
-		default: // select below is under default (not another case) since
-			// we want to catch stop signal with 100% certanty.
-			// if event below is another case case <-stop will be caught
-			// randomly and loop can be dead on waiting for an event
-			select {
-			case e := <-event:
-				if !s {
-					if err := dest.playEvent(e); err != nil {
-						//fmt.Println("error while running query trying to stop replicagor")
-						stopped <- true
-						// continue cycle so it continues receiving events
-						// and is killed from stop routine
-						s = true
-						//fmt.Println("buffer stopped")
-					} else {
-						if e.Position != 0 { // write position only if event has info about it
-							blinfos[idf].Position = e.Position // write event's binlog position and filename
-							blinfos[idf].File = e.File         // write event's binlog position and filename
-						}
-					}
-				}
+		case <-cont: // wait for turn from control routine
+		}
 
-				//fmt.Println(idf, blinfos)
-			default: // if no event on channel, then skip
-				//time.Sleep(time.Second)
-				//fmt.Println("waiting for event", stop)
+		select {
+		case e := <-event:
+			if !s {
+				if err := dest.playEvent(e); err != nil {
+					//fmt.Println("error while running query trying to stop replicagor")
+					stopped <- true
+					// continue cycle so it continues receiving events
+					// and is killed from stop routine
+					s = true
+					//fmt.Println("buffer stopped")
+					continue
+				}
+				unwritten = append(unwritten, e)
+				if len(event) == 0 { // no more events, write pending batched inserts
+					flush()
+				} else if !dest.pending(idf) {
+					written()
+				}
+			}
+		default: // if no event on channel, write pending batched inserts
+			if !s {
+				flush()
 			}
 		}
 	}
 }
 
-// control routine
+// control routine. Gives turns to buffers with queued events as scheduled by
+// sched (see scheduler.go). Buffers which have not taken turns given before
+// are skipped, when all buffers with events are busy the routine waits until
+// one of them takes turn or wake is signalled for new events
 func (r *replicagor) controlRoutine(
-	freqs []int,
+	sched *scheduler,
 	conts []chan bool,
+	events []chan *structs.Event,
+	wake <-chan bool,
 	stop <-chan bool,
 	stopped chan<- bool,
-	//	bstops map[chan bool]structs.STOPCH,
 ) {
-	fcounter := make([]int, len(freqs)-1) // 0th element is default
-	copy(fcounter, freqs[1:])             //exclude default buffer from fcounter
-
 	for {
-		select {
-		case <-stop:
+		if idf := sched.next(events, conts); idf != -1 {
+			select {
+			case conts[idf] <- true:
+			default: // buffer got turn from elsewhere
+			}
+			continue
+		}
+
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stop)},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(wake)},
+		}
+		for idf, e := range events {
+			if len(e) != 0 { // busy buffer
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(conts[idf]),
+					Send: reflect.ValueOf(true)})
+			}
+		}
+		if chosen, _, _ := reflect.Select(cases); chosen == 0 {
 			stopped <- true
 			return
-		default:
-			for idf := range fcounter {
-				fcounter[idf]--
-				if fcounter[idf] == 0 {
-					conts[idf+1] <- true // send to non-default buffer based on its frequency
-					fcounter[idf] = freqs[idf+1]
-				}
-			}
-			conts[0] <- true // always send to default buffer
 		}
 	}
 }
@@ -439,6 +645,80 @@ func main() {
 		sconf.AddSection(s)
 	}
 
+	if len(cmdflags.stats) != 0 {
+		go func() {
+			if err := http.ListenAndServe(cmdflags.stats, nil); err != nil {
+				logging.Errorf("Cannot serve counters at %v: %v", cmdflags.stats, err)
+			}
+		}()
+	}
+
+	if cmdflags.redrive {
+		logging.Info("Playing dead-lettered events")
+		dest, err := NewConnection(DEST, sconf, rconf, logging)
+		if err != nil {
+			logging.Error(err)
+			return
+		}
+		applied, failed, err := dest.redrive()
+		if err != nil {
+			logging.Error(err)
+		}
+		logging.Infof("Applied %v dead-lettered events, %v events still fail", applied, failed)
+		fmt.Printf("Applied %v dead-lettered events, %v events still fail\n", applied, failed)
+		return
+	}
+
+	if len(cmdflags.repair) != 0 {
+		st := strings.Split(cmdflags.repair, ".")
+		if len(st) != 2 || len(st[0]) == 0 || len(st[1]) == 0 {
+			logging.Errorf("Table to repair should be schemaname.tablename. Got %v", cmdflags.repair)
+			return
+		}
+		var ranges [][2][]interface{}
+		if len(cmdflags.ranges) != 0 {
+			d := json.NewDecoder(strings.NewReader(cmdflags.ranges))
+			d.UseNumber() // large keys keep their digits
+			if err := d.Decode(&ranges); err != nil {
+				logging.Errorf("Incorrect ranges %v: %v", cmdflags.ranges, err)
+				return
+			}
+		}
+		dest, err := NewConnection(DEST, sconf, rconf, logging)
+		if err != nil {
+			logging.Error(err)
+			return
+		}
+		if err := dest.queueRepair(st[0], st[1], ranges); err != nil {
+			logging.Error(err)
+			return
+		}
+		logging.Infof("Queued repair of %v", cmdflags.repair)
+		fmt.Printf("Queued repair of %v\n", cmdflags.repair)
+		return
+	}
+
+	if cmdflags.validate {
+		logging.Info("Validating replicated tables")
+		source, err := NewConnection(SOURCE, sconf, rconf, logging)
+		if err != nil {
+			logging.Error(err)
+			return
+		}
+		dest, err := NewConnection(DEST, sconf, rconf, logging)
+		if err != nil {
+			logging.Error(err)
+			return
+		}
+		mismatches, err := dest.validate(source)
+		if err != nil {
+			logging.Error(err)
+		}
+		logging.Infof("Validation finished, %v mismatching chunks", mismatches)
+		fmt.Printf("Validation finished, %v mismatching chunks\n", mismatches)
+		return
+	}
+
 	myreplication, err := NewReplicagor(rconf, sconf, logging)
 	if err != nil {
 		logging.Error(err)
@@ -0,0 +1,547 @@
+// parser and nodes of filter predicates
+
+package rowfilter
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokQuotedIdent
+	tokString
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+func (t token) is(word string) bool {
+	return t.kind == tokIdent && strings.EqualFold(t.text, word)
+}
+
+func (t token) isPunct(p string) bool {
+	return t.kind == tokPunct && t.text == p
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$' || c >= 0x80
+}
+
+func tokenize(text string) ([]token, error) {
+	tokens := make([]token, 0)
+	n := len(text)
+	for i := 0; i < n; {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			var sb strings.Builder
+			j := i + 1
+			for ; ; j++ {
+				if j >= n {
+					return nil, errors.New(fmt.Sprintf("Unterminated quote at position %v of row filter %v", i, text))
+				}
+				if text[j] == '\\' && c != '`' && j+1 < n {
+					j++
+					sb.WriteByte(text[j])
+					continue
+				}
+				if text[j] == c {
+					if j+1 < n && text[j+1] == c {
+						sb.WriteByte(c)
+						j++
+						continue
+					}
+					break
+				}
+				sb.WriteByte(text[j])
+			}
+			kind := tokString
+			if c == '`' {
+				kind = tokQuotedIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: sb.String(), pos: i})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < n && (text[j] >= '0' && text[j] <= '9' || text[j] == '.' || text[j] == 'e' || text[j] == 'E' ||
+				((text[j] == '-' || text[j] == '+') && (text[j-1] == 'e' || text[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: text[i:j], pos: i})
+			i = j
+		case isIdentChar(c):
+			j := i
+			for j < n && isIdentChar(text[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: text[i:j], pos: i})
+			i = j
+		default:
+			if i+1 < n {
+				switch two := text[i : i+2]; two {
+				case "<=", ">=", "<>", "!=":
+					tokens = append(tokens, token{kind: tokPunct, text: two, pos: i})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()=<>,-+", rune(c)) {
+				return nil, errors.New(fmt.Sprintf("Unexpected symbol %q at position %v of row filter %v", c, i, text))
+			}
+			tokens = append(tokens, token{kind: tokPunct, text: string(c), pos: i})
+			i++
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: n}), nil
+}
+
+type node interface {
+	eval(r *rowValues) (tri, error)
+}
+
+type operand interface {
+	value(r *rowValues) (value, error)
+}
+
+type (
+	andNode struct{ left, right node }
+	orNode  struct{ left, right node }
+	notNode struct{ expr node }
+
+	// bare operand used as condition, e.g. is_active
+	truthNode struct{ op operand }
+
+	cmpNode struct {
+		op          string
+		left, right operand
+	}
+
+	inNode struct {
+		op   operand
+		list []operand
+		not  bool
+	}
+
+	betweenNode struct {
+		op, low, high operand
+		not           bool
+	}
+
+	isNullNode struct {
+		op  operand
+		not bool
+	}
+
+	likeNode struct {
+		op      operand
+		pattern operand
+		not     bool
+	}
+
+	columnRef struct{ name string }
+	literal   struct{ v value }
+)
+
+func (n *andNode) eval(r *rowValues) (tri, error) {
+	l, err := n.left.eval(r)
+	if err != nil || l == triFalse {
+		return l, err
+	}
+	rt, err := n.right.eval(r)
+	if err != nil {
+		return rt, err
+	}
+	if rt == triFalse {
+		return triFalse, nil
+	}
+	if l == triUnknown || rt == triUnknown {
+		return triUnknown, nil
+	}
+	return triTrue, nil
+}
+
+func (n *orNode) eval(r *rowValues) (tri, error) {
+	l, err := n.left.eval(r)
+	if err != nil || l == triTrue {
+		return l, err
+	}
+	rt, err := n.right.eval(r)
+	if err != nil {
+		return rt, err
+	}
+	if rt == triTrue {
+		return triTrue, nil
+	}
+	if l == triUnknown || rt == triUnknown {
+		return triUnknown, nil
+	}
+	return triFalse, nil
+}
+
+func (n *notNode) eval(r *rowValues) (tri, error) {
+	t, err := n.expr.eval(r)
+	return t.not(), err
+}
+
+func (n *truthNode) eval(r *rowValues) (tri, error) {
+	v, err := n.op.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	return truth(v), nil
+}
+
+func (n *cmpNode) eval(r *rowValues) (tri, error) {
+	l, err := n.left.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	rt, err := n.right.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	cmp, ok := compare(l, rt)
+	if !ok {
+		return triUnknown, nil
+	}
+	switch n.op {
+	case "=":
+		return triOf(cmp == 0), nil
+	case "!=", "<>":
+		return triOf(cmp != 0), nil
+	case "<":
+		return triOf(cmp < 0), nil
+	case "<=":
+		return triOf(cmp <= 0), nil
+	case ">":
+		return triOf(cmp > 0), nil
+	case ">=":
+		return triOf(cmp >= 0), nil
+	}
+	return triUnknown, errors.New(fmt.Sprintf("unknown operator %v", n.op))
+}
+
+func (n *inNode) eval(r *rowValues) (tri, error) {
+	v, err := n.op.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	res := triFalse
+	for _, item := range n.list {
+		iv, err := item.value(r)
+		if err != nil {
+			return triUnknown, err
+		}
+		cmp, ok := compare(v, iv)
+		if !ok {
+			res = triUnknown
+		} else if cmp == 0 {
+			res = triTrue
+			break
+		}
+	}
+	if n.not {
+		return res.not(), nil
+	}
+	return res, nil
+}
+
+func (n *betweenNode) eval(r *rowValues) (tri, error) {
+	v, err := n.op.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	low, err := n.low.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	high, err := n.high.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	cl, okl := compare(v, low)
+	ch, okh := compare(v, high)
+	if !okl || !okh {
+		return triUnknown, nil
+	}
+	res := triOf(cl >= 0 && ch <= 0)
+	if n.not {
+		return res.not(), nil
+	}
+	return res, nil
+}
+
+func (n *isNullNode) eval(r *rowValues) (tri, error) {
+	v, err := n.op.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	return triOf(v.null != n.not), nil
+}
+
+func (n *likeNode) eval(r *rowValues) (tri, error) {
+	v, err := n.op.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	p, err := n.pattern.value(r)
+	if err != nil {
+		return triUnknown, err
+	}
+	if v.null || p.null {
+		return triUnknown, nil
+	}
+	res := triOf(likeRegexp(p.str).MatchString(v.str))
+	if n.not {
+		return res.not(), nil
+	}
+	return res, nil
+}
+
+// regexp of LIKE pattern. Matching is case insensitive as with default mysql collations
+func likeRegexp(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?is)^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+func (c *columnRef) value(r *rowValues) (value, error) {
+	return r.get(c.name)
+}
+
+func (l *literal) value(r *rowValues) (value, error) {
+	return l.v, nil
+}
+
+type parser struct {
+	text    string
+	tokens  []token
+	pos     int
+	columns map[string]bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(word string) bool {
+	if p.peek().is(word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptPunct(s string) bool {
+	if p.peek().isPunct(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("Cannot parse row filter %v at position %v: %v", p.text, p.peek().pos, fmt.Sprintf(format, args...)))
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.accept("NOT") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{expr: expr}, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() (node, error) {
+	if p.acceptPunct("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptPunct(")") {
+			return nil, p.errorf("expected )")
+		}
+		return expr, nil
+	}
+
+	op, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.isPunct("=") || t.isPunct("!=") || t.isPunct("<>") || t.isPunct("<") || t.isPunct("<=") ||
+		t.isPunct(">") || t.isPunct(">="):
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &cmpNode{op: t.text, left: op, right: right}, nil
+	case t.is("IS"):
+		p.next()
+		not := p.accept("NOT")
+		if !p.accept("NULL") {
+			return nil, p.errorf("expected NULL")
+		}
+		return &isNullNode{op: op, not: not}, nil
+	}
+
+	not := p.accept("NOT")
+	switch {
+	case p.accept("IN"):
+		if !p.acceptPunct("(") {
+			return nil, p.errorf("expected ( after IN")
+		}
+		n := &inNode{op: op, not: not}
+		for {
+			item, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, item)
+			if p.acceptPunct(")") {
+				return n, nil
+			}
+			if !p.acceptPunct(",") {
+				return nil, p.errorf("expected , or )")
+			}
+		}
+	case p.accept("BETWEEN"):
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept("AND") {
+			return nil, p.errorf("expected AND in BETWEEN")
+		}
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &betweenNode{op: op, low: low, high: high, not: not}, nil
+	case p.accept("LIKE"):
+		pattern, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &likeNode{op: op, pattern: pattern, not: not}, nil
+	}
+	if not {
+		return nil, p.errorf("expected IN, BETWEEN or LIKE after NOT")
+	}
+	return &truthNode{op: op}, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &literal{v: value{str: t.text}}, nil
+	case tokNumber:
+		r, ok := new(big.Rat).SetString(t.text)
+		if !ok {
+			return nil, p.errorf("incorrect number %v", t.text)
+		}
+		return &literal{v: value{str: t.text, num: r}}, nil
+	case tokPunct:
+		if t.text == "-" || t.text == "+" {
+			n := p.next()
+			r, ok := new(big.Rat).SetString(t.text + n.text)
+			if n.kind != tokNumber || !ok {
+				return nil, p.errorf("expected number after %v", t.text)
+			}
+			return &literal{v: value{str: t.text + n.text, num: r}}, nil
+		}
+	case tokQuotedIdent:
+		p.columns[t.text] = true
+		return &columnRef{name: t.text}, nil
+	case tokIdent:
+		switch {
+		case t.is("NULL"):
+			return &literal{v: value{null: true}}, nil
+		case t.is("TRUE"):
+			return &literal{v: intValue(1)}, nil
+		case t.is("FALSE"):
+			return &literal{v: intValue(0)}, nil
+		case t.is("AND"), t.is("OR"), t.is("NOT"), t.is("IN"), t.is("IS"), t.is("LIKE"), t.is("BETWEEN"):
+			return nil, p.errorf("unexpected %v", strings.ToUpper(t.text))
+		}
+		p.columns[t.text] = true
+		return &columnRef{name: t.text}, nil
+	}
+	if t.kind == tokEOF {
+		return nil, p.errorf("unexpected end of filter")
+	}
+	return nil, p.errorf("unexpected %v", t.text)
+}
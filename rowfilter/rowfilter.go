@@ -0,0 +1,251 @@
+// Package rowfilter evaluates predicates deciding which rows of a table are
+// replicated. Predicates use a small subset of SQL:
+//
+//	tenant_id IN (3,7) AND status != 'draft'
+//	(amount > 100 OR vip) AND deleted_at IS NULL
+//	name LIKE 'a%' AND created BETWEEN '2020-01-01' AND '2021-01-01'
+//
+// Comparison follows mysql: values are compared as numbers if either side is
+// a number, otherwise as strings. NULL makes comparison unknown, and rows
+// for which predicate is unknown are not replicated
+package rowfilter
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+type Filter struct {
+	text    string
+	expr    node
+	columns []string
+}
+
+// Parses predicate
+func Parse(text string) (*Filter, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{text: text, tokens: tokens, columns: make(map[string]bool)}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected %v", p.peek().text)
+	}
+
+	f := &Filter{text: text, expr: expr}
+	for c := range p.columns {
+		f.columns = append(f.columns, c)
+	}
+	return f, nil
+}
+
+func (f *Filter) String() string {
+	return f.text
+}
+
+// names of columns used by predicate
+func (f *Filter) Columns() []string {
+	return f.columns
+}
+
+// Evaluates predicate for row image. Columns missing in the image are NULL,
+// so binlog_row_image should be FULL
+func (f *Filter) Match(columns []*structs.Column, row []*structs.QueryValues) (bool, error) {
+	r := &rowValues{columns: columns, row: row}
+	res, err := f.expr.eval(r)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Cannot evaluate row filter %v. %v", f.text, err))
+	}
+	return res == triTrue, nil
+}
+
+// three-valued logic of SQL
+type tri int8
+
+const (
+	triFalse   tri = 0
+	triTrue    tri = 1
+	triUnknown tri = 2
+)
+
+func triOf(b bool) tri {
+	if b {
+		return triTrue
+	}
+	return triFalse
+}
+
+func (t tri) not() tri {
+	switch t {
+	case triTrue:
+		return triFalse
+	case triFalse:
+		return triTrue
+	}
+	return triUnknown
+}
+
+// value of operand. num is set if value is a number
+type value struct {
+	null bool
+	str  string
+	num  *big.Rat
+}
+
+func (v value) number() *big.Rat {
+	if v.num != nil {
+		return v.num
+	}
+	if r, ok := new(big.Rat).SetString(strings.TrimSpace(v.str)); ok {
+		return r
+	}
+	return nil
+}
+
+// compares values, ok is false if either value is NULL
+func compare(a, b value) (cmp int, ok bool) {
+	if a.null || b.null {
+		return 0, false
+	}
+	if a.num != nil || b.num != nil {
+		if na, nb := a.number(), b.number(); na != nil && nb != nil {
+			return na.Cmp(nb), true
+		}
+	}
+	return strings.Compare(a.str, b.str), true
+}
+
+func truth(v value) tri {
+	if v.null {
+		return triUnknown
+	}
+	if n := v.number(); n != nil {
+		return triOf(n.Sign() != 0)
+	}
+	return triFalse
+}
+
+// row being evaluated
+type rowValues struct {
+	columns []*structs.Column
+	row     []*structs.QueryValues
+}
+
+func (r *rowValues) get(name string) (value, error) {
+	id := -1
+	for idc, c := range r.columns {
+		if strings.EqualFold(c.Name, name) {
+			id = idc
+			break
+		}
+	}
+	if id < 0 {
+		return value{}, errors.New(fmt.Sprintf("unknown column %v", name))
+	}
+	for _, v := range r.row {
+		if v.ColumnId == id {
+			return columnValue(r.columns[id], v.Value), nil
+		}
+	}
+	return value{null: true}, nil
+}
+
+// converts value decoded from binlog. Integers come unsigned from binlog and
+// are converted to signed ones unless column is unsigned. Enums come as index
+// and are converted to labels
+func columnValue(column *structs.Column, v interface{}) value {
+	signed := !strings.Contains(column.Type, "unsigned")
+	switch t := v.(type) {
+	case nil:
+		return value{null: true}
+	case uint8:
+		if strings.HasPrefix(column.Type, "enum") {
+			if int(t) > 0 && int(t) <= len(column.Enum) {
+				return value{str: column.Enum[t-1]}
+			}
+			return value{str: ""}
+		}
+		if signed {
+			return intValue(int64(int8(t)))
+		}
+		return intValue(int64(t))
+	case uint16:
+		if signed && !strings.HasPrefix(column.Type, "year") {
+			return intValue(int64(int16(t)))
+		}
+		return intValue(int64(t))
+	case uint32:
+		if signed {
+			if strings.HasPrefix(column.Type, "mediumint") && t&0x800000 != 0 {
+				return intValue(int64(t) - 0x1000000)
+			}
+			return intValue(int64(int32(t)))
+		}
+		return intValue(int64(t))
+	case uint64:
+		if signed {
+			return intValue(int64(t))
+		}
+		return value{str: strconv.FormatUint(t, 10), num: new(big.Rat).SetFrac(new(big.Int).SetUint64(t), big.NewInt(1))}
+	case int8:
+		return intValue(int64(t))
+	case int16:
+		return intValue(int64(t))
+	case int32:
+		return intValue(int64(t))
+	case int64:
+		return intValue(t)
+	case int:
+		return intValue(int64(t))
+	case float32:
+		return floatValue(float64(t), 32)
+	case float64:
+		return floatValue(t, 64)
+	case time.Time:
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 && strings.HasPrefix(column.Type, "date") &&
+			!strings.HasPrefix(column.Type, "datetime") {
+			return value{str: t.Format("2006-01-02")}
+		}
+		return value{str: t.Format("2006-01-02 15:04:05.999999")}
+	case time.Duration:
+		sign := ""
+		if t < 0 {
+			sign = "-"
+			t = -t
+		}
+		return value{str: fmt.Sprintf("%v%02d:%02d:%02d", sign, int64(t/time.Hour), int64(t/time.Minute)%60, int64(t/time.Second)%60)}
+	case []byte:
+		return value{str: string(t)}
+	case string:
+		if strings.HasPrefix(column.Type, "decimal") {
+			if r, ok := new(big.Rat).SetString(t); ok {
+				return value{str: t, num: r}
+			}
+		}
+		return value{str: t}
+	}
+	return value{str: fmt.Sprintf("%v", v)}
+}
+
+func intValue(i int64) value {
+	return value{str: strconv.FormatInt(i, 10), num: big.NewRat(i, 1)}
+}
+
+// float is compared by its shortest decimal form, so 0.1 equals literal 0.1
+func floatValue(f float64, bitSize int) value {
+	s := strconv.FormatFloat(f, 'g', -1, bitSize)
+	if r, ok := new(big.Rat).SetString(s); ok {
+		return value{str: s, num: r}
+	}
+	return value{str: s} // NaN or Inf
+}
@@ -0,0 +1,84 @@
+package rowfilter
+
+import (
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+var testColumns = []*structs.Column{
+	&structs.Column{Name: "tenant_id", Type: "int(11)"},
+	&structs.Column{Name: "status", Type: "enum('draft','done')", Enum: []string{"draft", "done"}},
+	&structs.Column{Name: "amount", Type: "decimal(10,2)"},
+	&structs.Column{Name: "name", Type: "varchar(20)"},
+	&structs.Column{Name: "deleted_at", Type: "datetime"},
+}
+
+func testRow(tenant uint32, status uint8, amount string, name interface{}) []*structs.QueryValues {
+	return []*structs.QueryValues{
+		&structs.QueryValues{ColumnId: 0, Value: tenant},
+		&structs.QueryValues{ColumnId: 1, Value: status},
+		&structs.QueryValues{ColumnId: 2, Value: amount},
+		&structs.QueryValues{ColumnId: 3, Value: name},
+		&structs.QueryValues{ColumnId: 4, Value: nil},
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	for _, c := range []struct {
+		filter   string
+		row      []*structs.QueryValues
+		expected bool
+	}{
+		{"tenant_id IN (3,7) AND status != 'draft'", testRow(3, 2, "1.00", "a"), true},
+		{"tenant_id IN (3,7) AND status != 'draft'", testRow(3, 1, "1.00", "a"), false},
+		{"tenant_id IN (3,7) AND status != 'draft'", testRow(4, 2, "1.00", "a"), false},
+		{"tenant_id NOT IN (3,7)", testRow(4, 2, "1.00", "a"), true},
+		{"tenant_id = -1", testRow(0xffffffff, 2, "1.00", "a"), true},
+		{"amount > 100 OR name LIKE 'b%'", testRow(1, 1, "100.50", "a"), true},
+		{"amount > 100 OR name LIKE 'b%'", testRow(1, 1, "99.99", "Bob"), true},
+		{"amount BETWEEN 1 AND 2 AND deleted_at IS NULL", testRow(1, 1, "1.5", "a"), true},
+		{"NOT (amount >= 1.5)", testRow(1, 1, "1.50", "a"), false},
+		{"name = 'a'", testRow(1, 1, "1", nil), false},
+		{"NOT name = 'a'", testRow(1, 1, "1", nil), false},
+		{"name IS NOT NULL OR `tenant_id`", testRow(1, 1, "1", nil), true},
+	} {
+		f, err := Parse(c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		match, err := f.Match(testColumns, c.row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != c.expected {
+			t.Fatal(
+				"Incorrect match of", c.filter,
+				"expected", c.expected,
+				"got", match,
+			)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		"tenant_id IN (3,7",
+		"status = 'draft",
+		"tenant_id = 1 AND",
+		"tenant_id NOT 1",
+		"tenant_id = 1 status = 2",
+	} {
+		if _, err := Parse(filter); err == nil {
+			t.Fatal("Expected error for filter", filter)
+		}
+	}
+
+	f, err := Parse("missing = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Match(testColumns, testRow(1, 1, "1", "a")); err == nil {
+		t.Fatal("Expected error for unknown column")
+	}
+}
@@ -0,0 +1,150 @@
+// weighted scheduling of buffers
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+	"github.com/andsha/vconfig"
+)
+
+/* Control routine gives turns to buffers with queued events by smooth
+weighted round robin: on every turn each buffer with events adds its weight to
+its credit, buffer with the largest credit plays an event and its credit is
+lowered by sum of weights. Buffers get turns in proportion to their weights
+among buffers having events, so hot buffer does not starve cold ones and
+a buffer with backlog gets all turns while others are idle. Buffer busy with
+a slow event is skipped until it takes turns given before, so it does not
+stall other buffers.
+Weight is set in buffer section
+	weight = 0.5 (optional, default 1/frequency)
+Queue depth, written events and rows, and rows per second over last 10 seconds
+of every buffer are in expvar map buffers, served with -stats flag
+*/
+
+const rateWindow = 10 // seconds of rows per second stats
+
+var bufferStatsVar = expvar.NewMap("buffers")
+
+type scheduler struct {
+	weights []float64
+	credits []float64
+	stats   []*bufferStats
+}
+
+// reads weights of buffer sections. Buffers without weight get weight
+// 1/frequency so they keep share of turns they had with frequencies
+func newScheduler(rconf vconfig.VConfig, freqs []int) (*scheduler, error) {
+	s := &scheduler{weights: make([]float64, len(freqs)), credits: make([]float64, len(freqs))}
+	for idf, f := range freqs {
+		s.weights[idf] = 1 / float64(f)
+		s.stats = append(s.stats, &bufferStats{})
+	}
+	sections, err := rconf.GetSectionsByName("buffer")
+	if err != nil {
+		return s, nil
+	}
+	for _, sec := range sections {
+		num, _ := sec.GetSingleValue("number", "")
+		buf, err := strconv.Atoi(num)
+		if err != nil || buf < 0 || buf >= len(freqs) {
+			continue // reported while reading buffers of source
+		}
+		if w, err := sec.GetSingleValue("weight", ""); err == nil && len(w) != 0 {
+			if s.weights[buf], err = strconv.ParseFloat(w, 64); err != nil || s.weights[buf] <= 0 {
+				return nil, errors.New(fmt.Sprintf("weight of buffer %v must be positive number. Got %v", buf, w))
+			}
+		}
+	}
+	return s, nil
+}
+
+// buffer getting next turn, -1 if no buffer has events and room for turn
+// in conts. Busy buffer keeps its credit until it takes turns given before
+func (s *scheduler) next(events []chan *structs.Event, conts []chan bool) int {
+	best := -1
+	total := 0.0
+	for idf, e := range events {
+		if len(e) == 0 { // idle buffer does not save credit
+			s.credits[idf] = 0
+			continue
+		}
+		if len(conts[idf]) == cap(conts[idf]) {
+			continue
+		}
+		s.credits[idf] += s.weights[idf]
+		total += s.weights[idf]
+		if best == -1 || s.credits[idf] > s.credits[best] {
+			best = idf
+		}
+	}
+	if best != -1 {
+		s.credits[best] -= total
+	}
+	return best
+}
+
+// publishes stats of buffer in expvar. queue returns number of waiting events
+func (s *scheduler) publish(idf int, queue func() int) {
+	stats := s.stats[idf]
+	weight := s.weights[idf]
+	bufferStatsVar.Set(strconv.Itoa(idf), expvar.Func(func() interface{} {
+		events, rows, rate := stats.read(time.Now())
+		return map[string]interface{}{
+			"queue":         queue(),
+			"weight":        weight,
+			"events":        events,
+			"rows":          rows,
+			"rowsPerSecond": rate,
+		}
+	}))
+}
+
+// played events and rows of buffer
+type bufferStats struct {
+	mutex   sync.Mutex
+	events  int64
+	rows    int64
+	buckets [rateWindow]int64 // rows played in every second of window
+	second  int64             // unix second of latest bucket
+}
+
+// counts event written by buffer
+func (bs *bufferStats) played(e *structs.Event, now time.Time) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	bs.roll(now.Unix())
+	bs.events++
+	rows := int64(len(e.OldValues))
+	bs.rows += rows
+	bs.buckets[bs.second%rateWindow] += rows
+}
+
+// returns played events and rows and rows per second over window
+func (bs *bufferStats) read(now time.Time) (int64, int64, float64) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	bs.roll(now.Unix())
+	var sum int64
+	for _, b := range bs.buckets {
+		sum += b
+	}
+	return bs.events, bs.rows, float64(sum) / rateWindow
+}
+
+// clears buckets of seconds passed since latest bucket
+func (bs *bufferStats) roll(second int64) {
+	if second <= bs.second {
+		return
+	}
+	for sec := bs.second + 1; sec <= second && sec <= bs.second+rateWindow; sec++ {
+		bs.buckets[sec%rateWindow] = 0
+	}
+	bs.second = second
+}
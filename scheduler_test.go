@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+	"github.com/sirupsen/logrus"
+)
+
+// destination counting played events
+type benchDest struct {
+	connection
+	played sync.WaitGroup
+}
+
+func (d *benchDest) playEvent(e *structs.Event) error {
+	d.played.Done()
+	return nil
+}
+
+func (d *benchDest) flushEvents(buf int) error {
+	return nil
+}
+
+func (d *benchDest) pending(buf int) bool {
+	return false
+}
+
+// throughput of buffers and control routine with default buffer and buffer
+// of weight 0.1 getting events alternately
+func BenchmarkBuffers(b *testing.B) {
+	freqs := []int{1, 10}
+	r := &replicagor{logging: logrus.New()}
+	sched := &scheduler{weights: []float64{1, 0.1}, credits: make([]float64, 2),
+		stats: []*bufferStats{{}, {}}}
+	dest := &benchDest{}
+	cp := newCheckpoints(nil, 0)
+
+	var conts []chan bool
+	var events []chan *structs.Event
+	var stops, stoppeds []chan bool
+	for idf := range freqs {
+		conts = append(conts, make(chan bool, 2))
+		events = append(events, make(chan *structs.Event, 500))
+		stops = append(stops, make(chan bool, 1))
+		stoppeds = append(stoppeds, make(chan bool, 1))
+		go eventBuffer(idf, conts[idf], events[idf], dest, stops[idf], stoppeds[idf], cp, sched.stats[idf], nil)
+	}
+	stopCr, stoppedCr := make(chan bool, 1), make(chan bool, 1)
+	wake := make(chan bool, 1)
+	go r.controlRoutine(sched, conts, events, wake, stopCr, stoppedCr)
+
+	b.ResetTimer()
+	dest.played.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		events[i%len(freqs)] <- &structs.Event{Buf: i % len(freqs)}
+		select {
+		case wake <- true:
+		default:
+		}
+	}
+	dest.played.Wait()
+	b.StopTimer()
+
+	stopCr <- true
+	<-stoppedCr
+	for idf := range freqs {
+		stops[idf] <- true
+		<-stoppeds[idf]
+	}
+}
+
+// buffers with events get turns in proportion to weights
+func TestSchedulerNext(t *testing.T) {
+	s := &scheduler{weights: []float64{1, 0.25}, credits: make([]float64, 2)}
+	events := []chan *structs.Event{make(chan *structs.Event, 1), make(chan *structs.Event, 1)}
+	conts := []chan bool{make(chan bool, 1), make(chan bool, 1)}
+	events[0] <- &structs.Event{}
+	events[1] <- &structs.Event{}
+
+	turns := make([]int, 2)
+	for i := 0; i < 100; i++ {
+		turns[s.next(events, conts)]++
+	}
+	if turns[0] != 80 || turns[1] != 20 {
+		t.Fatal("Incorrect turns", "expected", []int{80, 20}, "got", turns)
+	}
+
+	<-events[0] // cold buffer gets every turn while hot one is idle
+	for i := 0; i < 10; i++ {
+		if idf := s.next(events, conts); idf != 1 {
+			t.Fatal("Incorrect buffer", "expected", 1, "got", idf)
+		}
+	}
+
+	conts[1] <- true // busy buffer is skipped
+	if idf := s.next(events, conts); idf != -1 {
+		t.Fatal("Incorrect buffer", "expected", -1, "got", idf)
+	}
+	<-conts[1]
+
+	<-events[1]
+	if idf := s.next(events, conts); idf != -1 {
+		t.Fatal("Incorrect buffer", "expected", -1, "got", idf)
+	}
+}
+
+func TestBufferStats(t *testing.T) {
+	bs := &bufferStats{}
+	now := time.Unix(1000, 0)
+	rows := make([][]*structs.QueryValues, 20)
+	bs.played(&structs.Event{OldValues: rows}, now)
+	bs.played(&structs.Event{OldValues: rows}, now.Add(5*time.Second))
+
+	if events, rows, rate := bs.read(now.Add(5 * time.Second)); events != 2 || rows != 40 || rate != 4 {
+		t.Fatal("Incorrect stats", "expected", 2, 40, 4.0, "got", events, rows, rate)
+	}
+	if _, _, rate := bs.read(now.Add(12 * time.Second)); rate != 2 {
+		t.Fatal("Incorrect rate", "expected", 2.0, "got", rate)
+	}
+	if _, _, rate := bs.read(now.Add(time.Minute)); rate != 0 {
+		t.Fatal("Incorrect rate", "expected", 0.0, "got", rate)
+	}
+}
+
+// destination blocking on played events until released
+type slowDest struct {
+	connection
+	release chan bool
+}
+
+func (d *slowDest) playEvent(e *structs.Event) error {
+	<-d.release
+	return nil
+}
+
+func (d *slowDest) flushEvents(buf int) error {
+	return nil
+}
+
+func (d *slowDest) pending(buf int) bool {
+	return false
+}
+
+// buffer busy with slow event does not stall other buffers
+func TestControlSkipsBusy(t *testing.T) {
+	r := &replicagor{logging: logrus.New()}
+	sched := &scheduler{weights: []float64{1, 1}, credits: make([]float64, 2), stats: []*bufferStats{{}, {}}}
+	cp := newCheckpoints(nil, 0)
+	fast, slow := &benchDest{}, &slowDest{release: make(chan bool)}
+	dests := []connection{fast, slow}
+
+	var conts []chan bool
+	var events []chan *structs.Event
+	var stops, stoppeds []chan bool
+	for idf := range dests {
+		conts = append(conts, make(chan bool, 2))
+		events = append(events, make(chan *structs.Event, 500))
+		stops = append(stops, make(chan bool, 1))
+		stoppeds = append(stoppeds, make(chan bool, 1))
+		go eventBuffer(idf, conts[idf], events[idf], dests[idf], stops[idf], stoppeds[idf], cp, sched.stats[idf], nil)
+	}
+	stopCr, stoppedCr := make(chan bool, 1), make(chan bool, 1)
+	wake := make(chan bool, 1)
+	go r.controlRoutine(sched, conts, events, wake, stopCr, stoppedCr)
+
+	for i := 0; i < 10; i++ {
+		events[1] <- &structs.Event{Buf: 1}
+	}
+	fast.played.Add(100)
+	for i := 0; i < 100; i++ {
+		events[0] <- &structs.Event{}
+		select {
+		case wake <- true:
+		default:
+		}
+	}
+	fast.played.Wait() // all events of default buffer are played while buffer 1 is blocked
+
+	close(slow.release)
+	stopCr <- true
+	<-stoppedCr
+	for idf := range dests {
+		stops[idf] <- true
+		<-stoppeds[idf]
+	}
+}
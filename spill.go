@@ -0,0 +1,390 @@
+// spill files of delayed buffers
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+	"github.com/sirupsen/logrus"
+)
+
+/* Delayed buffers (see throttle.go) keep events waiting for their delay in
+spill files instead of memory, so reading binlog does not wait for delayed
+buffers and events waiting for delay do not hold checkpoint (see
+checkpoint.go). Event is released from checkpoint when it is written and
+synced into spill. Spill of buffer is a sequence of segment files
+buffer<number>.<sequence>.spill in spill directory with one event in json
+(see structs.EncodeEvent) per line. Events are read from spill in order and
+held by checkpoint of the buffer, segment is deleted when buffer has written
+all its events. After restart buffer plays events of remaining segments
+again and skips events it applied before by its position in checkpoint table,
+so delayed buffers need store = postgres in checkpoint section. Events read
+from binlog again after restart are not spilled twice.
+*/
+
+const spillSegment = 10000 // events of segment before next segment is started
+
+// spill of buffer. Events are written by spillEvents and read by unspillEvents
+type spill struct {
+	dir      string
+	buf      int
+	mutex    sync.Mutex
+	segments []*segment         // oldest first, events are written into the last one
+	waiting  int                // events synced and not read yet
+	last     structs.BinLogInfo // position of last spilled event
+	synced   chan bool          // signals synced events
+	// held by events read from spill until buffer writes them
+	checkpoints *checkpoints
+
+	file     *os.File // segment written
+	unsynced int64    // bytes written and not synced
+	events   int      // events written and not synced
+	ended    bool     // last written event ends transaction or statement
+
+	read   int      // segments read before segment being read
+	rfile  *os.File // segment being read
+	offset int64    // bytes of segment being read
+}
+
+// spill file
+type segment struct {
+	path   string
+	seq    int
+	size   int64              // bytes synced
+	events int                // events synced
+	end    structs.BinLogInfo // position of last event with known position
+}
+
+// opens spill of buffer buf in directory dir. Events of segments left by
+// previous run are read again
+func openSpill(dir string, buf int) (*spill, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot create spill directory %v: %v", dir, err))
+	}
+	sp := &spill{dir: dir, buf: buf, synced: make(chan bool, 1), checkpoints: newCheckpoints(nil, 0)}
+	paths, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("buffer%v.*.spill", buf)))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		seg, err := readSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		sp.segments = append(sp.segments, seg)
+	}
+	sort.Slice(sp.segments, func(i, j int) bool { return sp.segments[i].seq < sp.segments[j].seq })
+	seq := 0
+	for _, seg := range sp.segments {
+		sp.waiting += seg.events
+		if len(seg.end.File) != 0 {
+			sp.last = seg.end
+		}
+		seq = seg.seq + 1
+	}
+	sp.segments = append(sp.segments, &segment{path: sp.segmentPath(seq), seq: seq})
+	return sp, nil
+}
+
+// reads segment left by previous run. Event partly written by crash is cut
+func readSegment(path string) (*segment, error) {
+	parts := strings.Split(filepath.Base(path), ".")
+	seq, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unexpected spill file %v", path))
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{path: path, seq: seq, size: int64(bytes.LastIndexByte(b, '\n') + 1)}
+	if seg.size != int64(len(b)) {
+		if err := os.Truncate(path, seg.size); err != nil {
+			return nil, err
+		}
+	}
+	events, err := decodeEvents(b[:seg.size])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot read spill file %v: %v", path, err))
+	}
+	seg.events = len(events)
+	for _, e := range events {
+		if end, ok := eventEnd(e); ok {
+			seg.end = end
+		}
+	}
+	return seg, nil
+}
+
+func decodeEvents(b []byte) ([]*structs.Event, error) {
+	var events []*structs.Event
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		e, err := structs.DecodeEvent(line)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (sp *spill) segmentPath(seq int) string {
+	return filepath.Join(sp.dir, fmt.Sprintf("buffer%v.%v.spill", sp.buf, seq))
+}
+
+// true if event was spilled before restart
+func (sp *spill) spilled(e *structs.Event) bool {
+	end, ok := eventEnd(e)
+	return ok && len(sp.last.File) != 0 && !binlogBefore(sp.last.File, sp.last.Position, end.File, end.Position)
+}
+
+// writes event into segment. Event can be read when it is synced
+func (sp *spill) write(e *structs.Event) error {
+	b, err := structs.EncodeEvent(e)
+	if err != nil {
+		return err
+	}
+	sp.mutex.Lock()
+	seg := sp.segments[len(sp.segments)-1]
+	sp.mutex.Unlock()
+	if sp.file == nil {
+		if sp.file, err = os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+	}
+	if _, err := sp.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	sp.unsynced += int64(len(b) + 1)
+	sp.events++
+	if end, ok := eventEnd(e); ok {
+		sp.last = end
+	}
+	sp.ended = e.Position != 0
+	return nil
+}
+
+// syncs written events and gives them to reader. Next segment is started
+// when segment is full and its last event ends transaction or statement
+func (sp *spill) sync() error {
+	if sp.events == 0 {
+		return nil
+	}
+	if err := sp.file.Sync(); err != nil {
+		return err
+	}
+	sp.mutex.Lock()
+	seg := sp.segments[len(sp.segments)-1]
+	seg.size += sp.unsynced
+	seg.events += sp.events
+	seg.end = sp.last
+	sp.waiting += sp.events
+	full := seg.events >= spillSegment && sp.ended
+	if full {
+		sp.segments = append(sp.segments, &segment{path: sp.segmentPath(seg.seq + 1), seq: seg.seq + 1})
+	}
+	sp.mutex.Unlock()
+	sp.unsynced, sp.events = 0, 0
+	select {
+	case sp.synced <- true:
+	default: // reader is already signaled
+	}
+	if full {
+		err := sp.file.Close()
+		sp.file = nil
+		return err
+	}
+	return nil
+}
+
+// reads next synced events, nil if there are none
+func (sp *spill) next() ([]*structs.Event, error) {
+	for {
+		sp.mutex.Lock()
+		seg := sp.segments[sp.read]
+		size, written := seg.size, sp.read < len(sp.segments)-1
+		sp.mutex.Unlock()
+		if sp.offset == size {
+			if !written {
+				return nil, nil
+			}
+			if sp.rfile != nil {
+				sp.rfile.Close()
+				sp.rfile = nil
+			}
+			sp.read++
+			sp.offset = 0
+			continue
+		}
+
+		if sp.rfile == nil {
+			var err error
+			if sp.rfile, err = os.Open(seg.path); err != nil {
+				return nil, err
+			}
+		}
+		n := size - sp.offset
+		if n > 1<<20 { // read events in parts of 1MB
+			n = 1 << 20
+		}
+		b := make([]byte, n)
+		if _, err := sp.rfile.ReadAt(b, sp.offset); err != nil {
+			return nil, err
+		}
+		if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+			b = b[:i+1]
+		} else { // event longer than part
+			b = make([]byte, size-sp.offset)
+			if _, err := sp.rfile.ReadAt(b, sp.offset); err != nil {
+				return nil, err
+			}
+		}
+		events, err := decodeEvents(b)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Cannot read spill file %v: %v", seg.path, err))
+		}
+		sp.offset += int64(len(b))
+		sp.mutex.Lock()
+		sp.waiting -= len(events)
+		sp.mutex.Unlock()
+		return events, nil
+	}
+}
+
+// deletes segments which are read and written by buffer
+func (sp *spill) release() error {
+	at, ok := sp.checkpoints.position()
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	for sp.read > 0 {
+		seg := sp.segments[0]
+		if len(seg.end.File) != 0 && (!ok || binlogBefore(at.File, at.Position, seg.end.File, seg.end.Position)) {
+			return nil // buffer has not written events of segment yet
+		}
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		sp.segments = sp.segments[1:]
+		sp.read--
+	}
+	return nil
+}
+
+// events spilled and not read yet
+func (sp *spill) pending() int {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return sp.waiting
+}
+
+// routine writing events of delayed buffer into spill. Event is released
+// from checkpoint when it is synced
+func spillEvents(
+	in <-chan *structs.Event,
+	sp *spill,
+	checkpoints *checkpoints,
+	logging *logrus.Logger,
+	stop <-chan bool,
+	stopped chan<- bool,
+) {
+	var unsynced []*structs.Event
+	sync := func() bool {
+		if err := sp.sync(); err != nil {
+			logging.Errorf("Cannot sync spill of buffer %v: %v", sp.buf, err)
+			return false
+		}
+		for _, e := range unsynced {
+			checkpoints.written(e)
+		}
+		unsynced = unsynced[:0]
+		return true
+	}
+
+	for {
+		select {
+		case <-stop:
+			sync()
+			if sp.file != nil {
+				sp.file.Close()
+			}
+			stopped <- true
+			return
+		case e := <-in:
+			if sp.spilled(e) { // read from binlog again after restart
+				checkpoints.written(e)
+				continue
+			}
+			if err := sp.write(e); err != nil {
+				logging.Errorf("Cannot write event into spill of buffer %v: %v", sp.buf, err)
+				stopped <- true
+				return
+			}
+			unsynced = append(unsynced, e)
+			if len(in) == 0 && !sync() {
+				stopped <- true
+				return
+			}
+		}
+	}
+}
+
+// routine reading spill of delayed buffer in order. Events are held by
+// checkpoint of the buffer until it writes them
+func unspillEvents(
+	sp *spill,
+	out chan<- *structs.Event,
+	logging *logrus.Logger,
+	stop <-chan bool,
+	stopped chan<- bool,
+) {
+	var events []*structs.Event
+	for {
+		if len(events) == 0 {
+			var err error
+			if err = sp.release(); err == nil {
+				events, err = sp.next()
+			}
+			if err != nil {
+				logging.Errorf("Cannot read spill of buffer %v: %v", sp.buf, err)
+				stopped <- true
+				return
+			}
+		}
+		if len(events) == 0 {
+			timer := time.NewTimer(time.Second) // segments are released while buffer writes events
+			select {
+			case <-stop:
+				timer.Stop()
+				stopped <- true
+				return
+			case <-sp.synced:
+				timer.Stop()
+			case <-timer.C:
+			}
+			continue
+		}
+
+		sp.checkpoints.hold(events[0])
+		select {
+		case <-stop:
+			stopped <- true
+			return
+		case out <- events[0]:
+			events = events[1:]
+		}
+	}
+}
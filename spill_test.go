@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+	"github.com/sirupsen/logrus"
+)
+
+// spilled events release checkpoint, are read again after restart and
+// segment is deleted when buffer writes its events
+func TestSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, err := openSpill(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := "mysql-bin.000003"
+	columns := []*structs.Column{{Name: "id", Type: "int", IsKey: true}}
+	chunk := &structs.RepairChunk{Repair: &structs.Repair{Id: 7, Schema: "db1", Table: "table1"}, From: []interface{}{int32(5)},
+		Delete: true}
+	events := []*structs.Event{
+		{Buf: 1, Query: "BEGIN", File: file, EventPosition: 4},
+		{Buf: 1, SchemaName: "db1", TableName: "table1", Columns: columns, EventType: structs.INSERT_EVENT, File: file,
+			EventPosition: 60, OldValues: [][]*structs.QueryValues{{{ColumnId: 0, Value: int32(1)}}}},
+		{Buf: 1, Query: "COMMIT", File: file, Position: 100},
+		{Buf: 1, SchemaName: "db1", TableName: "table1", Columns: columns, EventType: structs.REPAIR_EVENT, File: file,
+			EventPosition: 120, Chunk: chunk},
+	}
+	cp := newCheckpoints(nil, 0)
+	in := make(chan *structs.Event, len(events))
+	for _, e := range events {
+		cp.hold(e)
+		in <- e
+	}
+	stop, stopped := make(chan bool, 1), make(chan bool, 1)
+	go spillEvents(in, sp, cp, logrus.New(), stop, stopped)
+	<-sp.synced
+	stop <- true
+	<-stopped
+	if at, _ := cp.position(); at.Position != 100 || sp.pending() != len(events) {
+		t.Fatal("Incorrect spill", "expected", 100, len(events), "got", at.Position, sp.pending())
+	}
+
+	// restart after crash while writing event
+	path := sp.segmentPath(0)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"schema":"db1"`))
+	f.Close()
+	if sp, err = openSpill(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if sp.pending() != len(events) {
+		t.Fatal("Incorrect events after restart", "expected", len(events), "got", sp.pending())
+	}
+	if !sp.spilled(events[2]) || sp.spilled(&structs.Event{Buf: 1, Query: "COMMIT", File: file, Position: 200}) {
+		t.Fatal("Incorrect spilled events", "expected", "events before restart", "got", sp.last)
+	}
+
+	read, err := sp.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(events) {
+		t.Fatal("Incorrect events read", "expected", len(events), "got", len(read))
+	}
+	for ide, e := range read {
+		expected, _ := structs.EncodeEvent(events[ide])
+		got, _ := structs.EncodeEvent(e)
+		if string(got) != string(expected) {
+			t.Fatal("Incorrect event read", "expected", string(expected), "got", string(got))
+		}
+		sp.checkpoints.hold(e)
+	}
+	if more, err := sp.next(); err != nil || more != nil {
+		t.Fatal("Incorrect events read", "expected", nil, "got", more, err)
+	}
+
+	for _, e := range read[:3] {
+		sp.checkpoints.written(e)
+	}
+	if err := sp.release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("Incorrect release", "expected", "segment kept until repair chunk is written", "got", err)
+	}
+	sp.checkpoints.written(read[3])
+	commit := &structs.Event{Buf: 1, Query: "COMMIT", File: file, Position: 200} // position after repair chunk
+	sp.checkpoints.hold(commit)
+	sp.checkpoints.written(commit)
+	if err := sp.release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Incorrect release", "expected", "segment deleted", "got", err)
+	}
+	if paths, _ := filepath.Glob(filepath.Join(dir, "*.spill")); len(paths) != 0 {
+		t.Fatal("Incorrect spill files", "expected", 0, "got", paths)
+	}
+}
@@ -0,0 +1,349 @@
+package structs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// row event in json. Values keep their go types, so decoded event gives
+// the same statements as the original one
+type jsonEvent struct {
+	Schema        string        `json:"schema"`
+	Table         string        `json:"table"`
+	Type          byte          `json:"type"`
+	Query         string        `json:"query,omitempty"`
+	Columns       []jsonColumn  `json:"columns,omitempty"`
+	OldValues     [][]jsonValue `json:"old,omitempty"`
+	NewValues     [][]jsonValue `json:"new,omitempty"`
+	Buf           int           `json:"buf"`
+	File          string        `json:"file,omitempty"`
+	Position      uint32        `json:"position,omitempty"`
+	EventPosition uint32        `json:"eventPosition,omitempty"`
+	Timestamp     uint32        `json:"timestamp,omitempty"`
+	Gtid          string        `json:"gtid,omitempty"`
+	SkipMirror    bool          `json:"skipMirror,omitempty"`
+	Chunk         *jsonChunk    `json:"chunk,omitempty"`
+}
+
+// chunk of repair event
+type jsonChunk struct {
+	Id     int64                `json:"id"`
+	Schema string               `json:"schema"`
+	Table  string               `json:"table"`
+	Key    map[string]jsonValue `json:"key,omitempty"`
+	RFrom  []jsonValue          `json:"repairFrom,omitempty"`
+	RTo    []jsonValue          `json:"repairTo,omitempty"`
+	From   []jsonValue          `json:"from,omitempty"`
+	To     []jsonValue          `json:"to,omitempty"`
+	Keys   [][]jsonValue        `json:"keys,omitempty"`
+	Delete bool                 `json:"delete,omitempty"`
+	Last   bool                 `json:"last,omitempty"`
+}
+
+type jsonColumn struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Enum     []string `json:"enum,omitempty"`
+	Excluded bool     `json:"excluded,omitempty"`
+	PKey     bool     `json:"pkey,omitempty"`
+	Key      bool     `json:"key,omitempty"`
+}
+
+type jsonValue struct {
+	Column int    `json:"c"`
+	Type   string `json:"t"`
+	Value  string `json:"v,omitempty"`
+}
+
+// Encodes event into json
+func EncodeEvent(e *Event) ([]byte, error) {
+	je := jsonEvent{Schema: e.SchemaName, Table: e.TableName, Type: e.EventType, Query: e.Query, Buf: e.Buf, File: e.File,
+		Position: e.Position, EventPosition: e.EventPosition, Timestamp: e.Timestamp, Gtid: e.Gtid, SkipMirror: e.SkipMirror}
+	for _, c := range e.Columns {
+		je.Columns = append(je.Columns, jsonColumn{Name: c.Name, Type: c.Type, Enum: c.Enum, Excluded: c.ExcludedFromReplication,
+			PKey: c.IsPKey, Key: c.IsKey})
+	}
+	var err error
+	if je.OldValues, err = encodeRows(e.OldValues); err != nil {
+		return nil, err
+	}
+	if je.NewValues, err = encodeRows(e.NewValues); err != nil {
+		return nil, err
+	}
+	if e.Chunk != nil {
+		if je.Chunk, err = encodeChunk(e.Chunk); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(je)
+}
+
+// Decodes event encoded by EncodeEvent
+func DecodeEvent(b []byte) (*Event, error) {
+	var je jsonEvent
+	if err := json.Unmarshal(b, &je); err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot decode event. %v", err))
+	}
+	e := &Event{SchemaName: je.Schema, TableName: je.Table, EventType: je.Type, Query: je.Query, Buf: je.Buf, File: je.File,
+		Position: je.Position, EventPosition: je.EventPosition, Timestamp: je.Timestamp, Gtid: je.Gtid, SkipMirror: je.SkipMirror}
+	for _, c := range je.Columns {
+		e.Columns = append(e.Columns, &Column{Name: c.Name, Type: c.Type, Enum: c.Enum, ExcludedFromReplication: c.Excluded,
+			IsPKey: c.PKey, IsKey: c.Key})
+	}
+	var err error
+	if e.OldValues, err = decodeRows(je.OldValues); err != nil {
+		return nil, err
+	}
+	if e.NewValues, err = decodeRows(je.NewValues); err != nil {
+		return nil, err
+	}
+	if je.Chunk != nil {
+		if e.Chunk, err = decodeChunk(je.Chunk); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func encodeChunk(ch *RepairChunk) (*jsonChunk, error) {
+	jc := &jsonChunk{Delete: ch.Delete, Last: ch.Last}
+	if ch.Repair != nil {
+		jc.Id, jc.Schema, jc.Table = ch.Repair.Id, ch.Repair.Schema, ch.Repair.Table
+		if ch.Repair.Key != nil {
+			jc.Key = make(map[string]jsonValue)
+			for name, v := range ch.Repair.Key {
+				jv, err := encodeValue(v)
+				if err != nil {
+					return nil, err
+				}
+				jc.Key[name] = jv
+			}
+		}
+		var err error
+		if jc.RFrom, err = encodeValues(ch.Repair.From); err != nil {
+			return nil, err
+		}
+		if jc.RTo, err = encodeValues(ch.Repair.To); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if jc.From, err = encodeValues(ch.From); err != nil {
+		return nil, err
+	}
+	if jc.To, err = encodeValues(ch.To); err != nil {
+		return nil, err
+	}
+	for _, key := range ch.Keys {
+		values, err := encodeValues(key)
+		if err != nil {
+			return nil, err
+		}
+		jc.Keys = append(jc.Keys, values)
+	}
+	return jc, nil
+}
+
+func decodeChunk(jc *jsonChunk) (*RepairChunk, error) {
+	ch := &RepairChunk{Repair: &Repair{Id: jc.Id, Schema: jc.Schema, Table: jc.Table}, Delete: jc.Delete, Last: jc.Last}
+	if jc.Key != nil {
+		ch.Repair.Key = make(map[string]interface{})
+		for name, jv := range jc.Key {
+			v, err := decodeValue(jv)
+			if err != nil {
+				return nil, err
+			}
+			ch.Repair.Key[name] = v
+		}
+	}
+	var err error
+	if ch.Repair.From, err = decodeValues(jc.RFrom); err != nil {
+		return nil, err
+	}
+	if ch.Repair.To, err = decodeValues(jc.RTo); err != nil {
+		return nil, err
+	}
+	if ch.From, err = decodeValues(jc.From); err != nil {
+		return nil, err
+	}
+	if ch.To, err = decodeValues(jc.To); err != nil {
+		return nil, err
+	}
+	for _, key := range jc.Keys {
+		values, err := decodeValues(key)
+		if err != nil {
+			return nil, err
+		}
+		ch.Keys = append(ch.Keys, values)
+	}
+	return ch, nil
+}
+
+func encodeValues(values []interface{}) ([]jsonValue, error) {
+	if values == nil {
+		return nil, nil
+	}
+	res := make([]jsonValue, len(values))
+	for idv, v := range values {
+		jv, err := encodeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		res[idv] = jv
+	}
+	return res, nil
+}
+
+func decodeValues(values []jsonValue) ([]interface{}, error) {
+	if values == nil {
+		return nil, nil
+	}
+	res := make([]interface{}, len(values))
+	for idv, jv := range values {
+		v, err := decodeValue(jv)
+		if err != nil {
+			return nil, err
+		}
+		res[idv] = v
+	}
+	return res, nil
+}
+
+func encodeRows(rows [][]*QueryValues) ([][]jsonValue, error) {
+	if rows == nil {
+		return nil, nil
+	}
+	res := make([][]jsonValue, len(rows))
+	for idr, row := range rows {
+		res[idr] = make([]jsonValue, len(row))
+		for idv, v := range row {
+			jv, err := encodeValue(v.Value)
+			if err != nil {
+				return nil, err
+			}
+			jv.Column = v.ColumnId
+			res[idr][idv] = jv
+		}
+	}
+	return res, nil
+}
+
+func decodeRows(rows [][]jsonValue) ([][]*QueryValues, error) {
+	if rows == nil {
+		return nil, nil
+	}
+	res := make([][]*QueryValues, len(rows))
+	for idr, row := range rows {
+		res[idr] = make([]*QueryValues, len(row))
+		for idv, jv := range row {
+			v, err := decodeValue(jv)
+			if err != nil {
+				return nil, err
+			}
+			res[idr][idv] = &QueryValues{ColumnId: jv.Column, Value: v}
+		}
+	}
+	return res, nil
+}
+
+// values decoded from binlog have one of these types
+func encodeValue(v interface{}) (jsonValue, error) {
+	switch t := v.(type) {
+	case nil:
+		return jsonValue{Type: "null"}, nil
+	case uint8:
+		return jsonValue{Type: "uint8", Value: strconv.FormatUint(uint64(t), 10)}, nil
+	case uint16:
+		return jsonValue{Type: "uint16", Value: strconv.FormatUint(uint64(t), 10)}, nil
+	case uint32:
+		return jsonValue{Type: "uint32", Value: strconv.FormatUint(uint64(t), 10)}, nil
+	case uint64:
+		return jsonValue{Type: "uint64", Value: strconv.FormatUint(t, 10)}, nil
+	case int8:
+		return jsonValue{Type: "int8", Value: strconv.FormatInt(int64(t), 10)}, nil
+	case int16:
+		return jsonValue{Type: "int16", Value: strconv.FormatInt(int64(t), 10)}, nil
+	case int32:
+		return jsonValue{Type: "int32", Value: strconv.FormatInt(int64(t), 10)}, nil
+	case int64:
+		return jsonValue{Type: "int64", Value: strconv.FormatInt(t, 10)}, nil
+	case int:
+		return jsonValue{Type: "int", Value: strconv.Itoa(t)}, nil
+	case float32:
+		return jsonValue{Type: "float32", Value: strconv.FormatFloat(float64(t), 'g', -1, 32)}, nil
+	case float64:
+		return jsonValue{Type: "float64", Value: strconv.FormatFloat(t, 'g', -1, 64)}, nil
+	case string:
+		return jsonValue{Type: "string", Value: t}, nil
+	case []byte:
+		return jsonValue{Type: "bytes", Value: base64.StdEncoding.EncodeToString(t)}, nil
+	case time.Time:
+		return jsonValue{Type: "time", Value: t.Format(time.RFC3339Nano)}, nil
+	case time.Duration:
+		return jsonValue{Type: "duration", Value: strconv.FormatInt(int64(t), 10)}, nil
+	}
+	return jsonValue{}, errors.New(fmt.Sprintf("Cannot encode value %v of type %T", v, v))
+}
+
+func decodeValue(jv jsonValue) (interface{}, error) {
+	var v interface{}
+	var err error
+	switch jv.Type {
+	case "null":
+		return nil, nil
+	case "uint8", "uint16", "uint32", "uint64":
+		var u uint64
+		u, err = strconv.ParseUint(jv.Value, 10, 64)
+		switch jv.Type {
+		case "uint8":
+			v = uint8(u)
+		case "uint16":
+			v = uint16(u)
+		case "uint32":
+			v = uint32(u)
+		default:
+			v = u
+		}
+	case "int8", "int16", "int32", "int64", "int":
+		var i int64
+		i, err = strconv.ParseInt(jv.Value, 10, 64)
+		switch jv.Type {
+		case "int8":
+			v = int8(i)
+		case "int16":
+			v = int16(i)
+		case "int32":
+			v = int32(i)
+		case "int64":
+			v = i
+		default:
+			v = int(i)
+		}
+	case "float32":
+		var f float64
+		f, err = strconv.ParseFloat(jv.Value, 32)
+		v = float32(f)
+	case "float64":
+		v, err = strconv.ParseFloat(jv.Value, 64)
+	case "string":
+		v = jv.Value
+	case "bytes":
+		v, err = base64.StdEncoding.DecodeString(jv.Value)
+	case "time":
+		v, err = time.Parse(time.RFC3339Nano, jv.Value)
+	case "duration":
+		var d int64
+		d, err = strconv.ParseInt(jv.Value, 10, 64)
+		v = time.Duration(d)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown type %v of encoded value", jv.Type))
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot decode value %v of type %v. %v", jv.Value, jv.Type, err))
+	}
+	return v, nil
+}
@@ -4,6 +4,7 @@ const (
 	DELETE_EVENT byte = 0
 	INSERT_EVENT byte = 1
 	UPDATE_EVENT byte = 2
+	REPAIR_EVENT byte = 3 // rows of table read again from source
 )
 
 type (
@@ -18,9 +19,13 @@ type (
 		Name                    string
 		ExcludedFromReplication bool
 		EnableDelete            bool
+		SoftDelete              bool // deletes are sent to destination which marks rows as deleted
+		History                 bool // deletes are sent to destination which closes versions of rows
+		Audit                   bool // changes are written to audit table of destination
 		Buf                     int
 		Freq                    int
 		Columns                 []*Column
+		RowFilter               RowFilter // nil if all rows are replicated
 	}
 
 	Column struct {
@@ -28,7 +33,9 @@ type (
 		Type                    string
 		Enum                    []string
 		ExcludedFromReplication bool
-		IsPKey                  bool
+		IsPKey                  bool       // part of primary key
+		IsKey                   bool       // part of key identifying rows: primary key, or unique key if there is no primary key
+		Mask                    ColumnMask // nil if values are replicated as is
 	}
 
 	Event struct {
@@ -42,6 +49,35 @@ type (
 		Buf        int
 		Position   uint32 // binlig position
 		File       string // binlog file
+		// binlog position of row event. Unlike Position it is set for every
+		// row event and is never used for checkpoints
+		EventPosition uint32
+		Timestamp     uint32       // time of event in mysql, seconds since epoch
+		Gtid          string       // gtid of transaction, empty if gtid mode is off
+		SkipMirror    bool         // row change is written only to audit table
+		Chunk         *RepairChunk // chunk of REPAIR_EVENT, its rows are OldValues
+	}
+
+	// request to read rows of table again from source and write them to
+	// destination. Without key and range whole table is repaired
+	Repair struct {
+		Id     int64
+		Schema string
+		Table  string
+		Key    map[string]interface{} // values of key columns of single row
+		From   []interface{}          // keys after From up to To, nil is no bound
+		To     []interface{}
+	}
+
+	// chunk of repair. Destination rows with keys in the chunk, except Keys,
+	// are replaced with rows of event
+	RepairChunk struct {
+		Repair *Repair
+		From   []interface{} // range of keys of chunk, nil is no bound
+		To     []interface{}
+		Keys   [][]interface{} // keys of rows changed in binlog while chunk was read
+		Delete bool            // rows missing in source are deleted in destination
+		Last   bool            // last chunk of repair
 	}
 
 	BinLogInfo struct {
@@ -49,6 +85,16 @@ type (
 		File     string // binlog file
 	}
 
+	// predicate deciding which rows of table are replicated
+	RowFilter interface {
+		Match(columns []*Column, row []*QueryValues) (bool, error)
+	}
+
+	// transform of values of column applied before they leave source
+	ColumnMask interface {
+		Mask(column *Column, value interface{}) interface{}
+	}
+
 	QueryValues struct {
 		ColumnId int
 		Value    interface{}
@@ -0,0 +1,150 @@
+// delayed and rate limited buffers
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+	"github.com/andsha/vconfig"
+)
+
+/* Buffers other than default can replicate behind source and at limited
+rate. Options of buffer section
+	delay = 1h (optional) events are played when they are at least delay old by their timestamp in mysql
+	spill = /var/lib/replicagor (required with delay) directory of spill files of delayed buffer
+	maxRowsPerSecond = 500 (optional) rows played by buffer per second
+	queue = 100000 (optional, default 500) events waiting in memory of buffer. When queue is full reading binlog waits
+e.g. schema archive applied 1 hour behind source protects it from mistaken deletes
+	[buffer]
+		number = 1
+		frequency = 1
+		schemas = archive
+		delay = 1h
+		spill = /var/lib/replicagor
+Events waiting for delay are kept in spill files (see spill.go), so reading
+binlog and other buffers do not wait for delayed buffer, and delayed buffer
+needs store = postgres in checkpoint section (see checkpoint.go). Events of
+buffer with rate limit only are kept in memory and hold checkpoint.
+*/
+
+const defaultQueue = 500
+
+type throttle struct {
+	delay time.Duration
+	rate  int // rows per second, 0 is unlimited
+	queue int
+	spill string    // directory of spill files, set with delay
+	next  time.Time // time next event can be played at with rate limit
+}
+
+// reads delays and rates of buffer sections, key is buffer number
+func readThrottles(rconf vconfig.VConfig) (map[int]*throttle, error) {
+	throttles := make(map[int]*throttle)
+	sections, err := rconf.GetSectionsByName("buffer")
+	if err != nil {
+		return throttles, nil
+	}
+	for _, sec := range sections {
+		num, _ := sec.GetSingleValue("number", "")
+		buf, err := strconv.Atoi(num)
+		if err != nil {
+			continue // reported while reading buffers of source
+		}
+		th := &throttle{queue: defaultQueue}
+		if s, err := sec.GetSingleValue("delay", ""); err == nil && len(s) != 0 {
+			if th.delay, err = time.ParseDuration(s); err != nil || th.delay < 0 {
+				return nil, errors.New(fmt.Sprintf("delay of buffer %v must be duration like 1h. Got %v", buf, s))
+			}
+		}
+		if s, err := sec.GetSingleValue("maxRowsPerSecond", ""); err == nil && len(s) != 0 {
+			if th.rate, err = strconv.Atoi(s); err != nil || th.rate <= 0 {
+				return nil, errors.New(fmt.Sprintf("maxRowsPerSecond of buffer %v must be positive integer. Got %v", buf, s))
+			}
+		}
+		if s, err := sec.GetSingleValue("queue", ""); err == nil && len(s) != 0 {
+			if th.queue, err = strconv.Atoi(s); err != nil || th.queue <= 0 {
+				return nil, errors.New(fmt.Sprintf("queue of buffer %v must be positive integer. Got %v", buf, s))
+			}
+		}
+		if th.delay == 0 && th.rate == 0 {
+			continue
+		}
+		th.spill, _ = sec.GetSingleValue("spill", "")
+		if th.delay > 0 && len(th.spill) == 0 {
+			return nil, errors.New(fmt.Sprintf("spill directory of delayed buffer %v must be set", buf))
+		}
+		if buf == 0 { // default buffer gets BEGIN and COMMIT of all transactions
+			return nil, errors.New("delay and maxRowsPerSecond cannot be set for default (0'th) buffer")
+		}
+		throttles[buf] = th
+	}
+	return throttles, nil
+}
+
+// time event can be played at. Event is due delay after its timestamp and
+// after rows played before it at the rate
+func (th *throttle) due(e *structs.Event, now time.Time) time.Time {
+	at := now
+	if th.delay > 0 && e.Timestamp != 0 {
+		if t := time.Unix(int64(e.Timestamp), 0).Add(th.delay); t.After(at) {
+			at = t
+		}
+	}
+	if th.rate > 0 {
+		if th.next.After(at) {
+			at = th.next
+		}
+		rows := len(e.OldValues)
+		if rows == 0 {
+			rows = 1
+		}
+		th.next = at.Add(time.Duration(rows) * time.Second / time.Duration(th.rate))
+	}
+	return at
+}
+
+// routine passing events of delayed buffer to the buffer when they are due
+func delayEvents(
+	in <-chan *structs.Event,
+	out chan<- *structs.Event,
+	th *throttle,
+	wake chan<- bool,
+	stop <-chan bool,
+	stopped chan<- bool,
+) {
+	for {
+		var e *structs.Event
+		select {
+		case <-stop:
+			stopped <- true
+			return
+		case e = <-in:
+		}
+
+		if d := th.due(e, time.Now()).Sub(time.Now()); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-stop:
+				timer.Stop()
+				stopped <- true
+				return
+			case <-timer.C:
+			}
+		}
+
+		select {
+		case <-stop:
+			stopped <- true
+			return
+		case out <- e:
+		}
+		select {
+		case wake <- true:
+		default: // control routine is already woken
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestDue(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	th := &throttle{delay: time.Hour}
+	if at := th.due(&structs.Event{Timestamp: 900}, now); !at.Equal(time.Unix(900+3600, 0)) {
+		t.Fatal("Incorrect delay", "expected", time.Unix(900+3600, 0), "got", at)
+	}
+	if at := th.due(&structs.Event{Timestamp: 1}, now.Add(2*time.Hour)); !at.Equal(now.Add(2 * time.Hour)) {
+		t.Fatal("Incorrect delay of old event", "expected", now.Add(2*time.Hour), "got", at)
+	}
+
+	th = &throttle{rate: 10}
+	rows := make([][]*structs.QueryValues, 5)
+	if at := th.due(&structs.Event{OldValues: rows}, now); !at.Equal(now) {
+		t.Fatal("Incorrect time of first event", "expected", now, "got", at)
+	}
+	if at := th.due(&structs.Event{OldValues: rows}, now); !at.Equal(now.Add(500 * time.Millisecond)) {
+		t.Fatal("Incorrect rate", "expected", now.Add(500*time.Millisecond), "got", at)
+	}
+}
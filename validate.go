@@ -0,0 +1,221 @@
+// validation of destination tables against mysql
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andsha/replicagor/pgfuncs"
+	"github.com/andsha/replicagor/structs"
+)
+
+/* Validation reads replicated tables of rinfo from mysql and postgres in
+chunks of primary (or unique) key and compares row counts and checksums of
+chunks (see pgfuncs.Validation). Mismatching key ranges are reported.
+Validation can run while replication goes on, so mismatching chunks are read
+again after a delay and reported only if they still differ. Row filters are
+applied in mysql, masks are applied to mysql values before comparison.
+Bounds of chunks are compared by each database, so text keys need collations
+ordering them the same way.
+Validation is run with -validate and configured in validate section of rconfig
+	chunkSize = 1000 (optional, default 1000)
+	tables = db1.table1, db1.table2 (optional, default all replicated tables)
+	rechecks = 3 (optional, default 3)
+	recheckDelay = 10s (optional, default 10s)
+*/
+
+type validateConfig struct {
+	chunkSize int
+	tables    map[string]bool // empty for all tables
+	rechecks  int
+	delay     time.Duration
+}
+
+// chunk of rows with keys after from and up to to, nil is no bound
+type validateChunk struct {
+	from []interface{}
+	to   []interface{}
+}
+
+func (ch validateChunk) String() string {
+	from, to := "-inf", "+inf"
+	if ch.from != nil {
+		from = keyText(ch.from)
+	}
+	if ch.to != nil {
+		to = keyText(ch.to)
+	}
+	return fmt.Sprintf("(%v, %v]", from, to)
+}
+
+func keyText(key []interface{}) string {
+	if len(key) == 1 {
+		return fmt.Sprintf("%v", key[0])
+	}
+	vals := make([]string, len(key))
+	for idk, k := range key {
+		vals[idk] = fmt.Sprintf("%v", k)
+	}
+	return "(" + strings.Join(vals, ", ") + ")"
+}
+
+// reads validate section of rconfig
+func (c *pgConnection) validateConfig() (*validateConfig, error) {
+	cfg := &validateConfig{chunkSize: 1000, tables: make(map[string]bool), rechecks: 3, delay: 10 * time.Second}
+	sections, err := c.rconf.GetSectionsByName("validate")
+	if err != nil { // use defaults
+		return cfg, nil
+	}
+
+	if s, err := sections[0].GetSingleValue("chunkSize", ""); err == nil && len(s) != 0 {
+		if cfg.chunkSize, err = strconv.Atoi(s); err != nil || cfg.chunkSize < 1 {
+			return nil, errors.New(fmt.Sprintf("chunkSize in validate section must be positive integer. Got %v", s))
+		}
+	}
+	if s, err := sections[0].GetSingleValue("rechecks", ""); err == nil && len(s) != 0 {
+		if cfg.rechecks, err = strconv.Atoi(s); err != nil || cfg.rechecks < 0 {
+			return nil, errors.New(fmt.Sprintf("rechecks in validate section must be non-negative integer. Got %v", s))
+		}
+	}
+	if s, err := sections[0].GetSingleValue("recheckDelay", ""); err == nil && len(s) != 0 {
+		if cfg.delay, err = time.ParseDuration(s); err != nil || cfg.delay < 0 {
+			return nil, errors.New(fmt.Sprintf("recheckDelay in validate section must be duration like 10s. Got %v", s))
+		}
+	}
+	tables, _ := sections[0].GetValues("tables")
+	for _, t := range trimValues(tables) {
+		cfg.tables[t] = true
+	}
+	return cfg, nil
+}
+
+// compares replicated tables of source with destination tables.
+// Returns number of mismatching chunks
+func (c *pgConnection) validate(source connection) (int, error) {
+	cfg, err := c.validateConfig()
+	if err != nil {
+		return 0, err
+	}
+
+	mismatches := 0
+	for _, schema := range source.getInfo() {
+		for _, t := range schema.Tables {
+			if t.ExcludedFromReplication || (len(cfg.tables) != 0 && !cfg.tables[schema.Name+"."+t.Name]) {
+				continue
+			}
+			v, err := pgfuncs.NewValidation(schema.Name, t.Name, t.Columns, &c.opts)
+			if err != nil {
+				c.logging.Warnf("Table is not validated. %v", err)
+				fmt.Printf("SKIPPED %v.%v: %v\n", schema.Name, t.Name, err)
+				continue
+			}
+			n, err := c.validateTable(source, schema.Name, t, v, cfg)
+			if err != nil {
+				return mismatches, err
+			}
+			mismatches += n
+		}
+	}
+	return mismatches, nil
+}
+
+// compares table chunk by chunk, returns number of mismatching chunks
+func (c *pgConnection) validateTable(source connection, schema string, t *structs.Table, v *pgfuncs.Validation,
+	cfg *validateConfig) (int, error) {
+	c.logging.Infof("Validating %v.%v", schema, t.Name)
+	mismatches, chunks := 0, 0
+	var from []interface{}
+	for {
+		src, err := source.queryRows(mysqlChunk(schema, t, v, from, nil, cfg.chunkSize))
+		if err != nil {
+			return mismatches, err
+		}
+		ch := validateChunk{from: from}
+		if len(src) == cfg.chunkSize { // last chunk takes all remaining rows of destination
+			ch.to = src[len(src)-1][:v.Keys()]
+		}
+
+		dest, err := c.queryRows(v.Select(ch.from, ch.to))
+		if err != nil {
+			return mismatches, err
+		}
+		for recheck := 0; !sameChunk(v, src, dest) && recheck < cfg.rechecks; recheck++ {
+			time.Sleep(cfg.delay) // rows may be changing right now
+			if src, err = source.queryRows(mysqlChunk(schema, t, v, ch.from, ch.to, 0)); err != nil {
+				return mismatches, err
+			}
+			if dest, err = c.queryRows(v.Select(ch.from, ch.to)); err != nil {
+				return mismatches, err
+			}
+		}
+		if !sameChunk(v, src, dest) {
+			mismatches++
+			msg := fmt.Sprintf("MISMATCH %v.%v keys %v: %v rows in source, %v rows in destination", schema, t.Name, ch,
+				len(src), len(dest))
+			if len(src) == len(dest) {
+				msg += ", rows differ"
+			}
+			c.logging.Warn(msg)
+			fmt.Println(msg)
+		}
+		chunks++
+
+		if ch.to == nil {
+			break
+		}
+		from = ch.to
+	}
+	c.logging.Infof("Validated %v.%v: %v chunks, %v mismatching", schema, t.Name, chunks, mismatches)
+	return mismatches, nil
+}
+
+func sameChunk(v *pgfuncs.Validation, src [][]interface{}, dest [][]interface{}) bool {
+	return len(src) == len(dest) && v.Checksum(src, true) == v.Checksum(dest, false)
+}
+
+// select of mysql rows with keys after from and up to to, at most limit
+// rows if limit is not 0
+func mysqlChunk(schema string, t *structs.Table, v *pgfuncs.Validation, from []interface{}, to []interface{}, limit int) string {
+	names := make([]string, 0, len(v.Columns()))
+	for _, idc := range v.Columns() {
+		names = append(names, mysqlIdent(t.Columns[idc].Name))
+	}
+	keys := strings.Join(names[:v.Keys()], ", ")
+	sql := fmt.Sprintf("SELECT %v FROM %v.%v", strings.Join(names, ", "), mysqlIdent(schema), mysqlIdent(t.Name))
+
+	var conds []string
+	if f, ok := t.RowFilter.(fmt.Stringer); ok { // filter is written in mysql syntax
+		conds = append(conds, "("+f.String()+")")
+	}
+	if from != nil {
+		conds = append(conds, fmt.Sprintf("(%v) > (%v)", keys, mysqlValues(from)))
+	}
+	if to != nil {
+		conds = append(conds, fmt.Sprintf("(%v) <= (%v)", keys, mysqlValues(to)))
+	}
+	if len(conds) != 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	sql += " ORDER BY " + keys
+	if limit != 0 {
+		sql += fmt.Sprintf(" LIMIT %v", limit)
+	}
+	return sql
+}
+
+func mysqlIdent(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func mysqlValues(vals []interface{}) string {
+	res := make([]string, len(vals))
+	for idv, v := range vals {
+		s := resultText(v)
+		res[idv] = "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), "'", `\'`, -1) + "'"
+	}
+	return strings.Join(res, ", ")
+}
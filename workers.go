@@ -0,0 +1,375 @@
+// parallel apply workers of buffers
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/andsha/postgresutils"
+	"github.com/andsha/replicagor/structs"
+	"github.com/andsha/vconfig"
+)
+
+/* Every buffer plays its events in own connection to destination. Buffer
+can play its events with several apply workers, each with own connection.
+Rows are given to workers by hash of table and key of row (see
+structs.Column.IsKey), so changes of every row are played in source order.
+Rows of tables without key go to one worker.
+The first worker plays BEGIN and COMMIT of every transaction of the buffer,
+other workers get BEGIN before their first rows of transaction and COMMIT, so
+transaction is committed by every worker with its rows separately. With
+strict order (see consistency.go) all workers commit transaction before
+events of the next one are played. Statements, updates changing key of row
+and repair chunks are played by the first worker after all workers played
+events before them, and events after them wait until they are played.
+Event holds checkpoint until all workers write their parts of it. With
+store = postgres every worker keeps own position in checkpoint table.
+Workers are set in buffer section
+	workers = 4 (optional, default 1)
+Delayed buffers (see throttle.go) have one worker.
+*/
+
+// apply worker of buffer
+type workerSlot struct {
+	buf    int
+	worker int
+}
+
+// reads workers of buffer sections, key is buffer number. Buffers with one
+// worker are not included
+func readWorkers(rconf vconfig.VConfig, throttles map[int]*throttle) (map[int]int, error) {
+	workers := make(map[int]int)
+	sections, err := rconf.GetSectionsByName("buffer")
+	if err != nil {
+		return workers, nil
+	}
+	for _, sec := range sections {
+		num, _ := sec.GetSingleValue("number", "")
+		buf, err := strconv.Atoi(num)
+		if err != nil {
+			continue // reported while reading buffers of source
+		}
+		s, err := sec.GetSingleValue("workers", "")
+		if err != nil || len(s) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, errors.New(fmt.Sprintf("workers of buffer %v must be positive integer. Got %v", buf, s))
+		}
+		if n == 1 {
+			continue
+		}
+		if _, ok := throttles[buf]; ok {
+			return nil, errors.New(fmt.Sprintf("Delayed buffer %v cannot have several workers", buf))
+		}
+		workers[buf] = n
+	}
+	return workers, nil
+}
+
+// connections of buffers, one for every apply worker of buffer. Buffers
+// do not share connection, so rollback or reconnect of one buffer does not
+// touch transactions of others
+func (r *replicagor) workerConnections(buffers int) ([][]connection, error) {
+	dests := make([][]connection, buffers)
+	for buf := range dests {
+		n, ok := r.workers[buf]
+		if !ok {
+			n = 1
+		}
+		for w := 0; w < n; w++ {
+			dest, err := r.dest.newWorker(w)
+			if err != nil {
+				return nil, err
+			}
+			dests[buf] = append(dests[buf], dest)
+		}
+	}
+	return dests, nil
+}
+
+// workers of buffer and events given to them
+type workerPool struct {
+	workers     []chan *structs.Event
+	idle        *barrier // events given to workers and not played yet
+	strict      *barrier // nil unless buffers keep strict order
+	checkpoints *checkpoints
+	begin       *structs.Event // BEGIN of open transaction
+	began       []bool         // workers which got BEGIN of open transaction
+}
+
+func newWorkerPool(workers int, strict *barrier, checkpoints *checkpoints) *workerPool {
+	p := &workerPool{idle: new(barrier), strict: strict, checkpoints: checkpoints}
+	for w := 0; w < workers; w++ {
+		p.workers = append(p.workers, make(chan *structs.Event, defaultQueue))
+	}
+	return p
+}
+
+// buffer routine giving events to workers. Like eventBuffer it takes one
+// event on every turn given by control routine
+func dispatchEvents(
+	cont <-chan bool,
+	event <-chan *structs.Event,
+	pool *workerPool,
+	stop <-chan bool,
+	stopped chan<- bool,
+) {
+	for {
+		select {
+		case <-stop: // stop goroutine
+			stopped <- true
+			return
+		case <-cont: // wait for turn from control routine
+		}
+
+		select {
+		case e := <-event:
+			if !pool.dispatch(e, stop) {
+				stopped <- true
+				return
+			}
+		default: // workers write pending batched inserts when they have no events
+		}
+	}
+}
+
+// gives event to workers. False if stop was received while waiting for workers
+func (p *workerPool) dispatch(e *structs.Event, stop <-chan bool) bool {
+	if p.strict != nil { // event is counted by parts given to workers
+		defer p.strict.done()
+	}
+
+	switch {
+	case len(e.Query) != 0 && e.Position == 0: // BEGIN
+		if p.begin != nil { // transaction without COMMIT
+			p.checkpoints.written(p.begin)
+		}
+		p.begin, p.began = e, make([]bool, len(p.workers))
+		return p.begins(0, stop)
+	case e.Position != 0 && p.begin != nil: // COMMIT of workers which got BEGIN
+		p.checkpoints.written(p.begin) // BEGIN is written when workers write their copies
+		p.begin = nil
+		for w := 1; w < len(p.workers); w++ {
+			if !p.began[w] {
+				continue
+			}
+			commit := *e
+			commit.Query = "COMMIT"
+			p.checkpoints.share(e, &commit)
+			if !p.send(w, &commit, stop) {
+				return false
+			}
+		}
+		return p.send(0, e, stop)
+	}
+
+	if len(e.Query) == 0 && e.EventType != structs.REPAIR_EVENT {
+		if parts, ok := p.split(e); ok {
+			defer p.checkpoints.written(e) // written when workers write their parts
+			for w, part := range parts {
+				if part == nil {
+					continue
+				}
+				p.checkpoints.share(e, part)
+				if !p.begins(w, stop) || !p.send(w, part, stop) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	// statements, updates of keys and repairs are played alone
+	return p.drain(stop) && p.send(0, e, stop) && p.drain(stop)
+}
+
+// rows of event for every worker, nil if worker gets no rows. False if
+// update changes key of row, so the row moves to another worker
+func (p *workerPool) split(e *structs.Event) ([]*structs.Event, bool) {
+	parts := make([]*structs.Event, len(p.workers))
+	for idr, row := range e.OldValues {
+		key := workerKey(e, row)
+		update := e.EventType == structs.UPDATE_EVENT && idr < len(e.NewValues)
+		if update && workerKey(e, e.NewValues[idr]) != key {
+			return nil, false
+		}
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		w := int(h.Sum32() % uint32(len(p.workers)))
+		if parts[w] == nil {
+			part := *e
+			part.OldValues, part.NewValues = nil, nil
+			parts[w] = &part
+		}
+		parts[w].OldValues = append(parts[w].OldValues, row)
+		if update {
+			parts[w].NewValues = append(parts[w].NewValues, e.NewValues[idr])
+		}
+	}
+	return parts, true
+}
+
+// table and values of key columns of row
+func workerKey(e *structs.Event, row []*structs.QueryValues) string {
+	key := e.SchemaName + "." + e.TableName
+	for _, val := range row {
+		if e.Columns[val.ColumnId].IsKey {
+			key = fmt.Sprintf("%v\x00%v", key, val.Value)
+		}
+	}
+	return key
+}
+
+// gives BEGIN of open transaction to worker w before its first event of
+// the transaction
+func (p *workerPool) begins(w int, stop <-chan bool) bool {
+	if p.begin == nil || p.began[w] {
+		return true
+	}
+	p.began[w] = true
+	begin := *p.begin
+	p.checkpoints.share(p.begin, &begin)
+	return p.send(w, &begin, stop)
+}
+
+func (p *workerPool) send(w int, e *structs.Event, stop <-chan bool) bool {
+	p.idle.add()
+	if p.strict != nil {
+		p.strict.add()
+	}
+	select {
+	case p.workers[w] <- e:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// waits until workers play all events given to them
+func (p *workerPool) drain(stop <-chan bool) bool {
+	select {
+	case <-p.idle.wait():
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// worker routine playing events of worker w in connection dest
+func (p *workerPool) work(
+	w int,
+	dest connection,
+	stop <-chan bool,
+	stopped chan<- bool,
+	stats *bufferStats,
+) {
+	events := p.workers[w]
+	s := false
+	var unwritten []*structs.Event // played events with rows in pending batched inserts
+	// counts event given to worker as played, also when it failed
+	done := func() {
+		p.idle.done()
+		if p.strict != nil {
+			p.strict.done()
+		}
+	}
+	// releases played events when destination has written them
+	written := func() {
+		for _, e := range unwritten {
+			p.checkpoints.written(e)
+			stats.played(e, time.Now())
+			done()
+		}
+		unwritten = unwritten[:0]
+	}
+	// stops replication. Events not written keep checkpoint held
+	fail := func() {
+		for range unwritten {
+			done()
+		}
+		unwritten = unwritten[:0]
+		stopped <- true
+		s = true
+	}
+
+	for {
+		select {
+		case <-stop:
+			if !s && len(unwritten) != 0 && dest.flushEvents(unwritten[0].Buf) == nil {
+				written()
+			}
+			stopped <- true
+			return
+		case e := <-events:
+			if s { // keep receiving events until stopped
+				done()
+				continue
+			}
+			if err := dest.playEvent(e); err != nil {
+				done()
+				fail()
+				continue
+			}
+			unwritten = append(unwritten, e)
+			if len(events) == 0 { // write pending batched inserts
+				if err := dest.flushEvents(e.Buf); err != nil {
+					fail()
+					continue
+				}
+			}
+			if !dest.pending(e.Buf) {
+				written()
+			}
+		}
+	}
+}
+
+// connection of buffer or its apply worker. Worker shares configuration of c
+// and has own postgres connection, pending inserts and transactions
+func (c *pgConnection) newWorker(worker int) (connection, error) {
+	w := &pgConnection{
+		conn:            c.conn,
+		process:         new(postgresutils.PostgresProcess),
+		opts:            c.opts,
+		audit:           c.audit,
+		policies:        c.policies,
+		txs:             make(map[int]bool),
+		txLogs:          make(map[int][]*structs.Event),
+		retries:         c.retries,
+		conflicts:       c.conflicts,
+		repairs:         c.repairs,
+		checkpointTable: c.checkpointTable,
+		applied:         make(map[workerSlot]structs.BinLogInfo),
+		worker:          worker,
+	}
+	w.batches = newInsertBatches(c.batches.size, &w.opts)
+	if dl, ok := c.deadLetters.(*pgDeadLetters); ok {
+		w.deadLetters = &pgDeadLetters{c: w, table: dl.table}
+	} else {
+		w.deadLetters = c.deadLetters
+	}
+	c.txMutex.Lock()
+	for slot, bli := range c.applied {
+		w.applied[slot] = bli
+	}
+	c.txMutex.Unlock()
+
+	if err := w.blconnect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// mysql destination plays no events, buffers share the connection
+func (c *mysqlConnection) newWorker(worker int) (connection, error) {
+	if worker != 0 {
+		return nil, errors.New("Mysql cannot have apply workers")
+	}
+	return c, nil
+}
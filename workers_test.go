@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/andsha/replicagor/structs"
+)
+
+func TestWorkerSplit(t *testing.T) {
+	p := newWorkerPool(3, nil, newCheckpoints(nil, 0))
+	columns := []*structs.Column{{Name: "id", IsKey: true}, {Name: "name"}}
+	row := func(id int, name string) []*structs.QueryValues {
+		return []*structs.QueryValues{{ColumnId: 0, Value: id}, {ColumnId: 1, Value: name}}
+	}
+	e := &structs.Event{SchemaName: "db1", TableName: "table1", Columns: columns, EventType: structs.INSERT_EVENT}
+	for id := 0; id < 30; id++ {
+		e.OldValues = append(e.OldValues, row(id, "a"))
+	}
+	parts, ok := p.split(e)
+	if !ok {
+		t.Fatal("Incorrect split", "expected", true, "got", ok)
+	}
+	worker := make(map[interface{}]int)
+	rows := 0
+	for w, part := range parts {
+		if part == nil {
+			continue
+		}
+		for _, r := range part.OldValues {
+			worker[r[0].Value] = w
+			rows++
+		}
+	}
+	if rows != 30 || len(worker) != 30 {
+		t.Fatal("Incorrect rows of workers", "expected", 30, "got", rows)
+	}
+
+	// update of the same row goes to the same worker
+	u := &structs.Event{SchemaName: "db1", TableName: "table1", Columns: columns, EventType: structs.UPDATE_EVENT,
+		OldValues: [][]*structs.QueryValues{row(7, "a")}, NewValues: [][]*structs.QueryValues{row(7, "b")}}
+	parts, _ = p.split(u)
+	if parts[worker[7]] == nil || len(parts[worker[7]].NewValues) != 1 {
+		t.Fatal("Incorrect worker of update", "expected", worker[7], "got", parts)
+	}
+
+	// update changing key is not split
+	u.NewValues = [][]*structs.QueryValues{row(8, "a")}
+	if _, ok := p.split(u); ok {
+		t.Fatal("Incorrect split of key update", "expected", false, "got", ok)
+	}
+}
+
+// BEGIN and COMMIT are given to first worker and to workers with rows of
+// transaction
+func TestWorkerDispatch(t *testing.T) {
+	cp := newCheckpoints(nil, 0)
+	p := newWorkerPool(3, nil, cp)
+	stop := make(chan bool)
+	columns := []*structs.Column{{Name: "id", IsKey: true}}
+	begin := &structs.Event{Query: "BEGIN", File: "mysql-bin.000001", EventPosition: 4}
+	row := &structs.Event{SchemaName: "db1", TableName: "table1", Columns: columns, EventType: structs.INSERT_EVENT,
+		OldValues: [][]*structs.QueryValues{{{ColumnId: 0, Value: 1}}}}
+	commit := &structs.Event{Query: "COMMIT", Position: 120, File: "mysql-bin.000001"}
+	parts, _ := p.split(row)
+	w := 1
+	for parts[w] == nil { // worker other than first gets the row
+		row.OldValues[0][0].Value = row.OldValues[0][0].Value.(int) + 1
+		parts, _ = p.split(row)
+	}
+
+	for _, e := range []*structs.Event{begin, row, commit} {
+		cp.hold(e)
+		if !p.dispatch(e, stop) {
+			t.Fatal("Incorrect dispatch", "expected", true, "got", false)
+		}
+	}
+	expected := [][]string{{"BEGIN", "COMMIT"}, {"BEGIN", "", "COMMIT"}, {}}
+	var played []*structs.Event
+	for w, events := range p.workers {
+		var queries []string
+		for len(events) != 0 {
+			e := <-events
+			queries = append(queries, e.Query)
+			played = append(played, e)
+		}
+		if fmt.Sprint(queries) != fmt.Sprint(expected[w]) {
+			t.Fatal("Incorrect events of worker", w, "expected", expected[w], "got", queries)
+		}
+	}
+
+	// checkpoint moves when all workers write their events
+	for _, e := range played[:len(played)-1] {
+		cp.written(e)
+	}
+	if at, ok := cp.position(); ok {
+		t.Fatal("Incorrect checkpoint", "expected", false, "got", at)
+	}
+	cp.written(played[len(played)-1])
+	if at, _ := cp.position(); at.Position != 120 {
+		t.Fatal("Incorrect checkpoint", "expected", 120, "got", at.Position)
+	}
+}
+
+// failed worker keeps counting events, so dispatcher does not wait for it
+func TestWorkerFailure(t *testing.T) {
+	p := newWorkerPool(1, new(barrier), newCheckpoints(nil, 0))
+	stop, stopped := make(chan bool, 1), make(chan bool, 2)
+	go p.work(0, &failDest{}, stop, stopped, &bufferStats{})
+
+	for i := 0; i < 3; i++ {
+		if !p.send(0, &structs.Event{}, stop) {
+			t.Fatal("Incorrect send", "expected", true, "got", false)
+		}
+	}
+	done := make(chan bool)
+	go func() { done <- p.drain(done) }()
+	if !<-done {
+		t.Fatal("Incorrect drain", "expected", true, "got", false)
+	}
+	select {
+	case <-p.strict.wait():
+	default:
+		t.Fatal("Incorrect strict barrier", "expected", "drained", "got", "waiting")
+	}
+	<-stopped
+	stop <- true
+	<-stopped
+}
+
+// destination failing every event
+type failDest struct {
+	connection
+}
+
+func (d *failDest) playEvent(e *structs.Event) error {
+	return errors.New("failed")
+}